@@ -1,19 +1,66 @@
 package main
 
 import (
+	"flag"
+	"fmsh/daemon"
 	"fmsh/shell"
 	"fmsh/utils"
 	"fmt"
+	"os"
 )
 
 func main() {
-	// Define a color for the shell text (cyan)
-	const shellColor = utils.Cyan
-	const resetColor = utils.Reset
+	readOnly := flag.Bool("read-only", false, "disable every command that modifies the file system")
+	root := flag.String("root", "", "confine the shell to the given directory tree")
+	noPager := flag.Bool("no-pager", false, "never page long command output")
+	session := flag.String("session", utils.DefaultSession, "name of the session whose state is restored and saved")
+	flag.Parse()
 
-	fmt.Printf("%sWelcome to fmsh (File Management Shell)!\n", shellColor)
-	fmt.Printf("Type 'exit' to quit the shell.%s\n", resetColor)
+	if err := utils.ValidateSessionName(*session); err != nil {
+		fmt.Printf("fmsh: --session: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := utils.LoadConfig(); err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
+	}
+	if len(utils.GlobalConfig.ProtectedPaths) > 0 {
+		utils.GlobalPolicy.Protected = utils.GlobalConfig.ProtectedPaths
+	}
+	if name := utils.GlobalConfig.Theme; name != "" {
+		if theme, err := utils.LoadTheme(name); err != nil {
+			fmt.Printf("Error loading theme: %v\n", err)
+		} else {
+			utils.GlobalPalette = utils.NewPalette(name, theme)
+		}
+	}
+	utils.GlobalPolicy.ReadOnly = *readOnly
+	utils.GlobalPager.Enabled = !*noPager
+	if *root != "" {
+		if err := utils.GlobalPolicy.SetRoot(*root); err != nil {
+			fmt.Printf("fmsh: --root: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// "fmsh [flags] daemon [--socket path] [--tcp address]" serves commands
+	// to other programs instead of starting the shell
+	if flag.Arg(0) == "daemon" {
+		daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+		socket := daemonFlags.String("socket", daemon.DefaultSocket(), "path of the Unix socket to listen on")
+		tcp := daemonFlags.String("tcp", "", "also listen on this TCP address; clients authenticate with $"+daemon.TokenEnv)
+		daemonFlags.Parse(flag.Args()[1:])
+		if err := daemon.Run(*session, *socket, *tcp); err != nil {
+			fmt.Printf("fmsh: daemon: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Greet the user in the prompt colour of the theme
+	fmt.Println(utils.Colorize(utils.RolePrompt, "Welcome to fmsh (File Management Shell)!"))
+	fmt.Println(utils.Colorize(utils.RolePrompt, "Type 'exit' to quit the shell."))
 
 	// Start the shell
-	shell.Start()
+	shell.Start(*session)
 }
@@ -0,0 +1,463 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmsh/vfs"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The functions in this file run commands for programs instead of people:
+// they take structured arguments, return structured results and print
+// nothing. The handlers of the same commands print what they return.
+
+// ErrUnknownCommand is returned by RunIn for names missing from the registry
+var ErrUnknownCommand = errors.New("command not found")
+
+// Task carries the hooks of a long operation run on behalf of a client
+type Task struct {
+	Progress func(done, total int64) // Called now and then while the operation runs; total is 0 while unknown
+	Cancel   <-chan struct{}         // Stops the operation when closed
+}
+
+// canceled reports whether the task was asked to stop
+func (t Task) canceled() bool {
+	select {
+	case <-t.Cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// counter returns a function reporting a growing count of unknown total,
+// at most five times a second
+func (t Task) counter() func(done int64) {
+	if t.Progress == nil {
+		return func(int64) {}
+	}
+	var mu sync.Mutex
+	var last time.Time
+	return func(done int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(last) >= 200*time.Millisecond {
+			last = time.Now()
+			t.Progress(done, 0)
+		}
+	}
+}
+
+// InspectResult holds the analytics of a directory tree
+type InspectResult struct {
+	Path        string    `json:"path"`
+	Files       int       `json:"files"`
+	Dirs        int       `json:"dirs"`
+	Bytes       int64     `json:"bytes"`
+	Largest     string    `json:"largest,omitempty"`
+	LargestSize int64     `json:"largest_size,omitempty"`
+	Newest      string    `json:"newest,omitempty"`
+	NewestTime  time.Time `json:"newest_time,omitempty"`
+	Warnings    []string  `json:"warnings,omitempty"` // Entries that could not be read
+}
+
+// Inspect counts the files, directories and bytes below dir and finds its
+// largest and most recently modified files
+func Inspect(dir string, task Task) (InspectResult, error) {
+	if err := checkPathErr(dir); err != nil {
+		return InspectResult{}, err
+	}
+	return inspect(dir, task)
+}
+
+func inspect(dir string, task Task) (InspectResult, error) {
+	result := InspectResult{Path: dir}
+	loc, err := locate(dir, true)
+	if err != nil {
+		return result, err
+	}
+
+	var mu sync.Mutex
+	warn := func(name string, err error) {
+		mu.Lock()
+		result.Warnings = append(result.Warnings, "Unable to access "+loc.path(name)+": "+err.Error())
+		mu.Unlock()
+	}
+	report := task.counter()
+	var seen int64
+
+	// Workers stat the entries, following symlinks, while the walk goes on
+	names := make(chan string, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				info, err := loc.fs.Stat(name)
+				if err != nil {
+					warn(name, err)
+					continue
+				}
+				mu.Lock()
+				seen++
+				report(seen)
+				if info.IsDir() {
+					result.Dirs++
+				} else {
+					result.Files++
+					result.Bytes += info.Size()
+					if info.Size() > result.LargestSize {
+						result.LargestSize = info.Size()
+						result.Largest = loc.path(name)
+					}
+					if info.ModTime().After(result.NewestTime) {
+						result.NewestTime = info.ModTime()
+						result.Newest = loc.path(name)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = fs.WalkDir(loc.fs, loc.name, func(name string, entry fs.DirEntry, err error) error {
+		if task.canceled() {
+			return fileops.ErrCanceled
+		}
+		if err != nil {
+			warn(name, err)
+			return nil
+		}
+		names <- name
+		return nil
+	})
+	close(names)
+	wg.Wait()
+	return result, err
+}
+
+// TypeCount is the number and total size of files of one type
+type TypeCount struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Summary breaks the files of a directory tree down by MIME type, as
+// recognised from their first bytes
+type Summary struct {
+	Path    string               `json:"path"`
+	Types   map[string]TypeCount `json:"types"`
+	Untyped TypeCount            `json:"untyped"` // Files of no recognised type
+}
+
+// Summarise summarises the files below dir by type
+func Summarise(dir string, task Task) (Summary, error) {
+	if err := checkPathErr(dir); err != nil {
+		return Summary{}, err
+	}
+	return summarise(dir, task)
+}
+
+func summarise(dir string, task Task) (Summary, error) {
+	summary := Summary{Path: dir, Types: map[string]TypeCount{}}
+	loc, err := locate(dir, true)
+	if err != nil {
+		return summary, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	report := task.counter()
+	var done int64
+
+	// Walk the directory and start goroutines for file processing, a
+	// limited number at once so remote backends are not flooded
+	slots := make(chan struct{}, 4*runtime.NumCPU())
+	err = fs.WalkDir(loc.fs, loc.name, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if task.canceled() {
+			return fileops.ErrCanceled
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(path string, size int64) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				kind := fileType(loc.fs, path)
+				mu.Lock()
+				defer mu.Unlock()
+				if kind == "" {
+					summary.Untyped.Files++
+					summary.Untyped.Bytes += size
+				} else {
+					count := summary.Types[kind]
+					count.Files++
+					count.Bytes += size
+					summary.Types[kind] = count
+				}
+				done++
+				report(done)
+			}(path, info.Size())
+		}
+		return nil
+	})
+	wg.Wait()
+	return summary, err
+}
+
+// Find lists the files below dir named name, or all of them when name is
+// empty, stopping after limit matches unless limit is 0. The search runs
+// in parallel, so matches come in no particular order.
+func Find(dir, name string, limit int, task Task) ([]string, error) {
+	if err := checkPathErr(dir); err != nil {
+		return nil, err
+	}
+	return find(dir, name, limit, task)
+}
+
+func find(root, pattern string, limit int, task Task) ([]string, error) {
+	loc, err := locate(root, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// stop ends the search early, when the task is canceled or has enough
+	stop := make(chan struct{})
+	var once sync.Once
+	halt := func() { once.Do(func() { close(stop) }) }
+	go func() {
+		select {
+		case <-task.Cancel:
+			halt()
+		case <-stop:
+		}
+	}()
+
+	numCores := runtime.NumCPU()               // Get the number of CPU cores
+	semaphore := make(chan struct{}, numCores) // Limit concurrency to available cores
+	report := task.counter()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var found []string
+
+	// Recursive function for finding files; dir is the name in the backend
+	// and shown the path reported for it
+	var findFiles func(string, string)
+	findFiles = func(dir, shown string) {
+		defer wg.Done()
+
+		select {
+		case semaphore <- struct{}{}: // Acquire a slot
+		case <-stop:
+			return
+		}
+		defer func() { <-semaphore }() // Release the slot
+
+		entries, err := loc.fs.ReadDir(dir)
+		if err != nil {
+			// Silently consume the error and move on
+			return
+		}
+
+		for _, entry := range entries {
+			name := vfs.Join(loc.fs, dir, entry.Name())
+			path := joinPath(shown, entry.Name())
+			if entry.IsDir() {
+				wg.Add(1)
+				go findFiles(name, path)
+				continue
+			}
+			if pattern != "" && entry.Name() != pattern {
+				continue
+			}
+			mu.Lock()
+			if limit == 0 || len(found) < limit {
+				found = append(found, path)
+				report(int64(len(found)))
+			}
+			full := limit > 0 && len(found) >= limit
+			mu.Unlock()
+			if full {
+				halt()
+				return
+			}
+		}
+	}
+
+	wg.Add(1)
+	go findFiles(loc.name, root)
+	wg.Wait()
+	halt()
+	if task.canceled() {
+		return found, fileops.ErrCanceled
+	}
+	return found, nil
+}
+
+// CopyPath copies source to destination the way cp does, into it when it
+// is a directory, and records the copy in the audit log. The target of the
+// returned stats is where the copy ended up.
+func CopyPath(source, destination string, opts fileops.CopyOptions) (fileops.CopyStats, error) {
+	target := copyTarget(source, destination)
+	if err := checkPathErr(source); err != nil {
+		return fileops.CopyStats{}, err
+	}
+	if err := authorizePathErr(target); err != nil {
+		return fileops.CopyStats{}, err
+	}
+	return copyPath(source, target, opts)
+}
+
+// copyPath copies source to target, through the vfs when either is virtual
+func copyPath(source, target string, opts fileops.CopyOptions) (fileops.CopyStats, error) {
+	var stats fileops.CopyStats
+	src, err := locate(source, false)
+	var dst location
+	if err == nil {
+		dst, err = locate(target, false)
+	}
+	if err == nil && src.native() && dst.native() {
+		replaced := &replacements{}
+		opts.Replace = replaced.trash
+		stats, err = fileops.Copy(source, target, opts)
+		pushCopy(source, stats, opts.Conflict, replaced.steps)
+	} else if err == nil {
+		stats, err = fileops.CopyFS(src.fs, src.name, dst.fs, dst.name, opts)
+	}
+	if stats.Target != "" {
+		stats.Target = dst.path(stats.Target)
+	} else {
+		stats.Target = target
+	}
+	utils.GlobalAuditLog.Record(utils.AuditEntry{
+		Op:    "cp",
+		Paths: []string{source, stats.Target},
+		Sizes: []int64{stats.Bytes},
+	}, err)
+	return stats, err
+}
+
+// pushCopy records a copy on the host for undo, which removes what it wrote,
+// gives backups their names back and restores replaced files from the trash
+func pushCopy(source string, stats fileops.CopyStats, conflict fileops.ConflictOptions, replaced []utils.Action) {
+	suffix := conflict.BackupSuffix
+	if suffix == "" {
+		suffix = fileops.DefaultBackupSuffix
+	}
+	batch := utils.Action{Type: utils.Batch, Label: "cp", Actions: replaced}
+	for _, path := range stats.BackedUp {
+		batch.Actions = append(batch.Actions, utils.Action{Type: utils.Rename, Source: path, Dest: path + suffix})
+	}
+	sort.Strings(stats.Created)
+	for _, path := range stats.Created {
+		rel, err := filepath.Rel(stats.Target, path)
+		if err != nil {
+			continue
+		}
+		batch.Actions = append(batch.Actions, utils.Action{Type: utils.Copy, Source: filepath.Join(source, rel), Dest: path})
+	}
+	pushBatch(batch)
+}
+
+// replacements moves files that a copy or extraction is about to overwrite
+// into the trash, and keeps the undo steps that bring them back
+type replacements struct {
+	mu    sync.Mutex
+	steps []utils.Action
+}
+
+// trash is the Replace hook of the copy or extraction
+func (r *replacements) trash(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	trashed, err := fileops.TrashFor(abs).Put(abs)
+	utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "rm", Paths: []string{abs, trashed}}, err)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.steps = append(r.steps, utils.Action{Type: utils.Trash, Source: abs, Dest: trashed})
+	r.mu.Unlock()
+	return nil
+}
+
+// ResolveFrom makes a relative path relative to dir, which may be virtual
+func ResolveFrom(dir, path string) string {
+	if filepath.IsAbs(path) || vfs.IsURL(path) {
+		return path
+	}
+	return joinPath(dir, path)
+}
+
+// CheckPath applies the root jail to path
+func CheckPath(path string) error {
+	return checkPathErr(path)
+}
+
+// IsDirectory reports whether path is a directory, wherever it lives
+func IsDirectory(path string) bool {
+	return isDir(path)
+}
+
+// runMu serialises RunIn, which borrows the working directory and the
+// standard output of the process
+var runMu sync.Mutex
+
+// RunIn runs a registered command in dir and returns what it printed and
+// the working directory it left behind, so a command like cd can move a
+// client that keeps its own directory. The shell's working directory is
+// restored afterwards.
+func RunIn(dir, name string, args []string) (output, newDir string, err error) {
+	if _, ok := CommandRegistry[name]; !ok {
+		return "", dir, ErrUnknownCommand
+	}
+
+	runMu.Lock()
+	defer runMu.Unlock()
+	previous := Workdir()
+	if err := changeDir(dir); err != nil {
+		return "", dir, err
+	}
+	defer changeDir(previous)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", dir, err
+	}
+	var buf bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&buf, r)
+		r.Close()
+		close(copied)
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	func() {
+		defer func() { os.Stdout = stdout }()
+		dispatch(name, args)
+	}()
+	w.Close()
+	<-copied
+	return buf.String(), Workdir(), nil
+}
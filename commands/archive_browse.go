@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"os"
+	"sync"
+	"time"
+)
+
+// archiveCache keeps the most recently browsed archive indexed. Daemon jobs
+// browse concurrently, so it is guarded by mu. A replaced archive is not
+// closed, since another job may still be reading it; its file is closed
+// once nothing refers to it any more.
+var archiveCache struct {
+	mu      sync.Mutex
+	fsys    *fileops.ArchiveFS
+	modTime time.Time
+	size    int64
+}
+
+// openArchive returns the archive and the path inside it when path lies in
+// one. The archive itself only counts as a directory when asRoot is set, so
+// "preview x.zip" and "cp x.zip dir" still see the file.
+func openArchive(path string, asRoot bool) (*fileops.ArchiveFS, string, error) {
+	archive, inner, ok := fileops.SplitArchivePath(resolvePath(path))
+	if !ok || (inner == "." && !asRoot) {
+		return nil, "", nil
+	}
+	info, err := os.Stat(archive)
+	if err != nil {
+		return nil, "", err
+	}
+
+	archiveCache.mu.Lock()
+	defer archiveCache.mu.Unlock()
+	cached := archiveCache.fsys
+	if cached == nil || cached.Path() != archive || !archiveCache.modTime.Equal(info.ModTime()) || archiveCache.size != info.Size() {
+		fsys, err := fileops.OpenArchiveFS(archive)
+		if err != nil {
+			return nil, "", err
+		}
+		archiveCache.fsys, archiveCache.modTime, archiveCache.size = fsys, info.ModTime(), info.Size()
+	}
+	return archiveCache.fsys, inner, nil
+}
@@ -0,0 +1,242 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+const archiveUsage = "Usage: archive create [-j workers] [--force] [--xattrs] <archive> <path>... | " +
+	"archive extract [--force] [--xattrs] [--max-size size] [--max-entries n] [--max-ratio n] <archive> [directory] | " +
+	"archive list <archive> | archive test <archive>"
+
+// HandleArchive implements the "archive" command. The format follows from
+// the archive's name: .zip, .tar, .tar.gz (.tgz) or, for extraction only,
+// .tar.bz2.
+func HandleArchive(args []string) {
+	if len(args) == 0 {
+		failln(archiveUsage)
+		return
+	}
+	sub := args[0]
+	if sub == "create" || sub == "extract" {
+		if refuseReadOnly("archive", sub) {
+			return
+		}
+		if err := checkVirtual(args[1:]); err != nil {
+			failln(utils.Colorize(utils.RoleError, "fmsh: archive "+sub+": "+err.Error()))
+			return
+		}
+	}
+	if sub == "create" && !allowIrreversible("archive", args, "creating an archive") {
+		return
+	}
+
+	switch sub {
+	case "create":
+		createArchive(args[1:])
+	case "extract":
+		extractArchive(args[1:])
+	case "list":
+		listArchive(args[1:])
+	case "test":
+		testArchive(args[1:])
+	default:
+		failln(archiveUsage)
+	}
+}
+
+func createArchive(args []string) {
+	var opts fileops.ArchiveOptions
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-j", "--jobs":
+			if i+1 >= len(args) {
+				failln("fmsh: archive: -j needs a number of workers")
+				return
+			}
+			i++
+			workers, err := strconv.Atoi(args[i])
+			if err != nil || workers < 1 {
+				failf("fmsh: archive: invalid number of workers: %s\n", args[i])
+				return
+			}
+			opts.Workers = workers
+		case "--force", "-f":
+			opts.Overwrite = true
+		case "--xattrs":
+			opts.Xattrs = true
+		default:
+			paths = append(paths, args[i])
+		}
+	}
+	paths = expandGlobs("archive", paths)
+	if len(paths) < 2 {
+		failln("Usage: archive create [-j workers] [--force] [--xattrs] <archive> <path>...")
+		return
+	}
+
+	archivePath, sources := paths[0], paths[1:]
+	for _, source := range sources {
+		if !checkPath("archive", source) {
+			return
+		}
+	}
+	if !authorizePath("archive", archivePath) {
+		return
+	}
+
+	progress := newProgressPrinter("Archiving")
+	opts.Progress = progress.Update
+	stats, err := fileops.CreateArchive(archivePath, sources, opts)
+	progress.Done()
+	utils.GlobalAuditLog.Record(utils.AuditEntry{
+		Op:    "archive create",
+		Paths: append([]string{archivePath}, sources...),
+		Sizes: []int64{stats.Bytes},
+	}, err)
+	if err != nil {
+		failf("fmsh: archive: %v\n", err)
+		return
+	}
+	fmt.Printf("Archived %d entries (%d bytes) into %s\n", stats.Entries, stats.Bytes, archivePath)
+}
+
+func extractArchive(args []string) {
+	var opts fileops.ArchiveOptions
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--force", "-f":
+			opts.Overwrite = true
+			continue
+		case "--xattrs":
+			opts.Xattrs = true
+			continue
+		case "--max-size", "--max-entries", "--max-ratio":
+		default:
+			paths = append(paths, arg)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			failf("fmsh: archive: %s needs a value\n", arg)
+			return
+		}
+		i++
+		var err error
+		switch arg {
+		case "--max-size":
+			opts.Limits.MaxBytes = -1
+			if args[i] != "-1" {
+				opts.Limits.MaxBytes, err = fileops.ParseSize(args[i])
+			}
+		case "--max-entries":
+			opts.Limits.MaxEntries, err = strconv.Atoi(args[i])
+		case "--max-ratio":
+			opts.Limits.MaxRatio, err = strconv.ParseFloat(args[i], 64)
+		}
+		if err != nil {
+			failf("fmsh: archive: %s: invalid value %s\n", arg, args[i])
+			return
+		}
+	}
+	if len(paths) == 0 || len(paths) > 2 {
+		failln("Usage: archive extract [--force] [--xattrs] [--max-size size] [--max-entries n] [--max-ratio n] <archive> [directory]")
+		return
+	}
+
+	archivePath, dest := paths[0], "."
+	if len(paths) == 2 {
+		dest = paths[1]
+	}
+	if !checkPath("archive", archivePath) || !authorizePath("archive", dest) {
+		return
+	}
+
+	progress := newProgressPrinter("Extracting")
+	opts.Progress = progress.Update
+	replaced := &replacements{}
+	opts.Replace = replaced.trash
+	stats, err := fileops.ExtractArchive(archivePath, dest, opts)
+	progress.Done()
+	utils.GlobalAuditLog.Record(utils.AuditEntry{
+		Op:    "archive extract",
+		Paths: []string{archivePath, dest},
+		Sizes: []int64{stats.Bytes},
+	}, err)
+
+	// Undo removes what was extracted and restores the files it replaced,
+	// which after a failure are all that is left to restore
+	batch := utils.Action{Type: utils.Batch, Label: "archive extract", Actions: replaced.steps}
+	for _, path := range stats.Created {
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			continue
+		}
+		batch.Actions = append(batch.Actions, utils.Action{Type: utils.Extract, Source: archivePath, Dest: path, Target: filepath.ToSlash(rel)})
+	}
+	pushBatch(batch)
+	if err != nil {
+		failf("fmsh: archive: %v; the partial extraction was removed\n", err)
+		if len(replaced.steps) > 0 {
+			fmt.Println("The files it replaced are in the trash; undo restores them.")
+		}
+		return
+	}
+	fmt.Printf("Extracted %d entries (%d bytes) into %s\n", stats.Entries-stats.Skipped, stats.Bytes, dest)
+	if stats.Skipped > 0 {
+		fmt.Printf("Skipped %d special file(s).\n", stats.Skipped)
+	}
+}
+
+func listArchive(args []string) {
+	if len(args) != 1 {
+		failln("Usage: archive list <archive>")
+		return
+	}
+	if !checkPath("archive", args[0]) {
+		return
+	}
+	entries, err := fileops.ListArchive(args[0])
+	if err != nil {
+		failf("fmsh: archive: %v\n", err)
+		return
+	}
+
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name
+		switch entry.Type {
+		case fileops.EntryDir:
+			name += "/"
+		case fileops.EntrySymlink:
+			name += " -> " + entry.Linkname
+		case fileops.EntryHardlink:
+			name += " => " + entry.Linkname
+		}
+		total += entry.Size
+		fmt.Printf("%s  %10d  %s  %s\n", entry.Mode, entry.Size, entry.ModTime.Format("2006-01-02 15:04"), name)
+	}
+	fmt.Printf("%d entries, %d bytes\n", len(entries), total)
+}
+
+func testArchive(args []string) {
+	if len(args) != 1 {
+		failln("Usage: archive test <archive>")
+		return
+	}
+	if !checkPath("archive", args[0]) {
+		return
+	}
+	stats, err := fileops.TestArchive(args[0])
+	if err != nil {
+		failln(utils.Colorize(utils.RoleError, fmt.Sprintf("fmsh: archive: %v", err)))
+		return
+	}
+	fmt.Printf("%s: OK, %d entries, %d bytes\n", args[0], stats.Entries, stats.Bytes)
+}
@@ -1,14 +1,35 @@
 package commands
 
 import (
+	"fmsh/utils"
 	"fmt"
 	"strings"
 )
 
+// CommandFlag describes a property of a command that is enforced at dispatch time
+type CommandFlag int
+
+const (
+	// Mutating marks commands that modify the file system
+	Mutating CommandFlag = 1 << iota
+	// Paged marks commands whose long output is shown through the pager
+	Paged
+	// VFSAware marks mutating commands that work through the vfs, so they
+	// also run inside archives and mounted backends; others are refused
+	// there, since they would act on the host file system instead
+	VFSAware
+)
+
 // Command represents a shell command with a description and a callback
 type Command struct {
 	Description string
 	Callback    CommandCallback
+	Flags       CommandFlag
+}
+
+// Has reports whether the command was registered with the given flag
+func (c Command) Has(flag CommandFlag) bool {
+	return c.Flags&flag != 0
 }
 
 // CommandCallback represents a function that executes a shell command
@@ -17,12 +38,16 @@ type CommandCallback func(args []string)
 // CommandRegistry holds the mapping of command names to their Command struct
 var CommandRegistry = map[string]Command{}
 
-// RegisterCommand registers a new command with its description and callback
-func RegisterCommand(name, description string, callback CommandCallback) {
-	CommandRegistry[name] = Command{
+// RegisterCommand registers a new command with its description, callback and optional flags
+func RegisterCommand(name, description string, callback CommandCallback, flags ...CommandFlag) {
+	command := Command{
 		Description: description,
 		Callback:    callback,
 	}
+	for _, flag := range flags {
+		command.Flags |= flag
+	}
+	CommandRegistry[name] = command
 }
 
 // DispatchCommand dispatches the command based on user input
@@ -32,41 +57,117 @@ func DispatchCommand(input string) {
 		return
 	}
 
-	cmd := parts[0]
-	args := parts[1:]
+	dispatch(parts[0], parts[1:])
+}
+
+// failed is set when the running command reports a failure. Commands that
+// work through several arguments report each failure and carry on, so how
+// they return says nothing about whether they succeeded.
+var failed bool
+
+// failf prints a failure of the running command and marks it as failed
+func failf(format string, args ...interface{}) {
+	failed = true
+	fmt.Printf(format, args...)
+}
+
+// failln is failf for messages printed as fmt.Println does
+func failln(args ...interface{}) {
+	failed = true
+	fmt.Println(args...)
+}
 
-	if command, exists := CommandRegistry[cmd]; exists {
+// dispatch runs a registered command with its arguments
+func dispatch(cmd string, args []string) {
+	failed = false
+	defer rollbackOnFailure(cmd)
+	command, exists := CommandRegistry[cmd]
+	if !exists {
+		failln(utils.Colorize(utils.RoleError, "fmsh: command not found: "+cmd))
+		return
+	}
+	if command.Has(Mutating) && utils.GlobalPolicy.ReadOnly {
+		failln(utils.Colorize(utils.RoleError, "fmsh: "+cmd+": disabled in read-only mode"))
+		return
+	}
+	if command.Has(Mutating) && !command.Has(VFSAware) {
+		if err := checkVirtual(args); err != nil {
+			failln(utils.Colorize(utils.RoleError, "fmsh: "+cmd+": "+err.Error()))
+			return
+		}
+	}
+	// Mounted and remote backends have no trash or undo
+	if command.Has(Mutating) && cmd != "rollback" && cmd != "redo" && checkVirtual(args) != nil &&
+		!allowIrreversible(cmd, args, "a change to a mounted or remote path") {
+		return
+	}
+	if !command.Has(Paged) {
 		command.Callback(args)
-	} else {
-		fmt.Printf("fmsh: command not found: %s\n", cmd)
+		return
+	}
+
+	usePager := utils.GlobalPager.Enabled
+	filtered := args[:0:0]
+	for _, arg := range args {
+		if arg == "--no-pager" {
+			usePager = false
+		} else {
+			filtered = append(filtered, arg)
+		}
+	}
+	if !usePager {
+		command.Callback(filtered)
+		return
 	}
+	utils.GlobalPager.Run(func() { command.Callback(filtered) })
 }
 
 func InitializeCommands() {
 	RegisterCommand("echo", "Echoes back the input text", HandleEcho)
-	RegisterCommand("ls", "Lists the contents of a directory", HandleLs)
+	RegisterCommand("ls", "Lists the contents of a directory", HandleLs, Paged)
 	RegisterCommand("cd", "Changes the current directory", HandleCd)
-	RegisterCommand("rm", "Removes files or directories", HandleRm)
-	RegisterCommand("mkdir", "Creates a new directory", HandleMkdir)
-	RegisterCommand("cp", "Copies files or directories", HandleCp)
+	RegisterCommand("rm", "Moves files or directories to the trash", HandleRm, Mutating, VFSAware)
+	RegisterCommand("trash", "Lists, restores or empties trashed files", HandleTrash)
+	RegisterCommand("mkdir", "Creates a new directory", HandleMkdir, Mutating, VFSAware)
+	RegisterCommand("cp", "Copies files or directories, also out of archives", HandleCp, Mutating, VFSAware)
+	RegisterCommand("mv", "Moves files or directories", HandleMv, Mutating, VFSAware)
+	RegisterCommand("ln", "Creates hard or symbolic links", HandleLn, Mutating, VFSAware)
+	RegisterCommand("readlink", "Prints the target or canonical path of a symlink", HandleReadlink)
+	RegisterCommand("links", "Finds broken symlinks or files with several hard links", HandleLinks, Paged)
 	RegisterCommand("clear", "Clears the terminal screen", HandleClear)
 	RegisterCommand("inspect", "Analyzes the file system", HandleFsAnalytics)
 	RegisterCommand("disk-usage", "Shows disk usage of a directory", HandleDiskUsage)
-	RegisterCommand("tree", "Displays a tree-like structure of directories", HandleTree)
-	RegisterCommand("clean-tmp", "Cleans up temporary files", HandleCleanTmp)
-	RegisterCommand("preview", "Previews the contents of a file", HandlePreview)
-	RegisterCommand("backup", "Backs up files or directories", HandleBackup)
-	RegisterCommand("chmod", "Changes file permissions", HandleChmod)
+	RegisterCommand("tree", "Displays a tree-like structure of directories", HandleTree, Paged)
+	RegisterCommand("clean-tmp", "Cleans up temporary files", HandleCleanTmp, Mutating, VFSAware)
+	RegisterCommand("preview", "Previews the contents of a file", HandlePreview, Paged)
+	RegisterCommand("backup", "Backs up files or directories", HandleBackup, Mutating, VFSAware)
+	RegisterCommand("stat", "Shows the full metadata of files", HandleStat)
+	RegisterCommand("xattr", "Lists, reads, sets or removes extended attributes", HandleXattr)
+	RegisterCommand("chmod", "Changes file permissions, recursively with -R", HandleChmod, Mutating, VFSAware)
+	RegisterCommand("chown", "Changes the owner and group of files", HandleChown, Mutating)
+	RegisterCommand("chgrp", "Changes the group of files", HandleChgrp, Mutating)
 	RegisterCommand("open", "Opens a file with its default application", HandleOpen)
-	RegisterCommand("rename", "Renames a file or directory", HandleRename)
-	RegisterCommand("file-history", "Shows the history of a file", HandleFileHistory)
-	RegisterCommand("help", "Lists all available commands", HandleHelp)
+	RegisterCommand("rename", "Renames a file or directory", HandleRename, Mutating, VFSAware)
+	RegisterCommand("bulk-rename", "Renames many files with a regex or template", HandleBulkRename, Mutating, VFSAware)
+	RegisterCommand("mount", "Mounts a memory or host directory backend at a path", HandleMount)
+	RegisterCommand("umount", "Unmounts a backend", HandleUmount)
+	RegisterCommand("serve", "Shares a directory over HTTP", HandleServe)
+	RegisterCommand("archive", "Creates, extracts, lists or tests zip and tar archives", HandleArchive)
+	RegisterCommand("organize", "Sorts files into folders by rules", HandleOrganize)
+	RegisterCommand("file-history", "Shows the history of a file", HandleFileHistory, Paged)
+	RegisterCommand("help", "Lists all available commands", HandleHelp, Paged)
 	RegisterCommand("exit", "Exits the shell", HandleExit)
 	RegisterCommand("quit", "Exits the shell", HandleExit)
 	RegisterCommand("q", "Exits the shell", HandleExit)
 	RegisterCommand("summarise", "Summarizes a directory", HandleSummarise)
 	RegisterCommand("analytics", "Analyzes file access patterns", HandleAnalytics)
 	RegisterCommand("time", "Shows the current time", HandleTime)
-	RegisterCommand("find", "Finds files or directories", HandleFind)
-	RegisterCommand("undo", "Undoes the last command", HandleUndo)
+	RegisterCommand("find", "Finds files or directories", HandleFind, Paged)
+	RegisterCommand("undo", "Undoes the last command, or the last n", HandleUndo)
+	RegisterCommand("begin", "Starts a transaction of commands", HandleBegin)
+	RegisterCommand("commit", "Commits the open transaction", HandleCommit)
+	RegisterCommand("rollback", "Reverts every command of the open transaction", HandleRollback, Mutating, VFSAware)
+	RegisterCommand("redo", "Redoes the last undone command", HandleRedo, Mutating, VFSAware)
+	RegisterCommand("theme", "Shows or switches the colour theme", HandleTheme)
+	RegisterCommand("policy", "Shows or changes the safety policy", HandlePolicy)
 }
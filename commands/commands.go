@@ -2,21 +2,20 @@ package commands
 
 import (
 	"bufio"
+	"fmsh/fileops"
 	"fmsh/utils"
+	"fmsh/vfs"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/h2non/filetype"
 )
 
 // HandleHelp displays the list of available commands and their descriptions
@@ -48,13 +47,17 @@ func HandleHelp(args []string) {
 // HandleEcho handles the "echo" command with automatic colors
 func HandleEcho(args []string) {
 	if len(args) == 0 {
-		fmt.Println("Usage: echo <message>")
+		failln("Usage: echo <message>")
 		return
 	}
 
-	colorCode := utils.GetRandomColor()
 	message := strings.Join(args, " ")
-	fmt.Printf("%s%s\033[0m\n", colorCode, message)
+	if !utils.GlobalPalette.Enabled() {
+		fmt.Println(message)
+		return
+	}
+	colorCode := utils.GetRandomColor()
+	fmt.Printf("%s%s%s\n", colorCode, message, utils.Reset)
 }
 
 // HandleLs implements the "ls" command
@@ -63,194 +66,373 @@ func HandleLs(args []string) {
 	if len(args) > 0 {
 		path = args[0]
 	}
-
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		fmt.Printf("fmsh: ls: %v\n", err)
+	if !checkPath("ls", path) {
 		return
 	}
-
-	for _, file := range files {
-		if file.IsDir() {
-			fmt.Printf("%s/\n", file.Name())
-		} else {
-			fmt.Println(file.Name())
-		}
+	loc, err := locate(path, true)
+	if err == nil {
+		err = listDir(loc.fs, loc.name)
+	}
+	if err != nil {
+		failf("fmsh: ls: %v\n", err)
 	}
 }
 
 // HandleCd implements the "cd" command
 func HandleCd(args []string) {
 	if len(args) == 0 {
-		fmt.Println("Usage: cd <directory>")
+		failln("Usage: cd <directory>")
 		return
 	}
 
 	path := args[0]
-	err := os.Chdir(path)
-	if err != nil {
-		fmt.Printf("fmsh: cd: %v\n", err)
+	if !checkPath("cd", path) {
+		return
+	}
+	if err := changeDir(path); err != nil {
+		failf("fmsh: cd: %v\n", err)
 	}
 }
 
-// HandleRm implements the "rm" command with undo support
+// HandleRm implements the "rm" command, moving entries into the trash so they can be restored
 func HandleRm(args []string) {
-	if len(args) == 0 {
-		fmt.Println("Usage: rm <file>")
-		return
+	var recursive, force, permanent bool
+	var paths []string
+	for _, arg := range args {
+		switch arg {
+		case "-r", "-R", "--recursive":
+			recursive = true
+		case "-f", "--force":
+			force = true
+		case "--permanent":
+			permanent = true
+		case "-rf", "-fr":
+			recursive, force = true, true
+		default:
+			paths = append(paths, arg)
+		}
 	}
-
-	path := args[0]
-
-	// Read the file content for undo
-	content, err := os.ReadFile(path)
-	if err != nil {
-		fmt.Printf("fmsh: rm: Failed to read file for undo: %v\n", err)
+	if len(paths) == 0 {
+		failln("Usage: rm [-r] [-f] [--permanent] <path>...")
 		return
 	}
-
-	// Attempt to remove the file
-	err = os.Remove(path)
-	if err != nil {
-		fmt.Printf("fmsh: rm: %v\n", err)
+	if permanent && !allowIrreversible("rm", args, "deleting permanently") {
 		return
 	}
 
-	// Log the delete action in the global UndoManager
-	utils.GlobalUndoManager.Push(utils.Action{
-		Type:    utils.Delete,
-		Source:  path,
-		Content: content,
-	})
+	for _, path := range paths {
+		loc, err := locate(path, false)
+		var info os.FileInfo
+		if err == nil {
+			info, err = loc.fs.Lstat(loc.name)
+		}
+		if err != nil {
+			if !force || !os.IsNotExist(err) {
+				failf("fmsh: rm: %v\n", err)
+			}
+			continue
+		}
+		if info.IsDir() && !recursive {
+			failf("fmsh: rm: %s: is a directory (use -r)\n", path)
+			continue
+		}
+		if !authorizePath("rm", path) {
+			continue
+		}
 
-	fmt.Println("File deleted:", path)
-}
+		entry := utils.AuditEntry{
+			Op:         "rm",
+			Paths:      []string{resolvePath(path)},
+			Sizes:      []int64{info.Size()},
+			ModeBefore: utils.FileMode(path),
+		}
+		// Mounted backends have no trash, so removal there is permanent
+		if permanent || !loc.native() {
+			err = vfs.RemoveAll(loc.fs, loc.name)
+			utils.GlobalAuditLog.Record(entry, err)
+			if err != nil {
+				failf("fmsh: rm: %v\n", err)
+				continue
+			}
+			fmt.Println("Deleted permanently:", path)
+			continue
+		}
 
-// HandleUndo implements the "undo" command
-func HandleUndo(args []string) {
-	utils.GlobalUndoManager.Undo()
+		absPath, _ := filepath.Abs(path)
+		trashed, err := fileops.TrashFor(absPath).Put(absPath)
+		if err == nil {
+			entry.Paths = append(entry.Paths, trashed)
+		}
+		utils.GlobalAuditLog.Record(entry, err)
+		if err != nil {
+			failf("fmsh: rm: %v\n", err)
+			continue
+		}
+
+		utils.GlobalUndoManager.Push(utils.Action{
+			Type:   utils.Trash,
+			Source: absPath,
+			Dest:   trashed,
+		})
+		fmt.Println("Moved to trash:", path)
+	}
 }
 
 // HandleMkdir implements the "mkdir" command
 func HandleMkdir(args []string) {
 	if len(args) == 0 {
-		fmt.Println("Usage: mkdir <directory>")
+		failln("Usage: mkdir <directory>")
 		return
 	}
 
 	path := args[0]
-	err := os.Mkdir(path, 0755)
+	if !authorizePath("mkdir", path) {
+		return
+	}
+	loc, err := locate(path, false)
+	if err == nil {
+		err = loc.fs.Mkdir(loc.name, 0755)
+	}
+	utils.GlobalAuditLog.Record(utils.AuditEntry{
+		Op:        "mkdir",
+		Paths:     []string{resolvePath(path)},
+		ModeAfter: utils.FileMode(path),
+	}, err)
 	if err != nil {
-		fmt.Printf("fmsh: mkdir: %v\n", err)
+		failf("fmsh: mkdir: %v\n", err)
+		return
+	}
+	if loc.native() {
+		utils.GlobalUndoManager.Push(utils.Action{Type: utils.Mkdir, Source: path})
 	}
 }
 
-// HandleCp implements the "cp" command
+// HandleCp implements the "cp" command using the parallel copy engine
 func HandleCp(args []string) {
-	if len(args) < 2 {
-		fmt.Println("Usage: cp <source> <destination>")
+	opts := fileops.CopyOptions{PreserveOwnership: true}
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-r", "-R", "--recursive":
+			opts.Recursive = true
+		case "--verify":
+			opts.Verify = true
+		case "--xattrs":
+			opts.PreserveXattrs = true
+		case "-j", "--jobs":
+			if i+1 >= len(args) {
+				failln("fmsh: cp: -j needs a number of workers")
+				return
+			}
+			i++
+			workers, err := strconv.Atoi(args[i])
+			if err != nil || workers < 1 {
+				failf("fmsh: cp: invalid number of workers: %s\n", args[i])
+				return
+			}
+			opts.Workers = workers
+		default:
+			if !parseConflictFlag(arg, &opts.Conflict) {
+				paths = append(paths, arg)
+			}
+		}
+	}
+
+	if len(paths) < 2 {
+		failln("Usage: cp [-r] [-j workers] [--verify] [--xattrs] " + conflictUsage + " <source>... <destination>")
+		return
+	}
+	// In a virtual directory, relative paths are relative to it
+	for i := range paths {
+		paths[i] = resolvePath(paths[i])
+	}
+	sources, destination := paths[:len(paths)-1], paths[len(paths)-1]
+	if len(sources) > 1 && !isDir(destination) {
+		failf("fmsh: cp: target '%s' is not a directory\n", destination)
 		return
 	}
 
-	source := args[0]
-	destination := args[1]
-	err := os.Rename(source, destination)
-	if err != nil {
-		fmt.Printf("fmsh: cp: %v\n", err)
+	progress := newProgressPrinter("Copying")
+	opts.Progress = progress.Update
+
+	start := time.Now()
+	var total fileops.CopyStats
+	for _, source := range sources {
+		target := copyTarget(source, destination)
+		if !checkPath("cp", source) || !authorizePath("cp", target) {
+			continue
+		}
+
+		stats, err := copyPath(source, target, opts)
+		progress.Done()
+		if err != nil {
+			failf("fmsh: cp: %v\n", err)
+		}
+
+		total.Files += stats.Files
+		total.Dirs += stats.Dirs
+		total.Symlinks += stats.Symlinks
+		total.Bytes += stats.Bytes
+		total.Skipped += stats.Skipped
+		total.Resumed += stats.Resumed
+		total.Verified += stats.Verified
 	}
-}
 
-// HandleClear clears the terminal screen
-func HandleClear(args []string) {
-	fmt.Print("\033[H\033[2J")
+	fmt.Printf("Copied %d files, %d directories and %d symlinks (%d bytes) in %v\n",
+		total.Files, total.Dirs, total.Symlinks, total.Bytes, time.Since(start).Round(time.Millisecond))
+	if total.Skipped > 0 {
+		fmt.Printf("Skipped %d existing destinations\n", total.Skipped)
+	}
+	if total.Resumed > 0 {
+		fmt.Printf("Resumed %d interrupted files\n", total.Resumed)
+	}
+	if opts.Verify {
+		fmt.Printf("Verified %d files\n", total.Verified)
+	}
 }
 
-// HandleFsAnalytics performs file system analytics with improved performance using goroutines
-func HandleFsAnalytics(args []string) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		fmt.Printf("Error: Unable to get current directory: %v\n", err)
+// HandleMv implements the "mv" command, falling back to copy and delete across filesystems
+func HandleMv(args []string) {
+	var opts fileops.MoveOptions
+	var paths []string
+	for _, arg := range args {
+		if !parseConflictFlag(arg, &opts.Conflict) {
+			paths = append(paths, arg)
+		}
+	}
+
+	if len(paths) < 2 {
+		failln("Usage: mv " + conflictUsage + " <source>... <destination>")
+		return
+	}
+	// In a virtual directory, relative paths are relative to it
+	for i := range paths {
+		paths[i] = resolvePath(paths[i])
+	}
+	sources, destination := paths[:len(paths)-1], paths[len(paths)-1]
+	if len(sources) > 1 && !isDir(destination) {
+		failf("fmsh: mv: target '%s' is not a directory\n", destination)
 		return
 	}
 
-	var fileCount, dirCount int
-	var totalSize int64
-	var largestFile string
-	var largestFileSize int64
-	var mostRecentFile string
-	var mostRecentModTime time.Time
-	var mu sync.Mutex
-
-	// Channel for processing files and directories
-	fileChan := make(chan string, 100)
-
-	// WaitGroup to wait for all goroutines to complete
-	var wg sync.WaitGroup
-
-	// Worker goroutine to process files
-	processFile := func() {
-		defer wg.Done()
-		for path := range fileChan {
-			info, err := os.Stat(path)
-			if err != nil {
-				fmt.Printf("Warning: Unable to access %s: %v\n", path, err)
-				continue
-			}
+	progress := newProgressPrinter("Moving")
+	opts.Copy.Progress = progress.Update
 
-			mu.Lock()
-			if info.IsDir() {
-				dirCount++
-			} else {
-				fileCount++
-				totalSize += info.Size()
-				if info.Size() > largestFileSize {
-					largestFileSize = info.Size()
-					largestFile = path
-				}
-				if info.ModTime().After(mostRecentModTime) {
-					mostRecentModTime = info.ModTime()
-					mostRecentFile = path
-				}
+	for _, source := range sources {
+		target := copyTarget(source, destination)
+		if !authorizePath("mv", source) || !authorizePath("mv", target) {
+			continue
+		}
+
+		src, err := locate(source, false)
+		var dst location
+		if err == nil {
+			dst, err = locate(target, false)
+		}
+		if err != nil {
+			failf("fmsh: mv: %v\n", err)
+			continue
+		}
+		if !src.native() || !dst.native() {
+			moved, err := fileops.MoveFS(src.fs, src.name, dst.fs, dst.name, opts)
+			progress.Done()
+			reportVirtualMove(source, target, dst, moved, err)
+			continue
+		}
+
+		size := utils.FileSize(source)
+		moved, err := fileops.Move(source, target, opts)
+		progress.Done()
+		if err == nil && moved == "" {
+			fmt.Printf("Skipped '%s': '%s' already exists\n", source, target)
+			continue
+		}
+		utils.GlobalAuditLog.Record(utils.AuditEntry{
+			Op:    "mv",
+			Paths: []string{source, moved},
+			Sizes: []int64{size},
+		}, err)
+		if err != nil {
+			failf("fmsh: mv: %v\n", err)
+			if moved == "" {
+				continue
 			}
-			mu.Unlock()
 		}
+
+		// Absolute paths keep the undo working after a cd
+		absSource, _ := filepath.Abs(source)
+		absMoved, _ := filepath.Abs(moved)
+		utils.GlobalUndoManager.Push(utils.Action{
+			Type:   utils.Move,
+			Source: absSource,
+			Dest:   absMoved,
+		})
+		fmt.Printf("Moved '%s' to '%s'\n", source, moved)
 	}
+}
 
-	// Start worker goroutines
-	numWorkers := 4 // Number of worker goroutines
-	wg.Add(numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		go processFile()
+// reportVirtualMove reports a move that involved a mounted backend, which
+// unlike moves on the host cannot be undone
+func reportVirtualMove(source, target string, dst location, moved string, err error) {
+	if err == nil && moved == "" {
+		fmt.Printf("Skipped '%s': '%s' already exists\n", source, target)
+		return
+	}
+	if moved != "" {
+		moved = dst.path(moved)
 	}
+	utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "mv", Paths: []string{source, moved}}, err)
+	if err != nil {
+		failf("fmsh: mv: %v\n", err)
+		return
+	}
+	fmt.Printf("Moved '%s' to '%s'\n", source, moved)
+}
 
-	// Walk the directory and send file paths to the channel
-	err = filepath.Walk(currentDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("Warning: Unable to access %s: %v\n", path, err)
-			return nil
-		}
-		fileChan <- path
-		return nil
-	})
+// copyTarget is fileops.CopyTarget for destinations that may be virtual
+func copyTarget(src, dest string) string {
+	if isDir(dest) {
+		return joinPath(dest, path.Base(filepath.ToSlash(filepath.Clean(src))))
+	}
+	return dest
+}
 
+// isDir reports whether path is a directory, wherever it lives
+func isDir(path string) bool {
+	loc, err := locate(path, false)
 	if err != nil {
-		fmt.Printf("Error walking the directory: %v\n", err)
+		return false
 	}
+	info, err := loc.fs.Stat(loc.name)
+	return err == nil && info.IsDir()
+}
 
-	close(fileChan) // Close the channel to signal workers to stop
-	wg.Wait()       // Wait for all workers to finish
+// HandleClear clears the terminal screen
+func HandleClear(args []string) {
+	fmt.Print("\033[H\033[2J")
+}
+
+// HandleFsAnalytics performs file system analytics of the working directory
+func HandleFsAnalytics(args []string) {
+	result, err := inspect(Workdir(), Task{})
+	for _, warning := range result.Warnings {
+		fmt.Println(utils.Colorize(utils.RoleWarning, "Warning: "+warning))
+	}
+	if err != nil {
+		failf("Error walking the directory: %v\n", err)
+	}
 
 	// Display analytics
-	fmt.Printf("File System Analytics for: %s\n", currentDir)
+	fmt.Printf("File System Analytics for: %s\n", result.Path)
 	fmt.Println("-----------------------------------------")
-	fmt.Printf("Number of files: %d\n", fileCount)
-	fmt.Printf("Number of directories: %d\n", dirCount)
-	fmt.Printf("Total size of files: %d bytes\n", totalSize)
-	if largestFile != "" {
-		fmt.Printf("Largest file: %s (%d bytes)\n", largestFile, largestFileSize)
+	fmt.Printf("Number of files: %d\n", result.Files)
+	fmt.Printf("Number of directories: %d\n", result.Dirs)
+	fmt.Printf("Total size of files: %s\n", utils.Colorize(utils.RoleSize, fmt.Sprintf("%d bytes", result.Bytes)))
+	if result.Largest != "" {
+		fmt.Printf("Largest file: %s (%s)\n", result.Largest, utils.Colorize(utils.RoleSize, fmt.Sprintf("%d bytes", result.LargestSize)))
 	}
-	if mostRecentFile != "" {
-		fmt.Printf("Most recently modified file: %s (Modified at: %s)\n", mostRecentFile, mostRecentModTime.Format(time.RFC1123))
+	if result.Newest != "" {
+		fmt.Printf("Most recently modified file: %s (Modified at: %s)\n", result.Newest, result.NewestTime.Format(time.RFC1123))
 	}
 	fmt.Println("-----------------------------------------")
 }
@@ -258,191 +440,185 @@ func HandleFsAnalytics(args []string) {
 // HandleFind implements the find command
 func HandleFind(args []string) {
 	if len(args) < 1 {
-		fmt.Println("Usage: find <directory> [filename]")
+		failln("Usage: find <directory> [filename]")
 		return
 	}
 
 	root := args[0]
+	if !checkPath("find", root) {
+		return
+	}
 	pattern := ""
 	if len(args) > 1 {
 		pattern = args[1]
 	}
 
-	numCores := runtime.NumCPU()               // Get the number of CPU cores
-	semaphore := make(chan struct{}, numCores) // Limit concurrency to available cores
-
-	var wg sync.WaitGroup
-	results := make(chan string, 100)
-	foundDirs := make(chan string, 100)
-
-	// Recursive function for finding files
-	var findFiles func(string)
-	findFiles = func(dir string) {
-		defer wg.Done()
-
-		semaphore <- struct{}{}        // Acquire a slot
-		defer func() { <-semaphore }() // Release the slot
-
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			// Silently consume the error and move on
-			return
-		}
-
-		dirHasMatches := false
-		for _, entry := range entries {
-			path := filepath.Join(dir, entry.Name())
-			if entry.IsDir() {
-				wg.Add(1)
-				go findFiles(path)
-			} else if pattern == "" || entry.Name() == pattern {
-				results <- path
-				dirHasMatches = true
-			}
-		}
-
-		if dirHasMatches {
-			foundDirs <- dir
-		}
+	// One more than is shown tells whether there are more
+	const shown = 10
+	results, err := find(root, pattern, shown+1, Task{})
+	if err != nil {
+		failf("fmsh: find: %v\n", err)
+		return
 	}
-
-	// Start the search
-	wg.Add(1)
-	go findFiles(root)
-
-	// Close results and directories channels after all goroutines complete
-	go func() {
-		wg.Wait()
-		close(results)
-		close(foundDirs)
-	}()
-
 	fmt.Println("Searching for files in", root, "with pattern", pattern)
-	count := 0
-	for result := range results {
-		if count < 10 {
-			fmt.Println(result)
-		} else {
+	for i, result := range results {
+		if i == shown {
 			fmt.Println("found in many more directories")
 			break
 		}
-		count++
+		fmt.Println(result)
 	}
 }
 
-// HandleDiskUsage calculates the total disk usage of the current directory
+// HandleDiskUsage calculates the total disk usage of a directory, the current one by default
 func HandleDiskUsage(args []string) {
-	currentDir, err := os.Getwd()
+	currentDir := Workdir()
+	if len(args) > 0 {
+		currentDir = resolvePath(args[0])
+		if !checkPath("disk-usage", currentDir) {
+			return
+		}
+	}
+	loc, err := locate(currentDir, true)
 	if err != nil {
-		fmt.Printf("Error: Unable to get the current directory: %v\n", err)
+		failf("Error: Unable to get the current directory: %v\n", err)
 		return
 	}
 
 	var totalSize int64
-	err = filepath.Walk(currentDir, func(_ string, info os.FileInfo, err error) error {
+	err = fs.WalkDir(loc.fs, loc.name, func(_ string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			fmt.Printf("Error accessing file: %v\n", err)
+			failf("Error accessing file: %v\n", err)
 			return nil
 		}
-		if !info.IsDir() {
+		if info, err := entry.Info(); err == nil && !info.IsDir() {
 			totalSize += info.Size()
 		}
 		return nil
 	})
 
 	if err != nil {
-		fmt.Printf("Error calculating disk usage: %v\n", err)
+		failf("Error calculating disk usage: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Total disk usage of '%s': %d bytes\n", currentDir, totalSize)
+	fmt.Printf("Total disk usage of '%s': %s\n", currentDir, utils.Colorize(utils.RoleSize, fmt.Sprintf("%d bytes", totalSize)))
 }
 
 // HandleTree displays a tree-like structure of directories and files
 func HandleTree(args []string) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		fmt.Printf("Error: Unable to get the current directory: %v\n", err)
+	currentDir := Workdir()
+	if currentDir == "" {
+		failln("Error: Unable to get the current directory")
 		return
 	}
-
-	err = filepath.Walk(currentDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("Error accessing file: %v\n", err)
-			return nil
-		}
-
-		// Create indentation based on depth
-		relPath, _ := filepath.Rel(currentDir, path)
-		depth := len(filepath.SplitList(relPath)) - 1
-		indent := strings.Repeat("  ", depth)
-
-		// Print directories with a slash
-		if info.IsDir() {
-			fmt.Printf("%s%s/\n", indent, info.Name())
-		} else {
-			fmt.Printf("%s%s\n", indent, info.Name())
-		}
-		return nil
-	})
-
+	loc, err := locate(".", true)
+	if err == nil {
+		err = printTree(loc.fs, loc.name, filepath.Base(currentDir))
+	}
 	if err != nil {
-		fmt.Printf("Error generating tree: %v\n", err)
+		failf("Error generating tree: %v\n", err)
 	}
 }
 
 // HandleCleanTmp identifies and optionally deletes temporary files
 func HandleCleanTmp(args []string) {
-	currentDir, err := os.Getwd()
+	loc, err := locate(".", true)
+	if err == nil && loc.native() {
+		// Absolute paths keep the trash and undo independent of cd
+		loc.name, err = os.Getwd()
+	}
 	if err != nil {
-		fmt.Printf("Error: Unable to get the current directory: %v\n", err)
+		failf("Error: Unable to get the current directory: %v\n", err)
 		return
 	}
+	deleteFiles := len(args) > 0 && args[0] == "--delete"
 
 	fmt.Println("Identifying temporary files...")
 
-	err = filepath.Walk(currentDir, func(path string, info os.FileInfo, err error) error {
+	// Deleted files go to the trash and are undone together; mounted
+	// backends have no trash, so deleting there is permanent
+	batch := utils.Action{Type: utils.Batch, Label: "clean-tmp"}
+	err = fs.WalkDir(loc.fs, loc.name, func(name string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			fmt.Printf("Error accessing file: %v\n", err)
+			failf("Error accessing file: %v\n", err)
 			return nil
 		}
+		path := loc.path(name)
+		if entry.IsDir() && loc.native() && fileops.IsTrashDir(path) {
+			return fs.SkipDir
+		}
 
 		// Match common temporary file extensions
-		if strings.HasSuffix(info.Name(), ".tmp") || strings.HasSuffix(info.Name(), ".log") || strings.HasSuffix(info.Name(), ".bak") {
+		if strings.HasSuffix(entry.Name(), ".tmp") || strings.HasSuffix(entry.Name(), ".log") || strings.HasSuffix(entry.Name(), ".bak") {
 			fmt.Printf("Temporary file: %s\n", path)
-			if len(args) > 0 && args[0] == "--delete" {
-				err := os.Remove(path)
-				if err != nil {
-					fmt.Printf("Error deleting file %s: %v\n", path, err)
+			if deleteFiles {
+				if !authorizePath("clean-tmp", path) {
+					return nil
+				}
+				var size int64
+				if info, err := entry.Info(); err == nil {
+					size = info.Size()
+				}
+				auditEntry := utils.AuditEntry{Op: "clean-tmp", Paths: []string{path}, Sizes: []int64{size}}
+				trashed := ""
+				if loc.native() {
+					trashed, err = fileops.TrashFor(path).Put(path)
 				} else {
+					err = vfs.RemoveAll(loc.fs, name)
+				}
+				if err == nil && trashed != "" {
+					auditEntry.Paths = append(auditEntry.Paths, trashed)
+				}
+				utils.GlobalAuditLog.Record(auditEntry, err)
+				switch {
+				case err != nil:
+					failf("Error deleting file %s: %v\n", path, err)
+				case trashed != "":
+					batch.Actions = append(batch.Actions, utils.Action{Type: utils.Trash, Source: path, Dest: trashed})
 					fmt.Printf("Deleted: %s\n", path)
+				default:
+					fmt.Printf("Deleted permanently: %s\n", path)
+				}
+				if err == nil && entry.IsDir() {
+					return fs.SkipDir
 				}
 			}
 		}
 		return nil
 	})
 
+	if len(batch.Actions) > 0 {
+		utils.GlobalUndoManager.Push(batch)
+	}
 	if err != nil {
-		fmt.Printf("Error cleaning temporary files: %v\n", err)
+		failf("Error cleaning temporary files: %v\n", err)
 	}
 }
 
 // HandlePreview displays the first few lines of a file
 func HandlePreview(args []string) {
 	if len(args) == 0 {
-		fmt.Println("Usage: preview <filename> [lines]")
+		failln("Usage: preview <filename> [lines]")
 		return
 	}
 
 	filename := args[0]
+	if !checkPath("preview", filename) {
+		return
+	}
 	linesToRead := 10
 	if len(args) > 1 {
 		fmt.Sscanf(args[1], "%d", &linesToRead)
 	}
 
-	file, err := os.Open(filename)
+	var file fs.File
+	loc, err := locate(filename, false)
+	if err == nil {
+		file, err = loc.fs.Open(loc.name)
+	}
 	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
+		failf("Error opening file: %v\n", err)
 		return
 	}
 	defer file.Close()
@@ -458,26 +634,33 @@ func HandlePreview(args []string) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
+		failf("Error reading file: %v\n", err)
 	}
 }
 
 // HandleBackup creates a timestamped backup of a file
 func HandleBackup(args []string) {
 	if len(args) == 0 {
-		fmt.Println("Usage: backup <filename>")
+		failln("Usage: backup <filename>")
 		return
 	}
 
 	filename := args[0]
-	info, err := os.Stat(filename)
+	if !authorizePath("backup", filename) {
+		return
+	}
+	loc, err := locate(filename, false)
+	var info fs.FileInfo
+	if err == nil {
+		info, err = loc.fs.Stat(loc.name)
+	}
 	if err != nil {
-		fmt.Printf("Error accessing file: %v\n", err)
+		failf("Error accessing file: %v\n", err)
 		return
 	}
 
 	if info.IsDir() {
-		fmt.Println("Backup command is for files, not directories.")
+		failln("Backup command is for files, not directories.")
 		return
 	}
 
@@ -486,155 +669,35 @@ func HandleBackup(args []string) {
 	timestamp := time.Now().Format("20060102_150405")
 	backupName := fmt.Sprintf("%s_%s%s", base, timestamp, ext)
 
-	err = os.Rename(filename, backupName)
+	dir, _ := vfs.Split(loc.fs, loc.name)
+	err = loc.fs.Rename(loc.name, vfs.Join(loc.fs, dir, filepath.Base(backupName)))
+	utils.GlobalAuditLog.Record(utils.AuditEntry{
+		Op:    "backup",
+		Paths: []string{resolvePath(filename), resolvePath(backupName)},
+		Sizes: []int64{info.Size()},
+	}, err)
 	if err != nil {
-		fmt.Printf("Error creating backup: %v\n", err)
+		failf("Error creating backup: %v\n", err)
 		return
 	}
-
-	fmt.Printf("Backup created: %s\n", backupName)
-}
-
-// // HandleZip creates a zip archive from specified files
-// func HandleZip(args []string) {
-// 	if len(args) < 2 {
-// 		fmt.Println("Usage: zip <archive_name> <file1> <file2> ...")
-// 		return
-// 	}
-
-// 	archiveName := args[0]
-// 	files := args[1:]
-
-// 	zipFile, err := os.Create(archiveName)
-// 	if err != nil {
-// 		fmt.Printf("Error creating zip file: %v\n", err)
-// 		return
-// 	}
-// 	defer zipFile.Close()
-
-// 	zipWriter := zip.NewWriter(zipFile)
-// 	defer zipWriter.Close()
-
-// 	for _, file := range files {
-// 		err := addFileToZip(zipWriter, file)
-// 		if err != nil {
-// 			fmt.Printf("Error adding file to zip: %v\n", err)
-// 			return
-// 		}
-// 	}
-
-// 	fmt.Printf("Archive created: %s\n", archiveName)
-// }
-
-// func addFileToZip(zipWriter *zip.Writer, filePath string) error {
-// 	file, err := os.Open(filePath)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	defer file.Close()
-
-// 	info, err := file.Stat()
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	header, err := zip.FileInfoHeader(info)
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	header.Name = filepath.Base(filePath)
-// 	header.Method = zip.Deflate
-
-// 	writer, err := zipWriter.CreateHeader(header)
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	_, err = os.Copy(writer, file)
-// 	return err
-// }
-
-// // HandleUnzip extracts a zip archive
-// func HandleUnzip(args []string) {
-// 	if len(args) < 1 {
-// 		fmt.Println("Usage: unzip <archive_name>")
-// 		return
-// 	}
-
-// 	archiveName := args[0]
-
-// 	zipReader, err := zip.OpenReader(archiveName)
-// 	if err != nil {
-// 		fmt.Printf("Error opening zip file: %v\n", err)
-// 		return
-// 	}
-// 	defer zipReader.Close()
-
-// 	for _, file := range zipReader.File {
-// 		err := extractFile(file)
-// 		if err != nil {
-// 			fmt.Printf("Error extracting file: %v\n", err)
-// 			return
-// 		}
-// 	}
-
-// 	fmt.Printf("Archive extracted: %s\n", archiveName)
-// }
-
-// func extractFile(file *zip.File) error {
-// 	filePath := file.Name
-// 	fmt.Printf("Extracting: %s\n", filePath)
-
-// 	reader, err := file.Open()
-// 	if err != nil {
-// 		return err
-// 	}
-// 	defer reader.Close()
-
-// 	targetFile, err := os.Create(filePath)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	defer targetFile.Close()
-
-// 	_, err = os.Copy(targetFile, reader)
-// 	return err
-// }
-
-// HandleChmod changes file permissions
-func HandleChmod(args []string) {
-	if len(args) < 2 {
-		fmt.Println("Usage: chmod <permissions> <filename>")
-		return
-	}
-
-	permissions := args[0]
-	filename := args[1]
-
-	perm, err := strconv.ParseUint(permissions, 8, 32)
-	if err != nil {
-		fmt.Printf("Error parsing permissions: %v\n", err)
-		return
-	}
-
-	err = os.Chmod(filename, os.FileMode(perm))
-	if err != nil {
-		fmt.Printf("Error changing permissions: %v\n", err)
-		return
+	if loc.native() {
+		utils.GlobalUndoManager.Push(utils.Action{Type: utils.Rename, Source: filename, Dest: backupName})
 	}
 
-	fmt.Printf("Permissions of '%s' changed to '%s'\n", filename, permissions)
+	fmt.Printf("Backup created: %s\n", backupName)
 }
 
 // HandleOpen opens a file with the system's default application
 func HandleOpen(args []string) {
 	if len(args) < 1 {
-		fmt.Println("Usage: open <filename>")
+		failln("Usage: open <filename>")
 		return
 	}
 
 	filename := args[0]
+	if !checkPath("open", filename) {
+		return
+	}
 
 	var cmd *exec.Cmd
 	switch runtime.GOOS {
@@ -648,7 +711,7 @@ func HandleOpen(args []string) {
 
 	err := cmd.Start()
 	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
+		failf("Error opening file: %v\n", err)
 		return
 	}
 
@@ -657,52 +720,177 @@ func HandleOpen(args []string) {
 
 // HandleRename renames a file or directory
 func HandleRename(args []string) {
-	if len(args) < 2 {
-		fmt.Println("Usage: rename <oldname> <newname>")
+	var conflict fileops.ConflictOptions
+	var names []string
+	for _, arg := range args {
+		if !parseConflictFlag(arg, &conflict) {
+			names = append(names, arg)
+		}
+	}
+	if len(names) < 2 {
+		failln("Usage: rename " + conflictUsage + " <oldname> <newname>")
 		return
 	}
 
-	oldName := args[0]
-	newName := args[1]
+	oldName := names[0]
+	newName := names[1]
+	if !authorizePath("rename", oldName) || !authorizePath("rename", newName) {
+		return
+	}
 
-	err := os.Rename(oldName, newName)
+	oldLoc, err := locate(oldName, false)
+	var newLoc location
+	if err == nil {
+		newLoc, err = locate(newName, false)
+	}
+	if err == nil && oldLoc.root != newLoc.root {
+		err = fmt.Errorf("cannot rename across file systems, use mv")
+	}
+	var info fs.FileInfo
+	if err == nil {
+		info, err = oldLoc.fs.Lstat(oldLoc.name)
+	}
+	if err != nil {
+		failf("Error renaming file: %v\n", err)
+		return
+	}
+	_, statErr := newLoc.fs.Lstat(newLoc.name)
+	target, ok, err := conflict.ResolveFS(newLoc.fs, oldLoc.name, info, newLoc.name)
 	if err != nil {
-		fmt.Printf("Error renaming file: %v\n", err)
+		failf("Error renaming file: %v\n", err)
+		return
+	}
+	if !ok {
+		fmt.Printf("Skipped '%s': '%s' already exists\n", oldName, newName)
 		return
 	}
 
-	fmt.Printf("Renamed '%s' to '%s'\n", oldName, newName)
-}
+	err = oldLoc.fs.Rename(oldLoc.name, target)
+	target = newLoc.path(target)
+	utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "rename", Paths: []string{resolvePath(oldName), target}}, err)
+	if err != nil {
+		failf("Error renaming file: %v\n", err)
+		return
+	}
+	if !newLoc.native() {
+		fmt.Printf("Renamed '%s' to '%s'\n", oldName, target)
+		return
+	}
 
-var fileHistory []string
+	action := utils.Action{Type: utils.Rename, Source: oldName, Dest: target}
+	if conflict.Policy == fileops.Backup && statErr == nil {
+		// The existing destination was moved aside first and comes back on undo
+		suffix := conflict.BackupSuffix
+		if suffix == "" {
+			suffix = fileops.DefaultBackupSuffix
+		}
+		action = utils.Action{Type: utils.Batch, Label: "rename", Actions: []utils.Action{
+			{Type: utils.Rename, Source: newName, Dest: newName + suffix},
+			action,
+		}}
+	}
+	utils.GlobalUndoManager.Push(action)
 
-// LogFileHistory logs an operation to file history
-func LogFileHistory(operation string) {
-	fileHistory = append(fileHistory, operation)
+	fmt.Printf("Renamed '%s' to '%s'\n", oldName, target)
 }
 
-// HandleFileHistory displays session-level file history
+// HandleFileHistory queries the audit log of file system mutations
 func HandleFileHistory(args []string) {
-	if len(fileHistory) == 0 {
-		fmt.Println("No file operations recorded in this session.")
+	var query utils.AuditQuery
+	limit := 0
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			query.Path = arg
+			continue
+		}
+		if i+1 >= len(args) {
+			failf("fmsh: file-history: %s needs a value\n", arg)
+			return
+		}
+		i++
+		value := args[i]
+
+		var err error
+		switch arg {
+		case "--since":
+			query.Since, err = parseTimeArg(value)
+		case "--until":
+			query.Until, err = parseTimeArg(value)
+		case "--op":
+			query.Op = value
+		case "--session":
+			if value == "current" {
+				value = utils.GlobalAuditLog.Session()
+			}
+			query.Session = value
+		case "--limit":
+			limit, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			failf("fmsh: file-history: %v\n", err)
+			failln("Usage: file-history [path] [--since time] [--until time] [--op operation] [--session id|current] [--limit n]")
+			return
+		}
+	}
+
+	entries, err := utils.GlobalAuditLog.Query(query)
+	if err != nil {
+		failf("fmsh: file-history: %v\n", err)
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("No file operations recorded.")
 		return
 	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
 
 	fmt.Println("File Operation History:")
-	for _, entry := range fileHistory {
-		fmt.Println(entry)
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s  %s  %-10s %s", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Session, entry.Op, strings.Join(entry.Paths, " -> "))
+		if entry.ModeBefore != "" || entry.ModeAfter != "" {
+			line += fmt.Sprintf("  [mode %s -> %s]", entry.ModeBefore, entry.ModeAfter)
+		}
+		if entry.Result != "ok" {
+			line += "  FAILED: " + entry.Result
+		}
+		fmt.Println(line)
+	}
+}
+
+// parseTimeArg accepts an absolute time or an age such as "90m", "12h" or "7d"
+func parseTimeArg(value string) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if age, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-age), nil
 	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
 }
 
+// HandleExit asks the shell to exit once the current command returns, so the session is saved
 func HandleExit(args []string) {
 	fmt.Println("Exiting fmsh...")
-	os.Exit(0)
+	exitRequested = true
 }
 
 // HandleTime measures the time taken to execute a command
 func HandleTime(args []string) {
 	if len(args) < 1 {
-		fmt.Println("Usage: time <command> [arguments...]")
+		failln("Usage: time <command> [arguments...]")
 		return
 	}
 
@@ -718,133 +906,3 @@ func HandleTime(args []string) {
 	// Print the elapsed time
 	fmt.Printf("\nCommand executed in: %v\n", elapsed)
 }
-
-// OrganizeDirectory organizes files into folders based on their type in parallel
-func OrganiseDirectory(directory string) {
-	undoDir := filepath.Join(directory, ".undo")
-	os.MkdirAll(undoDir, os.ModePerm) // Create an undo directory to track changes
-
-	var wg sync.WaitGroup         // WaitGroup to synchronize goroutines
-	var mu sync.Mutex             // Mutex to protect shared resources
-	fileChan := make(chan string) // Channel for file paths
-	errorChan := make(chan error) // Channel for errors
-	done := make(chan struct{})   // Done channel to signal completion
-	fileCount := 0                // Count of files processed (for tracking)
-
-	// Worker goroutine to process files
-	go func() {
-		for path := range fileChan {
-			func(path string) {
-				defer wg.Done()
-
-				file, err := os.Open(path)
-				if err != nil {
-					errorChan <- err
-					return
-				}
-				defer file.Close()
-
-				buf := make([]byte, 261)
-				_, err = file.Read(buf)
-				if err != nil && err != io.EOF {
-					errorChan <- err
-					return
-				}
-
-				kind, _ := filetype.Match(buf)
-				var fileType string
-				if kind != filetype.Unknown {
-					fileType = kind.Extension
-				} else {
-					fileType = "unknown"
-				}
-
-				// Ensure directory creation is thread-safe
-				targetDir := filepath.Join(directory, fileType)
-				mu.Lock()
-				os.MkdirAll(targetDir, os.ModePerm)
-				mu.Unlock()
-
-				// Move the file to its corresponding folder
-				targetPath := filepath.Join(targetDir, filepath.Base(path))
-				undoPath := filepath.Join(undoDir, filepath.Base(path))
-				err = os.Rename(path, targetPath)
-				if err != nil {
-					errorChan <- err
-					return
-				}
-
-				// Track the original location in the undo directory
-				mu.Lock()
-				undoFile, err := os.Create(undoPath)
-				mu.Unlock()
-				if err != nil {
-					errorChan <- err
-					return
-				}
-				defer undoFile.Close()
-				_, err = undoFile.WriteString(path)
-				if err != nil {
-					errorChan <- err
-					return
-				}
-
-				// Increment file count
-				mu.Lock()
-				fileCount++
-				mu.Unlock()
-			}(path)
-		}
-		close(done)
-	}()
-
-	// Walk the directory and send files to the channel
-	go func() {
-		defer close(fileChan)
-		err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			// Skip directories and the undo directory itself
-			if info.IsDir() || strings.Contains(path, ".undo") {
-				return nil
-			}
-
-			wg.Add(1)
-			fileChan <- path
-			return nil
-		})
-
-		if err != nil {
-			errorChan <- err
-		}
-	}()
-
-	go func() {
-		wg.Wait()
-		close(errorChan)
-	}()
-
-	for {
-		select {
-		case err := <-errorChan:
-			if err != nil {
-				fmt.Printf("Error organizing file: %v\n", err)
-			}
-		case <-done:
-			fmt.Printf("Directory organized successfully. Total files processed: %d\n", fileCount)
-			return
-		}
-	}
-}
-
-func HandleOrganize(args []string) {
-	if len(args) < 1 {
-		fmt.Println("Usage: organize <directory>")
-		return
-	}
-
-	directory := args[0]
-	OrganiseDirectory(directory)
-}
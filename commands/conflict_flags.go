@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"strings"
+)
+
+// conflictUsage documents the flags understood by parseConflictFlag
+const conflictUsage = "[-n|--no-clobber] [-u|--update] [-b|--backup[=suffix]] [-i|--interactive] [--auto-rename]"
+
+// parseConflictFlag applies a conflict policy flag shared by the commands
+// that write to a destination, reporting whether arg was such a flag
+func parseConflictFlag(arg string, conflict *fileops.ConflictOptions) bool {
+	switch {
+	case arg == "-f" || arg == "--force":
+		conflict.Policy = fileops.Overwrite
+	case arg == "-n" || arg == "--no-clobber":
+		conflict.Policy = fileops.NoClobber
+	case arg == "-u" || arg == "--update":
+		conflict.Policy = fileops.Update
+	case arg == "-b" || arg == "--backup":
+		conflict.Policy = fileops.Backup
+	case strings.HasPrefix(arg, "--backup="):
+		conflict.Policy = fileops.Backup
+		conflict.BackupSuffix = strings.TrimPrefix(arg, "--backup=")
+	case arg == "-i" || arg == "--interactive":
+		conflict.Policy = fileops.Interactive
+		conflict.Ask = askOverwrite
+	case arg == "--auto-rename":
+		conflict.Policy = fileops.AutoRename
+	default:
+		return false
+	}
+	return true
+}
+
+func askOverwrite(src, dst string) bool {
+	return utils.Confirm(fmt.Sprintf("Overwrite '%s' with '%s'?", dst, src))
+}
@@ -0,0 +1,300 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const lnUsage = "Usage: ln [-s] [-r] [-f] <target>... [link|directory]"
+
+// HandleLn implements the "ln" command, which creates hard links or, with
+// -s, symbolic links. Like cp, several targets are linked into a directory.
+func HandleLn(args []string) {
+	var symbolic, relative, force bool
+	var paths []string
+	for _, arg := range args {
+		switch {
+		case arg == "--symbolic":
+			symbolic = true
+		case arg == "--relative":
+			relative = true
+		case arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-") && len(arg) > 1 && !strings.HasPrefix(arg, "--"):
+			for _, flag := range arg[1:] {
+				switch flag {
+				case 's':
+					symbolic = true
+				case 'r':
+					relative = true
+				case 'f':
+					force = true
+				default:
+					failln(lnUsage)
+					return
+				}
+			}
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		failln(lnUsage)
+		return
+	}
+	if relative && !symbolic {
+		failln("fmsh: ln: -r needs -s")
+		return
+	}
+
+	// Like ln, a single target is linked into the working directory
+	targets, destination := paths, "."
+	if len(paths) > 1 {
+		targets, destination = paths[:len(paths)-1], paths[len(paths)-1]
+	}
+	if len(targets) > 1 && !isDir(destination) {
+		failf("fmsh: ln: target '%s' is not a directory\n", destination)
+		return
+	}
+
+	for _, target := range targets {
+		link := copyTarget(target, destination)
+		if err := makeLink(target, link, symbolic, relative, force); err != nil {
+			failf("fmsh: ln: %v\n", err)
+		}
+	}
+}
+
+// makeLink links link to target, replacing an existing link with force,
+// and records it for undo
+func makeLink(target, link string, symbolic, relative, force bool) error {
+	// A symlink's target is relative to the link, not to the working directory
+	pointsTo := target
+	if symbolic && !relative && !filepath.IsAbs(target) {
+		pointsTo = filepath.Join(filepath.Dir(link), target)
+	}
+	if !checkPath("ln", pointsTo) || !authorizePath("ln", link) {
+		return nil
+	}
+	loc, err := locate(link, false)
+	if err != nil {
+		return err
+	}
+	if !loc.native() {
+		return makeMountedLink(loc, target, link, symbolic, relative, force)
+	}
+	if !symbolic {
+		if err := checkVirtual([]string{target}); err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+	}
+	absLink, _ := filepath.Abs(link)
+	absTarget, _ := filepath.Abs(pointsTo)
+
+	batch := utils.Action{Type: utils.Batch, Label: "ln"}
+	if info, err := os.Lstat(link); err == nil {
+		if !force {
+			return fmt.Errorf("%s: already exists (use -f to replace it)", link)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s: is a directory", link)
+		}
+		// The replaced file goes to the trash, so undo can bring it back
+		trashed, err := fileops.TrashFor(absLink).Put(absLink)
+		utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "rm", Paths: []string{absLink, trashed}, Sizes: []int64{info.Size()}}, err)
+		if err != nil {
+			return err
+		}
+		batch.Actions = append(batch.Actions, utils.Action{Type: utils.Trash, Source: absLink, Dest: trashed})
+	}
+
+	var action utils.Action
+	if symbolic {
+		text := target
+		if relative {
+			text, err = fileops.RelativeTarget(target, link)
+		}
+		if err == nil {
+			err = os.Symlink(text, link)
+		}
+		action = utils.Action{Type: utils.Symlink, Source: absLink, Target: text}
+	} else {
+		err = os.Link(target, link)
+		action = utils.Action{Type: utils.Link, Source: absLink, Dest: absTarget}
+	}
+	utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "ln", Paths: []string{link, target}}, err)
+	if err != nil {
+		if len(batch.Actions) > 0 {
+			utils.GlobalUndoManager.Push(batch)
+		}
+		return err
+	}
+
+	if len(batch.Actions) > 0 {
+		batch.Actions = append(batch.Actions, action)
+		utils.GlobalUndoManager.Push(batch)
+	} else {
+		utils.GlobalUndoManager.Push(action)
+	}
+	if symbolic {
+		fmt.Printf("Linked '%s' -> '%s'\n", link, action.Target)
+	} else {
+		fmt.Printf("Hard linked '%s' => '%s'\n", link, target)
+	}
+	return nil
+}
+
+// makeMountedLink creates a symlink in a mounted backend. Backends have
+// neither hard links nor a trash, so a replaced link is removed for good
+// and nothing is recorded for undo.
+func makeMountedLink(loc location, target, link string, symbolic, relative, force bool) error {
+	if !symbolic {
+		return fmt.Errorf("%s: hard links are %w", link, errMounted)
+	}
+	text := target
+	if relative {
+		targetLoc, err := locate(target, false)
+		if err != nil {
+			return err
+		}
+		if targetLoc.root != loc.root {
+			return fmt.Errorf("%s: -r needs the target on the same file system", target)
+		}
+		dir, _ := vfs.Split(loc.fs, loc.name)
+		rel, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(targetLoc.name))
+		if err != nil {
+			return err
+		}
+		text = filepath.ToSlash(rel)
+	}
+
+	if info, err := loc.fs.Lstat(loc.name); err == nil {
+		if !force {
+			return fmt.Errorf("%s: already exists (use -f to replace it)", link)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s: is a directory", link)
+		}
+		err := loc.fs.Remove(loc.name)
+		utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "rm", Paths: []string{link}, Sizes: []int64{info.Size()}}, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := loc.fs.Symlink(text, loc.name)
+	utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "ln", Paths: []string{link, target}}, err)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Linked '%s' -> '%s'\n", link, text)
+	return nil
+}
+
+// HandleReadlink implements the "readlink" command, printing the target of
+// symlinks or, with -f, the canonical path with every symlink resolved
+func HandleReadlink(args []string) {
+	canonical := false
+	var paths []string
+	for _, arg := range args {
+		if arg == "-f" || arg == "--canonicalize" {
+			canonical = true
+		} else {
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		failln("Usage: readlink [-f] <path>...")
+		return
+	}
+	// Canonical paths are only worked out on the host
+	if canonical {
+		if err := checkVirtual(paths); err != nil {
+			failln(utils.Colorize(utils.RoleError, "fmsh: readlink: "+err.Error()))
+			return
+		}
+	}
+
+	for _, path := range paths {
+		if !checkPath("readlink", path) {
+			continue
+		}
+		var target string
+		var err error
+		if canonical {
+			target, err = fileops.Canonicalize(path)
+		} else {
+			var loc location
+			if loc, err = locate(path, false); err == nil {
+				target, err = loc.fs.ReadLink(loc.name)
+			}
+		}
+		if err != nil {
+			failf("fmsh: readlink: %v\n", err)
+			continue
+		}
+		fmt.Println(target)
+	}
+}
+
+// HandleLinks implements the "links" command, which reports symlinks that
+// cannot be followed and files with several hard links
+func HandleLinks(args []string) {
+	if len(args) == 0 || len(args) > 2 || (args[0] != "broken" && args[0] != "hard") {
+		failln("Usage: links broken|hard [directory]")
+		return
+	}
+	dir := "."
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	if err := checkVirtual([]string{dir}); err != nil {
+		failln(utils.Colorize(utils.RoleError, "fmsh: links: "+err.Error()))
+		return
+	}
+	if !checkPath("links", dir) {
+		return
+	}
+
+	if args[0] == "broken" {
+		problems, err := fileops.FindBrokenLinks(dir)
+		if err != nil {
+			failf("fmsh: links: %v\n", err)
+			return
+		}
+		for _, problem := range problems {
+			kind := utils.Colorize(utils.RoleWarning, fmt.Sprintf("%-8s", problem.Kind))
+			fmt.Printf("%s  %s -> %s\n", kind, problem.Path, problem.Target)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("No broken symlinks under %s\n", dir)
+		} else {
+			fmt.Printf("Found %d symlinks that cannot be followed\n", len(problems))
+		}
+		return
+	}
+
+	groups, err := fileops.FindHardLinks(dir)
+	if err != nil {
+		failf("fmsh: links: %v\n", err)
+		return
+	}
+	for _, group := range groups {
+		fmt.Printf("inode %d: %d links, %s\n", group.ID.Ino, group.Links,
+			utils.Colorize(utils.RoleSize, fmt.Sprintf("%d bytes", group.Size)))
+		for _, path := range group.Paths {
+			fmt.Printf("  %s\n", path)
+		}
+		if outside := int(group.Links) - len(group.Paths); outside > 0 {
+			fmt.Printf("  (%d more outside %s)\n", outside, dir)
+		}
+	}
+	if len(groups) == 0 {
+		fmt.Printf("No files with several hard links under %s\n", dir)
+	}
+}
@@ -0,0 +1,211 @@
+package commands
+
+import (
+	"errors"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmsh/vfs"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// virtualDir is the working directory while it lies inside an archive, a
+// mounted backend or a URL, such as "/src/build.zip/bin", "/scratch/out" or
+// "s3://bucket/logs". Inside an archive the process stays in the archive's
+// directory; elsewhere it stays where it was.
+var virtualDir string
+
+// errMounted refuses commands that only work on the host file system
+var errMounted = errors.New("not supported on mounted or remote file systems")
+
+// Workdir returns the shell's working directory, which may be virtual
+func Workdir() string {
+	if virtualDir != "" {
+		return virtualDir
+	}
+	cwd, _ := os.Getwd()
+	return cwd
+}
+
+// resolvePath makes a relative path relative to a virtual working directory;
+// on the host paths are returned as they are
+func resolvePath(path string) string {
+	// Absolute paths never look at virtualDir, so the daemon can resolve
+	// them while a command runs in another directory
+	if filepath.IsAbs(path) || vfs.IsURL(path) || virtualDir == "" {
+		return path
+	}
+	return joinPath(virtualDir, path)
+}
+
+// joinPath joins a relative path to a directory, which may be a URL
+func joinPath(dir, rel string) string {
+	if scheme, rest, ok := strings.Cut(dir, "://"); ok && vfs.IsURL(dir) {
+		return scheme + "://" + path.Clean(path.Join(rest, filepath.ToSlash(rel)))
+	}
+	return filepath.Join(dir, rel)
+}
+
+// location is where a shell path lives: a name in the host file system, in
+// a mounted or remote backend or in an archive
+type location struct {
+	fs   vfs.FS
+	name string // Name of the path in fs
+	root string // Mount point, archive file or URL of the backend, "" on the host
+}
+
+// native reports whether the path is on the host file system, where
+// commands keep the trash, undo and the parallel copy engine
+func (l location) native() bool {
+	return l.root == ""
+}
+
+// path turns a name in the location's backend back into a shell path
+func (l location) path(name string) string {
+	switch {
+	case l.native():
+		return name
+	case vfs.IsURL(l.root) && name == ".":
+		return l.root
+	case vfs.IsURL(l.root):
+		return l.root + "/" + name
+	}
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+// locate finds the backend holding path. Mounts take precedence over
+// archives, and an archive file itself only counts as a directory when
+// asRoot is set, as for openArchive.
+func locate(path string, asRoot bool) (location, error) {
+	target := resolvePath(path)
+	if vfs.IsURL(target) {
+		fsys, name, root, err := vfs.Default.ResolveURL(target)
+		return location{fs: fsys, name: name, root: root}, err
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return location{}, err
+	}
+	if fsys, name, mount := vfs.Default.Resolve(abs); mount != "" {
+		return location{fs: fsys, name: name, root: mount}, nil
+	}
+	archive, inner, err := openArchive(abs, asRoot)
+	if err != nil {
+		return location{}, err
+	}
+	if archive != nil {
+		return location{fs: archive, name: inner, root: archive.Path()}, nil
+	}
+	return location{fs: vfs.Host, name: target}, nil
+}
+
+// checkVirtual refuses commands that do not go through the vfs when the
+// working directory or one of the arguments is virtual
+func checkVirtual(args []string) error {
+	paths := args
+	if virtualDir != "" {
+		paths = append([]string{virtualDir}, args...)
+	}
+	for _, arg := range paths {
+		if vfs.IsURL(resolvePath(arg)) {
+			return errMounted
+		}
+		abs, err := filepath.Abs(resolvePath(arg))
+		if err != nil {
+			continue
+		}
+		if _, _, mount := vfs.Default.Resolve(abs); mount != "" {
+			return errMounted
+		}
+		if _, inner, ok := fileops.SplitArchivePath(abs); ok && inner != "." {
+			return fileops.ErrArchiveReadOnly
+		}
+	}
+	return nil
+}
+
+// changeDir changes the working directory, which may be virtual
+func changeDir(path string) error {
+	loc, err := locate(path, true)
+	if err != nil {
+		return err
+	}
+	if loc.native() {
+		if err := os.Chdir(loc.name); err != nil {
+			return err
+		}
+		virtualDir = ""
+		return nil
+	}
+
+	info, err := loc.fs.Stat(loc.name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", path)
+	}
+	if archive, ok := loc.fs.(*fileops.ArchiveFS); ok {
+		if err := os.Chdir(filepath.Dir(archive.Path())); err != nil {
+			return err
+		}
+	}
+	virtualDir = loc.path(loc.name)
+	return nil
+}
+
+// listDir prints a directory of a backend the way ls does
+func listDir(fsys vfs.FS, name string) error {
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		mode := entry.Type()
+		if info, err := entry.Info(); err == nil {
+			mode = info.Mode()
+		}
+		colored := utils.ColorizeFile(entry.Name(), mode)
+		if entry.IsDir() {
+			fmt.Printf("%s/\n", colored)
+		} else {
+			fmt.Println(colored)
+		}
+	}
+	return nil
+}
+
+// printTree prints the tree below root in fsys, naming the top rootName
+func printTree(fsys fs.FS, root, rootName string) error {
+	return fs.WalkDir(fsys, root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			failf("Error accessing file: %v\n", err)
+			return nil
+		}
+		depth := 0
+		if p != root {
+			rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+			if root == "." {
+				rel = p
+			}
+			depth = strings.Count(rel, "/") + 1
+		}
+		indent := strings.Repeat("  ", depth)
+
+		// Print directories with a slash
+		name := utils.ColorizeFile(entry.Name(), entry.Type())
+		if p == root {
+			name = utils.ColorizeFile(rootName, fs.ModeDir)
+		}
+		if entry.IsDir() {
+			fmt.Printf("%s%s/\n", indent, name)
+		} else {
+			fmt.Printf("%s%s\n", indent, name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"fmsh/utils"
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const mountUsage = "Usage: mount | mount mem <path> | mount os <directory> <path>"
+
+// HandleMount implements the "mount" command, which lists the mounts of the
+// session or mounts a backend at a path. Mounts last until the shell exits.
+func HandleMount(args []string) {
+	if len(args) == 0 {
+		listMounts()
+		return
+	}
+
+	var fsys vfs.FS
+	var kind, point string
+	switch {
+	case args[0] == "mem" && len(args) == 2:
+		fsys, kind, point = vfs.NewMemFS(), "mem", args[1]
+	case args[0] == "os" && len(args) == 3:
+		dir, err := filepath.Abs(resolvePath(args[1]))
+		if err == nil && !checkPath("mount", dir) {
+			return
+		}
+		if info, statErr := os.Stat(dir); err == nil && (statErr != nil || !info.IsDir()) {
+			err = fmt.Errorf("%s: not a directory", args[1])
+		}
+		if err != nil {
+			failf("fmsh: mount: %v\n", err)
+			return
+		}
+		fsys, kind, point = vfs.NewOSFS(dir, checkJail), "os "+dir, args[2]
+	default:
+		failln(mountUsage)
+		return
+	}
+
+	point, err := filepath.Abs(resolvePath(point))
+	if err == nil && !checkPath("mount", point) {
+		return
+	}
+	if err == nil {
+		err = vfs.Default.Mount(point, fsys, kind)
+	}
+	if err != nil {
+		failf("fmsh: mount: %v\n", err)
+		return
+	}
+	fmt.Printf("Mounted %s on %s\n", kind, point)
+}
+
+// checkJail keeps host directories mounted with "mount os" inside the
+// policy root, since symlinks in them may lead anywhere on the host
+func checkJail(path string, follow bool) error {
+	var err error
+	if follow {
+		_, err = utils.GlobalPolicy.Check(path)
+	} else {
+		_, err = utils.GlobalPolicy.CheckEntry(path)
+	}
+	return err
+}
+
+func listMounts() {
+	mounts := vfs.Default.Mounts()
+	if len(mounts) == 0 {
+		fmt.Println("Nothing is mounted.")
+		return
+	}
+	for _, m := range mounts {
+		fmt.Printf("%s on %s\n", m.Kind, utils.Colorize(utils.RoleDirectory, m.Path))
+	}
+}
+
+// HandleUmount implements the "umount" command
+func HandleUmount(args []string) {
+	if len(args) != 1 {
+		failln("Usage: umount <path>")
+		return
+	}
+	point, err := filepath.Abs(resolvePath(args[0]))
+	if err != nil {
+		failf("fmsh: umount: %v\n", err)
+		return
+	}
+	if virtualDir != "" {
+		if _, _, mount := vfs.Default.Resolve(virtualDir); mount == filepath.Clean(point) {
+			failf("fmsh: umount: %s: working directory is inside the mount\n", args[0])
+			return
+		}
+	}
+	m, err := vfs.Default.Unmount(point)
+	if err != nil {
+		failf("fmsh: umount: %v\n", err)
+		return
+	}
+	fmt.Printf("Unmounted %s from %s\n", m.Kind, m.Path)
+}
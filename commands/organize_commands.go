@@ -0,0 +1,222 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const organizeUsage = "Usage: organize [directory] [--rules file] [--depth n | -r] [--dry-run] [--yes] " + conflictUsage
+
+// organizeRulesPath is the rules file used when --rules is not given
+func organizeRulesPath() string {
+	return utils.ConfigPath("organize.json")
+}
+
+// HandleOrganize implements the "organize" command
+func HandleOrganize(args []string) {
+	directory := "."
+	rulesPath := ""
+	depth := 1
+	dryRun, yes := false, false
+	conflict := fileops.ConflictOptions{Policy: fileops.AutoRename}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--rules", "--depth":
+			if i+1 >= len(args) {
+				failf("fmsh: organize: %s needs a value\n", arg)
+				return
+			}
+			i++
+			if arg == "--rules" {
+				rulesPath = args[i]
+				continue
+			}
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 0 {
+				failf("fmsh: organize: invalid depth %s\n", args[i])
+				return
+			}
+			depth = n
+		case "-r", "--recursive":
+			depth = 0
+		case "--dry-run", "-n":
+			dryRun = true
+		case "--yes", "-y":
+			yes = true
+		default:
+			if parseConflictFlag(arg, &conflict) {
+				continue
+			}
+			if len(arg) > 0 && arg[0] == '-' {
+				failln(organizeUsage)
+				return
+			}
+			directory = arg
+		}
+	}
+
+	if !checkPath("organize", directory) {
+		return
+	}
+	rules, err := loadOrganizeRules(rulesPath)
+	if err != nil {
+		failf("fmsh: organize: %v\n", err)
+		return
+	}
+	loc, err := locate(directory, true)
+	var plan []fileops.OrganizeMove
+	if err == nil {
+		plan, err = fileops.PlanOrganizeFS(loc.fs, loc.name, rules, depth)
+	}
+	if err != nil {
+		failf("fmsh: organize: %v\n", err)
+		return
+	}
+	if len(plan) == 0 {
+		fmt.Println("Nothing to organize.")
+		return
+	}
+
+	printOrganizePlan(loc, plan)
+	// A dry run only reads, so it is allowed in read-only mode
+	if dryRun || refuseReadOnly("organize", "") || !authorizePath("organize", directory) {
+		return
+	}
+	if !loc.native() && !allowIrreversible("organize", args, "a change to a mounted or remote path") {
+		return
+	}
+	if !yes && !utils.Confirm(fmt.Sprintf("Move %d file(s)?", len(plan))) {
+		return
+	}
+	applyOrganizePlan(loc, plan, conflict)
+}
+
+// OrganiseDirectory organizes the files directly inside directory with the
+// rules file, or by detected file type when there is none, without asking
+func OrganiseDirectory(directory string) {
+	rules, err := loadOrganizeRules("")
+	var loc location
+	if err == nil {
+		loc, err = locate(directory, true)
+	}
+	if err == nil {
+		var plan []fileops.OrganizeMove
+		if plan, err = fileops.PlanOrganizeFS(loc.fs, loc.name, rules, 1); err == nil {
+			applyOrganizePlan(loc, plan, fileops.ConflictOptions{Policy: fileops.AutoRename})
+			return
+		}
+	}
+	failf("Error organizing directory: %v\n", err)
+}
+
+// loadOrganizeRules reads the given rules file, or the default one when it
+// exists, and otherwise falls back to sorting by file type
+func loadOrganizeRules(path string) (*fileops.OrganizeRules, error) {
+	if path == "" {
+		path = organizeRulesPath()
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return fileops.DefaultOrganizeRules(), nil
+		}
+	}
+	return fileops.LoadOrganizeRules(path)
+}
+
+// printOrganizePlan shows the moves of a plan for the directory at loc
+func printOrganizePlan(loc location, plan []fileops.OrganizeMove) {
+	for _, move := range plan {
+		source, _ := filepath.Rel(loc.name, move.Source)
+		target, err := filepath.Rel(loc.name, move.Target)
+		if err != nil {
+			target = loc.path(move.Target)
+		}
+		note := ""
+		if _, err := loc.fs.Lstat(move.Target); err == nil {
+			note = utils.Colorize(utils.RoleWarning, "  (exists)")
+		}
+		fmt.Printf("%s -> %s  [%s]%s\n", source, target, move.Rule, note)
+	}
+}
+
+// applyOrganizePlan moves the planned files, creating destination folders as
+// needed. On the host everything is recorded as one undoable batch.
+func applyOrganizePlan(loc location, plan []fileops.OrganizeMove, conflict fileops.ConflictOptions) {
+	batch := utils.Action{Type: utils.Batch, Label: "organize"}
+	moved, skipped := 0, 0
+	for _, move := range plan {
+		if !authorizePath("organize", loc.path(move.Target)) {
+			continue
+		}
+		dir, _ := vfs.Split(loc.fs, move.Target)
+		created, err := mkdirAllRecorded(loc.fs, dir)
+		for _, dir := range created {
+			batch.Actions = append(batch.Actions, utils.Action{Type: utils.Mkdir, Source: dir})
+		}
+		if err != nil {
+			failf("Error organizing file: %v\n", err)
+			continue
+		}
+
+		var target string
+		if loc.native() {
+			target, err = fileops.Move(move.Source, move.Target, fileops.MoveOptions{Conflict: conflict})
+		} else {
+			target, err = fileops.MoveFS(loc.fs, move.Source, loc.fs, move.Target, fileops.MoveOptions{Conflict: conflict})
+		}
+		if err == nil && target == "" {
+			skipped++
+			continue
+		}
+		source := loc.path(move.Source)
+		if err == nil {
+			target = loc.path(target)
+		}
+		utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "organize", Paths: []string{source, target}}, err)
+		if err != nil {
+			failf("Error organizing file: %v\n", err)
+			continue
+		}
+		batch.Actions = append(batch.Actions, utils.Action{Type: utils.Move, Source: source, Dest: target})
+		moved++
+	}
+
+	if len(batch.Actions) > 0 && loc.native() {
+		utils.GlobalUndoManager.Push(batch)
+	}
+	fmt.Printf("Directory organized successfully. Total files processed: %d\n", moved)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d file(s) whose destination exists.\n", skipped)
+	}
+}
+
+// mkdirAllRecorded creates dir in fsys and its missing parents, returning
+// the directories it created, parents first
+func mkdirAllRecorded(fsys vfs.FS, dir string) ([]string, error) {
+	var missing []string
+	for p := dir; ; {
+		if _, err := fsys.Stat(p); err == nil {
+			break
+		}
+		missing = append(missing, p)
+		parent, _ := vfs.Split(fsys, p)
+		if parent == p {
+			break
+		}
+		p = parent
+	}
+
+	var created []string
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := fsys.Mkdir(missing[i], 0755); err != nil {
+			return created, err
+		}
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
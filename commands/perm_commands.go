@@ -0,0 +1,418 @@
+package commands
+
+import (
+	"errors"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmsh/vfs"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	chmodUsage = "Usage: chmod [-R] <mode>|--reference <file>|--files <mode> --dirs <mode> <path>..."
+	chownUsage = "Usage: chown [-R] <owner>[:<group>]|:<group>|--reference <file> <path>..."
+	chgrpUsage = "Usage: chgrp [-R] <group>|--reference <file> <path>..."
+)
+
+// permFlags are the options chmod, chown and chgrp share
+type permFlags struct {
+	recursive bool
+	reference string
+	files     string // chmod only
+	dirs      string // chmod only
+	args      []string
+}
+
+// parsePermFlags splits args into options and operands; withModes allows
+// chmod's --files and --dirs
+func parsePermFlags(args []string, withModes bool) (permFlags, bool) {
+	var flags permFlags
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		switch {
+		case arg == "-R" || arg == "--recursive":
+			flags.recursive = true
+		case name == "--reference" || (withModes && (name == "--files" || name == "--dirs")):
+			if !hasValue {
+				if i+1 == len(args) {
+					return flags, false
+				}
+				i++
+				value = args[i]
+			}
+			switch name {
+			case "--reference":
+				flags.reference = value
+			case "--files":
+				flags.files = value
+			default:
+				flags.dirs = value
+			}
+		case arg == "--":
+			flags.args = append(flags.args, args[i+1:]...)
+			return flags, true
+		case strings.HasPrefix(arg, "--"):
+			return flags, false
+		default:
+			flags.args = append(flags.args, arg)
+		}
+	}
+	return flags, true
+}
+
+// HandleChmod changes file permissions, to an octal or symbolic mode, to
+// the mode of a reference file, or with --files and --dirs to a different
+// mode for each
+func HandleChmod(args []string) {
+	flags, ok := parsePermFlags(args, true)
+	if !ok {
+		failln(chmodUsage)
+		return
+	}
+
+	var fileMode, dirMode *fileops.ModeChange
+	switch {
+	case flags.reference != "":
+		loc, err := locate(flags.reference, false)
+		var info fs.FileInfo
+		if err == nil {
+			info, err = loc.fs.Stat(loc.name)
+		}
+		if err != nil {
+			failf("fmsh: chmod: %v\n", err)
+			return
+		}
+		change, _ := fileops.ParseMode(fileops.OctalMode(info.Mode()))
+		fileMode, dirMode = &change, &change
+	case flags.files != "" || flags.dirs != "":
+		for _, spec := range []struct {
+			text string
+			mode **fileops.ModeChange
+		}{{flags.files, &fileMode}, {flags.dirs, &dirMode}} {
+			if spec.text == "" {
+				continue
+			}
+			change, err := fileops.ParseMode(spec.text)
+			if err != nil {
+				failf("fmsh: chmod: %v\n", err)
+				return
+			}
+			*spec.mode = &change
+		}
+	case len(flags.args) > 0:
+		change, err := fileops.ParseMode(flags.args[0])
+		if err != nil {
+			failf("fmsh: chmod: %v\n", err)
+			return
+		}
+		fileMode, dirMode = &change, &change
+		flags.args = flags.args[1:]
+	}
+	if len(flags.args) == 0 {
+		failln(chmodUsage)
+		return
+	}
+
+	batch := utils.Action{Type: utils.Batch, Label: "chmod"}
+	changed := 0
+	for _, path := range flags.args {
+		if !authorizePath("chmod", path) {
+			continue
+		}
+		loc, err := locate(path, false)
+		if err != nil {
+			failf("fmsh: chmod: %v\n", err)
+			continue
+		}
+		err = walkPerms(loc.fs, loc.name, flags.recursive, func(name string, info fs.FileInfo) error {
+			change := fileMode
+			if info.IsDir() {
+				change = dirMode
+			}
+			if change == nil {
+				return nil
+			}
+			before, after := fileops.ModeBits(info.Mode()), change.Apply(info.Mode())
+			if before != after {
+				err := loc.fs.Chmod(name, after)
+				utils.GlobalAuditLog.Record(utils.AuditEntry{
+					Op:         "chmod",
+					Paths:      []string{loc.path(name)},
+					ModeBefore: fileops.OctalMode(before),
+					ModeAfter:  fileops.OctalMode(after),
+				}, err)
+				if err != nil {
+					return err
+				}
+				changed++
+				if loc.native() {
+					batch.Actions = append(batch.Actions, utils.Action{Type: utils.Chmod, Source: name, Mode: before, NewMode: after})
+				}
+			}
+			if !flags.recursive && len(flags.args) == 1 {
+				fmt.Printf("Permissions of '%s' changed to '%s'\n", path, fileops.OctalMode(after))
+			}
+			return nil
+		})
+		if err != nil {
+			failf("fmsh: chmod: %v\n", err)
+		}
+	}
+	pushBatch(batch)
+	if flags.recursive || len(flags.args) > 1 {
+		fmt.Printf("Changed the permissions of %d file(s).\n", changed)
+	}
+}
+
+// HandleChown changes the owner and, after a colon, the group of files,
+// given by name or number
+func HandleChown(args []string) {
+	flags, ok := parsePermFlags(args, false)
+	if !ok {
+		failln(chownUsage)
+		return
+	}
+	uid, gid := -1, -1
+	var err error
+	switch {
+	case flags.reference != "":
+		uid, gid, err = referenceOwner(flags.reference)
+	case len(flags.args) > 0:
+		uid, gid, err = parseOwner(flags.args[0])
+		flags.args = flags.args[1:]
+	}
+	if err != nil {
+		failf("fmsh: chown: %v\n", err)
+		return
+	}
+	if len(flags.args) == 0 {
+		failln(chownUsage)
+		return
+	}
+	changeOwner("chown", flags, uid, gid)
+}
+
+// HandleChgrp changes the group of files, given by name or number
+func HandleChgrp(args []string) {
+	flags, ok := parsePermFlags(args, false)
+	if !ok {
+		failln(chgrpUsage)
+		return
+	}
+	gid := -1
+	var err error
+	switch {
+	case flags.reference != "":
+		_, gid, err = referenceOwner(flags.reference)
+	case len(flags.args) > 0:
+		gid, err = lookupGroup(flags.args[0])
+		flags.args = flags.args[1:]
+	}
+	if err != nil {
+		failf("fmsh: chgrp: %v\n", err)
+		return
+	}
+	if len(flags.args) == 0 {
+		failln(chgrpUsage)
+		return
+	}
+	changeOwner("chgrp", flags, -1, gid)
+}
+
+// changeOwner sets the owner and group of every path, leaving those given
+// as -1 alone, and records the previous ones for undo
+func changeOwner(cmd string, flags permFlags, uid, gid int) {
+	batch := utils.Action{Type: utils.Batch, Label: cmd}
+	changed := 0
+	for _, path := range flags.args {
+		if !authorizePath(cmd, path) {
+			continue
+		}
+		// The file a symlink argument points to is changed, so undo
+		// records that file rather than the link
+		root, err := filepath.EvalSymlinks(resolvePath(path))
+		if err != nil {
+			failf("fmsh: %s: %v\n", cmd, err)
+			continue
+		}
+		err = walkPerms(vfs.Host, root, flags.recursive, func(name string, info fs.FileInfo) error {
+			oldUID, oldGID, ok := fileops.FileOwner(info)
+			if !ok {
+				return errOwnership
+			}
+			newUID, newGID := oldUID, oldGID
+			if uid >= 0 {
+				newUID = uid
+			}
+			if gid >= 0 {
+				newGID = gid
+			}
+			if newUID != oldUID || newGID != oldGID {
+				err := os.Lchown(name, newUID, newGID)
+				utils.GlobalAuditLog.Record(utils.AuditEntry{Op: cmd, Paths: []string{name}}, err)
+				if err != nil {
+					return err
+				}
+				changed++
+				// Changing the owner clears setuid and setgid, which undo must restore
+				if after, err := os.Lstat(name); err == nil && after.Mode() != info.Mode() {
+					batch.Actions = append(batch.Actions, utils.Action{
+						Type:    utils.Chmod,
+						Source:  name,
+						Mode:    fileops.ModeBits(info.Mode()),
+						NewMode: fileops.ModeBits(after.Mode()),
+					})
+				}
+				batch.Actions = append(batch.Actions, utils.Action{
+					Type: utils.Chown, Source: name,
+					UID: oldUID, GID: oldGID, NewUID: newUID, NewGID: newGID,
+				})
+			}
+			if !flags.recursive && len(flags.args) == 1 {
+				fmt.Printf("Owner of '%s' changed to %s\n", path, ownerName(newUID, newGID))
+			}
+			return nil
+		})
+		if err != nil {
+			failf("fmsh: %s: %v\n", cmd, err)
+		}
+	}
+	pushBatch(batch)
+	if flags.recursive || len(flags.args) > 1 {
+		fmt.Printf("Changed the owner of %d file(s).\n", changed)
+	}
+}
+
+var errOwnership = errors.New("file ownership is not supported on this platform")
+
+// walkPerms calls fn for root, following it if it is a symlink, and with
+// recursive for everything below it except symlinks, which chmod cannot
+// change and chown leaves alone
+func walkPerms(fsys fs.FS, root string, recursive bool, fn func(name string, info fs.FileInfo) error) error {
+	info, err := fs.Stat(fsys, root)
+	if err != nil {
+		return err
+	}
+	if err := fn(root, info); err != nil || !recursive || !info.IsDir() {
+		return err
+	}
+	return fs.WalkDir(fsys, root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			failf("fmsh: %v\n", err)
+			return nil
+		}
+		if name == root || entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := entry.Info()
+		if err == nil {
+			err = fn(name, info)
+		}
+		if err != nil {
+			failf("fmsh: %v\n", err)
+		}
+		return nil
+	})
+}
+
+// pushBatch records the steps of batch for undo, as one action when there is only one
+func pushBatch(batch utils.Action) {
+	switch len(batch.Actions) {
+	case 0:
+	case 1:
+		utils.GlobalUndoManager.Push(batch.Actions[0])
+	default:
+		utils.GlobalUndoManager.Push(batch)
+	}
+}
+
+// parseOwner parses chown's OWNER, OWNER:GROUP, OWNER: for the owner's
+// login group, and :GROUP; ids not given are -1
+func parseOwner(spec string) (int, int, error) {
+	owner, group, hasGroup := strings.Cut(spec, ":")
+	uid, gid := -1, -1
+	if owner == "" && group == "" {
+		return uid, gid, fmt.Errorf("invalid owner: %q", spec)
+	}
+	if owner != "" {
+		u, err := lookupUser(owner)
+		if err != nil {
+			return uid, gid, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return uid, gid, fmt.Errorf("invalid user: %q", owner)
+		}
+		if hasGroup && group == "" {
+			if gid, err = strconv.Atoi(u.Gid); err != nil {
+				return uid, gid, fmt.Errorf("%s has no login group", owner)
+			}
+		}
+	}
+	if group != "" {
+		var err error
+		if gid, err = lookupGroup(group); err != nil {
+			return uid, gid, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// lookupUser finds a user by name or id; an unknown numeric id is taken as it is
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, convErr := strconv.Atoi(name); convErr == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		return &user.User{Uid: name}, nil
+	}
+	return nil, fmt.Errorf("invalid user: %q", name)
+}
+
+// lookupGroup finds a group id by name, or takes a number as it is
+func lookupGroup(name string) (int, error) {
+	if g, err := user.LookupGroup(name); err == nil {
+		if gid, err := strconv.Atoi(g.Gid); err == nil {
+			return gid, nil
+		}
+	}
+	if gid, err := strconv.Atoi(name); err == nil && gid >= 0 {
+		return gid, nil
+	}
+	return -1, fmt.Errorf("invalid group: %q", name)
+}
+
+// referenceOwner returns the owner and group of path
+func referenceOwner(path string) (int, int, error) {
+	info, err := os.Stat(resolvePath(path))
+	if err != nil {
+		return -1, -1, err
+	}
+	uid, gid, ok := fileops.FileOwner(info)
+	if !ok {
+		return -1, -1, errOwnership
+	}
+	return uid, gid, nil
+}
+
+// ownerName shows ids as user:group names where they have them
+func ownerName(uid, gid int) string {
+	owner, group := strconv.Itoa(uid), strconv.Itoa(gid)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner + ":" + group
+}
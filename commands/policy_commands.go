@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"slices"
+)
+
+// checkPath applies the root jail to a path argument and reports refusals for cmd
+func checkPath(cmd, path string) bool {
+	if err := checkPathErr(path); err != nil {
+		failln(utils.Colorize(utils.RoleError, fmt.Sprintf("fmsh: %s: %v", cmd, err)))
+		return false
+	}
+	return true
+}
+
+// checkPathErr is checkPath for callers that report errors themselves
+func checkPathErr(path string) error {
+	// Paths inside an archive are checked through the archive file
+	path = resolvePath(path)
+	if archive, _, ok := fileops.SplitArchivePath(path); ok {
+		path = archive
+	}
+	_, err := utils.GlobalPolicy.Check(path)
+	return err
+}
+
+// authorizePath checks a path that cmd is about to modify, confirming protected paths
+func authorizePath(cmd, path string) bool {
+	if err := authorizePathErr(path); err != nil {
+		failln(utils.Colorize(utils.RoleError, fmt.Sprintf("fmsh: %s: %v", cmd, err)))
+		return false
+	}
+	return true
+}
+
+// authorizePathErr is authorizePath for callers that report errors themselves
+func authorizePathErr(path string) error {
+	path = resolvePath(path)
+	if _, inner, ok := fileops.SplitArchivePath(path); ok && inner != "." {
+		return fmt.Errorf("%s: %w", path, fileops.ErrArchiveReadOnly)
+	}
+	_, err := utils.GlobalPolicy.Authorize(path)
+	return err
+}
+
+// refuseReadOnly reports the modifying subcommand of a command that also has
+// read-only subcommands, returning true when read-only mode disables it
+func refuseReadOnly(cmd, sub string) bool {
+	if !utils.GlobalPolicy.ReadOnly {
+		return false
+	}
+	if sub != "" {
+		cmd += " " + sub
+	}
+	failln(utils.Colorize(utils.RoleError, "fmsh: "+cmd+": disabled in read-only mode"))
+	return true
+}
+
+// HandlePolicy implements the "policy" command
+func HandlePolicy(args []string) {
+	policy := utils.GlobalPolicy
+
+	if len(args) == 0 {
+		fmt.Printf("Read-only: %t\n", policy.ReadOnly)
+		if policy.Root != "" {
+			fmt.Printf("Root: %s\n", policy.Root)
+		} else {
+			fmt.Println("Root: (none)")
+		}
+		fmt.Println("Protected paths:")
+		for _, pattern := range policy.Protected {
+			fmt.Printf("  %s\n", pattern)
+		}
+		return
+	}
+
+	if len(args) < 2 || (args[0] != "protect" && args[0] != "unprotect") {
+		failln("Usage: policy [protect|unprotect <pattern>]")
+		return
+	}
+
+	pattern := args[1]
+	entry := utils.AuditEntry{Op: "policy " + args[0], Paths: []string{utils.ExpandHome(pattern)}}
+	if args[0] == "protect" {
+		policy.AddProtected(pattern)
+		utils.GlobalAuditLog.Record(entry, nil)
+		fmt.Printf("Protected: %s\n", pattern)
+		return
+	}
+	if !slices.Contains(policy.Protected, pattern) {
+		failf("fmsh: policy: pattern not found: %s\n", pattern)
+		return
+	}
+	// Lifting a protection is what the policy exists to guard against
+	if !utils.Confirm(fmt.Sprintf("Stop protecting %s?", pattern)) {
+		return
+	}
+	policy.RemoveProtected(pattern)
+	utils.GlobalAuditLog.Record(entry, nil)
+	fmt.Printf("Unprotected: %s\n", pattern)
+}
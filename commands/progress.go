@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"fmsh/utils"
+	"fmt"
+)
+
+// progressPrinter shows the progress of a long operation on a single terminal line
+type progressPrinter struct {
+	label   string
+	enabled bool
+	shown   bool
+}
+
+func newProgressPrinter(label string) *progressPrinter {
+	return &progressPrinter{label: label, enabled: utils.StdoutIsTerminal()}
+}
+
+// Update redraws the progress line; it matches the progress callbacks of fileops
+func (p *progressPrinter) Update(done, total int64) {
+	if !p.enabled || total == 0 {
+		return
+	}
+	p.shown = true
+	fmt.Printf("\r%s... %3d%% (%d/%d bytes)", p.label, done*100/total, done, total)
+}
+
+// Done clears the progress line so the next output starts on a clean line
+func (p *progressPrinter) Done() {
+	if p.shown {
+		fmt.Print("\r\033[K")
+		p.shown = false
+	}
+}
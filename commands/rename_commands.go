@@ -0,0 +1,204 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const bulkRenameUsage = "Usage: bulk-rename [--regex pattern --replace text] [--template tmpl] [--case lower|upper|title] [--sanitize] [--start n] [--step n] [--dry-run] [--yes] <path>..."
+
+var groupReference = regexp.MustCompile(`\\(\d+)`)
+
+// HandleBulkRename implements the "bulk-rename" command
+func HandleBulkRename(args []string) {
+	var opts fileops.RenameOptions
+	opts.Start = 1
+	var patterns []string
+	dryRun, yes := false, false
+
+	for i := 0; i < len(args); i++ {
+		arg, value, hasValue := strings.Cut(args[i], "=")
+		switch arg {
+		case "--sanitize":
+			opts.Sanitize = true
+			continue
+		case "--dry-run", "-n":
+			dryRun = true
+			continue
+		case "--yes", "-y":
+			yes = true
+			continue
+		case "--regex", "--replace", "--template", "--case", "--start", "--step":
+		default:
+			patterns = append(patterns, args[i])
+			continue
+		}
+
+		// Values follow the option or an "=", which also allows an empty --replace=
+		if !hasValue {
+			if i+1 >= len(args) {
+				failf("fmsh: bulk-rename: %s needs a value\n", arg)
+				return
+			}
+			i++
+			value = args[i]
+		}
+
+		var err error
+		switch arg {
+		case "--regex":
+			opts.Pattern, err = regexp.Compile(value)
+		case "--replace":
+			// Groups are written $1 or, as in sed, \1
+			opts.Replace = groupReference.ReplaceAllString(value, "$${$1}")
+		case "--template":
+			opts.Template = value
+		case "--case":
+			opts.Case = value
+		case "--start":
+			opts.Start, err = strconv.Atoi(value)
+		case "--step":
+			opts.Step, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			failf("fmsh: bulk-rename: %s: %v\n", arg, err)
+			return
+		}
+	}
+
+	paths := expandGlobs("bulk-rename", patterns)
+	if len(paths) == 0 || (opts.Pattern == nil && opts.Template == "" && opts.Case == "" && !opts.Sanitize) {
+		failln(bulkRenameUsage)
+		return
+	}
+	for _, path := range paths {
+		if !authorizePath("bulk-rename", path) {
+			return
+		}
+	}
+
+	// Every path must live in the same backend, where the plan is made
+	var loc location
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		pathLoc, err := locate(path, false)
+		if err == nil && i > 0 && pathLoc.root != loc.root {
+			err = fmt.Errorf("%s: cannot rename across file systems", path)
+		}
+		if err != nil {
+			failf("fmsh: bulk-rename: %v\n", err)
+			return
+		}
+		loc, names[i] = pathLoc, pathLoc.name
+	}
+
+	entries, err := fileops.PlanRenamesFS(loc.fs, names, opts)
+	if err != nil {
+		failf("fmsh: bulk-rename: %v\n", err)
+		return
+	}
+	changes, problems := printRenamePlan(entries)
+	if problems > 0 {
+		failln(utils.Colorize(utils.RoleError, fmt.Sprintf("fmsh: bulk-rename: %d problem(s); nothing was renamed", problems)))
+		return
+	}
+	if changes == 0 {
+		fmt.Println("Nothing to rename.")
+		return
+	}
+	if dryRun || (!yes && !utils.Confirm(fmt.Sprintf("Rename %d file(s)?", changes))) {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Unchanged() && !authorizePath("bulk-rename", loc.path(entry.Target)) {
+			return
+		}
+	}
+
+	steps, err := fileops.ApplyRenamesFS(loc.fs, entries)
+	if err != nil {
+		utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "bulk-rename"}, err)
+		failf("fmsh: bulk-rename: %v; nothing was renamed\n", err)
+		return
+	}
+
+	batch := utils.Action{Type: utils.Batch, Label: "bulk-rename"}
+	for _, step := range steps {
+		from, to := loc.path(step.From), loc.path(step.To)
+		utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "bulk-rename", Paths: []string{from, to}}, nil)
+		batch.Actions = append(batch.Actions, utils.Action{Type: utils.Rename, Source: from, Dest: to})
+	}
+	// Undo only covers the host file system
+	if loc.native() {
+		utils.GlobalUndoManager.Push(batch)
+	}
+	fmt.Printf("Renamed %d file(s).\n", changes)
+}
+
+// printRenamePlan shows the plan as a table and counts renames and problems
+func printRenamePlan(entries []fileops.RenameEntry) (changes, problems int) {
+	width := len("OLD NAME")
+	for _, entry := range entries {
+		if n := utf8.RuneCountInString(filepath.Base(entry.Source)); n > width {
+			width = n
+		}
+	}
+
+	fmt.Printf("%s  %s\n", padRight("OLD NAME", width), "NEW NAME")
+	for _, entry := range entries {
+		line := padRight(filepath.Base(entry.Source), width) + "  " + filepath.Base(entry.Target)
+		switch {
+		case entry.Problem != "":
+			problems++
+			failln(utils.Colorize(utils.RoleError, line+"  ("+entry.Problem+")"))
+		case entry.Unchanged():
+			fmt.Println(line + "  (unchanged)")
+		default:
+			changes++
+			fmt.Println(line)
+		}
+	}
+	return changes, problems
+}
+
+func padRight(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// expandGlobs replaces arguments containing wildcards with the paths they
+// match, in mounted backends too
+func expandGlobs(cmd string, patterns []string) []string {
+	var paths []string
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			paths = append(paths, pattern)
+			continue
+		}
+		var matches []string
+		loc, err := locate(pattern, false)
+		if err == nil && loc.native() {
+			matches, err = filepath.Glob(pattern)
+		} else if err == nil {
+			matches, err = fs.Glob(loc.fs, loc.name)
+			for i, name := range matches {
+				matches[i] = loc.path(name)
+			}
+		}
+		if err != nil || len(matches) == 0 {
+			failf("fmsh: %s: no match for %s\n", cmd, pattern)
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	return paths
+}
@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmsh/fileops"
+	"fmsh/server"
+	"fmsh/utils"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const serveUsage = "Usage: serve [directory] [--port n] [--bind address] [--upload] [--max-upload size] [--auth user[:password]]"
+
+// HandleServe implements the "serve" command, which shares a directory over
+// HTTP until Ctrl-C. The share is read-only unless --upload is given.
+func HandleServe(args []string) {
+	opts := server.Options{Log: os.Stdout}
+	port, bind := 8000, ""
+	var dirs []string
+	generated := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--upload":
+			if refuseReadOnly("serve", "--upload") {
+				return
+			}
+			opts.Uploads = true
+			continue
+		case "--port", "-p", "--bind", "--max-upload", "--auth":
+		default:
+			if strings.HasPrefix(arg, "-") {
+				failln(serveUsage)
+				return
+			}
+			dirs = append(dirs, arg)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			failf("fmsh: serve: %s needs a value\n", arg)
+			return
+		}
+		i++
+		var err error
+		switch arg {
+		case "--port", "-p":
+			port, err = strconv.Atoi(args[i])
+			if err == nil && (port < 0 || port > 65535) {
+				err = fmt.Errorf("out of range")
+			}
+		case "--bind":
+			bind = args[i]
+		case "--max-upload":
+			opts.MaxUpload, err = fileops.ParseSize(args[i])
+		case "--auth":
+			var ok bool
+			opts.User, opts.Password, ok = strings.Cut(args[i], ":")
+			if !ok {
+				opts.Password, generated = randomPassword(), true
+			}
+			if opts.User == "" {
+				err = fmt.Errorf("missing user name")
+			}
+		}
+		if err != nil {
+			failf("fmsh: serve: %s: invalid value %s\n", arg, args[i])
+			return
+		}
+	}
+	if len(dirs) > 1 {
+		failln(serveUsage)
+		return
+	}
+
+	dir := "."
+	if len(dirs) == 1 {
+		dir = dirs[0]
+	}
+	if err := checkVirtual([]string{dir}); err != nil {
+		failln(utils.Colorize(utils.RoleError, "fmsh: serve: "+err.Error()))
+		return
+	}
+	if !checkPath("serve", dir) {
+		return
+	}
+	opts.Root, _ = filepath.Abs(dir)
+	opts.Uploaded = func(path string, size int64) {
+		utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "serve upload", Paths: []string{path}, Sizes: []int64{size}}, nil)
+	}
+	handler, err := server.NewHandler(opts)
+	if err != nil {
+		failf("fmsh: serve: %v\n", err)
+		return
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(port)))
+	if err != nil {
+		failf("fmsh: serve: %v\n", err)
+		return
+	}
+
+	mode := "read-only"
+	if opts.Uploads {
+		mode = "uploads enabled"
+	}
+	fmt.Printf("Serving %s (%s) at:\n", utils.Colorize(utils.RoleDirectory, opts.Root), mode)
+	for _, u := range serveURLs(listener.Addr().(*net.TCPAddr)) {
+		fmt.Println("  " + u)
+	}
+	if generated {
+		fmt.Printf("User %s, password %s\n", opts.User, opts.Password)
+	}
+	fmt.Println("Press Ctrl-C to stop.")
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(listener) }()
+	select {
+	case <-stop:
+	case err := <-done:
+		failf("fmsh: serve: %v\n", err)
+		return
+	}
+
+	// Give running downloads a moment before cutting them off
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if srv.Shutdown(ctx) != nil {
+		srv.Close()
+	}
+	fmt.Printf("\nStopped serving %s\n", opts.Root)
+}
+
+// serveURLs lists the URLs a server listening on addr is reachable at: on
+// every network interface for an unspecified address
+func serveURLs(addr *net.TCPAddr) []string {
+	port := strconv.Itoa(addr.Port)
+	if !addr.IP.IsUnspecified() {
+		return []string{"http://" + net.JoinHostPort(addr.IP.String(), port) + "/"}
+	}
+	urls := []string{"http://localhost:" + port + "/"}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			urls = append(urls, "http://"+net.JoinHostPort(ipNet.IP.String(), port)+"/")
+		}
+	}
+	return urls
+}
+
+// randomPassword returns a password for --auth without one
+func randomPassword() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
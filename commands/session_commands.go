@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+)
+
+var exitRequested bool
+
+// ExitRequested reports whether a command asked the shell to exit
+func ExitRequested() bool {
+	return exitRequested
+}
+
+// CaptureSession collects the state that is saved between runs
+func CaptureSession(name string) *utils.SessionState {
+	return &utils.SessionState{Name: name, Cwd: Workdir()}
+}
+
+// RestoreSession applies a saved state, skipping a working directory that is gone or outside the root
+func RestoreSession(state *utils.SessionState) {
+	if state.Cwd != "" {
+		checked := state.Cwd
+		if archive, _, ok := fileops.SplitArchivePath(checked); ok {
+			checked = archive
+		}
+		if _, err := utils.GlobalPolicy.Check(checked); err != nil {
+			fmt.Printf("Not restoring working directory: %v\n", err)
+		} else if err := changeDir(state.Cwd); err != nil {
+			fmt.Printf("Not restoring working directory: %v\n", err)
+		}
+	}
+}
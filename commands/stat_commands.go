@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const statTimeFormat = "2006-01-02 15:04:05.000000000 -0700"
+
+// HandleStat implements the "stat" command, which shows every piece of
+// metadata the platform keeps about a file
+func HandleStat(args []string) {
+	if len(args) == 0 {
+		failln("Usage: stat <path>...")
+		return
+	}
+	for i, path := range args {
+		if !checkPath("stat", path) {
+			continue
+		}
+		st, err := statPath(path)
+		if err != nil {
+			failf("fmsh: stat: %v\n", err)
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printStat(st)
+	}
+}
+
+// statPath gathers the metadata of path; backends other than the host only
+// know the basics
+func statPath(path string) (fileops.FileStat, error) {
+	loc, err := locate(path, false)
+	if err != nil {
+		return fileops.FileStat{}, err
+	}
+	if loc.native() {
+		return fileops.Stat(loc.name)
+	}
+	info, err := loc.fs.Lstat(loc.name)
+	if err != nil {
+		return fileops.FileStat{}, err
+	}
+	st := fileops.FileStat{Path: path, Info: info, Mtime: info.ModTime()}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		st.LinkTarget, _ = loc.fs.ReadLink(loc.name)
+	}
+	return st, nil
+}
+
+func printStat(st fileops.FileStat) {
+	info := st.Info
+	name := utils.ColorizeFile(st.Path, info.Mode())
+	if st.LinkTarget != "" {
+		name += " -> " + st.LinkTarget
+	}
+	fmt.Printf("  File: %s\n", name)
+	fmt.Printf("  Type: %s\n", fileops.FileTypeName(info))
+	if st.MIME != "" {
+		fmt.Printf("  MIME: %s\n", st.MIME)
+	}
+	fmt.Printf("  Size: %s Blocks: %-10d IO Block: %d\n",
+		utils.Colorize(utils.RoleSize, fmt.Sprintf("%-15d", info.Size())), st.Blocks, st.BlockSize)
+	fmt.Printf("Device: %-15s Inode: %-11d Links: %d\n", fmt.Sprintf("%d,%d", st.DevMajor, st.DevMinor), st.Inode, st.Links)
+
+	owner := "-"
+	if st.HasOwner {
+		owner = fmt.Sprintf("Uid: (%d/%s)  Gid: (%d/%s)", st.UID, st.Owner, st.GID, st.Group)
+	}
+	fmt.Printf("  Mode: %s (%s)  %s\n", fileops.OctalMode(info.Mode()), fileops.SymbolicMode(info.Mode()), owner)
+	fmt.Printf("Access: %s\n", statTime(st.Atime))
+	fmt.Printf("Modify: %s\n", statTime(st.Mtime))
+	fmt.Printf("Change: %s\n", statTime(st.Ctime))
+	fmt.Printf(" Birth: %s\n", statTime(st.Birth))
+
+	switch {
+	case st.XattrErr != nil:
+		fmt.Printf("Xattrs: %v\n", st.XattrErr)
+	case len(st.Xattrs) > 0:
+		fmt.Println("Xattrs:")
+		for _, attr := range st.Xattrs {
+			fmt.Printf("  %s=%s\n", attr.Name, xattrDisplay(attr.Value))
+		}
+	}
+}
+
+// statTime formats a time of stat, "-" when unknown
+func statTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(statTimeFormat)
+}
+
+// xattrDisplay shows a printable attribute value quoted and anything else in hex
+func xattrDisplay(value []byte) string {
+	if !utf8.Valid(value) {
+		return fmt.Sprintf("0x%x", value)
+	}
+	for _, r := range string(value) {
+		if !strconv.IsPrint(r) {
+			return fmt.Sprintf("0x%x", value)
+		}
+	}
+	return strconv.Quote(string(value))
+}
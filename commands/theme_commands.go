@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"fmsh/utils"
+	"fmt"
+)
+
+// HandleTheme implements the "theme" command
+func HandleTheme(args []string) {
+	if len(args) == 0 {
+		palette := utils.GlobalPalette
+		fmt.Printf("Current theme: %s\n", palette.Name)
+		if !palette.Enabled() {
+			fmt.Println("Colours are disabled (NO_COLOR is set or output is not a terminal).")
+		}
+		for _, role := range utils.Roles {
+			fmt.Printf("  %s\n", palette.Colorize(role, string(role)))
+		}
+		fmt.Println("Available themes:")
+		for _, name := range utils.ThemeNames() {
+			fmt.Printf("  %s\n", name)
+		}
+		return
+	}
+
+	name := args[0]
+	theme, err := utils.LoadTheme(name)
+	if err != nil {
+		failf("fmsh: theme: %v\n", err)
+		return
+	}
+	utils.GlobalPalette = utils.NewPalette(name, theme)
+	fmt.Printf("Theme set to %s\n", name)
+}
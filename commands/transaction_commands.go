@@ -0,0 +1,131 @@
+package commands
+
+import (
+	"errors"
+	"fmsh/utils"
+	"fmt"
+	"strings"
+)
+
+// HandleBegin implements the "begin" command
+func HandleBegin(args []string) {
+	var name string
+	autoRollback := false
+	for _, arg := range args {
+		switch {
+		case arg == "--auto-rollback":
+			autoRollback = true
+		case strings.HasPrefix(arg, "-") || name != "":
+			failln("Usage: begin [--auto-rollback] [name]")
+			return
+		default:
+			name = arg
+		}
+	}
+
+	if err := utils.GlobalUndoManager.Begin(name, autoRollback); err != nil {
+		failf("fmsh: begin: %v\n", err)
+		return
+	}
+	fmt.Println("Transaction started. Finish it with commit or rollback.")
+}
+
+// HandleCommit implements the "commit" command
+func HandleCommit(args []string) {
+	n, err := utils.GlobalUndoManager.Commit()
+	if err != nil {
+		failf("fmsh: commit: %v\n", err)
+		return
+	}
+	fmt.Printf("Transaction committed with %d action(s); one undo reverts it.\n", n)
+}
+
+// HandleRollback implements the "rollback" command
+func HandleRollback(args []string) {
+	force := len(args) > 0 && (args[0] == "--force" || args[0] == "-f")
+	rollbackTransaction("rollback", force)
+}
+
+func rollbackTransaction(cmd string, force bool) {
+	tx := utils.GlobalUndoManager.Transaction()
+	err := utils.GlobalUndoManager.Rollback(force)
+	if errors.Is(err, utils.ErrUndoConflict) {
+		failf("fmsh: %s: %v (use rollback --force to roll back anyway)\n", cmd, err)
+		return
+	}
+	if err != nil {
+		failf("fmsh: %s: %v\n", cmd, err)
+		return
+	}
+	if tx == nil || len(tx.Irreversible) == 0 {
+		fmt.Println("Transaction rolled back.")
+		return
+	}
+	fmt.Println("Transaction rolled back, except for these commands, which cannot be undone:")
+	for _, command := range tx.Irreversible {
+		fmt.Printf("  %s\n", command)
+	}
+}
+
+// allowIrreversible lets a command change files in a way rollback cannot
+// revert, such as deleting permanently or changing a mounted or remote
+// path, inside a transaction only when the user confirms it. The command is
+// then remembered so rollback can name it. Outside a transaction anything
+// is allowed.
+func allowIrreversible(cmd string, args []string, what string) bool {
+	if utils.GlobalUndoManager.Transaction() == nil {
+		return true
+	}
+	if !utils.Confirm(fmt.Sprintf("fmsh: %s: %s cannot be undone, so rollback will not revert it. Run it anyway?", cmd, what)) {
+		failln(utils.Colorize(utils.RoleError, "fmsh: "+cmd+": "+what+" cannot be undone, so it is refused inside a transaction"))
+		return false
+	}
+	utils.GlobalUndoManager.NoteIrreversible(strings.Join(append([]string{cmd}, args...), " "))
+	return true
+}
+
+// rollbackOnFailure rolls back an auto-rollback transaction when the command
+// that just ran reported a failure, including refused paths and usage errors
+func rollbackOnFailure(cmd string) {
+	tx := utils.GlobalUndoManager.Transaction()
+	if tx == nil || !tx.AutoRollback || !failed || cmd == "rollback" {
+		return
+	}
+	fmt.Println(utils.Colorize(utils.RoleWarning, "fmsh: "+cmd+" failed; rolling back the transaction"))
+	rollbackTransaction(cmd, false)
+}
+
+// RecoverTransaction offers to finish a transaction left open by a previous
+// run that exited or crashed before commit or rollback
+func RecoverTransaction() {
+	tx := utils.GlobalUndoManager.Transaction()
+	if tx == nil {
+		return
+	}
+
+	name := ""
+	if tx.Name != "" {
+		name = " '" + tx.Name + "'"
+	}
+	fmt.Println(utils.Colorize(utils.RoleWarning, fmt.Sprintf("An unfinished transaction%s from %s holds %d action(s):",
+		name, tx.Started.Format("2006-01-02 15:04:05"), len(tx.Actions))))
+	for _, action := range tx.Actions {
+		fmt.Printf("  %s\n", action)
+	}
+	for _, command := range tx.Irreversible {
+		fmt.Printf("  %s (cannot be rolled back)\n", command)
+	}
+
+	answer, err := utils.ReadLine("[r]oll back, [c]ommit or [k]eep it open? ")
+	if err != nil {
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "r", "rollback":
+		rollbackTransaction("rollback", false)
+	case "c", "commit":
+		HandleCommit(nil)
+	default:
+		fmt.Println("The transaction stays open.")
+	}
+}
@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const trashUsage = "Usage: trash list | trash restore " + conflictUsage + " <item>... | trash empty [--older-than age]"
+
+// HandleTrash implements the "trash" command
+func HandleTrash(args []string) {
+	if len(args) == 0 {
+		failln(trashUsage)
+		return
+	}
+	if args[0] != "list" && refuseReadOnly("trash", args[0]) {
+		return
+	}
+
+	// Besides the home trash, entries may sit in the trash at the top of
+	// another filesystem
+	trashes := fileops.Trashes()
+	switch args[0] {
+	case "list":
+		listTrash(trashes)
+	case "restore":
+		restoreTrash(trashes, args[1:])
+	case "empty":
+		if allowIrreversible("trash", args, "emptying the trash") {
+			emptyTrash(trashes, args[1:])
+		}
+	default:
+		failln(trashUsage)
+	}
+}
+
+func listTrash(trashes []*fileops.Trash) {
+	var items []fileops.TrashItem
+	for _, trash := range trashes {
+		found, err := trash.List()
+		if err != nil {
+			failf("fmsh: trash: %v\n", err)
+			continue
+		}
+		items = append(items, found...)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	if len(items) == 0 {
+		fmt.Println("The trash is empty.")
+		return
+	}
+
+	nameWidth := len("NAME")
+	for _, item := range items {
+		if len(item.Name) > nameWidth {
+			nameWidth = len(item.Name)
+		}
+	}
+	fmt.Printf("%-*s  %-19s  %s\n", nameWidth, "NAME", "DELETED", "ORIGINAL PATH")
+	for _, item := range items {
+		name := item.Name
+		if item.IsDir {
+			name += "/"
+		}
+		fmt.Printf("%-*s  %-19s  %s\n", nameWidth, name, item.DeletedAt.Format("2006-01-02 15:04:05"), item.OriginalPath)
+	}
+}
+
+func restoreTrash(trashes []*fileops.Trash, args []string) {
+	// An entry already back at its original path usually means two deletions
+	// of the same name, so keep both unless told otherwise
+	conflict := fileops.ConflictOptions{Policy: fileops.AutoRename}
+	var names []string
+	for _, arg := range args {
+		if !parseConflictFlag(arg, &conflict) {
+			names = append(names, arg)
+		}
+	}
+	if len(names) == 0 {
+		failln("Usage: trash restore " + conflictUsage + " <item>...")
+		return
+	}
+
+	for _, name := range names {
+		trash, item, err := findTrashed(trashes, name)
+		if err != nil {
+			failf("fmsh: trash: %v\n", err)
+			continue
+		}
+		if !authorizePath("trash", item.OriginalPath) {
+			continue
+		}
+
+		trashed := trash.FilePath(item.Name)
+		restored, err := trash.Restore(item.Name, conflict)
+		if err == nil && restored == "" {
+			fmt.Printf("Skipped '%s': '%s' already exists\n", item.Name, item.OriginalPath)
+			continue
+		}
+		utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "trash-restore", Paths: []string{trashed, restored}}, err)
+		if err != nil {
+			failf("fmsh: trash: %v\n", err)
+			continue
+		}
+		utils.GlobalUndoManager.Push(utils.Action{Type: utils.Move, Source: trashed, Dest: restored})
+		fmt.Printf("Restored '%s' to '%s'\n", item.Name, restored)
+	}
+}
+
+// findTrashed looks name up in each trash in turn
+func findTrashed(trashes []*fileops.Trash, name string) (*fileops.Trash, fileops.TrashItem, error) {
+	var err error
+	for _, trash := range trashes {
+		var item fileops.TrashItem
+		if item, err = trash.Find(name); err == nil {
+			return trash, item, nil
+		}
+	}
+	return nil, fileops.TrashItem{}, err
+}
+
+func emptyTrash(trashes []*fileops.Trash, args []string) {
+	var cutoff time.Time
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--older-than" || i+1 >= len(args) {
+			failln("Usage: trash empty [--older-than age]")
+			return
+		}
+		var err error
+		cutoff, err = parseTimeArg(args[i+1])
+		if err != nil {
+			failf("fmsh: trash: %v\n", err)
+			return
+		}
+		i++
+	}
+
+	if cutoff.IsZero() && !utils.Confirm("Permanently delete everything in the trash?") {
+		return
+	}
+	removed := 0
+	for _, trash := range trashes {
+		n, err := trash.Empty(cutoff)
+		removed += n
+		if n > 0 || err != nil {
+			utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "trash-empty", Paths: []string{trash.Dir}}, err)
+		}
+		if err != nil {
+			failf("fmsh: trash: %v\n", err)
+		}
+	}
+	fmt.Printf("Permanently deleted %d item(s) from the trash.\n", removed)
+}
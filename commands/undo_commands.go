@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"fmsh/utils"
+	"fmt"
+	"strconv"
+)
+
+// HandleUndo implements the "undo" command
+func HandleUndo(args []string) {
+	steps, force := 1, false
+	for _, arg := range args {
+		switch {
+		case arg == "list":
+			listUndo()
+			return
+		case arg == "--force" || arg == "-f":
+			force = true
+		default:
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				failln("Usage: undo [list | <n>] [--force]")
+				return
+			}
+			steps = n
+		}
+	}
+	// Listing only reads, so only reverting is refused in read-only mode
+	if refuseReadOnly("undo", "") {
+		return
+	}
+	// The undo manager prints its own errors
+	if utils.GlobalUndoManager.UndoSteps(steps, force) != nil {
+		failed = true
+	}
+}
+
+// HandleRedo implements the "redo" command
+func HandleRedo(args []string) {
+	steps := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			failln("Usage: redo [n]")
+			return
+		}
+		steps = n
+	}
+	if utils.GlobalUndoManager.RedoSteps(steps) != nil {
+		failed = true
+	}
+}
+
+// listUndo prints the undo stack most recent first, numbered as "undo <n>" counts them
+func listUndo() {
+	actions := utils.GlobalUndoManager.Actions()
+	redo := utils.GlobalUndoManager.RedoActions()
+	if len(actions) == 0 && len(redo) == 0 {
+		fmt.Println("Nothing to undo.")
+		return
+	}
+
+	for i := len(actions) - 1; i >= 0; i-- {
+		action := actions[i]
+		status := ""
+		if action.CheckConflict() != nil {
+			status = utils.Colorize(utils.RoleWarning, "  (changed since)")
+		}
+		fmt.Printf("%3d  %s  %s%s\n", len(actions)-i, action.Time.Format("2006-01-02 15:04:05"), action, status)
+	}
+	if len(redo) > 0 {
+		fmt.Printf("%d undone action(s) can be redone with redo.\n", len(redo))
+	}
+}
@@ -0,0 +1,267 @@
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const xattrUsage = "Usage: xattr list [-R] [--encoding text|hex|base64] <path>... | " +
+	"xattr get [--encoding text|hex|base64] <name> <path>... | " +
+	"xattr set [-R] [--encoding text|hex|base64] <name> <value> <path>... | " +
+	"xattr remove [-R] <name> <path>..."
+
+// xattrFlags are the options of the xattr subcommands
+type xattrFlags struct {
+	recursive bool
+	encoding  string // text, hex or base64
+	args      []string
+}
+
+// HandleXattr implements the "xattr" command, which lists, reads, sets and
+// removes extended attributes. Names without a namespace are in "user.".
+func HandleXattr(args []string) {
+	if len(args) == 0 {
+		failln(xattrUsage)
+		return
+	}
+	sub := args[0]
+	if sub == "set" || sub == "remove" {
+		if refuseReadOnly("xattr", sub) {
+			return
+		}
+	}
+	flags, ok := parseXattrFlags(args[1:])
+	if !ok {
+		failln(xattrUsage)
+		return
+	}
+
+	// Attribute names and values may look like URLs; only paths are checked
+	var paths []string
+	switch {
+	case sub == "list":
+		paths = flags.args
+	case (sub == "get" || sub == "remove") && len(flags.args) > 1:
+		paths = flags.args[1:]
+	case sub == "set" && len(flags.args) > 2:
+		paths = flags.args[2:]
+	}
+	if err := checkVirtual(paths); err != nil {
+		failln(utils.Colorize(utils.RoleError, "fmsh: xattr "+sub+": "+err.Error()))
+		return
+	}
+
+	switch {
+	case sub == "list" && len(flags.args) > 0:
+		listXattrs(flags)
+	case sub == "get" && len(flags.args) > 1 && !flags.recursive:
+		getXattr(flags)
+	case sub == "set" && len(flags.args) > 2:
+		value, err := decodeXattr(flags.args[1], flags.encoding)
+		if err != nil {
+			failf("fmsh: xattr: %v\n", err)
+			return
+		}
+		changeXattr("set", flags.args[0], value, flags.args[2:], flags.recursive)
+	case sub == "remove" && len(flags.args) > 1:
+		changeXattr("remove", flags.args[0], nil, flags.args[1:], flags.recursive)
+	default:
+		failln(xattrUsage)
+	}
+}
+
+func parseXattrFlags(args []string) (xattrFlags, bool) {
+	flags := xattrFlags{encoding: "text"}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-R" || arg == "--recursive":
+			flags.recursive = true
+		case arg == "--encoding" || arg == "-e":
+			if i+1 == len(args) {
+				return flags, false
+			}
+			i++
+			flags.encoding = args[i]
+		case strings.HasPrefix(arg, "--encoding="):
+			flags.encoding = strings.TrimPrefix(arg, "--encoding=")
+		case arg == "--":
+			flags.args = append(flags.args, args[i+1:]...)
+			i = len(args)
+		default:
+			flags.args = append(flags.args, arg)
+		}
+	}
+	switch flags.encoding {
+	case "text", "hex", "base64":
+		return flags, true
+	}
+	return flags, false
+}
+
+func listXattrs(flags xattrFlags) {
+	headed := flags.recursive || len(flags.args) > 1
+	for _, path := range flags.args {
+		if !checkPath("xattr", path) {
+			continue
+		}
+		walkXattrs(path, flags.recursive, func(name string) error {
+			attrs, err := fileops.ReadXattrs(name)
+			if err != nil {
+				return err
+			}
+			if !headed {
+				if len(attrs) == 0 {
+					fmt.Println("No extended attributes")
+				}
+				for _, attr := range attrs {
+					fmt.Printf("%s=%s\n", attr.Name, encodeXattr(attr.Value, flags.encoding))
+				}
+				return nil
+			}
+			if len(attrs) > 0 {
+				fmt.Printf("%s:\n", name)
+			}
+			for _, attr := range attrs {
+				fmt.Printf("  %s=%s\n", attr.Name, encodeXattr(attr.Value, flags.encoding))
+			}
+			return nil
+		})
+	}
+}
+
+func getXattr(flags xattrFlags) {
+	name, paths := fileops.XattrName(flags.args[0]), flags.args[1:]
+	for _, path := range paths {
+		if !checkPath("xattr", path) {
+			continue
+		}
+		value, err := fileops.GetXattr(resolvePath(path), name)
+		if err != nil {
+			failf("fmsh: xattr: %v\n", err)
+			continue
+		}
+		// A single text value is printed as it is, for use in scripts
+		text := string(value)
+		if flags.encoding != "text" || len(paths) > 1 {
+			text = encodeXattr(value, flags.encoding)
+		}
+		if len(paths) > 1 {
+			fmt.Printf("%s: %s\n", path, text)
+		} else {
+			fmt.Println(text)
+		}
+	}
+}
+
+// changeXattr sets the attribute to value, or removes it when value is nil,
+// and records the previous value for undo
+func changeXattr(op, name string, value []byte, paths []string, recursive bool) {
+	name = fileops.XattrName(name)
+	batch := utils.Action{Type: utils.Batch, Label: "xattr " + op}
+	changed := 0
+	for _, path := range paths {
+		if !authorizePath("xattr", path) {
+			continue
+		}
+		walkXattrs(path, recursive, func(file string) error {
+			old, err := fileops.GetXattr(file, name)
+			switch {
+			case errors.Is(err, fileops.ErrNoXattr):
+				// Files below a directory need not all have the attribute
+				if value == nil && file != resolvePath(path) {
+					return nil
+				}
+				old = nil
+			case err != nil:
+				return err
+			}
+			if value == nil {
+				err = fileops.RemoveXattr(file, name)
+			} else {
+				err = fileops.SetXattr(file, name, value)
+			}
+			utils.GlobalAuditLog.Record(utils.AuditEntry{Op: "xattr " + op, Paths: []string{file}}, err)
+			if err != nil {
+				return err
+			}
+			changed++
+			batch.Actions = append(batch.Actions, utils.Action{
+				Type:   utils.Xattr,
+				Source: file,
+				Attr:   &utils.AttrChange{Name: name, Value: old, New: value},
+			})
+			return nil
+		})
+	}
+	pushBatch(batch)
+	if op == "set" {
+		fmt.Printf("Set %s on %d file(s).\n", name, changed)
+	} else {
+		fmt.Printf("Removed %s from %d file(s).\n", name, changed)
+	}
+}
+
+// walkXattrs calls fn for path and, with recursive, for everything below
+// it. Symlinks below are skipped, since only their targets carry user
+// attributes; errors are reported and the walk goes on.
+func walkXattrs(path string, recursive bool, fn func(name string) error) {
+	root := resolvePath(path)
+	if err := fn(root); err != nil {
+		failf("fmsh: xattr: %v\n", err)
+	}
+	if info, err := os.Stat(root); !recursive || err != nil || !info.IsDir() {
+		return
+	}
+	filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err == nil && (name == root || entry.Type()&fs.ModeSymlink != 0) {
+			return nil
+		}
+		if err == nil {
+			err = fn(name)
+		}
+		if err != nil {
+			failf("fmsh: xattr: %v\n", err)
+		}
+		return nil
+	})
+}
+
+// encodeXattr shows a value in the encoding asked for, using getfattr's
+// 0x and 0s prefixes for hex and base64
+func encodeXattr(value []byte, encoding string) string {
+	switch encoding {
+	case "hex":
+		return "0x" + hex.EncodeToString(value)
+	case "base64":
+		return "0s" + base64.StdEncoding.EncodeToString(value)
+	}
+	return xattrDisplay(value)
+}
+
+// decodeXattr turns a value given on the command line into bytes; the 0x
+// and 0s prefixes are optional
+func decodeXattr(text, encoding string) ([]byte, error) {
+	var value []byte
+	var err error
+	switch encoding {
+	case "hex":
+		value, err = hex.DecodeString(strings.TrimPrefix(text, "0x"))
+	case "base64":
+		value, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(text, "0s"))
+	default:
+		return []byte(text), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %q", encoding, text)
+	}
+	return value, nil
+}
@@ -0,0 +1,411 @@
+// Package daemon lets other programs drive fmsh over JSON-RPC 2.0. Every
+// request, response and notification is one line of JSON on a Unix socket
+// or, for clients that authenticate with a token first, a TCP connection.
+// Long operations run as jobs: they report progress through notifications
+// and can be canceled by the id of their request. Each connection has its
+// own working directory, which relative paths are resolved against.
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Error codes of JSON-RPC 2.0 and of the daemon
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeFailed         = -32000 // The operation ran and failed
+	CodeUnauthorized   = -32001 // A TCP client has not sent the right token
+	CodeCanceled       = -32800 // The request was canceled
+)
+
+// maxLine limits the size of a request
+const maxLine = 1 << 20
+
+// Error is the error object of a response
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// Request is a call or, without an id, a notification
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Response answers a call; ID is null when the request could not be read
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Notification is sent by the daemon without being asked, such as progress
+type Notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// Progress is the parameter of a "progress" notification. Total is 0 for
+// operations that cannot know it in advance, such as a search.
+type Progress struct {
+	ID    json.RawMessage `json:"id"`
+	Done  int64           `json:"done"`
+	Total int64           `json:"total"`
+}
+
+// Options configures a daemon
+type Options struct {
+	Dir   string    // Working directory new connections start in
+	Token string    // Secret that TCP clients must send with "auth" before anything else
+	Log   io.Writer // Receives one line per request when set
+}
+
+// Server serves connections until it is closed
+type Server struct {
+	opts Options
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[*conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New returns a daemon server
+func New(opts Options) *Server {
+	return &Server{opts: opts, conns: map[*conn]struct{}{}}
+}
+
+// ListenUnix listens on a Unix socket only the user can connect to. A
+// socket left behind by a daemon that died is replaced; one that still
+// answers is not.
+func ListenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(path); err == nil {
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("a daemon is already running at %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve accepts connections on l until the server is closed. Clients on an
+// untrusted listener must authenticate with the token first.
+func (s *Server) Serve(l net.Listener, trusted bool) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.ServeConn(c, trusted)
+	}
+}
+
+// ServeConn serves the requests of one client until it disconnects
+func (s *Server) ServeConn(rw net.Conn, trusted bool) {
+	c := &conn{
+		srv:    s,
+		rw:     rw,
+		enc:    json.NewEncoder(rw),
+		dir:    s.opts.Dir,
+		authed: trusted,
+		jobs:   map[string]chan struct{}{},
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		rw.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	c.serve()
+}
+
+// Close stops listening, cancels every job and waits for the connections
+// to end
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.rw.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.opts.Log != nil {
+		fmt.Fprintf(s.opts.Log, time.Now().Format("15:04:05")+" "+format+"\n", args...)
+	}
+}
+
+// conn is the state of one client connection
+type conn struct {
+	srv *Server
+	rw  net.Conn
+
+	wmu sync.Mutex // Serialises writes to enc
+	enc *json.Encoder
+
+	mu     sync.Mutex
+	dir    string                   // Working directory of the client
+	authed bool                     // Whether the client may call methods
+	jobs   map[string]chan struct{} // Cancel channels of running jobs by request id
+	wg     sync.WaitGroup           // Running jobs
+}
+
+func (c *conn) serve() {
+	defer c.rw.Close()
+	scanner := bufio.NewScanner(c.rw)
+	scanner.Buffer(make([]byte, 64<<10), maxLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		c.handle(line)
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		c.reply(nil, nil, &Error{Code: CodeInvalidRequest, Message: "request too large"})
+	}
+
+	// Jobs of a client that went away have nobody to report to
+	c.mu.Lock()
+	for id, cancel := range c.jobs {
+		close(cancel)
+		delete(c.jobs, id)
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+}
+
+// handle answers one line from the client
+func (c *conn) handle(line []byte) {
+	if line[0] == '[' {
+		c.reply(nil, nil, &Error{Code: CodeInvalidRequest, Message: "batches are not supported"})
+		return
+	}
+	var req Request
+	if err := json.Unmarshal(line, &req); err != nil {
+		c.reply(nil, nil, &Error{Code: CodeParseError, Message: "parse error: " + err.Error()})
+		return
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		c.reply(req.ID, nil, &Error{Code: CodeInvalidRequest, Message: "invalid request"})
+		return
+	}
+
+	c.mu.Lock()
+	authed := c.authed
+	c.mu.Unlock()
+	if !authed && req.Method != "auth" {
+		c.reply(req.ID, nil, &Error{Code: CodeUnauthorized, Message: "unauthorized: call auth with the daemon's token first"})
+		return
+	}
+
+	m, ok := methods[req.Method]
+	if !ok {
+		c.reply(req.ID, nil, &Error{Code: CodeMethodNotFound, Message: "method not found: " + req.Method})
+		return
+	}
+	if !m.job {
+		result, err := m.call(c, &job{conn: c, id: req.ID}, req.Params)
+		c.finish(req, result, err)
+		return
+	}
+
+	// Jobs run in the background, so the client can cancel them or send
+	// more requests meanwhile
+	j := &job{conn: c, id: req.ID, cancel: make(chan struct{})}
+	key := string(req.ID)
+	c.mu.Lock()
+	if req.ID != nil {
+		if _, busy := c.jobs[key]; busy {
+			c.mu.Unlock()
+			c.reply(req.ID, nil, &Error{Code: CodeInvalidRequest, Message: "a request with this id is still running"})
+			return
+		}
+		c.jobs[key] = j.cancel
+	}
+	c.wg.Add(1)
+	c.mu.Unlock()
+	go func() {
+		defer c.wg.Done()
+		result, err := m.call(c, j, req.Params)
+		c.mu.Lock()
+		if req.ID != nil && c.jobs[key] == j.cancel {
+			delete(c.jobs, key)
+		}
+		c.mu.Unlock()
+		c.finish(req, result, err)
+	}()
+}
+
+// finish answers a call, which notifications never get
+func (c *conn) finish(req Request, result any, err error) {
+	var rpcErr *Error
+	if err != nil && !errors.As(err, &rpcErr) {
+		rpcErr = &Error{Code: CodeFailed, Message: err.Error()}
+	}
+	code := 0
+	if rpcErr != nil {
+		code = rpcErr.Code
+	}
+	c.srv.logf("%s %s %d", c.rw.RemoteAddr(), req.Method, code)
+	if req.ID != nil {
+		c.reply(req.ID, result, rpcErr)
+	}
+}
+
+func (c *conn) reply(id json.RawMessage, result any, err *Error) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	if err == nil && result == nil {
+		result = struct{}{}
+	}
+	c.write(Response{JSONRPC: "2.0", ID: id, Result: result, Error: err})
+}
+
+func (c *conn) notify(method string, params any) {
+	c.write(Notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (c *conn) write(v any) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.enc.Encode(v)
+}
+
+// cancelJob cancels the running job started by the request with id
+func (c *conn) cancelJob(id json.RawMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancel, ok := c.jobs[string(id)]
+	if ok {
+		close(cancel)
+		delete(c.jobs, string(id))
+	}
+	return ok
+}
+
+func (c *conn) workdir() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dir
+}
+
+func (c *conn) setWorkdir(dir string) {
+	c.mu.Lock()
+	c.dir = dir
+	c.mu.Unlock()
+}
+
+// authenticate lets the client in when token is the daemon's
+func (c *conn) authenticate(token string) bool {
+	want := c.srv.opts.Token
+	ok := want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+	if ok {
+		c.mu.Lock()
+		c.authed = true
+		c.mu.Unlock()
+	}
+	return ok
+}
+
+// job is a request being served
+type job struct {
+	conn   *conn
+	id     json.RawMessage
+	cancel chan struct{} // Closed when the job is canceled; nil for quick methods
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// progress sends a progress notification, at most five a second; calls
+// without an id have nobody to tell
+func (j *job) progress(done, total int64) {
+	if j.id == nil {
+		return
+	}
+	j.mu.Lock()
+	now := time.Now()
+	if now.Sub(j.last) < 200*time.Millisecond && (total == 0 || done < total) {
+		j.mu.Unlock()
+		return
+	}
+	j.last = now
+	j.mu.Unlock()
+	j.conn.notify("progress", Progress{ID: j.id, Done: done, Total: total})
+}
@@ -0,0 +1,308 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"sort"
+)
+
+// method serves one RPC method; jobs run in the background and can be canceled
+type method struct {
+	job  bool
+	call func(c *conn, j *job, params json.RawMessage) (any, error)
+}
+
+var methods = map[string]method{
+	"auth":      {call: callAuth},
+	"commands":  {call: callCommands},
+	"cwd":       {call: callCwd},
+	"chdir":     {call: callChdir},
+	"cancel":    {call: callCancel},
+	"inspect":   {job: true, call: callInspect},
+	"summarise": {job: true, call: callSummarise},
+	"find":      {job: true, call: callFind},
+	"copy":      {job: true, call: callCopy},
+	"run":       {job: true, call: callRun},
+}
+
+// interactive lists commands that wait for a person or end the shell, which
+// "run" refuses
+var interactive = map[string]bool{
+	"serve": true,
+	"clear": true,
+	"exit":  true,
+	"quit":  true,
+	"q":     true,
+}
+
+// conflictPolicies maps the "conflict" parameter of copy to a policy
+var conflictPolicies = map[string]fileops.ConflictPolicy{
+	"overwrite":   fileops.Overwrite,
+	"no-clobber":  fileops.NoClobber,
+	"update":      fileops.Update,
+	"backup":      fileops.Backup,
+	"auto-rename": fileops.AutoRename,
+}
+
+// decode reads the params of a request into v; absent params leave v as is
+func decode(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+func invalidParams(message string) error {
+	return &Error{Code: CodeInvalidParams, Message: "invalid params: " + message}
+}
+
+// failed turns the error of a job into its RPC error, keeping what was done
+// before it failed as data
+func failed(err error, partial any) error {
+	code := CodeFailed
+	if errors.Is(err, fileops.ErrCanceled) {
+		code = CodeCanceled
+	}
+	return &Error{Code: code, Message: err.Error(), Data: partial}
+}
+
+func (j *job) task() commands.Task {
+	return commands.Task{Progress: j.progress, Cancel: j.cancel}
+}
+
+// path resolves a path parameter against the working directory of the client
+func (c *conn) path(p string) string {
+	if p == "" {
+		p = "."
+	}
+	return commands.ResolveFrom(c.workdir(), p)
+}
+
+func callAuth(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		Token string `json:"token"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if !c.authenticate(p.Token) {
+		return nil, &Error{Code: CodeUnauthorized, Message: "unauthorized: wrong token"}
+	}
+	return true, nil
+}
+
+type commandInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Mutating    bool   `json:"mutating"`
+}
+
+func callCommands(c *conn, j *job, params json.RawMessage) (any, error) {
+	list := []commandInfo{}
+	for name, command := range commands.CommandRegistry {
+		if !interactive[name] {
+			list = append(list, commandInfo{name, command.Description, command.Has(commands.Mutating)})
+		}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list, nil
+}
+
+type dirResult struct {
+	Dir string `json:"dir"`
+}
+
+func callCwd(c *conn, j *job, params json.RawMessage) (any, error) {
+	return dirResult{c.workdir()}, nil
+}
+
+func callChdir(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		Path string `json:"path"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Path == "" {
+		return nil, invalidParams("path is required")
+	}
+	dir := c.path(p.Path)
+	if err := commands.CheckPath(dir); err != nil {
+		return nil, err
+	}
+	if !commands.IsDirectory(dir) {
+		return nil, errors.New(dir + ": not a directory")
+	}
+	c.setWorkdir(dir)
+	return dirResult{dir}, nil
+}
+
+func callCancel(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if p.ID == nil {
+		return nil, invalidParams("id is required")
+	}
+	return struct {
+		Canceled bool `json:"canceled"`
+	}{c.cancelJob(p.ID)}, nil
+}
+
+func callInspect(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		Path string `json:"path"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	result, err := commands.Inspect(c.path(p.Path), j.task())
+	if err != nil {
+		return nil, failed(err, nil)
+	}
+	return result, nil
+}
+
+func callSummarise(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		Path string `json:"path"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	summary, err := commands.Summarise(c.path(p.Path), j.task())
+	if err != nil {
+		return nil, failed(err, nil)
+	}
+	return summary, nil
+}
+
+func callFind(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		Path  string `json:"path"`
+		Name  string `json:"name"`
+		Limit int    `json:"limit"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Limit < 0 {
+		return nil, invalidParams("limit must not be negative")
+	}
+	matches, err := commands.Find(c.path(p.Path), p.Name, p.Limit, j.task())
+	if matches == nil {
+		matches = []string{}
+	}
+	if err != nil {
+		return nil, failed(err, matches)
+	}
+	return matches, nil
+}
+
+// copyResult describes the copy of one source
+type copyResult struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Files    int    `json:"files"`
+	Dirs     int    `json:"dirs"`
+	Symlinks int    `json:"symlinks"`
+	Bytes    int64  `json:"bytes"`
+	Skipped  int    `json:"skipped"`
+	Resumed  int    `json:"resumed"`
+	Verified int    `json:"verified"`
+}
+
+func callCopy(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		Sources      []string `json:"sources"`
+		Destination  string   `json:"destination"`
+		Recursive    bool     `json:"recursive"`
+		Verify       bool     `json:"verify"`
+		Workers      int      `json:"workers"`
+		Conflict     string   `json:"conflict"`
+		BackupSuffix string   `json:"backup_suffix"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Sources) == 0 || p.Destination == "" {
+		return nil, invalidParams("sources and destination are required")
+	}
+	if p.Workers < 0 {
+		return nil, invalidParams("workers must not be negative")
+	}
+	opts := fileops.CopyOptions{
+		Recursive:         p.Recursive,
+		Verify:            p.Verify,
+		Workers:           p.Workers,
+		PreserveOwnership: true,
+		Progress:          j.progress,
+		Cancel:            j.cancel,
+	}
+	if p.Conflict != "" {
+		policy, ok := conflictPolicies[p.Conflict]
+		if !ok {
+			return nil, invalidParams("unknown conflict policy " + p.Conflict)
+		}
+		opts.Conflict = fileops.ConflictOptions{Policy: policy, BackupSuffix: p.BackupSuffix}
+	}
+	if utils.GlobalPolicy.ReadOnly {
+		return nil, errors.New("disabled in read-only mode")
+	}
+
+	destination := c.path(p.Destination)
+	if len(p.Sources) > 1 && !commands.IsDirectory(destination) {
+		return nil, errors.New("target '" + destination + "' is not a directory")
+	}
+	results := []copyResult{}
+	for _, source := range p.Sources {
+		source = c.path(source)
+		stats, err := commands.CopyPath(source, destination, opts)
+		if err != nil {
+			return nil, failed(err, results)
+		}
+		results = append(results, copyResult{
+			Source: source, Target: stats.Target,
+			Files: stats.Files, Dirs: stats.Dirs, Symlinks: stats.Symlinks, Bytes: stats.Bytes,
+			Skipped: stats.Skipped, Resumed: stats.Resumed, Verified: stats.Verified,
+		})
+	}
+	return results, nil
+}
+
+func callRun(c *conn, j *job, params json.RawMessage) (any, error) {
+	var p struct {
+		Command string   `json:"command"`
+		Args    []string `json:"args"`
+	}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Command == "" {
+		return nil, invalidParams("command is required")
+	}
+	if interactive[p.Command] {
+		return nil, invalidParams(p.Command + " cannot run in the daemon")
+	}
+	output, dir, err := commands.RunIn(c.workdir(), p.Command, p.Args)
+	if errors.Is(err, commands.ErrUnknownCommand) {
+		return nil, invalidParams("command not found: " + p.Command)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.setWorkdir(dir)
+	return struct {
+		Output string `json:"output"`
+		Dir    string `json:"dir"`
+	}{output, dir}, nil
+}
@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmsh/commands"
+	"fmsh/utils"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// TokenEnv names the environment variable holding the token of TCP clients
+const TokenEnv = "FMSH_DAEMON_TOKEN"
+
+// DefaultSocket is where the daemon listens unless told otherwise
+func DefaultSocket() string {
+	return utils.ConfigPath("daemon.sock")
+}
+
+// Run starts the daemon for the named session and serves until SIGINT or
+// SIGTERM. It listens on socket and, when tcp is set, on that address too.
+func Run(session, socket, tcp string) error {
+	commands.InitializeCommands()
+	if err := utils.GlobalUndoManager.Open(utils.UndoJournalPath(session)); err != nil {
+		fmt.Printf("Error loading undo journal: %v\n", err)
+	}
+	if err := utils.GlobalAuditLog.Open(utils.ConfigPath("audit.jsonl"), utils.NewSessionID()); err != nil {
+		fmt.Printf("Error opening audit log: %v\n", err)
+	}
+
+	// Output of commands goes to clients as plain text, and nobody is
+	// there to answer prompts, so they are declined
+	utils.GlobalPager.Enabled = false
+	utils.GlobalPalette.Depth = utils.DepthNone
+	utils.SetInput(strings.NewReader(""))
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	opts := Options{Dir: dir, Log: os.Stdout}
+	if tcp != "" {
+		opts.Token = os.Getenv(TokenEnv)
+		if opts.Token == "" {
+			opts.Token = newToken()
+			fmt.Printf("TCP token: %s\n", opts.Token)
+		}
+	}
+	srv := New(opts)
+
+	unixListener, err := ListenUnix(socket)
+	if err != nil {
+		return err
+	}
+	listeners := []net.Listener{unixListener}
+	fmt.Printf("Listening on %s\n", socket)
+	if tcp != "" {
+		tcpListener, err := net.Listen("tcp", tcp)
+		if err != nil {
+			unixListener.Close()
+			return err
+		}
+		listeners = append(listeners, tcpListener)
+		fmt.Printf("Listening on tcp %s\n", tcpListener.Addr())
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(l net.Listener, trusted bool) { errs <- srv.Serve(l, trusted) }(l, i == 0)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	select {
+	case <-stop:
+	case err = <-errs:
+	}
+	srv.Close()
+	fmt.Println("Daemon stopped")
+	return err
+}
+
+// newToken returns a token for TCP clients when none is configured
+func newToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
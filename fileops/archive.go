@@ -0,0 +1,288 @@
+package fileops
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat identifies a supported archive format
+type ArchiveFormat int
+
+const (
+	FormatZip ArchiveFormat = iota
+	FormatTar
+	FormatTarGz
+	FormatTarBz2 // Extraction only; the standard library has no bzip2 compressor
+)
+
+var formatNames = map[ArchiveFormat]string{
+	FormatZip:    "zip",
+	FormatTar:    "tar",
+	FormatTarGz:  "tar.gz",
+	FormatTarBz2: "tar.bz2",
+}
+
+func (f ArchiveFormat) String() string {
+	return formatNames[f]
+}
+
+// ErrUnsafeArchive is returned for entries that would be written outside the
+// destination, and for archives that exceed the extraction limits
+var ErrUnsafeArchive = errors.New("unsafe archive")
+
+// DetectArchiveFormat tells the format from an archive's file name
+func DetectArchiveFormat(name string) (ArchiveFormat, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return FormatZip, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return FormatTar, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return FormatTarGz, nil
+	case strings.HasSuffix(lower, ".tar.bz2"), strings.HasSuffix(lower, ".tbz2"), strings.HasSuffix(lower, ".tbz"):
+		return FormatTarBz2, nil
+	}
+	return 0, fmt.Errorf("%s: unknown archive format (use .zip, .tar, .tar.gz or .tar.bz2)", name)
+}
+
+// EntryType is the kind of an archive entry
+type EntryType int
+
+const (
+	EntryFile EntryType = iota
+	EntryDir
+	EntrySymlink
+	EntryHardlink
+	EntryOther // Devices, FIFOs and the like, which are never extracted
+)
+
+// ArchiveEntry describes one member of an archive
+type ArchiveEntry struct {
+	Name           string // Slash-separated, directories without the trailing slash
+	Type           EntryType
+	Size           int64
+	CompressedSize int64 // Zip only
+	Mode           os.FileMode
+	ModTime        time.Time
+	Linkname       string  // Target of symlinks and hard links
+	Xattrs         []Xattr // Extended attributes, tar only
+}
+
+// ArchiveStats summarises an archive operation
+type ArchiveStats struct {
+	Entries int
+	Bytes   int64
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// walkArchive calls fn for every entry in order with a reader of its content.
+// When consumed is not nil it tracks how many bytes of the archive file have
+// been processed, which serves as progress for compressed streams.
+func walkArchive(archivePath string, consumed *int64, fn func(entry ArchiveEntry, content io.Reader) error) error {
+	format, err := DetectArchiveFormat(archivePath)
+	if err != nil {
+		return err
+	}
+	if consumed == nil {
+		consumed = new(int64)
+	}
+	if format == FormatZip {
+		return walkZip(archivePath, consumed, fn)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = countingReader{f, consumed}
+	switch format {
+	case FormatTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case FormatTarBz2:
+		r = bzip2.NewReader(r)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			// Drain the stream so gzip checks its trailing checksum
+			_, err = io.Copy(io.Discard, r)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		entry := ArchiveEntry{
+			Name:     strings.TrimSuffix(header.Name, "/"),
+			Size:     header.Size,
+			Mode:     header.FileInfo().Mode(),
+			ModTime:  header.ModTime,
+			Linkname: header.Linkname,
+		}
+		for key, value := range header.PAXRecords {
+			if name, ok := strings.CutPrefix(key, xattrRecordPrefix); ok {
+				entry.Xattrs = append(entry.Xattrs, Xattr{Name: name, Value: []byte(value)})
+			}
+		}
+		sort.Slice(entry.Xattrs, func(i, j int) bool { return entry.Xattrs[i].Name < entry.Xattrs[j].Name })
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			entry.Type = EntryFile
+		case tar.TypeDir:
+			entry.Type = EntryDir
+		case tar.TypeSymlink:
+			entry.Type = EntrySymlink
+		case tar.TypeLink:
+			entry.Type = EntryHardlink
+		default:
+			entry.Type = EntryOther
+		}
+		if err := fn(entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(archivePath string, consumed *int64, fn func(entry ArchiveEntry, content io.Reader) error) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, file := range zr.File {
+		mode := file.Mode()
+		entry := ArchiveEntry{
+			Name:           strings.TrimSuffix(file.Name, "/"),
+			Size:           int64(file.UncompressedSize64),
+			CompressedSize: int64(file.CompressedSize64),
+			Mode:           mode,
+			ModTime:        file.Modified,
+		}
+		switch {
+		case mode.IsDir() || strings.HasSuffix(file.Name, "/"):
+			entry.Type = EntryDir
+		case mode&os.ModeSymlink != 0:
+			entry.Type = EntrySymlink
+		case mode.IsRegular():
+			entry.Type = EntryFile
+		default:
+			entry.Type = EntryOther
+		}
+
+		err := func() error {
+			rc, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			if entry.Type == EntrySymlink {
+				// Zip stores the link target as the entry's content
+				target, err := io.ReadAll(io.LimitReader(rc, 4096))
+				if err != nil {
+					return err
+				}
+				entry.Linkname = string(target)
+				return fn(entry, strings.NewReader(""))
+			}
+			return fn(entry, rc)
+		}()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+		*consumed += int64(file.CompressedSize64)
+	}
+	return nil
+}
+
+// ListArchive returns the entries of an archive without extracting it
+func ListArchive(archivePath string) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	err := walkArchive(archivePath, nil, func(entry ArchiveEntry, _ io.Reader) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// TestArchive reads every entry to the end, which verifies the CRCs of zip
+// entries and the checksums of compressed tar streams, and checks that no
+// entry would escape the destination when extracted
+func TestArchive(archivePath string) (ArchiveStats, error) {
+	var stats ArchiveStats
+	var problems []error
+	err := walkArchive(archivePath, nil, func(entry ArchiveEntry, content io.Reader) error {
+		if _, err := safeEntryPath(entry.Name); err != nil {
+			problems = append(problems, err)
+		}
+		if entry.Type == EntrySymlink || entry.Type == EntryHardlink {
+			if err := checkLinkTarget(entry); err != nil {
+				problems = append(problems, err)
+			}
+		}
+		n, err := io.Copy(io.Discard, content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name, err)
+		}
+		stats.Entries++
+		stats.Bytes += n
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	return stats, errors.Join(problems...)
+}
+
+// safeEntryPath cleans an entry name and refuses absolute names and names
+// that climb out of the destination, the "zip slip" attack
+func safeEntryPath(name string) (string, error) {
+	cleaned := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: entry %q escapes the destination", ErrUnsafeArchive, name)
+	}
+	return cleaned, nil
+}
+
+// checkLinkTarget refuses links whose target lies outside the destination
+func checkLinkTarget(entry ArchiveEntry) error {
+	target := entry.Linkname
+	if entry.Type == EntrySymlink && !path.IsAbs(target) {
+		// Symlink targets are relative to the link's directory
+		target = path.Join(path.Dir(entry.Name), target)
+	}
+	if _, err := safeEntryPath(target); err != nil || path.IsAbs(entry.Linkname) {
+		return fmt.Errorf("%w: link %q points outside the destination (%s)", ErrUnsafeArchive, entry.Name, entry.Linkname)
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package fileops
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// zipBufferLimit is the largest file whose zip entry is compressed in memory
+// by a worker; bigger files are compressed by the writer as they are stored
+const zipBufferLimit = 32 << 20
+
+// ArchiveOptions controls CreateArchive and ExtractArchive
+type ArchiveOptions struct {
+	Workers   int                     // Zip entries compressed in parallel, the number of CPUs by default
+	Progress  func(done, total int64) // Called after every entry
+	Overwrite bool                    // Replace an existing archive, or existing files when extracting
+	Xattrs    bool                    // Store extended attributes in tar archives, and restore those of the user namespace
+	Limits    ExtractLimits
+	Replace   func(path string) error // Called instead of deleting a file that extracting with Overwrite replaces
+	Only      string                  // Extract only this slash-separated entry and what lies beneath it
+}
+
+type archiveSource struct {
+	path string
+	name string // Slash-separated name inside the archive
+	info os.FileInfo
+	link string
+}
+
+// collectArchiveSources walks the sources without following symlinks. Each
+// source is stored under its own base name, so "a/b" becomes "b/...".
+func collectArchiveSources(archivePath string, sources []string) ([]archiveSource, int64, error) {
+	archiveAbs, _ := filepath.Abs(archivePath)
+	var items []archiveSource
+	var total int64
+	for _, source := range sources {
+		source = filepath.Clean(source)
+		base := filepath.Dir(source)
+		err := filepath.WalkDir(source, func(p string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if abs, _ := filepath.Abs(p); abs == archiveAbs {
+				return nil
+			}
+			info, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(base, p)
+			if err != nil {
+				return err
+			}
+			item := archiveSource{path: p, name: filepath.ToSlash(rel), info: info}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				if item.link, err = os.Readlink(p); err != nil {
+					return err
+				}
+			case info.Mode().IsRegular():
+				total += info.Size()
+			case !info.IsDir():
+				// Sockets, devices and FIFOs cannot be archived portably
+				return nil
+			}
+			items = append(items, item)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return items, total, nil
+}
+
+// CreateArchive stores the sources, recursively, in a new archive whose
+// format follows from its name. Permissions, modification times and
+// symlinks are kept. The archive is written to a temporary file first, so a
+// failure never leaves a truncated archive behind.
+func CreateArchive(archivePath string, sources []string, opts ArchiveOptions) (ArchiveStats, error) {
+	format, err := DetectArchiveFormat(archivePath)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	if format == FormatTarBz2 {
+		return ArchiveStats{}, errors.New("creating tar.bz2 archives is not supported; use tar.gz")
+	}
+	if format == FormatZip && opts.Xattrs {
+		return ArchiveStats{}, errors.New("extended attributes can only be stored in tar archives")
+	}
+	if _, err := os.Lstat(archivePath); err == nil && !opts.Overwrite {
+		return ArchiveStats{}, fmt.Errorf("%s: %w", archivePath, os.ErrExist)
+	}
+
+	items, total, err := collectArchiveSources(archivePath, sources)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(archivePath), "."+filepath.Base(archivePath)+".*")
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var stats ArchiveStats
+	if format == FormatZip {
+		stats, err = writeZip(tmp, items, total, opts)
+	} else {
+		stats, err = writeTar(tmp, format, items, total, opts)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return stats, err
+	}
+	return stats, os.Rename(tmp.Name(), archivePath)
+}
+
+func writeTar(w io.Writer, format ArchiveFormat, items []archiveSource, total int64, opts ArchiveOptions) (ArchiveStats, error) {
+	var stats ArchiveStats
+	out := w
+	var gz *gzip.Writer
+	if format == FormatTarGz {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+
+	for _, item := range items {
+		header, err := tar.FileInfoHeader(item.info, item.link)
+		if err != nil {
+			return stats, err
+		}
+		header.Name = item.name
+		if item.info.IsDir() {
+			header.Name += "/"
+		}
+		if opts.Xattrs && item.link == "" {
+			if err := addXattrRecords(header, item.path); err != nil {
+				return stats, err
+			}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return stats, err
+		}
+		if item.info.Mode().IsRegular() {
+			n, err := copyFileTo(tw, item.path)
+			if err != nil {
+				return stats, err
+			}
+			stats.Bytes += n
+		}
+		stats.Entries++
+		if opts.Progress != nil {
+			opts.Progress(stats.Bytes, total)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	if gz != nil {
+		return stats, gz.Close()
+	}
+	return stats, nil
+}
+
+// xattrRecordPrefix starts the PAX records GNU tar and bsdtar keep extended attributes in
+const xattrRecordPrefix = "SCHILY.xattr."
+
+// addXattrRecords stores the extended attributes of path in header
+func addXattrRecords(header *tar.Header, path string) error {
+	attrs, err := ReadXattrs(path)
+	if errors.Is(err, ErrXattrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[xattrRecordPrefix+attr.Name] = string(attr.Value)
+	}
+	return nil
+}
+
+func copyFileTo(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// zipJob is a zip entry, compressed ahead of time by a worker when small enough
+type zipJob struct {
+	item   archiveSource
+	header *zip.FileHeader
+	data   []byte // Deflated content, nil when the writer compresses the file itself
+	err    error
+	done   chan struct{}
+}
+
+// writeZip compresses file entries in parallel into memory and stores them
+// in their original order. At most a few entries per worker are buffered at
+// a time, and files over zipBufferLimit are compressed while being written.
+func writeZip(w io.Writer, items []archiveSource, total int64, opts ArchiveOptions) (ArchiveStats, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	jobs := make([]*zipJob, len(items))
+	for i, item := range items {
+		jobs[i] = &zipJob{item: item, done: make(chan struct{})}
+	}
+
+	// window bounds the jobs that are compressed but not yet written
+	window := make(chan struct{}, workers*2)
+	queue := make(chan *zipJob)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job.header, job.data, job.err = prepareZipEntry(job.item)
+				close(job.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case queue <- job:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	var stats ArchiveStats
+	zw := zip.NewWriter(w)
+	for _, job := range jobs {
+		<-job.done
+		<-window
+		if job.err != nil {
+			return stats, job.err
+		}
+		n, err := writeZipEntry(zw, job)
+		job.data = nil
+		if err != nil {
+			return stats, err
+		}
+		stats.Entries++
+		stats.Bytes += n
+		if opts.Progress != nil {
+			opts.Progress(stats.Bytes, total)
+		}
+	}
+	return stats, zw.Close()
+}
+
+// prepareZipEntry builds the header of an entry and deflates small files
+func prepareZipEntry(item archiveSource) (*zip.FileHeader, []byte, error) {
+	header, err := zip.FileInfoHeader(item.info)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Name = item.name
+	switch {
+	case item.info.IsDir():
+		header.Name += "/"
+		header.Method = zip.Store
+		return header, nil, nil
+	case item.link != "":
+		// Zip keeps the target of a symlink as the entry's content
+		header.Method = zip.Store
+		return header, nil, nil
+	case item.info.Size() > zipBufferLimit:
+		header.Method = zip.Deflate
+		return header, nil, nil
+	}
+
+	f, err := os.Open(item.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(fw, crc), f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, nil, err
+	}
+	header.Method = zip.Deflate
+	header.CRC32 = crc.Sum32()
+	header.UncompressedSize64 = uint64(n)
+	header.CompressedSize64 = uint64(buf.Len())
+	return header, buf.Bytes(), nil
+}
+
+func writeZipEntry(zw *zip.Writer, job *zipJob) (int64, error) {
+	if job.data != nil {
+		w, err := zw.CreateRaw(job.header)
+		if err != nil {
+			return 0, err
+		}
+		_, err = w.Write(job.data)
+		return int64(job.header.UncompressedSize64), err
+	}
+
+	w, err := zw.CreateHeader(job.header)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case job.item.link != "":
+		_, err = io.Copy(w, strings.NewReader(job.item.link))
+		return 0, err
+	case job.item.info.Mode().IsRegular():
+		return copyFileTo(w, job.item.path)
+	}
+	return 0, nil
+}
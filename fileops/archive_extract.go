@@ -0,0 +1,429 @@
+package fileops
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExtractLimits protects against decompression bombs. Zero fields take the
+// value from DefaultExtractLimits and negative ones disable the check.
+type ExtractLimits struct {
+	MaxBytes   int64   // Total bytes written
+	MaxEntries int     // Number of entries
+	MaxRatio   float64 // Bytes written per byte of archive, checked beyond the first MiB
+}
+
+// DefaultExtractLimits allows ordinary archives while stopping bombs early
+var DefaultExtractLimits = ExtractLimits{
+	MaxBytes:   16 << 30,
+	MaxEntries: 1000000,
+	MaxRatio:   200,
+}
+
+// ratioAllowance is the output size below which MaxRatio is not enforced,
+// since tiny archives of repetitive data legitimately have huge ratios
+const ratioAllowance = 1 << 20
+
+// budget returns the number of bytes an archive of the given size may expand to
+func (l ExtractLimits) budget(archiveSize int64) int64 {
+	maxBytes, maxRatio := l.MaxBytes, l.MaxRatio
+	if maxBytes == 0 {
+		maxBytes = DefaultExtractLimits.MaxBytes
+	}
+	if maxRatio == 0 {
+		maxRatio = DefaultExtractLimits.MaxRatio
+	}
+	budget := int64(-1)
+	if maxBytes > 0 {
+		budget = maxBytes
+	}
+	if maxRatio > 0 {
+		byRatio := int64(float64(archiveSize) * maxRatio)
+		if byRatio < ratioAllowance {
+			byRatio = ratioAllowance
+		}
+		if budget < 0 || byRatio < budget {
+			budget = byRatio
+		}
+	}
+	return budget
+}
+
+func (l ExtractLimits) maxEntries() int {
+	if l.MaxEntries == 0 {
+		return DefaultExtractLimits.MaxEntries
+	}
+	return l.MaxEntries
+}
+
+// ExtractStats summarises a finished extraction
+type ExtractStats struct {
+	ArchiveStats
+	Skipped int      // Devices, FIFOs and other entries that are never extracted
+	Created []string // Outermost paths created or replaced in the destination, none after a failure
+}
+
+type extractedDir struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// ExtractArchive unpacks an archive into dest, which is created if needed.
+// Entries that would land outside dest, through their names, through links
+// or through symlinked directories extracted earlier, are refused, and the
+// extraction stops once it exceeds opts.Limits. Existing files are only
+// replaced with opts.Overwrite; existing directories are merged into.
+// Set-user-ID and similar bits are not restored.
+func ExtractArchive(archivePath, dest string, opts ArchiveOptions) (ExtractStats, error) {
+	var stats ExtractStats
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return stats, err
+	}
+	_, statErr := os.Lstat(dest)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return stats, err
+	}
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return stats, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return stats, err
+	}
+
+	budget := opts.Limits.budget(info.Size())
+	maxEntries := opts.Limits.maxEntries()
+	created := map[string]bool{} // Slash-separated names that did not exist before
+	var dirs []extractedDir
+	var made, links []string // Everything created, in order, and the symlinks among it
+
+	var consumed int64
+	err = walkArchive(archivePath, &consumed, func(entry ArchiveEntry, content io.Reader) error {
+		stats.Entries++
+		if maxEntries > 0 && stats.Entries > maxEntries {
+			return fmt.Errorf("%w: more than %d entries", ErrUnsafeArchive, maxEntries)
+		}
+		if entry.Type == EntryOther {
+			stats.Skipped++
+			return nil
+		}
+		if !opts.Xattrs {
+			entry.Xattrs = nil
+		}
+		rel, err := safeEntryPath(entry.Name)
+		if err != nil {
+			return err
+		}
+		if rel == "." || (opts.Only != "" && rel != opts.Only && !strings.HasPrefix(rel, opts.Only+"/")) {
+			return nil
+		}
+		target := filepath.Join(root, filepath.FromSlash(rel))
+		if !holds(created, rel) {
+			if name := missingPrefix(root, rel); name != "" {
+				created[name] = true
+			}
+		}
+		if err := prepareParent(root, target, &made); err != nil {
+			return err
+		}
+		// A file that was there before the extraction goes to opts.Replace,
+		// and one the extraction wrote itself is simply removed
+		makeRoom := func() error {
+			if holds(created, rel) {
+				return clearTarget(target, opts.Overwrite, nil)
+			}
+			if err := clearTarget(target, opts.Overwrite, opts.Replace); err != nil {
+				return err
+			}
+			if _, err := os.Lstat(target); os.IsNotExist(err) {
+				created[rel] = true
+			}
+			return nil
+		}
+
+		switch entry.Type {
+		case EntryDir:
+			if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+				dirs = append(dirs, extractedDir{target, entry.Mode.Perm(), entry.ModTime})
+				return restoreXattrs(target, entry.Xattrs)
+			}
+			if err := makeRoom(); err != nil {
+				return err
+			}
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			made = append(made, target)
+			dirs = append(dirs, extractedDir{target, entry.Mode.Perm(), entry.ModTime})
+			if err := restoreXattrs(target, entry.Xattrs); err != nil {
+				return err
+			}
+		case EntryFile:
+			if err := makeRoom(); err != nil {
+				return err
+			}
+			remaining := int64(-1)
+			if budget >= 0 {
+				remaining = budget - stats.Bytes
+			}
+			n, err := writeEntryFile(target, content, entry, remaining)
+			stats.Bytes += n
+			if _, statErr := os.Lstat(target); statErr == nil {
+				made = append(made, target)
+			}
+			if err != nil {
+				return err
+			}
+		case EntrySymlink:
+			if err := checkLinkTarget(entry); err != nil {
+				return err
+			}
+			if err := checkExtractedLink(root, target, entry.Linkname); err != nil {
+				return err
+			}
+			if err := makeRoom(); err != nil {
+				return err
+			}
+			if err := os.Symlink(entry.Linkname, target); err != nil {
+				return err
+			}
+			made = append(made, target)
+			links = append(links, target)
+		case EntryHardlink:
+			if err := checkLinkTarget(entry); err != nil {
+				return err
+			}
+			linked, _ := safeEntryPath(entry.Linkname)
+			source, err := ResolvePath(filepath.Join(root, filepath.FromSlash(linked)), true)
+			if err != nil {
+				return err
+			}
+			if !IsWithin(root, source) {
+				return fmt.Errorf("%w: link %q points outside the destination (%s)", ErrUnsafeArchive, entry.Name, entry.Linkname)
+			}
+			if existing, err := os.Lstat(source); err != nil || !existing.Mode().IsRegular() {
+				return fmt.Errorf("%s: hard link to missing file %s", entry.Name, entry.Linkname)
+			}
+			if err := makeRoom(); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			made = append(made, target)
+		}
+		if opts.Progress != nil {
+			opts.Progress(consumed, info.Size())
+		}
+		return nil
+	})
+
+	// A symlink that pointed inside when it was made may lead out through
+	// links extracted after it, so every one is checked again at the end
+	if err == nil {
+		for _, link := range links {
+			target, _ := os.Readlink(link)
+			if err = checkExtractedLink(root, link, target); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// Nothing of a failed extraction is left behind, newest first so
+		// directories are empty when their turn comes
+		for i := len(made) - 1; i >= 0; i-- {
+			os.Remove(made[i])
+		}
+		if os.IsNotExist(statErr) {
+			os.Remove(dest)
+		}
+		return stats, err
+	}
+
+	// Directories were created writable; give them their own mode and time
+	// last, deepest first, so extracting into them worked
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i].path) > len(dirs[j].path) })
+	for _, dir := range dirs {
+		if dir.mode != 0 {
+			os.Chmod(dir.path, dir.mode)
+		}
+		if !dir.modTime.IsZero() {
+			os.Chtimes(dir.path, dir.modTime, dir.modTime)
+		}
+	}
+
+	for name := range created {
+		stats.Created = append(stats.Created, filepath.Join(dest, filepath.FromSlash(name)))
+	}
+	sort.Strings(stats.Created)
+	return stats, err
+}
+
+// prepareParent creates the parent directories of target one at a time,
+// checking before each step that the path so far resolves inside root, so an
+// extracted symlink cannot redirect later entries elsewhere. Directories it
+// creates are added to made.
+func prepareParent(root, target string, made *[]string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(next)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(next, 0755); err != nil {
+				return err
+			}
+			*made = append(*made, next)
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			resolved, err := filepath.EvalSymlinks(next)
+			if err != nil {
+				return err
+			}
+			if !IsWithin(root, resolved) {
+				return fmt.Errorf("%w: %s resolves outside the destination", ErrUnsafeArchive, target)
+			}
+			next = resolved
+		case !info.IsDir():
+			return fmt.Errorf("%s: not a directory", next)
+		}
+		current = next
+	}
+	return nil
+}
+
+// checkExtractedLink refuses a symlink at link whose target, resolved
+// through the files already extracted the way the kernel would, lies
+// outside root
+func checkExtractedLink(root, link, target string) error {
+	resolved, err := ResolvePath(filepath.Dir(link)+string(filepath.Separator)+filepath.FromSlash(target), true)
+	if err != nil || !IsWithin(root, resolved) {
+		return fmt.Errorf("%w: link %s points outside the destination (%s)", ErrUnsafeArchive, link, target)
+	}
+	return nil
+}
+
+// clearTarget removes an existing non-directory so it can be replaced.
+// Removing rather than truncating also avoids writing through a symlink.
+func clearTarget(target string, overwrite bool, replace func(string) error) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !overwrite {
+		return fmt.Errorf("%s: %w", target, os.ErrExist)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: is a directory", target)
+	}
+	if replace != nil {
+		return replace(target)
+	}
+	return os.Remove(target)
+}
+
+// holds reports whether name or a directory above it is in names
+func holds(names map[string]bool, name string) bool {
+	for {
+		if names[name] {
+			return true
+		}
+		i := strings.LastIndexByte(name, '/')
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+// missingPrefix returns the outermost part of the slash-separated name that
+// does not exist below root, or "" when all of it does
+func missingPrefix(root, name string) string {
+	if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name))); err == nil {
+		return ""
+	}
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && name[i] != '/' {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name[:i]))); os.IsNotExist(err) {
+			return name[:i]
+		}
+	}
+	return ""
+}
+
+// writeEntryFile writes at most limit bytes (no limit when negative) and
+// fails once the content turns out to be larger
+func writeEntryFile(target string, content io.Reader, entry ArchiveEntry, limit int64) (int64, error) {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if limit >= 0 {
+		n, err = io.Copy(f, io.LimitReader(content, limit+1))
+		if err == nil && n > limit {
+			err = fmt.Errorf("%w: %s expands beyond the extraction limit", ErrUnsafeArchive, entry.Name)
+		}
+	} else {
+		n, err = io.Copy(f, content)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+		return n, err
+	}
+
+	if err := restoreXattrs(target, entry.Xattrs); err != nil {
+		return n, err
+	}
+	if err := os.Chmod(target, entry.Mode.Perm()); err != nil {
+		return n, err
+	}
+	if !entry.ModTime.IsZero() {
+		os.Chtimes(target, entry.ModTime, entry.ModTime)
+	}
+	return n, nil
+}
+
+// restoreXattrs sets the extended attributes of the user namespace on
+// target. Other namespaces grant privileges or change access, so they are
+// never taken from an archive; a file system without attributes loses them.
+func restoreXattrs(target string, attrs []Xattr) error {
+	for _, attr := range attrs {
+		if !IsUserXattr(attr.Name) {
+			continue
+		}
+		err := SetXattr(target, attr.Name, attr.Value)
+		if errors.Is(err, ErrXattrUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
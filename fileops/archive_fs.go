@@ -0,0 +1,382 @@
+package fileops
+
+import (
+	"archive/zip"
+	"errors"
+	"fmsh/vfs"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrArchiveReadOnly is returned for attempts to modify the contents of an archive
+var ErrArchiveReadOnly = errors.New("archive contents are read-only; copy files out or extract the archive")
+
+// SplitArchivePath finds the archive that p lies in, such as "build.zip" in
+// "build.zip/bin/tool", and returns its path and the slash-separated path
+// inside it, "." for the archive itself. Only existing regular files with an
+// archive extension count, so a directory named "x.zip" is a directory.
+func SplitArchivePath(p string) (string, string, bool) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", "", false
+	}
+	for current := p; ; current = filepath.Dir(current) {
+		if _, err := DetectArchiveFormat(current); err == nil {
+			if info, err := os.Stat(current); err == nil && info.Mode().IsRegular() {
+				rel, _ := filepath.Rel(current, p)
+				return current, filepath.ToSlash(rel), true
+			}
+		}
+		if filepath.Dir(current) == current {
+			return "", "", false
+		}
+	}
+}
+
+type archiveNode struct {
+	entry    ArchiveEntry
+	children []string // Sorted base names
+	zipFile  *zip.File
+}
+
+// ArchiveFS presents an archive as a read-only vfs.FS. The entries are
+// indexed when it is opened; directories that the archive only implies are
+// added, and symlinks are followed as long as they stay inside the archive.
+// Zip entries are read directly, tar entries by scanning to them.
+type ArchiveFS struct {
+	path    string
+	format  ArchiveFormat
+	modTime time.Time
+	nodes   map[string]*archiveNode
+	zip     *zip.ReadCloser
+}
+
+// OpenArchiveFS indexes the archive at archivePath
+func OpenArchiveFS(archivePath string) (*ArchiveFS, error) {
+	format, err := DetectArchiveFormat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	a := &ArchiveFS{
+		path:    archivePath,
+		format:  format,
+		modTime: info.ModTime(),
+		nodes:   map[string]*archiveNode{},
+	}
+	a.nodes["."] = &archiveNode{entry: ArchiveEntry{Name: ".", Type: EntryDir, Mode: fs.ModeDir | 0755, ModTime: info.ModTime()}}
+
+	entries, err := ListArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		a.add(entry)
+	}
+	if format == FormatZip {
+		if a.zip, err = zip.OpenReader(archivePath); err != nil {
+			return nil, err
+		}
+		for _, file := range a.zip.File {
+			if name, err := safeEntryPath(file.Name); err == nil {
+				if node := a.nodes[name]; node != nil && node.entry.Type == EntryFile {
+					node.zipFile = file
+				}
+			}
+		}
+	}
+	for _, node := range a.nodes {
+		sort.Strings(node.children)
+	}
+	return a, nil
+}
+
+// add indexes an entry and the directories above it. Entries whose names
+// escape the archive are left out, as extraction would refuse them.
+func (a *ArchiveFS) add(entry ArchiveEntry) {
+	name, err := safeEntryPath(entry.Name)
+	if err != nil || name == "." {
+		return
+	}
+	entry.Name = name
+	if entry.Type == EntryDir {
+		entry.Mode |= fs.ModeDir
+	}
+	if node, ok := a.nodes[name]; ok {
+		// A later entry replaces an earlier one, as it would when extracting
+		node.entry = entry
+		return
+	}
+	a.nodes[name] = &archiveNode{entry: entry}
+
+	for child := name; child != "."; {
+		parent := path.Dir(child)
+		node, ok := a.nodes[parent]
+		if !ok {
+			node = &archiveNode{entry: ArchiveEntry{Name: parent, Type: EntryDir, Mode: fs.ModeDir | 0755, ModTime: a.modTime}}
+			a.nodes[parent] = node
+		}
+		node.children = append(node.children, path.Base(child))
+		if ok {
+			break
+		}
+		child = parent
+	}
+}
+
+// Path returns the path of the archive file
+func (a *ArchiveFS) Path() string {
+	return a.path
+}
+
+// Close releases the archive
+func (a *ArchiveFS) Close() error {
+	if a.zip != nil {
+		return a.zip.Close()
+	}
+	return nil
+}
+
+// lookup finds a node, following symlinks unless follow is false for the last element
+func (a *ArchiveFS) lookup(op, name string, follow bool) (*archiveNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	current := name
+	for hops := 0; hops < 40; hops++ {
+		node, ok := a.nodes[current]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if node.entry.Type != EntrySymlink || !follow {
+			return node, nil
+		}
+		target := node.entry.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(current), target)
+		}
+		if current, ok = cleanInside(target); !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("symlink points outside the archive")}
+		}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+}
+
+func cleanInside(target string) (string, bool) {
+	cleaned, err := safeEntryPath(target)
+	return cleaned, err == nil
+}
+
+// Stat returns information about a file, following symlinks
+func (a *ArchiveFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := a.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return archiveInfo{node.entry}, nil
+}
+
+// Lstat returns information about a file without following a final symlink
+func (a *ArchiveFS) Lstat(name string) (fs.FileInfo, error) {
+	node, err := a.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return archiveInfo{node.entry}, nil
+}
+
+// ReadLink returns the target of a symlink
+func (a *ArchiveFS) ReadLink(name string) (string, error) {
+	node, err := a.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.entry.Type != EntrySymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.entry.Linkname, nil
+}
+
+// ReadDir lists a directory in name order
+func (a *ArchiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := a.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.entry.Type != EntryDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.DirEntry, 0, len(node.children))
+	for _, child := range node.children {
+		entries = append(entries, fs.FileInfoToDirEntry(archiveInfo{a.nodes[path.Join(node.entry.Name, child)].entry}))
+	}
+	return entries, nil
+}
+
+// Open opens a file or directory for reading
+func (a *ArchiveFS) Open(name string) (fs.File, error) {
+	node, err := a.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	file := &archiveFile{fsys: a, node: node, name: name}
+	switch node.entry.Type {
+	case EntryDir:
+	case EntryFile:
+		if node.zipFile != nil {
+			file.content, err = node.zipFile.Open()
+		} else {
+			file.content, err = a.openTarEntry(node.entry.Name)
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	case EntryHardlink:
+		target, ok := cleanInside(node.entry.Linkname)
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return a.Open(target)
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("not a regular file")}
+	}
+	return file, nil
+}
+
+// OpenFile opens a file for reading; any flag that would modify the archive is refused
+func (a *ArchiveFS) OpenFile(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnly("open", name)
+	}
+	f, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*archiveFile), nil
+}
+
+func readOnly(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: ErrArchiveReadOnly}
+}
+
+func (a *ArchiveFS) Mkdir(name string, perm fs.FileMode) error { return readOnly("mkdir", name) }
+func (a *ArchiveFS) Rename(oldname, newname string) error      { return readOnly("rename", oldname) }
+func (a *ArchiveFS) Remove(name string) error                  { return readOnly("remove", name) }
+func (a *ArchiveFS) Chmod(name string, mode fs.FileMode) error { return readOnly("chmod", name) }
+func (a *ArchiveFS) Symlink(target, name string) error         { return readOnly("symlink", name) }
+
+func (a *ArchiveFS) Chtimes(name string, atime, mtime time.Time) error {
+	return readOnly("chtimes", name)
+}
+
+// errFound stops the archive scan of openTarEntry
+var errFound = errors.New("entry found")
+
+// openTarEntry streams one entry by scanning the tar stream in the background
+func (a *ArchiveFS) openTarEntry(name string) (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	go func() {
+		err := walkArchive(a.path, nil, func(entry ArchiveEntry, content io.Reader) error {
+			if cleaned, ok := cleanInside(entry.Name); !ok || cleaned != name {
+				return nil
+			}
+			if _, err := io.Copy(w, content); err != nil {
+				return err
+			}
+			return errFound
+		})
+		if err == nil {
+			err = fs.ErrNotExist
+		} else if err == errFound {
+			err = nil
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+type archiveFile struct {
+	fsys    *ArchiveFS
+	node    *archiveNode
+	name    string
+	content io.ReadCloser
+	listed  int
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return archiveInfo{f.node.entry}, nil
+}
+
+func (f *archiveFile) Read(p []byte) (int, error) {
+	if f.content == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	return f.content.Read(p)
+}
+
+func (f *archiveFile) Write(p []byte) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+func (f *archiveFile) Close() error {
+	if f.content != nil {
+		return f.content.Close()
+	}
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile
+func (f *archiveFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := f.fsys.ReadDir(f.node.entry.Name)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[f.listed:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	f.listed += len(entries)
+	return entries, nil
+}
+
+// archiveInfo adapts an ArchiveEntry to fs.FileInfo
+type archiveInfo struct {
+	entry ArchiveEntry
+}
+
+func (i archiveInfo) Name() string {
+	return path.Base(i.entry.Name)
+}
+
+func (i archiveInfo) Size() int64 {
+	return i.entry.Size
+}
+
+func (i archiveInfo) Mode() fs.FileMode {
+	return i.entry.Mode
+}
+
+func (i archiveInfo) ModTime() time.Time {
+	return i.entry.ModTime
+}
+
+func (i archiveInfo) IsDir() bool {
+	return i.entry.Type == EntryDir
+}
+
+func (i archiveInfo) Sys() any {
+	return nil
+}
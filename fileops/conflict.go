@@ -0,0 +1,132 @@
+package fileops
+
+import (
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when a destination already exists
+type ConflictPolicy int
+
+const (
+	Overwrite   ConflictPolicy = iota // Replace the destination
+	NoClobber                         // Keep the destination and skip the source
+	Update                            // Replace only when the source is newer
+	Backup                            // Rename the destination with a suffix, then replace it
+	Interactive                       // Ask before replacing
+	AutoRename                        // Write the source under a free name such as "a (1).txt"
+)
+
+// DefaultBackupSuffix is appended to destinations saved by the Backup policy
+const DefaultBackupSuffix = "~"
+
+// ConflictOptions configures conflict handling for copy and move operations
+type ConflictOptions struct {
+	Policy       ConflictPolicy
+	BackupSuffix string                     // Suffix for Backup, DefaultBackupSuffix when empty
+	Ask          func(src, dst string) bool // Answers Interactive prompts
+}
+
+// Resolve applies the policy to a destination that may exist. It returns the
+// path to write, or false when the source must be skipped. Directories are
+// merged into existing directories rather than treated as conflicts.
+func (o ConflictOptions) Resolve(src string, srcInfo os.FileInfo, dst string) (string, bool, error) {
+	return o.ResolveFS(vfs.Host, src, srcInfo, dst)
+}
+
+// ResolveFS is Resolve for a destination in fsys
+func (o ConflictOptions) ResolveFS(fsys vfs.FS, src string, srcInfo os.FileInfo, dst string) (string, bool, error) {
+	target, ok, backup, err := o.decide(fsys, src, srcInfo, dst)
+	if err == nil && backup {
+		err = o.backup(fsys, target)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return target, ok, nil
+}
+
+// decide is ResolveFS without touching the file system. When backup is true
+// the existing destination must be saved with o.backup before it is written,
+// which callers that plan ahead do only right before writing each file.
+func (o ConflictOptions) decide(fsys vfs.FS, src string, srcInfo os.FileInfo, dst string) (target string, ok, backup bool, err error) {
+	dstInfo, err := fsys.Lstat(dst)
+	if os.IsNotExist(err) {
+		return dst, true, false, nil
+	}
+	if err != nil {
+		return "", false, false, err
+	}
+	if srcInfo.IsDir() && dstInfo.IsDir() {
+		return dst, true, false, nil
+	}
+
+	if o.Policy == AutoRename {
+		return UniqueNameFS(fsys, dst), true, false, nil
+	}
+	if dstInfo.IsDir() != srcInfo.IsDir() {
+		return "", false, false, fmt.Errorf("cannot overwrite %s with %s: one is a directory", dst, src)
+	}
+
+	switch o.Policy {
+	case NoClobber:
+		return "", false, false, nil
+	case Update:
+		if !srcInfo.ModTime().After(dstInfo.ModTime()) {
+			return "", false, false, nil
+		}
+	case Backup:
+		return dst, true, true, nil
+	case Interactive:
+		if o.Ask == nil || !o.Ask(src, dst) {
+			return "", false, false, nil
+		}
+	}
+	return dst, true, false, nil
+}
+
+// backup renames dst with the backup suffix
+func (o ConflictOptions) backup(fsys vfs.FS, dst string) error {
+	suffix := o.BackupSuffix
+	if suffix == "" {
+		suffix = DefaultBackupSuffix
+	}
+	return fsys.Rename(dst, dst+suffix)
+}
+
+// restore puts back a destination saved by backup when writing it failed
+func (o ConflictOptions) restore(fsys vfs.FS, dst string) error {
+	suffix := o.BackupSuffix
+	if suffix == "" {
+		suffix = DefaultBackupSuffix
+	}
+	return fsys.Rename(dst+suffix, dst)
+}
+
+// UniqueName returns path, or the first of "name (1).ext", "name (2).ext", ... that does not exist
+func UniqueName(path string) string {
+	return UniqueNameFS(vfs.Host, path)
+}
+
+// UniqueNameFS is UniqueName for a name in fsys
+func UniqueNameFS(fsys vfs.FS, path string) string {
+	if _, err := fsys.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+
+	dir, base := vfs.Split(fsys, path)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = "" // Dot files such as ".bashrc" have no extension
+	}
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		candidate := vfs.Join(fsys, dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		if _, err := fsys.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
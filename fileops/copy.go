@@ -0,0 +1,678 @@
+// Package fileops implements the file operations shared by several fmsh
+// commands, such as the parallel copy engine.
+package fileops
+
+import (
+	"errors"
+	"fmsh/vfs"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultChunkSize is the size above which a file is copied in parallel chunks
+const DefaultChunkSize = 64 << 20
+
+// ErrInsufficientSpace is returned when the destination cannot hold the copy
+var ErrInsufficientSpace = errors.New("not enough free space on destination")
+
+// ErrCanceled is returned by operations stopped through their Cancel channel
+var ErrCanceled = errors.New("operation canceled")
+
+// CopyOptions controls how Copy duplicates files and trees
+type CopyOptions struct {
+	Recursive         bool                    // Copy directories and everything beneath them
+	Workers           int                     // Files copied in parallel, the number of CPUs by default
+	ChunkSize         int64                   // Files larger than this are split into chunks copied in parallel
+	PreserveOwnership bool                    // Copy owner and group; silently skipped without the privilege
+	PreserveXattrs    bool                    // Copy extended attributes of files and directories
+	Progress          func(done, total int64) // Called periodically with the bytes copied so far
+	Conflict          ConflictOptions         // What to do with destinations that already exist
+	Verify            bool                    // Compare checksums of every copied file with its source
+	Cancel            <-chan struct{}         // Stops the copy between files and chunks when closed
+	Replace           func(dst string) error  // Called by Copy right before an existing destination is overwritten, which it may move away
+}
+
+// canceled reports whether the copy was asked to stop
+func (o CopyOptions) canceled() bool {
+	select {
+	case <-o.Cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// CopyStats summarises a finished copy
+type CopyStats struct {
+	Target   string // Final destination, which differs from the requested one after an automatic rename
+	Files    int
+	Dirs     int
+	Symlinks int
+	Bytes    int64
+	Skipped  int      // Sources left alone because of the conflict policy
+	Resumed  int      // Large files continued from an interrupted copy
+	Verified int      // Files whose checksum matched the source
+	Created  []string // Outermost paths written where nothing was, or where a destination was replaced or backed up
+	BackedUp []string // Destinations renamed with the backup suffix
+}
+
+type copyEntry struct {
+	src     string
+	dst     string
+	info    os.FileInfo
+	backup  bool // The existing destination is saved by the Backup policy before it is written
+	replace bool // The existing destination is overwritten
+	outer   bool // No directory made by the copy holds dst, so it is listed in CopyStats.Created
+}
+
+type copyPlan struct {
+	target    string
+	skipped   int
+	dirs      []copyEntry
+	files     []copyEntry
+	links     []copyEntry
+	bytes     int64 // Apparent size of all files
+	allocated int64 // Blocks actually used, which is less for sparse files
+}
+
+// CopyTarget returns where src ends up when copied to dest: inside dest when
+// it is an existing directory, otherwise dest itself
+func CopyTarget(src, dest string) string {
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		return filepath.Join(dest, filepath.Base(filepath.Clean(src)))
+	}
+	return dest
+}
+
+// Copy copies src to dst, which must be the final path of the copy.
+// Directories require opts.Recursive. Symlinks inside a tree are recreated
+// rather than followed, while a symlink named directly is followed unless
+// the copy is recursive.
+func Copy(src, dst string, opts CopyOptions) (CopyStats, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+
+	plan, err := planCopy(src, dst, opts)
+	if err != nil {
+		return CopyStats{}, err
+	}
+	if err := checkFreeSpace(plan.target, plan.allocated); err != nil {
+		return CopyStats{}, err
+	}
+
+	c := &copier{opts: opts, chunkSlots: make(chan struct{}, opts.Workers)}
+	c.stats.Target = plan.target
+	c.stats.Skipped = plan.skipped
+	stats, err := c.run(plan)
+	if err != nil || !opts.Verify {
+		return stats, err
+	}
+	stats.Verified, err = verifyCopies(plan.files, opts.Workers)
+	return stats, err
+}
+
+func planCopy(src, dst string, opts CopyOptions) (*copyPlan, error) {
+	recursive := opts.Recursive
+	stat := os.Stat
+	if recursive {
+		stat = os.Lstat
+	}
+	info, err := stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() && !recursive {
+		return nil, fmt.Errorf("%s is a directory (use -r)", src)
+	}
+
+	if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(info, dstInfo) {
+		return nil, fmt.Errorf("%s and %s are the same file", src, dst)
+	}
+
+	plan := &copyPlan{target: dst}
+	if !info.IsDir() {
+		plan.add(copyEntry{src: src, dst: dst, info: info})
+		return plan, plan.resolveConflicts(opts.Conflict)
+	}
+
+	// An existing directory is merged into, unless the policy asks for a fresh name
+	if opts.Conflict.Policy == AutoRename {
+		dst = UniqueName(dst)
+		plan.target = dst
+	}
+
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(absDst)); err == nil {
+		absDst = filepath.Join(resolved, filepath.Base(absDst))
+	}
+	if resolved, err := filepath.EvalSymlinks(absSrc); err == nil {
+		absSrc = resolved
+	}
+	if IsWithin(absSrc, absDst) {
+		return nil, fmt.Errorf("cannot copy %s into itself", src)
+	}
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		plan.add(copyEntry{src: path, dst: filepath.Join(dst, rel), info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, plan.resolveConflicts(opts.Conflict)
+}
+
+// resolveConflicts applies the conflict policy to every file and symlink
+// before anything is copied, so interactive questions are asked up front.
+// Backups are only marked here and made as each file is written, so a copy
+// that fails early leaves the destination as it was.
+func (p *copyPlan) resolveConflicts(conflict ConflictOptions) error {
+	// Directories missing from the destination are made by the copy, along
+	// with everything inside them
+	made := map[string]bool{}
+	for i, dir := range p.dirs {
+		if _, err := os.Lstat(dir.dst); os.IsNotExist(err) {
+			p.dirs[i].outer = !made[filepath.Dir(dir.dst)]
+			made[dir.dst] = true
+		}
+	}
+
+	resolve := func(entries []copyEntry) ([]copyEntry, error) {
+		kept := entries[:0]
+		for _, entry := range entries {
+			dst, ok, backup, err := conflict.decide(vfs.Host, entry.src, entry.info, entry.dst)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				p.skipped++
+				continue
+			}
+			if entry.dst == p.target {
+				p.target = dst
+			}
+			entry.dst, entry.backup = dst, backup
+			entry.outer = !made[filepath.Dir(dst)]
+			if entry.outer && !backup {
+				_, err := os.Lstat(dst)
+				entry.replace = err == nil
+			}
+			kept = append(kept, entry)
+		}
+		return kept, nil
+	}
+
+	var err error
+	if p.files, err = resolve(p.files); err != nil {
+		return err
+	}
+	if p.links, err = resolve(p.links); err != nil {
+		return err
+	}
+
+	p.bytes, p.allocated = 0, 0
+	for _, file := range p.files {
+		p.bytes += file.info.Size()
+		p.allocated += allocatedBytes(file.info)
+	}
+	return nil
+}
+
+func (p *copyPlan) add(entry copyEntry) {
+	switch mode := entry.info.Mode(); {
+	case mode.IsDir():
+		p.dirs = append(p.dirs, entry)
+	case mode&os.ModeSymlink != 0:
+		p.links = append(p.links, entry)
+	case mode.IsRegular():
+		p.files = append(p.files, entry)
+		p.bytes += entry.info.Size()
+		p.allocated += allocatedBytes(entry.info)
+	default:
+		// Devices, sockets and pipes are skipped like any file manager would
+	}
+}
+
+// checkFreeSpace compares the space needed against the filesystem holding dst
+func checkFreeSpace(dst string, needed int64) error {
+	dir := filepath.Dir(dst)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil // Unknown free space is not a reason to refuse the copy
+	}
+	if uint64(needed) > free {
+		return fmt.Errorf("%w: need %d bytes, %d available", ErrInsufficientSpace, needed, free)
+	}
+	return nil
+}
+
+type copier struct {
+	opts       CopyOptions
+	chunkSlots chan struct{}
+	done       atomic.Int64
+
+	mu    sync.Mutex
+	errs  []error
+	stats CopyStats
+}
+
+func (c *copier) fail(err error) {
+	c.mu.Lock()
+	c.errs = append(c.errs, err)
+	c.mu.Unlock()
+}
+
+func (c *copier) run(plan *copyPlan) (CopyStats, error) {
+	for _, dir := range plan.dirs {
+		if err := os.MkdirAll(dir.dst, 0700); err != nil {
+			return c.stats, err
+		}
+		c.stats.Dirs++
+		c.written(dir)
+	}
+
+	stopProgress := c.startProgress(plan.bytes)
+
+	var wg sync.WaitGroup
+	fileSlots := make(chan struct{}, c.opts.Workers)
+	for _, file := range plan.files {
+		fileSlots <- struct{}{}
+		if c.opts.canceled() {
+			<-fileSlots
+			c.fail(ErrCanceled)
+			break
+		}
+		wg.Add(1)
+		go func(file copyEntry) {
+			defer wg.Done()
+			defer func() { <-fileSlots }()
+			if err := c.copyFile(file); err != nil {
+				c.fail(fmt.Errorf("%s: %w", file.src, err))
+				return
+			}
+			c.mu.Lock()
+			c.stats.Files++
+			c.stats.Bytes += file.info.Size()
+			c.mu.Unlock()
+			c.written(file)
+		}(file)
+	}
+	wg.Wait()
+	stopProgress()
+	if c.opts.canceled() {
+		// Files copied so far stay; interrupted large files can be resumed
+		return c.stats, ErrCanceled
+	}
+
+	for _, link := range plan.links {
+		if err := c.copySymlink(link); err != nil {
+			c.fail(fmt.Errorf("%s: %w", link.src, err))
+			continue
+		}
+		c.stats.Symlinks++
+		c.written(link)
+	}
+
+	// Directory metadata goes last, deepest first, so adding entries does not
+	// disturb the copied modification times
+	for i := len(plan.dirs) - 1; i >= 0; i-- {
+		if err := applyMetadata(plan.dirs[i], c.opts); err != nil {
+			c.fail(fmt.Errorf("%s: %w", plan.dirs[i].src, err))
+		}
+	}
+
+	return c.stats, errors.Join(c.errs...)
+}
+
+func (c *copier) startProgress(total int64) func() {
+	if c.opts.Progress == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.opts.Progress(c.done.Load(), total)
+			case <-stop:
+				c.opts.Progress(c.done.Load(), total)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// copyFile copies one regular file, cloning it when the filesystem supports
+// reflinks and otherwise copying only its data segments so holes stay sparse
+func (c *copier) copyFile(file copyEntry) error {
+	size := file.info.Size()
+	if size >= c.opts.ChunkSize {
+		return c.copyLargeFile(file)
+	}
+
+	src, err := os.Open(file.src)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := c.makeRoom(file); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(file.dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if reflink(dst, src) == nil {
+		c.done.Add(size)
+	} else if err := c.copySegments(src, dst, size); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return applyMetadata(file, c.opts)
+}
+
+func (c *copier) copySegments(src, dst *os.File, size int64) error {
+	// Extend first so holes between data segments read back as zeros
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+	for _, segment := range dataSegments(src, size) {
+		if err := copyRange(src, dst, segment.offset, segment.length); err != nil {
+			return err
+		}
+		c.done.Add(segment.length)
+	}
+	return nil
+}
+
+// copyLargeFile copies chunks in parallel into a partial file next to the
+// destination. Finished chunks are journaled, so after an interruption the
+// next copy of the same source only transfers what is missing.
+func (c *copier) copyLargeFile(file copyEntry) error {
+	size := file.info.Size()
+	part := file.dst + PartialSuffix
+	journal, resumed := openResumeJournal(part, file.src, file.info)
+
+	src, err := os.Open(file.src)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if resumed {
+		c.mu.Lock()
+		c.stats.Resumed++
+		c.mu.Unlock()
+	} else {
+		dst, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if reflink(dst, src) == nil {
+			c.done.Add(size)
+			if err := dst.Close(); err != nil {
+				return err
+			}
+			return c.finishPartial(part, file)
+		}
+		err = dst.Truncate(size)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, segment := range dataSegments(src, size) {
+		for offset := segment.offset; offset < segment.offset+segment.length; offset += c.opts.ChunkSize {
+			length := c.opts.ChunkSize
+			if end := segment.offset + segment.length; offset+length > end {
+				length = end - offset
+			}
+			if journal.isDone(offset, length) {
+				c.done.Add(length)
+				continue
+			}
+
+			c.chunkSlots <- struct{}{}
+			if c.opts.canceled() {
+				<-c.chunkSlots
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = ErrCanceled
+				}
+				mu.Unlock()
+				break
+			}
+			wg.Add(1)
+			go func(offset, length int64) {
+				defer wg.Done()
+				defer func() { <-c.chunkSlots }()
+				err := copyChunk(file.src, part, offset, length)
+				if err == nil {
+					err = journal.markDone(offset, length)
+					c.done.Add(length)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}(offset, length)
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr // The journal stays behind so the copy can be resumed
+	}
+
+	journal.remove()
+	return c.finishPartial(part, file)
+}
+
+// finishPartial moves a completed partial file into place and copies the metadata
+func (c *copier) finishPartial(part string, file copyEntry) error {
+	if err := c.makeRoom(file); err != nil {
+		return err
+	}
+	if err := os.Rename(part, file.dst); err != nil {
+		return err
+	}
+	return applyMetadata(file, c.opts)
+}
+
+// makeRoom runs right before the destination of entry is written: it saves
+// the destination when the Backup policy asked for it, and otherwise hands a
+// destination about to be overwritten to opts.Replace
+func (c *copier) makeRoom(entry copyEntry) error {
+	switch {
+	case entry.backup:
+		if err := c.opts.Conflict.backup(vfs.Host, entry.dst); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.stats.BackedUp = append(c.stats.BackedUp, entry.dst)
+		c.mu.Unlock()
+	case entry.replace && c.opts.Replace != nil:
+		return c.opts.Replace(entry.dst)
+	}
+	return nil
+}
+
+// written lists the destination of entry in the stats once it is in place
+func (c *copier) written(entry copyEntry) {
+	if entry.outer {
+		c.mu.Lock()
+		c.stats.Created = append(c.stats.Created, entry.dst)
+		c.mu.Unlock()
+	}
+}
+
+// copyChunk copies one byte range using its own descriptors, so chunks of a
+// file can be copied concurrently
+func copyChunk(srcPath, dstPath string, offset, length int64) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := copyRange(src, dst, offset, length); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// copyRange copies length bytes at offset. Copying between two *os.File
+// values lets the runtime use copy_file_range or sendfile where available.
+func copyRange(src, dst *os.File, offset, length int64) error {
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, src, length)
+	return err
+}
+
+type segment struct {
+	offset int64
+	length int64
+}
+
+// dataSegments lists the parts of a file holding data, treating the whole
+// file as data when the filesystem cannot report holes
+func dataSegments(f *os.File, size int64) []segment {
+	whole := []segment{{0, size}}
+	if size == 0 {
+		return nil
+	}
+
+	var segments []segment
+	offset := int64(0)
+	for offset < size {
+		start, err := f.Seek(offset, seekData)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				break // Only a hole remains
+			}
+			return whole
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return whole
+		}
+		if end > size {
+			end = size
+		}
+		segments = append(segments, segment{start, end - start})
+		offset = end
+	}
+	return segments
+}
+
+func (c *copier) copySymlink(link copyEntry) error {
+	target, err := os.Readlink(link.src)
+	if err != nil {
+		return err
+	}
+	if err := c.makeRoom(link); err != nil {
+		return err
+	}
+	if err := os.Remove(link.dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, link.dst); err != nil {
+		return err
+	}
+	return applyMetadata(link, c.opts)
+}
+
+// applyMetadata copies ownership, extended attributes, mode and timestamps
+// from the entry's source onto its destination. Ownership goes first because
+// chown clears the setuid and setgid bits, and attributes go before the mode
+// because setting them needs write permission.
+func applyMetadata(entry copyEntry, opts CopyOptions) error {
+	path, info := entry.dst, entry.info
+	if opts.PreserveOwnership {
+		if uid, gid, ok := fileOwner(info); ok {
+			if err := os.Lchown(path, uid, gid); err != nil && !errors.Is(err, syscall.EPERM) {
+				return err
+			}
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil // Mode and times of a link would apply to its target
+	}
+	if opts.PreserveXattrs {
+		if err := CopyXattrs(entry.src, path); err != nil {
+			return err
+		}
+	}
+
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, fileAtime(info), info.ModTime())
+}
@@ -0,0 +1,217 @@
+package fileops
+
+import (
+	"fmsh/vfs"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// CopyFS copies srcName in src to dstName in dst, which must be the final
+// name of the copy, for copies that involve a backend other than the host,
+// such as copying out of an archive or into a memory mount. Directories
+// require opts.Recursive; symlinks inside a tree are recreated. Progress,
+// Recursive and Conflict are honoured.
+func CopyFS(src vfs.FS, srcName string, dst vfs.FS, dstName string, opts CopyOptions) (CopyStats, error) {
+	var stats CopyStats
+	stat := src.Stat
+	if opts.Recursive {
+		stat = src.Lstat
+	}
+	info, err := stat(srcName)
+	if err != nil {
+		return stats, err
+	}
+	if info.IsDir() && !opts.Recursive {
+		return stats, fmt.Errorf("%s is a directory (use -r)", srcName)
+	}
+	if info.IsDir() && opts.Conflict.Policy == AutoRename {
+		dstName = UniqueNameFS(dst, dstName)
+	}
+	stats.Target = dstName
+
+	var total int64
+	fs.WalkDir(src, srcName, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+
+	// Directories get their mode once their contents are written, deepest first
+	type dirMode struct {
+		name string
+		info fs.FileInfo
+	}
+	var dirs []dirMode
+
+	err = fs.WalkDir(src, srcName, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if opts.canceled() {
+			return ErrCanceled
+		}
+		info, err := entry.Info()
+		if p == srcName {
+			info, err = stat(srcName)
+		}
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, srcName), "/")
+		target := dstName
+		if rel != "" {
+			target = vfs.Join(dst, append([]string{dstName}, strings.Split(rel, "/")...)...)
+		}
+		if rel != "" || !info.IsDir() {
+			resolved, ok, err := opts.Conflict.ResolveFS(dst, p, info, target)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				stats.Skipped++
+				if info.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			target = resolved
+			if rel == "" {
+				stats.Target = target
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if err := vfs.MkdirAll(dst, target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, info})
+			stats.Dirs++
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := src.ReadLink(p)
+			if err != nil {
+				return err
+			}
+			dst.Remove(target)
+			if err := dst.Symlink(link, target); err != nil {
+				return err
+			}
+			stats.Symlinks++
+		default:
+			n, err := copyFileFS(src, p, dst, target, info)
+			stats.Bytes += n
+			if err != nil {
+				return err
+			}
+			stats.Files++
+			if opts.Progress != nil {
+				opts.Progress(stats.Bytes, total)
+			}
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dst.Chmod(dirs[i].name, dirs[i].info.Mode().Perm())
+		dst.Chtimes(dirs[i].name, dirs[i].info.ModTime(), dirs[i].info.ModTime())
+	}
+	return stats, err
+}
+
+// copyFileFS copies one file through a temporary sibling, so a failed copy
+// never replaces the destination, unless the backend writes atomically anyway.
+// Backends that copy on the server do so within themselves.
+func copyFileFS(src vfs.FS, name string, dst vfs.FS, target string, info fs.FileInfo) (int64, error) {
+	if copier, ok := dst.(vfs.Copier); ok && src == dst {
+		if err := copier.Copy(name, target); err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	in, err := src.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	dir, base := vfs.Split(dst, target)
+	tmp := vfs.Join(dst, dir, fmt.Sprintf(".%s.%d", base, rand.Int63()))
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if vfs.WritesAtomically(dst) {
+		tmp, flag = target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC
+	}
+	out, err := dst.OpenFile(tmp, flag, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = dst.Chmod(tmp, info.Mode().Perm())
+	}
+	if err == nil {
+		dst.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil && tmp != target {
+		err = dst.Rename(tmp, target)
+	}
+	if err != nil && tmp != target {
+		dst.Remove(tmp)
+	}
+	return n, err
+}
+
+// MoveFS moves srcName in src to dstName in dst like Move does on the host.
+// Within one backend it renames; across backends it copies and then removes
+// the source.
+func MoveFS(src vfs.FS, srcName string, dst vfs.FS, dstName string, opts MoveOptions) (string, error) {
+	info, err := src.Lstat(srcName)
+	if err != nil {
+		return "", err
+	}
+	target, ok, backup, err := opts.Conflict.decide(dst, srcName, info, dstName)
+	if err != nil || !ok {
+		return "", err
+	}
+	if info.IsDir() {
+		if _, err := dst.Lstat(target); err == nil {
+			return "", fmt.Errorf("cannot move %s to %s: %w", srcName, target, ErrDirExists)
+		}
+	}
+	if backup {
+		if err := opts.Conflict.backup(dst, target); err != nil {
+			return "", err
+		}
+	}
+	if src == dst {
+		err := src.Rename(srcName, target)
+		if err != nil && backup {
+			opts.Conflict.restore(dst, target)
+		}
+		return target, err
+	}
+
+	copyOpts := opts.Copy
+	copyOpts.Recursive = true
+	copyOpts.Conflict = ConflictOptions{}
+	if _, err := CopyFS(src, srcName, dst, target, copyOpts); err != nil {
+		// Drop what was copied so the saved destination can come back
+		if backup {
+			vfs.RemoveAll(dst, target)
+			opts.Conflict.restore(dst, target)
+		}
+		return "", err
+	}
+	if err := vfs.RemoveAll(src, srcName); err != nil {
+		return target, fmt.Errorf("copied to %s but could not remove the source: %w", target, err)
+	}
+	return target, nil
+}
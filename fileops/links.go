@@ -0,0 +1,191 @@
+package fileops
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// ErrHardLinksUnsupported is returned where files carry no inode numbers
+var ErrHardLinksUnsupported = errors.New("hard links cannot be detected on this platform")
+
+// RelativeTarget returns the target of a symlink at link that reaches
+// target through a relative path, as ln -r does. Symlinks in the
+// directories of both are resolved first, so the path stays right.
+func RelativeTarget(target, link string) (string, error) {
+	absTarget, err := Canonicalize(target)
+	if err != nil {
+		return "", err
+	}
+	linkDir, err := Canonicalize(filepath.Dir(link))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(linkDir, absTarget)
+}
+
+// Canonicalize returns the absolute path of path with every symlink
+// resolved, as readlink -f does. The last component need not exist.
+func Canonicalize(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err == nil {
+		return resolved, nil
+	}
+	if _, lstatErr := os.Lstat(abs); !os.IsNotExist(lstatErr) {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// LinkProblemKind says why a symlink cannot be followed
+type LinkProblemKind string
+
+const (
+	LinkDangling LinkProblemKind = "dangling" // The target does not exist
+	LinkLoop     LinkProblemKind = "loop"     // Following it leads back to itself
+	LinkAncestor LinkProblemKind = "ancestor" // It points to a directory containing it, so tree walks that follow links never end
+	LinkBroken   LinkProblemKind = "broken"   // The target cannot be reached, e.g. for lack of permission
+)
+
+// LinkProblem is a symlink that cannot be followed safely
+type LinkProblem struct {
+	Path   string
+	Target string // Contents of the link
+	Kind   LinkProblemKind
+	Err    error // Why following it failed, nil for LinkAncestor
+}
+
+// FindBrokenLinks walks the tree below root without following symlinks and
+// reports every symlink that is dangling, part of a loop, unreachable or
+// that leads to one of its own ancestors
+func FindBrokenLinks(root string) ([]LinkProblem, error) {
+	var problems []LinkProblem
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // Unreadable directories are skipped
+		}
+		if entry.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			problems = append(problems, LinkProblem{Path: path, Kind: LinkBroken, Err: err})
+			return nil
+		}
+		problem := LinkProblem{Path: path, Target: target}
+		info, err := os.Stat(path)
+		switch {
+		case errors.Is(err, syscall.ELOOP):
+			problem.Kind, problem.Err = LinkLoop, err
+		case os.IsNotExist(err):
+			problem.Kind, problem.Err = LinkDangling, err
+		case err != nil:
+			problem.Kind, problem.Err = LinkBroken, err
+		case info.IsDir() && linksToAncestor(path):
+			problem.Kind = LinkAncestor
+		default:
+			return nil
+		}
+		problems = append(problems, problem)
+		return nil
+	})
+	return problems, err
+}
+
+// linksToAncestor reports whether the directory symlink at path resolves to
+// a directory that contains the link
+func linksToAncestor(path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	return IsWithin(resolved, dir)
+}
+
+// FileID identifies a file independently of its names
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// HardLinkGroup is a file with several names
+type HardLinkGroup struct {
+	ID    FileID
+	Size  int64
+	Links uint64   // Names the file has in total, some perhaps outside the tree
+	Paths []string // Names found in the tree, sorted
+}
+
+// FindHardLinks walks the tree below root and groups the regular files that
+// have more than one hard link by inode, largest first
+func FindHardLinks(root string) ([]HardLinkGroup, error) {
+	groups := map[FileID]*HardLinkGroup{}
+	supported := true
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		id, links, ok := fileID(info)
+		if !ok {
+			supported = false
+			return filepath.SkipAll
+		}
+		if links < 2 {
+			return nil
+		}
+		group := groups[id]
+		if group == nil {
+			group = &HardLinkGroup{ID: id, Size: info.Size(), Links: links}
+			groups[id] = group
+		}
+		group.Paths = append(group.Paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !supported {
+		return nil, ErrHardLinksUnsupported
+	}
+
+	result := make([]HardLinkGroup, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.Paths)
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Size != result[j].Size {
+			return result[i].Size > result[j].Size
+		}
+		return result[i].Paths[0] < result[j].Paths[0]
+	})
+	return result, nil
+}
@@ -0,0 +1,167 @@
+package fileops
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ModeChange is a mode as chmod takes it: either octal, which sets every
+// permission bit, or symbolic clauses such as "u+x,g-w,o=r" that change
+// some bits of the current mode
+type ModeChange struct {
+	octal   bool
+	bits    uint32 // The octal mode
+	clauses []modeClause
+}
+
+type modeClause struct {
+	who   uint32 // Bits the clause may touch
+	op    byte   // '+', '-' or '='
+	perm  uint32 // Bits named by r, w, x, s and t, for every class
+	execX bool   // X: execute only for directories and files executable by someone
+	copy  byte   // u, g or o: the bits of that class instead of perm
+}
+
+// Bits each class letter of a symbolic mode stands for
+var modeClasses = map[byte]uint32{
+	'u': 04700,
+	'g': 02070,
+	'o': 01007,
+	'a': 07777,
+}
+
+// ParseMode parses an octal or symbolic mode. As with chmod, a symbolic
+// clause without u, g, o or a applies to everyone; the umask is not consulted.
+func ParseMode(spec string) (ModeChange, error) {
+	if spec != "" && strings.Trim(spec, "01234567") == "" {
+		bits, err := strconv.ParseUint(spec, 8, 32)
+		if err != nil || bits > 07777 {
+			return ModeChange{}, fmt.Errorf("invalid mode: %q", spec)
+		}
+		return ModeChange{octal: true, bits: uint32(bits)}, nil
+	}
+
+	var change ModeChange
+	for _, clause := range strings.Split(spec, ",") {
+		var who uint32
+		i := 0
+		for ; i < len(clause) && modeClasses[clause[i]] != 0; i++ {
+			who |= modeClasses[clause[i]]
+		}
+		if who == 0 {
+			who = modeClasses['a']
+		}
+		if i == len(clause) {
+			return ModeChange{}, fmt.Errorf("invalid mode: %q", spec)
+		}
+		// Each operator starts an action of its own, as in "u+r-w"
+		for i < len(clause) {
+			action := modeClause{who: who, op: clause[i]}
+			if !strings.ContainsRune("+-=", rune(action.op)) {
+				return ModeChange{}, fmt.Errorf("invalid mode: %q", spec)
+			}
+			for i++; i < len(clause) && !strings.ContainsRune("+-=", rune(clause[i])); i++ {
+				switch c := clause[i]; c {
+				case 'r':
+					action.perm |= 0444
+				case 'w':
+					action.perm |= 0222
+				case 'x':
+					action.perm |= 0111
+				case 'X':
+					action.execX = true
+				case 's':
+					action.perm |= 06000
+				case 't':
+					action.perm |= 01000
+				case 'u', 'g', 'o':
+					if action.copy != 0 || action.perm != 0 || action.execX {
+						return ModeChange{}, fmt.Errorf("invalid mode: %q", spec)
+					}
+					action.copy = c
+				default:
+					return ModeChange{}, fmt.Errorf("invalid mode: %q", spec)
+				}
+			}
+			change.clauses = append(change.clauses, action)
+		}
+	}
+	return change, nil
+}
+
+// Apply returns the permission, setuid, setgid and sticky bits that mode
+// has after the change
+func (c ModeChange) Apply(mode os.FileMode) os.FileMode {
+	if c.octal {
+		return fromUnixBits(c.bits)
+	}
+	bits := unixBits(mode)
+	for _, clause := range c.clauses {
+		perm := clause.perm
+		switch clause.copy {
+		case 'u':
+			perm = (bits >> 6 & 07) * 0111
+		case 'g':
+			perm = (bits >> 3 & 07) * 0111
+		case 'o':
+			perm = (bits & 07) * 0111
+		}
+		if clause.execX && (mode.IsDir() || bits&0111 != 0) {
+			perm |= 0111
+		}
+		perm &= clause.who
+		switch clause.op {
+		case '+':
+			bits |= perm
+		case '-':
+			bits &^= perm
+		case '=':
+			bits = bits&^clause.who | perm
+		}
+	}
+	return fromUnixBits(bits)
+}
+
+// unixBits is mode's permission, setuid, setgid and sticky bits as the
+// kernel numbers them
+func unixBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// fromUnixBits is the inverse of unixBits
+func fromUnixBits(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// ModeBits is the part of mode that chmod sets
+func ModeBits(mode os.FileMode) os.FileMode {
+	return fromUnixBits(unixBits(mode))
+}
+
+// FileOwner returns the numeric owner and group of info, where the
+// platform has them
+func FileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return fileOwner(info)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package fileops
+
+// mountPoints lists the mount points of the running system; only Linux
+// reports them, so elsewhere just the home trash is searched
+func mountPoints() []string {
+	return nil
+}
@@ -0,0 +1,95 @@
+package fileops
+
+import (
+	"errors"
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrDirExists is returned when a directory would be moved onto an existing one
+var ErrDirExists = errors.New("destination directory exists")
+
+// MoveOptions controls how Move handles existing destinations and cross-device copies
+type MoveOptions struct {
+	Conflict ConflictOptions
+	Copy     CopyOptions // Used when the move crosses filesystems
+}
+
+// Move moves src to dst, which must be the final path. It renames when both
+// are on the same filesystem. Across filesystems it copies into a hidden
+// sibling of dst, renames that into place and only then removes src, so dst
+// never appears half-written. It returns the final destination, which
+// differs from dst after an automatic rename, or "" when the conflict policy
+// skipped the source.
+func Move(src, dst string, opts MoveOptions) (string, error) {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		absSrc, _ := filepath.Abs(src)
+		absDst, _ := filepath.Abs(dst)
+		if absSrc != absDst && IsWithin(absSrc, absDst) {
+			return "", fmt.Errorf("cannot move %s into itself", src)
+		}
+	}
+
+	target, ok, backup, err := opts.Conflict.decide(vfs.Host, src, info, dst)
+	if err != nil || !ok {
+		return "", err
+	}
+	// Directories are not merged, so refuse before a cross-device copy starts
+	if info.IsDir() {
+		if _, err := os.Lstat(target); err == nil {
+			return "", fmt.Errorf("cannot move %s to %s: %w", src, target, ErrDirExists)
+		}
+	}
+
+	if backup {
+		if err := opts.Conflict.backup(vfs.Host, target); err != nil {
+			return "", err
+		}
+	}
+	err = os.Rename(src, target)
+	if err == nil {
+		return target, nil
+	}
+	if backup {
+		// The destination stays in place until the copy below has finished
+		opts.Conflict.restore(vfs.Host, target)
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return "", err
+	}
+
+	// A stable name lets an interrupted move resume its large-file copies
+	staging := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".fmsh-mv")
+	copyOpts := opts.Copy
+	copyOpts.Recursive = true
+	copyOpts.PreserveOwnership = true
+	copyOpts.PreserveXattrs = true
+	copyOpts.Conflict = ConflictOptions{}
+	if _, err := Copy(src, staging, copyOpts); err != nil {
+		return "", err
+	}
+	if backup {
+		if err := opts.Conflict.backup(vfs.Host, target); err != nil {
+			os.RemoveAll(staging)
+			return "", err
+		}
+	}
+	if err := os.Rename(staging, target); err != nil {
+		os.RemoveAll(staging)
+		if backup {
+			opts.Conflict.restore(vfs.Host, target)
+		}
+		return "", err
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return target, fmt.Errorf("copied to %s but could not remove the source: %w", target, err)
+	}
+	return target, nil
+}
@@ -0,0 +1,337 @@
+package fileops
+
+import (
+	"encoding/json"
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2non/filetype"
+)
+
+// OrganizeRule moves the files it matches into the directory named by Dest.
+// Every condition that is set must match; sizes take K, M, G and T suffixes
+// and ages d and w suffixes as well as Go durations.
+type OrganizeRule struct {
+	Name       string   `json:"name,omitempty"`
+	Extensions []string `json:"extensions,omitempty"` // Without dot, compared case-insensitively
+	MIME       string   `json:"mime,omitempty"`       // Detected type, with wildcards such as "image/*"
+	Pattern    string   `json:"pattern,omitempty"`    // Wildcard pattern on the file name
+	MinSize    string   `json:"min_size,omitempty"`
+	MaxSize    string   `json:"max_size,omitempty"`
+	OlderThan  string   `json:"older_than,omitempty"` // Age of the modification time
+	NewerThan  string   `json:"newer_than,omitempty"`
+	Dest       string   `json:"dest"` // Template relative to the organized directory, see TemplateVars
+
+	minSize, maxSize     int64
+	olderThan, newerThan time.Duration
+}
+
+// OrganizeRules is the content of a rules file; the first matching rule wins
+type OrganizeRules struct {
+	Rules []OrganizeRule `json:"rules"`
+}
+
+// DefaultOrganizeRules sorts every file into a folder named after its detected type
+func DefaultOrganizeRules() *OrganizeRules {
+	return &OrganizeRules{Rules: []OrganizeRule{{Name: "by type", Dest: "{type}"}}}
+}
+
+// LoadOrganizeRules reads and validates a rules file
+func LoadOrganizeRules(path string) (*OrganizeRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules OrganizeRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &rules, nil
+}
+
+func (r *OrganizeRules) compile() error {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		label := rule.Name
+		if label == "" {
+			label = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.Dest == "" {
+			return fmt.Errorf("%s: dest is missing", label)
+		}
+
+		var err error
+		if rule.minSize, err = parseOptionalSize(rule.MinSize); err != nil {
+			return fmt.Errorf("%s: min_size: %w", label, err)
+		}
+		if rule.maxSize, err = parseOptionalSize(rule.MaxSize); err != nil {
+			return fmt.Errorf("%s: max_size: %w", label, err)
+		}
+		if rule.olderThan, err = parseOptionalAge(rule.OlderThan); err != nil {
+			return fmt.Errorf("%s: older_than: %w", label, err)
+		}
+		if rule.newerThan, err = parseOptionalAge(rule.NewerThan); err != nil {
+			return fmt.Errorf("%s: newer_than: %w", label, err)
+		}
+		for _, pattern := range []string{rule.Pattern, rule.MIME} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: bad pattern %q", label, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseSize parses a byte count such as "512", "100K" or "1.5G"
+func ParseSize(value string) (int64, error) {
+	units := map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	scale := 1.0
+	if n := len(number); n > 0 {
+		if unit, ok := units[number[n-1]]; ok {
+			number, scale = number[:n-1], unit
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * scale), nil
+}
+
+// ParseAge parses an age such as "90m", "12h", "30d" or "2w"
+func ParseAge(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			if n, err := strconv.Atoi(number); err == nil && n >= 0 {
+				return time.Duration(n) * unit, nil
+			}
+		}
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
+
+func parseOptionalSize(value string) (int64, error) {
+	if value == "" {
+		return -1, nil
+	}
+	return ParseSize(value)
+}
+
+func parseOptionalAge(value string) (time.Duration, error) {
+	if value == "" {
+		return -1, nil
+	}
+	return ParseAge(value)
+}
+
+// fileKind is what organizing knows about a file
+type fileKind struct {
+	path string
+	info os.FileInfo
+	ext  string // Detected extension, "unknown" when undetected
+	mime string
+}
+
+func (rule *OrganizeRule) matches(file fileKind, now time.Time) bool {
+	name := file.info.Name()
+	if len(rule.Extensions) > 0 {
+		ext := strings.TrimPrefix(filepath.Ext(name), ".")
+		found := false
+		for _, want := range rule.Extensions {
+			if strings.EqualFold(strings.TrimPrefix(want, "."), ext) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.MIME != "" {
+		if ok, _ := path.Match(rule.MIME, file.mime); !ok {
+			return false
+		}
+	}
+	if rule.Pattern != "" {
+		if ok, _ := path.Match(rule.Pattern, name); !ok {
+			return false
+		}
+	}
+	size := file.info.Size()
+	if (rule.minSize >= 0 && size < rule.minSize) || (rule.maxSize >= 0 && size > rule.maxSize) {
+		return false
+	}
+	age := now.Sub(file.info.ModTime())
+	if (rule.olderThan >= 0 && age < rule.olderThan) || (rule.newerThan >= 0 && age > rule.newerThan) {
+		return false
+	}
+	return true
+}
+
+// OrganizeMove is one planned move of an organize run
+type OrganizeMove struct {
+	Source string
+	Target string
+	Rule   string
+}
+
+// PlanOrganize walks dir up to maxDepth levels deep (0 for no limit) and
+// returns where the first matching rule sends each file. Hidden files and
+// directories are left alone, as are files already in place. File types
+// are detected in parallel.
+func PlanOrganize(dir string, rules *OrganizeRules, maxDepth int) ([]OrganizeMove, error) {
+	return PlanOrganizeFS(vfs.Host, dir, rules, maxDepth)
+}
+
+// PlanOrganizeFS is PlanOrganize for a directory of fsys. Sources and
+// targets of the plan are names in fsys.
+func PlanOrganizeFS(fsys vfs.FS, dir string, rules *OrganizeRules, maxDepth int) ([]OrganizeMove, error) {
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := fsys.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			p := vfs.Join(fsys, dir, entry.Name())
+			if entry.IsDir() {
+				if maxDepth > 0 && depth >= maxDepth {
+					continue
+				}
+				if err := walk(p, depth+1); err != nil {
+					return err
+				}
+			} else if entry.Type().IsRegular() {
+				files = append(files, p)
+			}
+		}
+		return nil
+	}
+	root := vfs.Join(fsys, dir)
+	if err := walk(root, 1); err != nil {
+		return nil, err
+	}
+
+	// Each worker writes only its own slots, so no locking is needed
+	moves := make([]*OrganizeMove, len(files))
+	errs := make([]error, len(files))
+	now := time.Now()
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				moves[i], errs[i] = planMove(fsys, root, files[i], rules, now)
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var plan []OrganizeMove
+	for i, move := range moves {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if move != nil {
+			plan = append(plan, *move)
+		}
+	}
+	return plan, nil
+}
+
+func planMove(fsys vfs.FS, root, file string, rules *OrganizeRules, now time.Time) (*OrganizeMove, error) {
+	kind, err := detectKind(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if !rule.matches(kind, now) {
+			continue
+		}
+
+		vars := TemplateVars(file, kind.info)
+		vars["type"] = kind.ext
+		vars["category"], _, _ = strings.Cut(kind.mime, "/")
+		dest, err := ExpandTemplate(rule.Dest, vars, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		switch {
+		case !filepath.IsAbs(dest):
+			dest = vfs.Join(fsys, root, dest)
+		case fsys != vfs.Host:
+			return nil, fmt.Errorf("%s: absolute destinations only work on the host file system", rule.Name)
+		}
+		_, base := vfs.Split(fsys, file)
+		target := vfs.Join(fsys, dest, base)
+		if target == file {
+			return nil, nil
+		}
+		return &OrganizeMove{Source: file, Target: target, Rule: rule.Name}, nil
+	}
+	return nil, nil
+}
+
+func detectKind(fsys vfs.FS, file string) (fileKind, error) {
+	info, err := fsys.Lstat(file)
+	if err != nil {
+		return fileKind{}, err
+	}
+	kind := fileKind{path: file, info: info, ext: "unknown", mime: "application/octet-stream"}
+
+	f, err := fsys.Open(file)
+	if err != nil {
+		return fileKind{}, err
+	}
+	defer f.Close()
+	head := make([]byte, 261)
+	n, _ := f.Read(head)
+	if match, _ := filetype.Match(head[:n]); match != filetype.Unknown {
+		kind.ext = match.Extension
+		kind.mime = match.MIME.Value
+	} else if n > 0 && isText(head[:n]) {
+		kind.mime = "text/plain"
+	}
+	return kind, nil
+}
+
+// isText guesses that data without NUL bytes is text
+func isText(data []byte) bool {
+	for _, b := range data {
+		if b == 0 {
+			return false
+		}
+	}
+	return true
+}
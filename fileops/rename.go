@@ -0,0 +1,259 @@
+package fileops
+
+import (
+	"errors"
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// RenameOptions describes how PlanRenames derives new names. The steps run
+// in order: regex replacement on the whole name, template, case, sanitising.
+type RenameOptions struct {
+	Pattern  *regexp.Regexp // Replaced by Replace when set, with $1-style groups
+	Replace  string
+	Template string // See TemplateVars; {name} and {ext} reflect the regex result
+	Case     string // "lower", "upper" or "title"
+	Sanitize bool   // Transliterate accents, turn spaces into _ and drop other unsafe characters
+	Start    int    // First value of the {n} counter
+	Step     int    // Counter increment, 1 when zero
+}
+
+// RenameEntry is one line of a rename plan. Problem is set when the rename
+// cannot be applied, e.g. because two files would get the same name.
+type RenameEntry struct {
+	Source  string
+	Target  string
+	Problem string
+}
+
+// Unchanged reports whether the entry keeps its name
+func (e RenameEntry) Unchanged() bool {
+	return e.Source == e.Target
+}
+
+// RenameStep is a single rename performed while applying a plan
+type RenameStep struct {
+	From string
+	To   string
+}
+
+// ErrRenameProblems is returned when applying a plan that has problems
+var ErrRenameProblems = errors.New("the rename plan has problems")
+
+// PlanRenames computes the new name of every path without touching the file
+// system, and flags names that collide with each other or with files that
+// are not being renamed. Renames stay within each file's directory.
+func PlanRenames(paths []string, opts RenameOptions) ([]RenameEntry, error) {
+	return PlanRenamesFS(vfs.Host, paths, opts)
+}
+
+// PlanRenamesFS is PlanRenames for names in fsys
+func PlanRenamesFS(fsys vfs.FS, paths []string, opts RenameOptions) ([]RenameEntry, error) {
+	step := opts.Step
+	if step == 0 {
+		step = 1
+	}
+
+	entries := make([]RenameEntry, 0, len(paths))
+	sources := map[string]bool{}
+	for i, path := range paths {
+		info, err := fsys.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		source := vfs.Join(fsys, path)
+		dir, base := vfs.Split(fsys, source)
+		name, err := newName(path, base, info, opts, opts.Start+i*step)
+		if err != nil {
+			return nil, err
+		}
+		sources[source] = true
+		entries = append(entries, RenameEntry{Source: source, Target: vfs.Join(fsys, dir, name)})
+	}
+
+	targets := map[string]int{}
+	for i := range entries {
+		entry := &entries[i]
+		if first, ok := targets[entry.Target]; ok {
+			_, other := vfs.Split(fsys, entries[first].Source)
+			entry.Problem = "same new name as " + other
+			if entries[first].Problem == "" {
+				_, base := vfs.Split(fsys, entry.Source)
+				entries[first].Problem = "same new name as " + base
+			}
+			continue
+		}
+		targets[entry.Target] = i
+		if entry.Unchanged() || sources[entry.Target] {
+			continue
+		}
+		if existing, err := fsys.Lstat(entry.Target); err == nil {
+			// On case-insensitive file systems the target may be the source itself
+			if source, err := fsys.Lstat(entry.Source); err != nil || !os.SameFile(source, existing) {
+				entry.Problem = "exists already"
+			}
+		}
+	}
+	return entries, nil
+}
+
+func newName(path, name string, info os.FileInfo, opts RenameOptions, counter int) (string, error) {
+	if opts.Pattern != nil {
+		name = opts.Pattern.ReplaceAllString(name, opts.Replace)
+	}
+	if opts.Template != "" {
+		vars := TemplateVars(name, info)
+		var err error
+		if name, err = ExpandTemplate(opts.Template, vars, counter); err != nil {
+			return "", err
+		}
+	}
+	switch opts.Case {
+	case "":
+	case "lower":
+		name = strings.ToLower(name)
+	case "upper":
+		name = strings.ToUpper(name)
+	case "title":
+		name = titleCase(name)
+	default:
+		return "", fmt.Errorf("unknown case %q", opts.Case)
+	}
+	if opts.Sanitize {
+		name = SanitizeName(name)
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: invalid new name %q", path, name)
+	}
+	return name, nil
+}
+
+// titleCase capitalises the first letter of every word and lowercases the rest
+func titleCase(s string) string {
+	runes := []rune(s)
+	start := true
+	for i, r := range runes {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start {
+				runes[i] = unicode.ToUpper(r)
+			} else {
+				runes[i] = unicode.ToLower(r)
+			}
+			start = false
+		} else {
+			start = true
+		}
+	}
+	return string(runes)
+}
+
+// transliterations maps common accented letters to ASCII
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae",
+	'ç': "c", 'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ñ': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'œ': "oe",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'ÿ': "y", 'ß': "ss",
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE",
+	'Ç': "C", 'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ñ': "N",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Œ': "OE",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ý': "Y",
+}
+
+// SanitizeName makes a name safe for scripts and other file systems:
+// accents are transliterated, runs of spaces become one underscore and
+// anything other than ASCII letters, digits, '.', '_' and '-' is dropped
+func SanitizeName(name string) string {
+	var out strings.Builder
+	space := false
+	for _, r := range name {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space && out.Len() > 0 {
+			out.WriteByte('_')
+		}
+		space = false
+
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-'):
+			out.WriteRune(r)
+		case transliterations[r] != "":
+			out.WriteString(transliterations[r])
+		}
+	}
+	return out.String()
+}
+
+// ApplyRenames performs a plan. Renames are ordered so no file is replaced
+// by another before it has moved out of the way, e.g. a->b before b->c, and
+// cycles such as a->b, b->a go through a temporary name. The performed
+// steps are returned in order; if one fails, those already done are
+// reverted and the error is returned.
+func ApplyRenames(entries []RenameEntry) ([]RenameStep, error) {
+	return ApplyRenamesFS(vfs.Host, entries)
+}
+
+// ApplyRenamesFS is ApplyRenames for a plan made by PlanRenamesFS
+func ApplyRenamesFS(fsys vfs.FS, entries []RenameEntry) ([]RenameStep, error) {
+	var pending []RenameEntry
+	for _, entry := range entries {
+		if entry.Problem != "" {
+			return nil, fmt.Errorf("%w: %s: %s", ErrRenameProblems, entry.Source, entry.Problem)
+		}
+		if !entry.Unchanged() {
+			pending = append(pending, entry)
+		}
+	}
+
+	var steps []RenameStep
+	rename := func(from, to string) error {
+		if err := fsys.Rename(from, to); err != nil {
+			for i := len(steps) - 1; i >= 0; i-- {
+				fsys.Rename(steps[i].To, steps[i].From)
+			}
+			return err
+		}
+		steps = append(steps, RenameStep{From: from, To: to})
+		return nil
+	}
+
+	for len(pending) > 0 {
+		occupied := map[string]bool{}
+		for _, entry := range pending {
+			occupied[entry.Source] = true
+		}
+
+		var blocked []RenameEntry
+		for _, entry := range pending {
+			if occupied[entry.Target] {
+				blocked = append(blocked, entry)
+				continue
+			}
+			if err := rename(entry.Source, entry.Target); err != nil {
+				return nil, err
+			}
+			delete(occupied, entry.Source)
+		}
+		if len(blocked) == len(pending) {
+			// Every remaining rename waits for another: break the cycle
+			entry := &blocked[0]
+			dir, base := vfs.Split(fsys, entry.Source)
+			temp := UniqueNameFS(fsys, vfs.Join(fsys, dir, "."+base+".fmsh-rename"))
+			if err := rename(entry.Source, temp); err != nil {
+				return nil, err
+			}
+			entry.Source = temp
+		}
+		pending = blocked
+	}
+	return steps, nil
+}
@@ -0,0 +1,77 @@
+package fileops
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PartialSuffix marks large files whose copy has not finished yet
+const PartialSuffix = ".fmsh-part"
+
+// resumeJournal records the finished chunks of a partial file so an
+// interrupted copy can continue instead of starting over
+type resumeJournal struct {
+	mu   sync.Mutex
+	path string
+
+	Source  string          `json:"source"`
+	Size    int64           `json:"size"`
+	ModTime time.Time       `json:"mod_time"`
+	Done    map[int64]int64 `json:"done"` // Offset to length of finished chunks
+}
+
+// openResumeJournal loads the journal of part when it still describes the
+// same source; otherwise it starts a new one. The second result reports
+// whether the partial file can be resumed.
+func openResumeJournal(part, src string, info os.FileInfo) (*resumeJournal, bool) {
+	if abs, err := filepath.Abs(src); err == nil {
+		src = abs
+	}
+	journal := &resumeJournal{
+		path:    part + ".json",
+		Source:  src,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Done:    map[int64]int64{},
+	}
+
+	data, err := os.ReadFile(journal.path)
+	if err != nil {
+		return journal, false
+	}
+	var saved resumeJournal
+	if json.Unmarshal(data, &saved) != nil || saved.Source != journal.Source || saved.Size != journal.Size || !saved.ModTime.Equal(journal.ModTime) {
+		return journal, false
+	}
+	if partInfo, err := os.Stat(part); err != nil || partInfo.Size() != journal.Size {
+		return journal, false
+	}
+	if saved.Done != nil {
+		journal.Done = saved.Done
+	}
+	return journal, len(journal.Done) > 0
+}
+
+func (j *resumeJournal) isDone(offset, length int64) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Done[offset] == length
+}
+
+func (j *resumeJournal) markDone(offset, length int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Done[offset] = length
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(j.path, data, 0600)
+}
+
+func (j *resumeJournal) remove() {
+	os.Remove(j.path)
+}
@@ -0,0 +1,144 @@
+package fileops
+
+import (
+	"fmsh/vfs"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileStat is the full metadata of a file, as shown by the stat command.
+// Fields the platform does not provide are left zero; Birth is zero where
+// the kernel or the file system does not record it.
+type FileStat struct {
+	Path       string
+	Info       os.FileInfo // From lstat, so a symlink describes itself
+	LinkTarget string      // Contents of a symlink
+	HasOwner   bool        // Whether UID and GID are known
+	UID, GID   uint32
+	Owner      string // User name, or the UID when it has none
+	Group      string // Group name, or the GID when it has none
+	Blocks     int64  // Allocated 512-byte blocks
+	BlockSize  int64  // Preferred I/O block size
+	Inode      uint64
+	DevMajor   uint32 // Device holding the file
+	DevMinor   uint32
+	Links      uint64
+	Atime      time.Time
+	Mtime      time.Time
+	Ctime      time.Time // Last status change
+	Birth      time.Time
+	Xattrs     []Xattr
+	XattrErr   error  // Why Xattrs could not be read
+	MIME       string // Detected type of regular files
+}
+
+// Stat gathers the metadata of path without following a final symlink
+func Stat(path string) (FileStat, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return FileStat{}, err
+	}
+	st := FileStat{Path: path, Info: info, Mtime: info.ModTime()}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		st.LinkTarget, _ = os.Readlink(path)
+	}
+	platformStat(path, &st)
+	if st.HasOwner {
+		st.Owner = strconv.FormatUint(uint64(st.UID), 10)
+		if u, err := user.LookupId(st.Owner); err == nil {
+			st.Owner = u.Username
+		}
+		st.Group = strconv.FormatUint(uint64(st.GID), 10)
+		if g, err := user.LookupGroupId(st.Group); err == nil {
+			st.Group = g.Name
+		}
+	}
+	// Symlinks cannot carry user attributes, and reading them would follow the link
+	if info.Mode()&fs.ModeSymlink == 0 {
+		st.Xattrs, st.XattrErr = ReadXattrs(path)
+	}
+	if info.Mode().IsRegular() {
+		if kind, err := detectKind(vfs.Host, path); err == nil {
+			st.MIME = kind.mime
+		}
+	}
+	return st, nil
+}
+
+// FileTypeName describes the type of a file the way stat does
+func FileTypeName(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode.IsRegular() && info.Size() == 0:
+		return "regular empty file"
+	case mode.IsRegular():
+		return "regular file"
+	case mode.IsDir():
+		return "directory"
+	case mode&fs.ModeSymlink != 0:
+		return "symbolic link"
+	case mode&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character special file"
+	case mode&fs.ModeDevice != 0:
+		return "block special file"
+	}
+	return "unknown"
+}
+
+// OctalMode formats the permission bits of mode, with setuid, setgid and
+// sticky, as chmod takes them
+func OctalMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", unixBits(mode))
+}
+
+// SymbolicMode formats mode the way ls -l does, such as "drwxr-sr-t"
+func SymbolicMode(mode os.FileMode) string {
+	var b strings.Builder
+	switch {
+	case mode.IsDir():
+		b.WriteByte('d')
+	case mode&fs.ModeSymlink != 0:
+		b.WriteByte('l')
+	case mode&fs.ModeNamedPipe != 0:
+		b.WriteByte('p')
+	case mode&fs.ModeSocket != 0:
+		b.WriteByte('s')
+	case mode&fs.ModeCharDevice != 0:
+		b.WriteByte('c')
+	case mode&fs.ModeDevice != 0:
+		b.WriteByte('b')
+	default:
+		b.WriteByte('-')
+	}
+	special := [3]os.FileMode{os.ModeSetuid, os.ModeSetgid, os.ModeSticky}
+	for i := 0; i < 3; i++ {
+		bits := mode.Perm() >> uint(6-3*i)
+		b.WriteByte("-r"[bits>>2&1])
+		b.WriteByte("-w"[bits>>1&1])
+		exec := bits&1 != 0
+		switch {
+		case mode&special[i] == 0 && exec:
+			b.WriteByte('x')
+		case mode&special[i] == 0:
+			b.WriteByte('-')
+		case i == 2 && exec:
+			b.WriteByte('t')
+		case i == 2:
+			b.WriteByte('T')
+		case exec:
+			b.WriteByte('s')
+		default:
+			b.WriteByte('S')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,22 @@
+package fileops
+
+import (
+	"syscall"
+	"time"
+)
+
+// platformStat fills in st from lstat, which on macOS includes the birth time
+func platformStat(path string, st *FileStat) {
+	sys, ok := st.Info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	dev := uint32(sys.Dev)
+	st.HasOwner, st.UID, st.GID = true, sys.Uid, sys.Gid
+	st.Blocks, st.BlockSize = sys.Blocks, int64(sys.Blksize)
+	st.Inode, st.Links = sys.Ino, uint64(sys.Nlink)
+	st.DevMajor, st.DevMinor = dev>>24&0xff, dev&0xffffff
+	st.Atime = time.Unix(sys.Atimespec.Unix())
+	st.Ctime = time.Unix(sys.Ctimespec.Unix())
+	st.Birth = time.Unix(sys.Birthtimespec.Unix())
+}
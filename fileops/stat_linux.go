@@ -0,0 +1,105 @@
+package fileops
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// statx is not in the syscall package, so its number is kept per architecture
+var sysStatx = map[string]uintptr{
+	"386":      383,
+	"amd64":    332,
+	"arm":      397,
+	"arm64":    291,
+	"loong64":  291,
+	"mips":     4366,
+	"mipsle":   4366,
+	"mips64":   5326,
+	"mips64le": 5326,
+	"ppc64":    383,
+	"ppc64le":  383,
+	"riscv64":  291,
+	"s390x":    379,
+}[runtime.GOARCH]
+
+const (
+	atFDCWD           = -100
+	atSymlinkNoFollow = 0x100
+	statxAll          = 0xfff
+	statxBtime        = 0x800
+)
+
+type statxTimestamp struct {
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+// statxT mirrors struct statx of linux/stat.h
+type statxT struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	UID            uint32
+	GID            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	_              [14]uint64
+}
+
+func (t statxTimestamp) time() time.Time {
+	return time.Unix(t.Sec, int64(t.Nsec))
+}
+
+// platformStat fills in st with statx, which also knows the birth time, or
+// with lstat on kernels older than 4.11
+func platformStat(path string, st *FileStat) {
+	if sysStatx != 0 {
+		if p, err := syscall.BytePtrFromString(path); err == nil {
+			var sx statxT
+			fd := atFDCWD
+			_, _, errno := syscall.Syscall6(sysStatx, uintptr(fd), uintptr(unsafe.Pointer(p)),
+				atSymlinkNoFollow, statxAll, uintptr(unsafe.Pointer(&sx)), 0)
+			if errno == 0 {
+				st.HasOwner, st.UID, st.GID = true, sx.UID, sx.GID
+				st.Blocks, st.BlockSize = int64(sx.Blocks), int64(sx.Blksize)
+				st.Inode, st.Links = sx.Ino, uint64(sx.Nlink)
+				st.DevMajor, st.DevMinor = sx.DevMajor, sx.DevMinor
+				st.Atime, st.Mtime, st.Ctime = sx.Atime.time(), sx.Mtime.time(), sx.Ctime.time()
+				// Some file systems set the flag but leave the time zero
+				if sx.Mask&statxBtime != 0 && (sx.Btime.Sec != 0 || sx.Btime.Nsec != 0) {
+					st.Birth = sx.Btime.time()
+				}
+				return
+			}
+		}
+	}
+
+	sys, ok := st.Info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	dev := uint64(sys.Dev)
+	st.HasOwner, st.UID, st.GID = true, sys.Uid, sys.Gid
+	st.Blocks, st.BlockSize = int64(sys.Blocks), int64(sys.Blksize)
+	st.Inode, st.Links = uint64(sys.Ino), uint64(sys.Nlink)
+	st.DevMajor = uint32((dev>>8)&0xfff | (dev>>32)&^0xfff)
+	st.DevMinor = uint32(dev&0xff | (dev>>12)&^0xff)
+	st.Atime = time.Unix(sys.Atim.Unix())
+	st.Ctime = time.Unix(sys.Ctim.Unix())
+}
@@ -0,0 +1,6 @@
+//go:build !linux && !darwin
+
+package fileops
+
+// platformStat leaves st as os.Lstat filled it in where there is no stat(2)
+func platformStat(path string, st *FileStat) {}
@@ -0,0 +1,24 @@
+package fileops
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	seekHole = 3
+	seekData = 4
+)
+
+// reflink is not attempted on macOS; clonefile(2) needs a path-based API
+func reflink(dst, src *os.File) error {
+	return syscall.ENOTSUP
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Unix())
+	}
+	return info.ModTime()
+}
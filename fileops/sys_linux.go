@@ -0,0 +1,30 @@
+package fileops
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+
+	ioctlFICLONE = 0x40049409
+)
+
+// reflink shares the data blocks of src with dst on filesystems such as Btrfs and XFS
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ioctlFICLONE, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,40 @@
+//go:build !linux && !darwin
+
+package fileops
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var errUnsupported = errors.New("not supported on this platform")
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+func reflink(dst, src *os.File) error {
+	return errUnsupported
+}
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errUnsupported
+}
+
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func allocatedBytes(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+func fileID(info os.FileInfo) (FileID, uint64, bool) {
+	return FileID{}, 0, false
+}
@@ -0,0 +1,70 @@
+package fileops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TemplateVars returns the placeholders a name template can use for a file:
+// {name} (without extension), {ext} (without dot), {.ext} (with dot, or
+// empty), and {date}, {year}, {month}, {day} and {time} from its mtime
+func TemplateVars(path string, info os.FileInfo) map[string]string {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = "" // Dot files such as ".bashrc" have no extension
+	}
+	mtime := info.ModTime()
+	return map[string]string{
+		"name":  strings.TrimSuffix(base, ext),
+		"ext":   strings.TrimPrefix(ext, "."),
+		".ext":  ext,
+		"date":  mtime.Format("2006-01-02"),
+		"year":  mtime.Format("2006"),
+		"month": mtime.Format("01"),
+		"day":   mtime.Format("02"),
+		"time":  mtime.Format("150405"),
+	}
+}
+
+// ExpandTemplate replaces each {key} in tmpl with vars[key]. A counter
+// placeholder {n} expands to counter, and {n:3} pads it to three digits.
+// Unknown placeholders are an error so typos do not end up in file names.
+func ExpandTemplate(tmpl string, vars map[string]string, counter int) (string, error) {
+	var out strings.Builder
+	for {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			out.WriteString(tmpl)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(tmpl[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed { in template %q", tmpl)
+		}
+		out.WriteString(tmpl[:open])
+		placeholder := tmpl[open : open+end+1]
+		key, arg, hasArg := strings.Cut(placeholder[1:len(placeholder)-1], ":")
+		tmpl = tmpl[open+end+1:]
+
+		if key == "n" {
+			width := 0
+			if hasArg {
+				var err error
+				if width, err = strconv.Atoi(arg); err != nil || width < 0 {
+					return "", fmt.Errorf("invalid counter width %q", arg)
+				}
+			}
+			fmt.Fprintf(&out, "%0*d", width, counter)
+			continue
+		}
+		value, ok := vars[key]
+		if !ok || hasArg {
+			return "", fmt.Errorf("unknown placeholder %s", placeholder)
+		}
+		out.WriteString(value)
+	}
+}
@@ -0,0 +1,447 @@
+package fileops
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// trashDateLayout is the DeletionDate format of the freedesktop.org Trash spec, in local time
+const trashDateLayout = "2006-01-02T15:04:05"
+
+// Trash is a trash directory laid out as the freedesktop.org Trash spec
+// describes: deleted entries live in files/ and a .trashinfo file with the
+// same name in info/ records where each came from and when
+type Trash struct {
+	Dir string
+}
+
+// TrashItem describes one entry of a trash directory
+type TrashItem struct {
+	Name         string // Name inside files/
+	OriginalPath string
+	DeletedAt    time.Time
+	IsDir        bool
+	Size         int64
+}
+
+// HomeTrash returns the trash in $XDG_DATA_HOME, ~/.local/share/Trash by default
+func HomeTrash() *Trash {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			homeDir = "."
+		}
+		dataHome = filepath.Join(homeDir, ".local", "share")
+	}
+	return &Trash{Dir: filepath.Join(dataHome, "Trash")}
+}
+
+// TrashFor returns the trash an entry at path goes to: the home trash when
+// it is on the same filesystem, otherwise the trash at the top of the
+// entry's filesystem, which is $topdir/.Trash/$uid when an administrator
+// prepared a sticky $topdir/.Trash, or else $topdir/.Trash-$uid. The home
+// trash is the fallback when neither can be used.
+func TrashFor(path string) *Trash {
+	home := HomeTrash()
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return home
+	}
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return home
+	}
+	id, _, ok := fileID(info)
+	if !ok || os.Getuid() < 0 {
+		return home
+	}
+	if dev, ok := deviceOf(home.Dir); !ok || dev == id.Dev {
+		return home
+	}
+	if trash := topDirTrash(mountTop(abs, id.Dev)); trash != nil {
+		return trash
+	}
+	return home
+}
+
+// Trashes returns the home trash followed by the top directory trashes of
+// the current user on mounted filesystems
+func Trashes() []*Trash {
+	trashes := []*Trash{HomeTrash()}
+	if os.Getuid() < 0 {
+		return trashes
+	}
+	uid := strconv.Itoa(os.Getuid())
+	seen := map[string]bool{}
+	for _, top := range mountPoints() {
+		for _, dir := range []string{filepath.Join(top, ".Trash", uid), filepath.Join(top, ".Trash-"+uid)} {
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			if info, err := os.Lstat(filepath.Join(dir, "info")); err == nil && info.IsDir() {
+				trashes = append(trashes, &Trash{Dir: dir})
+			}
+		}
+	}
+	return trashes
+}
+
+// IsTrashDir reports whether dir is the home trash or a top directory trash,
+// which walks over the file system should not descend into
+func IsTrashDir(dir string) bool {
+	if dir == HomeTrash().Dir {
+		return true
+	}
+	base := filepath.Base(dir)
+	return base == ".Trash" || base == ".Trash-"+strconv.Itoa(os.Getuid())
+}
+
+// topDirTrash returns the trash of the current user at the top of a
+// filesystem, creating it when needed, or nil when it cannot be used
+func topDirTrash(top string) *Trash {
+	uid := strconv.Itoa(os.Getuid())
+
+	// A shared .Trash must be a real sticky directory, never a symlink
+	shared := filepath.Join(top, ".Trash")
+	if info, err := os.Lstat(shared); err == nil && info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		dir := filepath.Join(shared, uid)
+		if err := os.Mkdir(dir, 0700); err == nil || os.IsExist(err) {
+			if info, err := os.Lstat(dir); err == nil && info.IsDir() {
+				return &Trash{Dir: dir}
+			}
+		}
+	}
+
+	dir := filepath.Join(top, ".Trash-"+uid)
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return nil
+	}
+	if info, err := os.Lstat(dir); err == nil && info.IsDir() {
+		return &Trash{Dir: dir}
+	}
+	return nil
+}
+
+// mountTop returns the top directory of the filesystem dev holding path
+func mountTop(path string, dev uint64) string {
+	dir := path
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		if parentDev, ok := deviceOf(parent); !ok || parentDev != dev {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// deviceOf returns the device of path, or of its closest existing parent
+func deviceOf(path string) (uint64, bool) {
+	for {
+		if info, err := os.Stat(path); err == nil {
+			id, _, ok := fileID(info)
+			return id.Dev, ok
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0, false
+		}
+		path = parent
+	}
+}
+
+// TrashOf returns the trash holding a path inside its files/ directory
+func TrashOf(trashedPath string) *Trash {
+	return &Trash{Dir: filepath.Dir(filepath.Dir(trashedPath))}
+}
+
+// top is the directory holding a top directory trash, either as
+// $topdir/.Trash-$uid or as $topdir/.Trash/$uid
+func (t *Trash) top() string {
+	parent := filepath.Dir(t.Dir)
+	if filepath.Base(parent) == ".Trash" {
+		return filepath.Dir(parent)
+	}
+	return parent
+}
+
+func (t *Trash) filesDir() string { return filepath.Join(t.Dir, "files") }
+func (t *Trash) infoDir() string  { return filepath.Join(t.Dir, "info") }
+
+// FilePath returns where the entry called name is stored
+func (t *Trash) FilePath(name string) string {
+	return filepath.Join(t.filesDir(), name)
+}
+
+func (t *Trash) infoPath(name string) string {
+	return filepath.Join(t.infoDir(), name+".trashinfo")
+}
+
+// Put moves path into the trash and returns the path it is stored under.
+// The info file is created first with O_EXCL, which reserves the name even
+// when several programs trash files with the same name at once.
+func (t *Trash) Put(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(abs); err != nil {
+		return "", err
+	}
+	if IsWithin(abs, t.Dir) {
+		return "", fmt.Errorf("cannot move %s into the trash that contains it", path)
+	}
+	if err := os.MkdirAll(t.filesDir(), 0700); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(t.infoDir(), 0700); err != nil {
+		return "", err
+	}
+
+	name, err := t.reserveName(abs)
+	if err != nil {
+		return "", err
+	}
+
+	trashed := t.FilePath(name)
+	err = os.Rename(abs, trashed)
+	if errors.Is(err, syscall.EXDEV) {
+		// Only the home trash was usable and it is on another filesystem; copy the entry over
+		_, err = Move(abs, trashed, MoveOptions{})
+	}
+	if err != nil {
+		os.Remove(t.infoPath(name))
+		return "", err
+	}
+	return trashed, nil
+}
+
+func (t *Trash) reserveName(abs string) (string, error) {
+	base := filepath.Base(abs)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s.%d%s", stem, i, ext)
+		}
+		if _, err := os.Lstat(t.FilePath(name)); err == nil {
+			continue
+		}
+		err := t.writeInfo(name, abs)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+}
+
+// writeInfo records that the entry called name was deleted from abs now.
+// It fails when the info file exists.
+func (t *Trash) writeInfo(name, abs string) error {
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: abs}).EscapedPath(), time.Now().Format(trashDateLayout))
+	f, err := os.OpenFile(t.infoPath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(info)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(t.infoPath(name))
+	}
+	return err
+}
+
+// InTrash reports whether path is an entry in the files/ directory of a trash
+func InTrash(path string) bool {
+	files := filepath.Dir(path)
+	if filepath.Base(files) != "files" {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(filepath.Dir(files), "info"))
+	return err == nil && info.IsDir()
+}
+
+// Return moves path back into the trash as the entry called name, which it
+// was restored from, and records it as deleted from path again
+func (t *Trash) Return(path, name string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(t.FilePath(name)); err == nil {
+		return fmt.Errorf("%s: already in the trash", name)
+	}
+	if err := t.writeInfo(name, abs); err != nil {
+		return err
+	}
+	if _, err := Move(abs, t.FilePath(name), MoveOptions{}); err != nil {
+		os.Remove(t.infoPath(name))
+		return err
+	}
+	return nil
+}
+
+// List returns the entries of the trash, most recently deleted first
+func (t *Trash) List() ([]TrashItem, error) {
+	infos, err := os.ReadDir(t.infoDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var items []TrashItem
+	for _, entry := range infos {
+		name, ok := strings.CutSuffix(entry.Name(), ".trashinfo")
+		if !ok {
+			continue
+		}
+		item, err := t.Item(name)
+		if err != nil {
+			continue // Orphaned or unreadable info files are not listed
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+// Item reads the info of the entry called name
+func (t *Trash) Item(name string) (TrashItem, error) {
+	stat, err := os.Lstat(t.FilePath(name))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	f, err := os.Open(t.infoPath(name))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	defer f.Close()
+
+	item := TrashItem{Name: name, IsDir: stat.IsDir(), Size: stat.Size()}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Path":
+			path, err := url.PathUnescape(value)
+			if err != nil {
+				return TrashItem{}, err
+			}
+			if !filepath.IsAbs(path) {
+				// Relative paths are relative to the top of the trash's filesystem
+				path = filepath.Join(t.top(), path)
+			}
+			item.OriginalPath = path
+		case "DeletionDate":
+			item.DeletedAt, _ = time.ParseInLocation(trashDateLayout, value, time.Local)
+		}
+	}
+	if item.OriginalPath == "" {
+		return TrashItem{}, fmt.Errorf("%s: missing Path in trash info", name)
+	}
+	return item, scanner.Err()
+}
+
+// Find looks an entry up by its trash name, or else by its original path,
+// preferring the most recent deletion
+func (t *Trash) Find(nameOrPath string) (TrashItem, error) {
+	if item, err := t.Item(nameOrPath); err == nil {
+		return item, nil
+	}
+	abs, _ := filepath.Abs(nameOrPath)
+	items, err := t.List()
+	if err != nil {
+		return TrashItem{}, err
+	}
+	for _, item := range items {
+		if item.OriginalPath == abs {
+			return item, nil
+		}
+	}
+	return TrashItem{}, fmt.Errorf("%s: not in the trash", nameOrPath)
+}
+
+// Restore moves an entry back to its original location, recreating missing
+// parent directories. The conflict policy decides what happens when something
+// already exists there; the final path is returned, or "" when skipped.
+func (t *Trash) Restore(name string, conflict ConflictOptions) (string, error) {
+	item, err := t.Item(name)
+	if err != nil {
+		return "", err
+	}
+	return t.RestoreTo(name, item.OriginalPath, conflict)
+}
+
+// RestoreTo moves the entry called name to target and drops its info file
+func (t *Trash) RestoreTo(name, target string, conflict ConflictOptions) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	restored, err := Move(t.FilePath(name), target, MoveOptions{Conflict: conflict})
+	if err != nil || restored == "" {
+		return restored, err
+	}
+	os.Remove(t.infoPath(name))
+	return restored, nil
+}
+
+// Remove permanently deletes the entry called name
+func (t *Trash) Remove(name string) error {
+	if err := os.RemoveAll(t.FilePath(name)); err != nil {
+		return err
+	}
+	return os.Remove(t.infoPath(name))
+}
+
+// Empty permanently deletes entries trashed before cutoff, or all of them
+// when cutoff is zero, returning how many were removed
+func (t *Trash) Empty(cutoff time.Time) (int, error) {
+	items, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	var errs []error
+	for _, item := range items {
+		if !cutoff.IsZero() && !item.DeletedAt.Before(cutoff) {
+			continue
+		}
+		if err := t.Remove(item.Name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package fileops
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrVerifyMismatch is returned when a copied file does not match its source
+var ErrVerifyMismatch = errors.New("checksum mismatch")
+
+// FileChecksum returns the hex SHA-256 digest of a file
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyCopies checksums every source and destination pair with a bounded
+// number of workers and reports each mismatch
+func verifyCopies(files []copyEntry, workers int) (int, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	verified := 0
+
+	slots := make(chan struct{}, workers)
+	for _, file := range files {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(file copyEntry) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			srcSum, err := FileChecksum(file.src)
+			if err == nil {
+				var dstSum string
+				dstSum, err = FileChecksum(file.dst)
+				if err == nil && srcSum != dstSum {
+					err = fmt.Errorf("%w: %s (%s) and %s (%s)", ErrVerifyMismatch, file.src, srcSum[:12], file.dst, dstSum[:12])
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			verified++
+		}(file)
+	}
+	wg.Wait()
+	return verified, errors.Join(errs...)
+}
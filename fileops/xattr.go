@@ -0,0 +1,81 @@
+package fileops
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrXattrUnsupported is returned where extended attributes are not available
+	ErrXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+	// ErrNoXattr is returned for an attribute a file does not have
+	ErrNoXattr = errors.New("no such attribute")
+)
+
+// Xattr is an extended attribute of a file
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// xattrNamespaces are the namespaces Linux knows; names in none of them are users'
+var xattrNamespaces = []string{"user.", "trusted.", "security.", "system."}
+
+// XattrName completes a bare attribute name, such as "pipeline", into the
+// user namespace
+func XattrName(name string) string {
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(name, ns) {
+			return name
+		}
+	}
+	return "user." + name
+}
+
+// IsUserXattr reports whether name is in the user namespace, the only one
+// restored from archives
+func IsUserXattr(name string) bool {
+	return strings.HasPrefix(name, "user.")
+}
+
+// ReadXattrs returns every extended attribute of path that can be read, sorted by name
+func ReadXattrs(path string) ([]Xattr, error) {
+	names, err := ListXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	attrs := make([]Xattr, 0, len(names))
+	for _, name := range names {
+		value, err := GetXattr(path, name)
+		if err != nil {
+			continue // Some namespaces need privileges to read
+		}
+		attrs = append(attrs, Xattr{Name: name, Value: value})
+	}
+	return attrs, nil
+}
+
+// CopyXattrs gives dst the extended attributes of src. Attributes are lost
+// on a destination without support for them, as with mv; those outside the
+// user namespace are copied where privileges allow.
+func CopyXattrs(src, dst string) error {
+	attrs, err := ReadXattrs(src)
+	if errors.Is(err, ErrXattrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		err := SetXattr(dst, attr.Name, attr.Value)
+		if errors.Is(err, ErrXattrUnsupported) {
+			return nil
+		}
+		if err != nil && IsUserXattr(attr.Name) {
+			return err
+		}
+	}
+	return nil
+}
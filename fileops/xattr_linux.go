@@ -0,0 +1,81 @@
+package fileops
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ListXattrs returns the names of the extended attributes of path
+func ListXattrs(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	for err == nil {
+		buf := make([]byte, size)
+		var n int
+		n, err = syscall.Listxattr(path, buf)
+		// The list may have grown since it was measured
+		if errors.Is(err, syscall.ERANGE) {
+			size, err = syscall.Listxattr(path, nil)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	return nil, xattrError("listxattr", path, err)
+}
+
+// GetXattr returns the value of the extended attribute name of path
+func GetXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	for err == nil {
+		buf := make([]byte, size)
+		var n int
+		n, err = syscall.Getxattr(path, name, buf)
+		if errors.Is(err, syscall.ERANGE) {
+			size, err = syscall.Getxattr(path, name, nil)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		return buf[:n], nil
+	}
+	return nil, xattrError("getxattr", path, err)
+}
+
+// SetXattr creates or replaces the extended attribute name of path
+func SetXattr(path, name string, value []byte) error {
+	if err := syscall.Setxattr(path, name, value, 0); err != nil {
+		return xattrError("setxattr", path, err)
+	}
+	return nil
+}
+
+// RemoveXattr removes the extended attribute name of path
+func RemoveXattr(path, name string) error {
+	if err := syscall.Removexattr(path, name); err != nil {
+		return xattrError("removexattr", path, err)
+	}
+	return nil
+}
+
+// xattrError reports a file system without extended attributes, and a
+// missing attribute, as such
+func xattrError(op, path string, err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOTSUP):
+		err = ErrXattrUnsupported
+	case errors.Is(err, syscall.ENODATA):
+		err = ErrNoXattr
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
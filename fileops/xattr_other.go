@@ -0,0 +1,23 @@
+//go:build !linux
+
+package fileops
+
+// ListXattrs returns the names of the extended attributes of path
+func ListXattrs(path string) ([]string, error) {
+	return nil, ErrXattrUnsupported
+}
+
+// GetXattr returns the value of the extended attribute name of path
+func GetXattr(path, name string) ([]byte, error) {
+	return nil, ErrXattrUnsupported
+}
+
+// SetXattr creates or replaces the extended attribute name of path
+func SetXattr(path, name string, value []byte) error {
+	return ErrXattrUnsupported
+}
+
+// RemoveXattr removes the extended attribute name of path
+func RemoveXattr(path, name string) error {
+	return ErrXattrUnsupported
+}
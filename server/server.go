@@ -0,0 +1,379 @@
+// Package server shares a directory over HTTP: an HTML index of every
+// directory, files with range requests, directories as zip files made on
+// the fly and, when enabled, uploads. Nothing outside the directory can be
+// reached, not even through symlinks.
+package server
+
+import (
+	"archive/zip"
+	"crypto/subtle"
+	"errors"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Options controls a file server
+type Options struct {
+	Root      string    // Directory to serve
+	Uploads   bool      // Accept uploads into directories; the server is read-only otherwise
+	MaxUpload int64     // Largest upload request in bytes, unlimited when 0
+	User      string    // Require basic authentication when set
+	Password  string    // Password of User
+	Log       io.Writer // Receives one line per request when set
+
+	// Uploaded is called for every file stored by an upload
+	Uploaded func(path string, size int64)
+}
+
+// handler serves the files below root
+type handler struct {
+	opts Options
+	root string // Resolved Options.Root
+	jail *utils.Policy
+}
+
+// NewHandler returns a handler serving opts.Root
+func NewHandler(opts Options) (http.Handler, error) {
+	abs, err := filepath.Abs(opts.Root)
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", opts.Root)
+	}
+	return &handler{opts: opts, root: root, jail: &utils.Policy{Root: root}}, nil
+}
+
+// statusWriter remembers the status of a response for the log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w}
+	h.serve(sw, r)
+	if h.opts.Log != nil {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprintf(h.opts.Log, "%s %s %s %s %d\n", time.Now().Format("15:04:05"), host, r.Method, r.URL.Path, sw.status)
+	}
+}
+
+func (h *handler) serve(w http.ResponseWriter, r *http.Request) {
+	if h.opts.User != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(h.opts.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(h.opts.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fmsh", charset="UTF-8"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	file, info, ok := h.resolve(urlPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && info.IsDir() && h.opts.Uploads:
+		h.upload(w, r, file, urlPath)
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+	case info.IsDir() && r.URL.Query().Has("zip"):
+		h.zipDir(w, file, urlPath)
+	case info.IsDir() && !strings.HasSuffix(r.URL.Path, "/"):
+		http.Redirect(w, r, escapePath(urlPath)+"/", http.StatusMovedPermanently)
+	case info.IsDir():
+		h.listDir(w, r, file, urlPath)
+	default:
+		f, err := os.Open(file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		// ServeContent answers range and conditional requests
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	}
+}
+
+// resolve maps a cleaned URL path to a file inside the root, following
+// symlinks only as long as they stay inside it
+func (h *handler) resolve(urlPath string) (string, os.FileInfo, bool) {
+	file, err := h.jail.Check(filepath.Join(h.root, filepath.FromSlash(urlPath)))
+	if err != nil {
+		return "", nil, false
+	}
+	info, err := os.Stat(file)
+	if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+		return "", nil, false
+	}
+	return file, info, true
+}
+
+type indexEntry struct {
+	Name    string
+	Href    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// listDir renders the HTML index of a directory, directories first
+func (h *handler) listDir(w http.ResponseWriter, r *http.Request, dir, urlPath string) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+	var entries []indexEntry
+	for _, entry := range dirEntries {
+		// Hide what cannot be served, such as symlinks leading outside
+		_, info, ok := h.resolve(path.Join(urlPath, entry.Name()))
+		if !ok {
+			continue
+		}
+		// "./" keeps names with a colon from reading as a URL scheme
+		href := "./" + escapePath(entry.Name())
+		if info.IsDir() {
+			href += "/"
+		}
+		entries = append(entries, indexEntry{Name: entry.Name(), Href: href, IsDir: info.IsDir(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].IsDir && !entries[j].IsDir })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	indexPage.Execute(w, struct {
+		Path    string
+		Parent  bool
+		Uploads bool
+		Entries []indexEntry
+	}{urlPath, urlPath != "/", h.opts.Uploads, entries})
+}
+
+// zipDir streams a directory as a zip file. Symlinks are left out, so the
+// archive holds nothing from outside the root.
+func (h *handler) zipDir(w http.ResponseWriter, dir, urlPath string) {
+	name := path.Base(urlPath)
+	if urlPath == "/" {
+		name = filepath.Base(h.root)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+
+	zw := zip.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name + "/" + filepath.ToSlash(rel)
+		if entry.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		out, err := zw.CreateHeader(header)
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(out, f)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// The status is long sent; a broken archive is all the client gets
+		fmt.Fprintf(os.Stderr, "serve: zip of %s: %v\n", urlPath, err)
+	}
+}
+
+// upload stores the files of a multipart form in a directory. Existing
+// files are never replaced: clashing uploads get a numbered name.
+func (h *handler) upload(w http.ResponseWriter, r *http.Request, dir, urlPath string) {
+	// Browsers resend basic auth to any page that posts here, so only
+	// forms served by this share may upload
+	if !sameOrigin(r) {
+		http.Error(w, "403 forbidden: cross-origin upload", http.StatusForbidden)
+		return
+	}
+	if h.opts.MaxUpload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.opts.MaxUpload)
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := part.FileName()
+		if name == "" {
+			continue // An ordinary form field
+		}
+		name = filepath.Base(filepath.FromSlash(strings.ReplaceAll(name, "\\", "/")))
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			http.Error(w, "400 bad request: invalid file name", http.StatusBadRequest)
+			return
+		}
+		target, size, err := h.store(part, filepath.Join(dir, name))
+		if err != nil {
+			status := http.StatusInternalServerError
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("%d upload failed: %v", status, err), status)
+			return
+		}
+		if h.opts.Uploaded != nil {
+			h.opts.Uploaded(target, size)
+		}
+	}
+	http.Redirect(w, r, escapePath(urlPath), http.StatusSeeOther)
+}
+
+// sameOrigin reports whether r comes from a page of the host being served.
+// Clients such as curl send neither Origin nor Referer and are let through.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Referer()
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	return err == nil && u.Host == r.Host
+}
+
+// store writes an upload through a temporary file, so failed uploads leave
+// nothing behind, and returns where it ended up
+func (h *handler) store(r io.Reader, target string) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		target = fileops.UniqueName(target)
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return target, size, nil
+}
+
+// escapePath escapes a slash-separated path for use in a URL
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// humanSize formats a byte count with binary units
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n), 0
+	for value >= 1024 && unit < 5 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "BKMGTP"[unit])
+}
+
+var indexPage = template.Must(template.New("index").Funcs(template.FuncMap{"size": humanSize}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: left; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<p><a href="?zip">Download this folder as zip</a></p>
+{{if .Uploads}}<form method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple> <input type="submit" value="Upload">
+</form>{{end}}
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Parent}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td class="size">{{if not .IsDir}}{{size .Size}}{{end}}</td><td>{{.ModTime.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
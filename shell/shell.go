@@ -2,6 +2,7 @@ package shell
 
 import (
 	"fmsh/commands"
+	"fmsh/utils"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,12 +14,42 @@ import (
 var historyFile string
 var history = []string{}
 
-// Start begins the shell session
-func Start() {
+// Start begins the shell session, restoring and finally saving the named session state
+func Start(session string) {
 	commands.InitializeCommands()
 
+	state, err := utils.LoadSession(session)
+	if err != nil {
+		fmt.Printf("Error loading session %s: %v\n", session, err)
+	}
+	commands.RestoreSession(state)
+	defer func() {
+		if err := commands.CaptureSession(session).Save(); err != nil {
+			fmt.Printf("Error saving session %s: %v\n", session, err)
+		}
+	}()
+
+	if err := utils.GlobalUndoManager.Open(utils.UndoJournalPath(session)); err != nil {
+		fmt.Printf("Error loading undo journal: %v\n", err)
+	}
+
+	if err := utils.GlobalAuditLog.Open(utils.ConfigPath("audit.jsonl"), utils.NewSessionID()); err != nil {
+		fmt.Printf("Error opening audit log: %v\n", err)
+	}
+	commands.RecoverTransaction()
+	defer func() {
+		if utils.GlobalUndoManager.Transaction() != nil {
+			fmt.Println("The open transaction is kept; you will be asked about it on the next start.")
+		}
+	}()
+
 	setHistoryFile()
+
+	// Commands run in the terminal mode fmsh was started in, so prompts and
+	// pagers see cooked input; liner's raw mode is restored for the next line
+	originalMode, _ := liner.TerminalMode()
 	line := liner.NewLiner()
+	linerMode, _ := liner.TerminalMode()
 	defer func() {
 		saveHistory(line)
 		line.Close()
@@ -54,7 +85,16 @@ func Start() {
 		history = append(history, input)
 		line.AppendHistory(input)
 
+		if originalMode != nil {
+			originalMode.ApplyMode()
+		}
 		commands.DispatchCommand(input)
+		if linerMode != nil {
+			linerMode.ApplyMode()
+		}
+		if commands.ExitRequested() {
+			break
+		}
 	}
 }
 
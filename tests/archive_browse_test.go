@@ -0,0 +1,117 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func makeBrowseArchive(t *testing.T, name string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	tree := filepath.Join(dir, "rel")
+	mustMkdir(t, filepath.Join(tree, "bin"))
+	mustMkdir(t, filepath.Join(tree, "doc"))
+	mustWrite(t, filepath.Join(tree, "bin", "tool"), []byte("tool"), 0755)
+	mustWrite(t, filepath.Join(tree, "doc", "README"), []byte("read me"), 0644)
+	if err := os.Symlink("../doc/README", filepath.Join(tree, "bin", "readme")); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, name)
+	if _, err := fileops.CreateArchive(archive, []string{tree}, fileops.ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return dir, archive
+}
+
+func TestArchiveFS(t *testing.T) {
+	for _, name := range []string{"rel.zip", "rel.tar.gz"} {
+		_, archive := makeBrowseArchive(t, name)
+		fsys, err := fileops.OpenArchiveFS(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fstest.TestFS(fsys, "rel/bin/tool", "rel/doc/README", "rel/bin/readme"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		fsys.Close()
+
+		if _, inner, ok := fileops.SplitArchivePath(filepath.Join(archive, "rel", "bin")); !ok || inner != "rel/bin" {
+			t.Errorf("%s: expected the path inside the archive, got %q %v", name, inner, ok)
+		}
+	}
+}
+
+func TestBrowseArchive(t *testing.T) {
+	cwd, _ := os.Getwd()
+	defer commands.DispatchCommand("cd " + cwd)
+	commands.InitializeCommands()
+
+	dir, archive := makeBrowseArchive(t, "rel.tar.gz")
+	commands.DispatchCommand("cd " + archive + "/rel/bin")
+	if got := commands.Workdir(); got != filepath.Join(archive, "rel", "bin") {
+		t.Fatalf("Expected to be inside the archive, got %s", got)
+	}
+
+	// Mutations are refused, copies out of the archive work
+	commands.DispatchCommand("rm tool")
+	commands.DispatchCommand("mkdir new")
+	commands.DispatchCommand("cp tool " + filepath.Join(dir, "tool.out"))
+	commands.DispatchCommand("cp -r ../doc " + filepath.Join(dir, "doc.out"))
+	if _, err := os.Stat(filepath.Join(dir, "new")); err == nil {
+		t.Error("Expected mkdir to be refused inside an archive")
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "tool.out")); err != nil || string(data) != "tool" {
+		t.Errorf("Expected the file to be copied out: %q %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "tool.out")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected the copy to keep its mode: %v", info)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doc.out", "README")); err != nil {
+		t.Errorf("Expected the directory to be copied out: %v", err)
+	}
+
+	commands.DispatchCommand("cd ../../..")
+	if got := commands.Workdir(); got != dir {
+		t.Errorf("Expected cd .. to leave the archive, got %s", got)
+	}
+	commands.DispatchCommand("rm " + archive + "/rel/bin/tool")
+	if _, err := os.Stat(archive); err != nil {
+		t.Errorf("Expected the archive to be left alone: %v", err)
+	}
+}
+
+func TestInspectArchivesConcurrently(t *testing.T) {
+	_, first := makeBrowseArchive(t, "first.zip")
+	_, second := makeBrowseArchive(t, "second.zip")
+
+	// Each job replaces the cached archive the other one is reading
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		archive := first
+		if i%2 == 1 {
+			archive = second
+		}
+		wg.Add(1)
+		go func(i int, archive string) {
+			defer wg.Done()
+			result, err := commands.Inspect(archive, commands.Task{})
+			if err == nil && result.Files != 3 {
+				err = fmt.Errorf("%s: expected 3 files, got %d", archive, result.Files)
+			}
+			errs[i] = err
+		}(i, archive)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package shell_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmsh/fileops"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	tree := filepath.Join(src, "tree")
+	mustMkdir(t, filepath.Join(tree, "sub"))
+	mustWrite(t, filepath.Join(tree, "a.txt"), []byte(strings.Repeat("hello ", 1000)), 0644)
+	mustWrite(t, filepath.Join(tree, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	mustWrite(t, filepath.Join(tree, "sub", "empty"), nil, 0600)
+	if err := os.Symlink("a.txt", filepath.Join(tree, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"out.zip", "out.tar", "out.tar.gz"} {
+		archive := filepath.Join(t.TempDir(), name)
+		stats, err := fileops.CreateArchive(archive, []string{tree}, fileops.ArchiveOptions{Workers: 3})
+		if err != nil {
+			t.Fatalf("%s: create failed: %v", name, err)
+		}
+		if stats.Entries != 6 {
+			t.Errorf("%s: expected 6 entries, got %d", name, stats.Entries)
+		}
+		if _, err := fileops.TestArchive(archive); err != nil {
+			t.Errorf("%s: test failed: %v", name, err)
+		}
+
+		dest := t.TempDir()
+		if _, err := fileops.ExtractArchive(archive, dest, fileops.ArchiveOptions{}); err != nil {
+			t.Fatalf("%s: extract failed: %v", name, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dest, "tree", "a.txt"))
+		if err != nil || len(data) != 6000 {
+			t.Errorf("%s: expected a.txt to round-trip: %v", name, err)
+		}
+		if info, err := os.Stat(filepath.Join(dest, "tree", "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+			t.Errorf("%s: expected run.sh to keep mode 0755: %v", name, info)
+		}
+		if target, err := os.Readlink(filepath.Join(dest, "tree", "link")); err != nil || target != "a.txt" {
+			t.Errorf("%s: expected link -> a.txt, got %q (%v)", name, target, err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "tree", "sub", "empty")); err != nil {
+			t.Errorf("%s: expected the empty file: %v", name, err)
+		}
+
+		// Extracting again only replaces files when told to
+		if _, err := fileops.ExtractArchive(archive, dest, fileops.ArchiveOptions{}); !errors.Is(err, os.ErrExist) {
+			t.Errorf("%s: expected a conflict, got %v", name, err)
+		}
+		if _, err := fileops.ExtractArchive(archive, dest, fileops.ArchiveOptions{Overwrite: true}); err != nil {
+			t.Errorf("%s: expected --force to overwrite: %v", name, err)
+		}
+	}
+
+	if _, err := fileops.CreateArchive(filepath.Join(t.TempDir(), "x.tar.bz2"), []string{tree}, fileops.ArchiveOptions{}); err == nil {
+		t.Error("Expected tar.bz2 creation to be refused")
+	}
+}
+
+func writeZipEntries(t *testing.T, path string, entries map[string]string, symlinks map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range entries {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	for name, target := range symlinks {
+		header := &zip.FileHeader{Name: name}
+		header.SetMode(os.ModeSymlink | 0777)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(target))
+	}
+	zw.Close()
+	mustWrite(t, path, buf.Bytes(), 0644)
+}
+
+func TestArchiveExtractRefusesUnsafeEntries(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "dest")
+
+	slip := filepath.Join(dir, "slip.zip")
+	writeZipEntries(t, slip, map[string]string{"../evil.txt": "x"}, nil)
+	if _, err := fileops.ExtractArchive(slip, dest, fileops.ArchiveOptions{}); !errors.Is(err, fileops.ErrUnsafeArchive) {
+		t.Errorf("Expected zip slip to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.txt")); err == nil {
+		t.Error("Expected nothing to be written outside the destination")
+	}
+	if _, err := fileops.TestArchive(slip); !errors.Is(err, fileops.ErrUnsafeArchive) {
+		t.Errorf("Expected archive test to report the unsafe entry, got %v", err)
+	}
+
+	// A symlink out of the destination must not be created, nor followed later
+	escape := filepath.Join(dir, "escape.zip")
+	writeZipEntries(t, escape, nil, map[string]string{"out": "../../"})
+	if _, err := fileops.ExtractArchive(escape, dest, fileops.ArchiveOptions{}); !errors.Is(err, fileops.ErrUnsafeArchive) {
+		t.Errorf("Expected an escaping symlink to be refused, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	tw.Close()
+	abs := filepath.Join(dir, "abs.tar")
+	mustWrite(t, abs, buf.Bytes(), 0644)
+	if _, err := fileops.ExtractArchive(abs, dest, fileops.ArchiveOptions{}); !errors.Is(err, fileops.ErrUnsafeArchive) {
+		t.Errorf("Expected an absolute symlink to be refused, got %v", err)
+	}
+
+	// Targets are resolved through links extracted earlier, and later
+	// links cannot turn an earlier one into an escape
+	chains := map[string][]tar.Header{
+		"chain.tar": {
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "m", Typeflag: tar.TypeSymlink, Linkname: "l/../escape"},
+			{Name: "m/sub/x.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"late.tar": {
+			{Name: "keep.txt", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "x/../escape"},
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+		},
+	}
+	for name, headers := range chains {
+		buf.Reset()
+		tw := tar.NewWriter(&buf)
+		for _, header := range headers {
+			header := header
+			tw.WriteHeader(&header)
+		}
+		tw.Close()
+		archive := filepath.Join(dir, name)
+		mustWrite(t, archive, buf.Bytes(), 0644)
+		target := filepath.Join(dir, "chained")
+		if _, err := fileops.ExtractArchive(archive, target, fileops.ArchiveOptions{}); !errors.Is(err, fileops.ErrUnsafeArchive) {
+			t.Errorf("%s: expected a chained escape to be refused, got %v", name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "escape")); err == nil {
+			t.Errorf("%s: expected nothing to be created outside the destination", name)
+		}
+		if _, err := os.Lstat(target); err == nil {
+			t.Errorf("%s: expected the failed extraction to be removed", name)
+		}
+	}
+}
+
+func TestArchiveExtractLimits(t *testing.T) {
+	dir := t.TempDir()
+	bomb := filepath.Join(dir, "bomb.zip")
+	writeZipEntries(t, bomb, map[string]string{"zeros": strings.Repeat("\x00", 4<<20)}, nil)
+
+	// 4 MiB of zeros compresses to a few KiB, far beyond the default ratio
+	_, err := fileops.ExtractArchive(bomb, filepath.Join(dir, "a"), fileops.ArchiveOptions{})
+	if !errors.Is(err, fileops.ErrUnsafeArchive) {
+		t.Errorf("Expected the ratio limit to stop extraction, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "zeros")); err == nil {
+		t.Error("Expected the partial file to be removed")
+	}
+
+	_, err = fileops.ExtractArchive(bomb, filepath.Join(dir, "b"), fileops.ArchiveOptions{Limits: fileops.ExtractLimits{MaxRatio: -1}})
+	if err != nil {
+		t.Errorf("Expected extraction to succeed without a ratio limit: %v", err)
+	}
+
+	many := filepath.Join(dir, "many.zip")
+	writeZipEntries(t, many, map[string]string{"1": "", "2": "", "3": ""}, nil)
+	_, err = fileops.ExtractArchive(many, filepath.Join(dir, "c"), fileops.ArchiveOptions{Limits: fileops.ExtractLimits{MaxEntries: 2}})
+	if !errors.Is(err, fileops.ErrUnsafeArchive) {
+		t.Errorf("Expected the entry limit to stop extraction, got %v", err)
+	}
+}
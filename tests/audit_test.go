@@ -0,0 +1,81 @@
+package shell_test
+
+import (
+	"errors"
+	"fmsh/utils"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogQuery(t *testing.T) {
+	dir := t.TempDir()
+	first := &utils.AuditLog{}
+	if err := first.Open(filepath.Join(dir, "audit.jsonl"), "first"); err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	first.Record(utils.AuditEntry{Op: "mkdir", Paths: []string{"/data/reports"}}, nil)
+	first.Record(utils.AuditEntry{Op: "chmod", Paths: []string{"/data/reports/q1.csv"}, ModeBefore: "0644", ModeAfter: "0600"}, nil)
+
+	// A second session appends to the same file
+	second := &utils.AuditLog{}
+	if err := second.Open(filepath.Join(dir, "audit.jsonl"), "second"); err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	second.Record(utils.AuditEntry{Op: "rm", Paths: []string{"/data/other.txt"}}, errors.New("permission denied"))
+
+	cases := []struct {
+		name  string
+		query utils.AuditQuery
+		want  int
+	}{
+		{"everything", utils.AuditQuery{}, 3},
+		{"by directory", utils.AuditQuery{Path: "/data/reports"}, 2},
+		{"by file", utils.AuditQuery{Path: "/data/other.txt"}, 1},
+		{"by operation", utils.AuditQuery{Op: "chmod"}, 1},
+		{"by session", utils.AuditQuery{Session: "first"}, 2},
+		{"in the future", utils.AuditQuery{Since: time.Now().Add(time.Hour)}, 0},
+	}
+	for _, c := range cases {
+		entries, err := second.Query(c.query)
+		if err != nil {
+			t.Fatalf("%s: query failed: %v", c.name, err)
+		}
+		if len(entries) != c.want {
+			t.Errorf("%s: expected %d entries, got %d", c.name, c.want, len(entries))
+		}
+	}
+
+	entries, _ := second.Query(utils.AuditQuery{Op: "rm"})
+	if len(entries) == 1 && entries[0].Result != "permission denied" {
+		t.Errorf("Expected the failure to be recorded, got result %q", entries[0].Result)
+	}
+}
+
+func TestAuditRecordKeepsCallerPaths(t *testing.T) {
+	log := &utils.AuditLog{}
+	if err := log.Open(filepath.Join(t.TempDir(), "audit.jsonl"), "paths"); err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	paths := []string{"relative/report.csv"}
+	log.Record(utils.AuditEntry{Op: "touch", Paths: paths}, nil)
+	if paths[0] != "relative/report.csv" {
+		t.Errorf("Expected the caller's paths to be left alone, got %q", paths[0])
+	}
+	entries, _ := log.Query(utils.AuditQuery{Op: "touch"})
+	if len(entries) != 1 || !filepath.IsAbs(entries[0].Paths[0]) {
+		t.Errorf("Expected the recorded path to be absolute, got %v", entries)
+	}
+}
+
+func TestAuditRecordKeepsURLs(t *testing.T) {
+	log := &utils.AuditLog{}
+	if err := log.Open(filepath.Join(t.TempDir(), "audit.jsonl"), "urls"); err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	log.Record(utils.AuditEntry{Op: "rm", Paths: []string{"s3://bucket/logs/old.log"}}, nil)
+	entries, _ := log.Query(utils.AuditQuery{Path: "s3://bucket/logs"})
+	if len(entries) != 1 || entries[0].Paths[0] != "s3://bucket/logs/old.log" {
+		t.Errorf("Expected the URL to be recorded as it is, got %v", entries)
+	}
+}
@@ -0,0 +1,171 @@
+package shell_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmsh/fileops"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyConflictPolicies(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  fileops.ConflictOptions
+		newer   bool
+		want    string
+		extra   string // Another file expected to exist afterwards
+		skipped int
+	}{
+		{"overwrite", fileops.ConflictOptions{Policy: fileops.Overwrite}, false, "new", "", 0},
+		{"no-clobber", fileops.ConflictOptions{Policy: fileops.NoClobber}, false, "old", "", 1},
+		{"update older source", fileops.ConflictOptions{Policy: fileops.Update}, false, "old", "", 1},
+		{"update newer source", fileops.ConflictOptions{Policy: fileops.Update}, true, "new", "", 0},
+		{"backup", fileops.ConflictOptions{Policy: fileops.Backup, BackupSuffix: ".orig"}, false, "new", "dst.txt.orig", 0},
+		{"interactive no", fileops.ConflictOptions{Policy: fileops.Interactive, Ask: func(string, string) bool { return false }}, false, "old", "", 1},
+		{"auto-rename", fileops.ConflictOptions{Policy: fileops.AutoRename}, false, "old", "dst (1).txt", 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src.txt")
+			dst := filepath.Join(dir, "dst.txt")
+			mustWrite(t, src, []byte("new"), 0644)
+			mustWrite(t, dst, []byte("old"), 0644)
+
+			srcTime := time.Now().Add(-time.Hour)
+			if c.newer {
+				srcTime = time.Now().Add(time.Hour)
+			}
+			os.Chtimes(src, srcTime, srcTime)
+
+			stats, err := fileops.Copy(src, dst, fileops.CopyOptions{Conflict: c.policy})
+			if err != nil {
+				t.Fatalf("Copy failed: %v", err)
+			}
+			if data, _ := os.ReadFile(dst); string(data) != c.want {
+				t.Errorf("Expected destination to contain %q, got %q", c.want, data)
+			}
+			if stats.Skipped != c.skipped {
+				t.Errorf("Expected %d skipped, got %d", c.skipped, stats.Skipped)
+			}
+			if c.extra != "" {
+				if _, err := os.Stat(filepath.Join(dir, c.extra)); err != nil {
+					t.Errorf("Expected %s to exist: %v", c.extra, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyResumeAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "big.bin")
+	dst := filepath.Join(dir, "copy.bin")
+	data := bytes.Repeat([]byte("abcdefgh"), 4096) // 32 KiB, two 16 KiB chunks
+	mustWrite(t, src, data, 0644)
+	info, _ := os.Stat(src)
+
+	// Leave behind what an interrupted copy would: a partial file whose first
+	// chunk is journaled as finished. Its bytes are deliberately wrong so the
+	// test can tell that the chunk was not copied again.
+	part := dst + fileops.PartialSuffix
+	mustWrite(t, part, make([]byte, len(data)), 0600)
+	journal, _ := json.Marshal(map[string]interface{}{
+		"source":   src,
+		"size":     info.Size(),
+		"mod_time": info.ModTime(),
+		"done":     map[string]int64{"0": 16 << 10},
+	})
+	mustWrite(t, part+".json", journal, 0600)
+
+	stats, err := fileops.Copy(src, dst, fileops.CopyOptions{ChunkSize: 16 << 10, Verify: true})
+	if stats.Resumed != 1 {
+		t.Errorf("Expected the copy to be resumed, got %+v", stats)
+	}
+	if !errors.Is(err, fileops.ErrVerifyMismatch) {
+		t.Errorf("Expected verification to catch the stale chunk, got %v", err)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to be moved into place")
+	}
+
+	copied, _ := os.ReadFile(dst)
+	if !bytes.Equal(copied[16<<10:], data[16<<10:]) {
+		t.Errorf("Expected the missing chunk to be copied")
+	}
+
+	// A clean copy verifies
+	stats, err = fileops.Copy(src, dst, fileops.CopyOptions{ChunkSize: 16 << 10, Verify: true})
+	if err != nil || stats.Verified != 1 {
+		t.Errorf("Expected a verified copy, got %+v (%v)", stats, err)
+	}
+}
+
+func TestCopyBackupOnlyWhenWritten(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, root := range []string{src, dst} {
+		mustMkdir(t, root)
+		mustWrite(t, filepath.Join(root, "a.txt"), []byte(root), 0644)
+		mustWrite(t, filepath.Join(root, "b.txt"), []byte(root), 0644)
+	}
+
+	// A copy stopped before any file is written leaves every destination in place
+	cancel := make(chan struct{})
+	close(cancel)
+	opts := fileops.CopyOptions{Recursive: true, Conflict: fileops.ConflictOptions{Policy: fileops.Backup}, Cancel: cancel}
+	if _, err := fileops.Copy(src, dst, opts); !errors.Is(err, fileops.ErrCanceled) {
+		t.Fatalf("Expected the copy to be canceled, got %v", err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := os.Stat(filepath.Join(dst, name+"~")); !os.IsNotExist(err) {
+			t.Errorf("Expected no backup of %s before it is written", name)
+		}
+	}
+
+	opts.Cancel = nil
+	if _, err := fileops.Copy(src, dst, opts); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "a.txt~")); string(data) != dst {
+		t.Errorf("Expected the replaced file to be backed up, got %q", data)
+	}
+}
+
+func TestCopyResumeChecksSource(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "big.bin")
+	other := filepath.Join(dir, "other.bin")
+	dst := filepath.Join(dir, "copy.bin")
+	data := bytes.Repeat([]byte("abcdefgh"), 4096)
+	mustWrite(t, src, data, 0644)
+	info, _ := os.Stat(src)
+
+	// A partial file left by another source of the same size and time
+	part := dst + fileops.PartialSuffix
+	mustWrite(t, part, make([]byte, len(data)), 0600)
+	journal, _ := json.Marshal(map[string]interface{}{
+		"source":   other,
+		"size":     info.Size(),
+		"mod_time": info.ModTime(),
+		"done":     map[string]int64{"0": 16 << 10},
+	})
+	mustWrite(t, part+".json", journal, 0600)
+
+	stats, err := fileops.Copy(src, dst, fileops.CopyOptions{ChunkSize: 16 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Resumed != 0 {
+		t.Errorf("Expected a partial file of another source not to be resumed, got %+v", stats)
+	}
+	if copied, _ := os.ReadFile(dst); !bytes.Equal(copied, data) {
+		t.Errorf("Expected a complete copy")
+	}
+}
@@ -0,0 +1,103 @@
+package shell_test
+
+import (
+	"bytes"
+	"fmsh/fileops"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	mustMkdir(t, filepath.Join(src, "nested"))
+	mustWrite(t, filepath.Join(src, "small.txt"), []byte("hello"), 0640)
+	mustWrite(t, filepath.Join(src, "nested", "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	if err := os.Symlink("small.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	// Large enough to be split into several chunks, with a hole in the middle
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	bigPath := filepath.Join(src, "nested", "big.bin")
+	f, err := os.Create(bigPath)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	f.Write(big)
+	f.WriteAt(big, 1<<20)
+	f.Close()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "small.txt"), mtime, mtime)
+	os.Chtimes(filepath.Join(src, "nested"), mtime, mtime)
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	stats, err := fileops.Copy(src, dst, fileops.CopyOptions{Recursive: true, Workers: 2, ChunkSize: 16 << 10})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.Files != 3 || stats.Dirs != 2 || stats.Symlinks != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// The source is left in place
+	if _, err := os.Stat(filepath.Join(src, "small.txt")); err != nil {
+		t.Errorf("Expected the source to remain: %v", err)
+	}
+
+	for _, name := range []string{"small.txt", "nested/run.sh", "nested/big.bin"} {
+		want, _ := os.ReadFile(filepath.Join(src, name))
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Content of %s differs (%v)", name, err)
+		}
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "nested", "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755 to be preserved, got %v (%v)", info.Mode(), err)
+	}
+	for _, name := range []string{"small.txt", "nested"} {
+		if info, err := os.Stat(filepath.Join(dst, name)); err != nil || !info.ModTime().Equal(mtime) {
+			t.Errorf("Expected the modification time of %s to be preserved (%v)", name, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "small.txt" {
+		t.Errorf("Expected the symlink to be recreated, got %q (%v)", target, err)
+	}
+}
+
+func TestCopyRefusals(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, filepath.Join(dir, "file.txt"), []byte("data"), 0644)
+
+	if _, err := fileops.Copy(dir, filepath.Join(dir, "inside"), fileops.CopyOptions{Recursive: true}); err == nil {
+		t.Errorf("Expected copying a directory into itself to fail")
+	}
+	if _, err := fileops.Copy(dir, filepath.Join(t.TempDir(), "out"), fileops.CopyOptions{}); err == nil {
+		t.Errorf("Expected copying a directory without -r to fail")
+	}
+	file := filepath.Join(dir, "file.txt")
+	if _, err := fileops.Copy(file, file, fileops.CopyOptions{}); err == nil {
+		t.Errorf("Expected copying a file onto itself to fail")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "data" {
+		t.Errorf("Expected the file to be untouched, got %q", data)
+	}
+}
+
+func mustMkdir(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", path, err)
+	}
+}
+
+func mustWrite(t *testing.T, path string, data []byte, perm os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(path, data, perm); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	os.Chmod(path, perm)
+}
@@ -0,0 +1,311 @@
+package shell_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmsh/commands"
+	"fmsh/daemon"
+	"fmsh/vfs"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rpcClient speaks to a daemon connection one line at a time
+type rpcClient struct {
+	t       *testing.T
+	conn    net.Conn
+	lines   *bufio.Scanner
+	nextID  int
+	pending []map[string]json.RawMessage // Messages read while waiting for another
+}
+
+func newRPCClient(t *testing.T, srv *daemon.Server, trusted bool) *rpcClient {
+	client, server := net.Pipe()
+	go srv.ServeConn(server, trusted)
+	t.Cleanup(func() { client.Close() })
+	return &rpcClient{t: t, conn: client, lines: bufio.NewScanner(client)}
+}
+
+func (c *rpcClient) send(line string) {
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// start sends a call and returns its id
+func (c *rpcClient) start(method string, params any) string {
+	c.nextID++
+	id, _ := json.Marshal(c.nextID)
+	data, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": json.RawMessage(id), "method": method, "params": params})
+	c.send(string(data))
+	return string(id)
+}
+
+func (c *rpcClient) read() map[string]json.RawMessage {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if !c.lines.Scan() {
+		c.t.Fatalf("Connection ended: %v", c.lines.Err())
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(c.lines.Bytes(), &msg); err != nil {
+		c.t.Fatalf("Invalid message %s: %v", c.lines.Bytes(), err)
+	}
+	return msg
+}
+
+// wait returns the response to the call with id, keeping other messages
+func (c *rpcClient) wait(id string) map[string]json.RawMessage {
+	for i, msg := range c.pending {
+		if _, ok := msg["method"]; !ok && string(msg["id"]) == id {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return msg
+		}
+	}
+	for {
+		msg := c.read()
+		if _, ok := msg["method"]; !ok && string(msg["id"]) == id {
+			return msg
+		}
+		c.pending = append(c.pending, msg)
+	}
+}
+
+// call makes a call and decodes its result into result, failing on errors
+func (c *rpcClient) call(method string, params, result any) {
+	c.t.Helper()
+	msg := c.wait(c.start(method, params))
+	if msg["error"] != nil {
+		c.t.Fatalf("%s failed: %s", method, msg["error"])
+	}
+	if result != nil {
+		if err := json.Unmarshal(msg["result"], result); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// fail makes a call that must fail and returns the error code
+func (c *rpcClient) fail(method string, params any) int {
+	c.t.Helper()
+	msg := c.wait(c.start(method, params))
+	var rpcErr daemon.Error
+	if msg["error"] == nil || json.Unmarshal(msg["error"], &rpcErr) != nil {
+		c.t.Fatalf("Expected %s to fail, got %v", method, msg)
+	}
+	return rpcErr.Code
+}
+
+func TestDaemonMethods(t *testing.T) {
+	commands.InitializeCommands()
+	dir := t.TempDir()
+	mustMkdir(t, filepath.Join(dir, "src", "deep"))
+	mustWrite(t, filepath.Join(dir, "src", "notes.txt"), []byte("notes"), 0644)
+	mustWrite(t, filepath.Join(dir, "src", "deep", "notes.txt"), []byte("more notes"), 0644)
+	mustWrite(t, filepath.Join(dir, "src", "image.png"), []byte("\x89PNG\r\n\x1a\n0000"), 0644)
+	mustMkdir(t, filepath.Join(dir, "dst"))
+
+	srv := daemon.New(daemon.Options{Dir: dir})
+	defer srv.Close()
+	client := newRPCClient(t, srv, true)
+	other := newRPCClient(t, srv, true)
+
+	// Working directories belong to connections
+	var cwd struct{ Dir string }
+	client.call("chdir", map[string]string{"path": "src"}, &cwd)
+	if cwd.Dir != filepath.Join(dir, "src") {
+		t.Errorf("Expected chdir to resolve against the directory, got %s", cwd.Dir)
+	}
+	other.call("cwd", nil, &cwd)
+	if cwd.Dir != dir {
+		t.Errorf("Expected the other connection to stay in %s, got %s", dir, cwd.Dir)
+	}
+	if code := client.fail("chdir", map[string]string{"path": "notes.txt"}); code != daemon.CodeFailed {
+		t.Errorf("Expected chdir into a file to fail, got %d", code)
+	}
+
+	var matches []string
+	client.call("find", map[string]string{"name": "notes.txt"}, &matches)
+	sort.Strings(matches)
+	if len(matches) != 2 || matches[0] != filepath.Join(dir, "src", "deep", "notes.txt") {
+		t.Errorf("Unexpected matches %v", matches)
+	}
+	client.call("find", map[string]any{"limit": 1}, &matches)
+	if len(matches) != 1 {
+		t.Errorf("Expected the limit to stop the search, got %v", matches)
+	}
+
+	var summary commands.Summary
+	client.call("summarise", nil, &summary)
+	if summary.Types["image/png"].Files != 1 || summary.Untyped.Files != 2 || summary.Untyped.Bytes != 15 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	var inspected commands.InspectResult
+	other.call("inspect", map[string]string{"path": "src"}, &inspected)
+	if inspected.Files != 3 || inspected.Dirs != 2 || inspected.Largest != filepath.Join(dir, "src", "image.png") {
+		t.Errorf("Unexpected analytics %+v", inspected)
+	}
+
+	// Copies report their progress before the result
+	var copies []struct {
+		Target string
+		Files  int
+		Bytes  int64
+	}
+	id := client.start("copy", map[string]any{"sources": []string{"."}, "destination": "../dst", "recursive": true})
+	msg := client.wait(id)
+	if msg["error"] != nil {
+		t.Fatalf("copy failed: %s", msg["error"])
+	}
+	json.Unmarshal(msg["result"], &copies)
+	if len(copies) != 1 || copies[0].Files != 3 || copies[0].Target != filepath.Join(dir, "dst", "src") {
+		t.Errorf("Unexpected copy result %+v", copies)
+	}
+	progressed := false
+	for _, note := range client.pending {
+		var p daemon.Progress
+		json.Unmarshal(note["params"], &p)
+		if string(note["method"]) == `"progress"` && string(p.ID) == id && p.Done == p.Total && p.Total == 27 {
+			progressed = true
+		}
+	}
+	if !progressed {
+		t.Errorf("Expected a final progress notification, got %v", client.pending)
+	}
+	if code := client.fail("copy", map[string]any{"sources": []string{"notes.txt"}, "destination": "x", "conflict": "sometimes"}); code != daemon.CodeInvalidParams {
+		t.Errorf("Expected an unknown conflict policy to be refused, got %d", code)
+	}
+
+	// Commands run in the directory of the connection and can move it
+	var run struct{ Output, Dir string }
+	other.call("run", map[string]any{"command": "ls", "args": []string{"dst/src"}}, &run)
+	if !strings.Contains(run.Output, "notes.txt") || !strings.Contains(run.Output, "deep/") {
+		t.Errorf("Expected the listing as output, got %q", run.Output)
+	}
+	other.call("run", map[string]any{"command": "cd", "args": []string{"dst"}}, &run)
+	other.call("cwd", nil, &cwd)
+	if run.Dir != filepath.Join(dir, "dst") || cwd.Dir != run.Dir {
+		t.Errorf("Expected cd to move the connection, got %q and %q", run.Dir, cwd.Dir)
+	}
+	if wd, _ := os.Getwd(); wd == run.Dir {
+		t.Error("Expected the daemon's own directory to be restored")
+	}
+	if code := other.fail("run", map[string]any{"command": "serve"}); code != daemon.CodeInvalidParams {
+		t.Errorf("Expected serve to be refused, got %d", code)
+	}
+
+	if code := client.fail("frobnicate", nil); code != daemon.CodeMethodNotFound {
+		t.Errorf("Expected an unknown method, got %d", code)
+	}
+	client.send(`{"jsonrpc": "2.0", "id": 99, "method": "cwd"`)
+	if code := string(client.read()["error"]); !strings.Contains(code, "-32700") {
+		t.Errorf("Expected a parse error, got %s", code)
+	}
+	client.send(`[{"jsonrpc": "2.0", "id": 100, "method": "cwd"}]`)
+	if code := string(client.read()["error"]); !strings.Contains(code, "-32600") {
+		t.Errorf("Expected batches to be refused, got %s", code)
+	}
+}
+
+// gatedFS holds directory listings until its gate opens
+type gatedFS struct {
+	*vfs.MemFS
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (g *gatedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	select {
+	case g.entered <- struct{}{}:
+	default:
+	}
+	<-g.gate
+	return g.MemFS.ReadDir(name)
+}
+
+func TestDaemonCancelAndAuth(t *testing.T) {
+	commands.InitializeCommands()
+	mountPoint := filepath.Join(t.TempDir(), "slow")
+	gated := &gatedFS{MemFS: vfs.NewMemFS(), entered: make(chan struct{}, 1), gate: make(chan struct{})}
+	vfs.WriteFile(gated, "a.txt", []byte("a"), 0644)
+	if err := vfs.Default.Mount(mountPoint, gated, "mem"); err != nil {
+		t.Fatal(err)
+	}
+	defer vfs.Default.Unmount(mountPoint)
+
+	srv := daemon.New(daemon.Options{Dir: t.TempDir(), Token: "s3cret"})
+	defer srv.Close()
+	client := newRPCClient(t, srv, false)
+
+	// TCP clients must authenticate first
+	if code := client.fail("cwd", nil); code != daemon.CodeUnauthorized {
+		t.Errorf("Expected an unauthenticated call to be refused, got %d", code)
+	}
+	if code := client.fail("auth", map[string]string{"token": "guess"}); code != daemon.CodeUnauthorized {
+		t.Errorf("Expected a wrong token to be refused, got %d", code)
+	}
+	client.call("auth", map[string]string{"token": "s3cret"}, nil)
+
+	id := client.start("find", map[string]string{"path": mountPoint})
+	<-gated.entered
+	var canceled struct{ Canceled bool }
+	client.call("cancel", map[string]json.RawMessage{"id": json.RawMessage(id)}, &canceled)
+	if !canceled.Canceled {
+		t.Error("Expected the running search to be canceled")
+	}
+	close(gated.gate)
+	var rpcErr daemon.Error
+	json.Unmarshal(client.wait(id)["error"], &rpcErr)
+	if rpcErr.Code != daemon.CodeCanceled {
+		t.Errorf("Expected the search to end as canceled, got %+v", rpcErr)
+	}
+	client.call("cancel", map[string]json.RawMessage{"id": json.RawMessage(id)}, &canceled)
+	if canceled.Canceled {
+		t.Error("Expected a finished request to be beyond canceling")
+	}
+}
+
+func TestDaemonSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "run", "daemon.sock")
+	l, err := daemon.ListenUnix(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := daemon.New(daemon.Options{Dir: t.TempDir()})
+	go srv.Serve(l, true)
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a private socket, got %v (%v)", info.Mode(), err)
+	}
+	if _, err := daemon.ListenUnix(socket); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("Expected a second daemon to be refused, got %v", err)
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(`{"jsonrpc": "2.0", "id": "x", "method": "commands"}` + "\n"))
+	var resp struct {
+		ID     string
+		Result []struct{ Name string }
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil || resp.ID != "x" || len(resp.Result) == 0 {
+		t.Errorf("Unexpected response %+v (%v)", resp, err)
+	}
+	conn.Close()
+	srv.Close()
+
+	// A socket left behind by a dead daemon is taken over
+	os.WriteFile(socket, nil, 0600)
+	l, err = daemon.ListenUnix(socket)
+	if err != nil {
+		t.Fatalf("Expected a stale socket to be replaced: %v", err)
+	}
+	l.Close()
+}
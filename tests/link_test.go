@@ -0,0 +1,136 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLnAndUndo(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustMkdir(t, filepath.Join(dir, "data", "v1"))
+	mustMkdir(t, filepath.Join(dir, "bin"))
+	mustWrite(t, filepath.Join(dir, "data", "v1", "tool"), []byte("tool"), 0755)
+	commands.InitializeCommands()
+
+	// -r writes the target relative to the link's directory
+	commands.DispatchCommand("ln -sr data/v1/tool bin")
+	if target, err := os.Readlink(filepath.Join(dir, "bin", "tool")); err != nil || target != filepath.Join("..", "data", "v1", "tool") {
+		t.Fatalf("Expected a relative symlink, got %q (%v)", target, err)
+	}
+	commands.DispatchCommand("ln data/v1/tool hard")
+	if data, err := os.ReadFile(filepath.Join(dir, "hard")); err != nil || string(data) != "tool" {
+		t.Fatalf("Expected a hard link, got %q (%v)", data, err)
+	}
+
+	// An existing name is only replaced with -f, and undo brings it back
+	mustWrite(t, filepath.Join(dir, "current"), []byte("old"), 0644)
+	commands.DispatchCommand("ln -s data/v1 current")
+	if _, err := os.Readlink(filepath.Join(dir, "current")); err == nil {
+		t.Fatal("Expected ln without -f to keep the existing file")
+	}
+	commands.DispatchCommand("ln -sf data/v1 current")
+	if target, _ := os.Readlink(filepath.Join(dir, "current")); target != "data/v1" {
+		t.Fatalf("Expected -f to replace the file, got %q", target)
+	}
+
+	commands.DispatchCommand("undo")
+	if data, err := os.ReadFile(filepath.Join(dir, "current")); err != nil || string(data) != "old" {
+		t.Errorf("Expected undo to restore the replaced file, got %q (%v)", data, err)
+	}
+	commands.DispatchCommand("undo 2")
+	for _, name := range []string{"hard", filepath.Join("bin", "tool")} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected undo to remove %s, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", "v1", "tool")); err != nil {
+		t.Errorf("Expected the link target to survive undo: %v", err)
+	}
+	commands.DispatchCommand("redo 2")
+	if target, err := os.Readlink(filepath.Join(dir, "bin", "tool")); err != nil || target != filepath.Join("..", "data", "v1", "tool") {
+		t.Errorf("Expected redo to recreate the relative symlink, got %q (%v)", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "hard")); err != nil {
+		t.Errorf("Expected redo to recreate the hard link: %v", err)
+	}
+
+	canonical, err := fileops.Canonicalize(filepath.Join("bin", "tool"))
+	want, _ := filepath.EvalSymlinks(filepath.Join(dir, "data", "v1", "tool"))
+	if err != nil || canonical != want {
+		t.Errorf("Expected %s, got %s (%v)", want, canonical, err)
+	}
+	if canonical, err := fileops.Canonicalize(filepath.Join("bin", "missing")); err != nil || filepath.Base(canonical) != "missing" {
+		t.Errorf("Expected a missing last component to be allowed, got %s (%v)", canonical, err)
+	}
+}
+
+func TestFindBrokenAndHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	mustMkdir(t, filepath.Join(dir, "sub"))
+	mustWrite(t, filepath.Join(dir, "file"), []byte("data"), 0644)
+	mustWrite(t, filepath.Join(dir, "big"), []byte("bigger data"), 0644)
+	links := map[string]string{
+		"ok":          "file",
+		"dangling":    "nowhere",
+		"loop-a":      "loop-b",
+		"loop-b":      "loop-a",
+		"sub/up":      "..",
+		"sub/through": "../dangling",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := fileops.FindBrokenLinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]fileops.LinkProblemKind{}
+	for _, problem := range problems {
+		rel, _ := filepath.Rel(dir, problem.Path)
+		kinds[filepath.ToSlash(rel)] = problem.Kind
+	}
+	want := map[string]fileops.LinkProblemKind{
+		"dangling":    fileops.LinkDangling,
+		"loop-a":      fileops.LinkLoop,
+		"loop-b":      fileops.LinkLoop,
+		"sub/up":      fileops.LinkAncestor,
+		"sub/through": fileops.LinkDangling,
+	}
+	if len(kinds) != len(want) {
+		t.Errorf("Expected %v, got %v", want, kinds)
+	}
+	for name, kind := range want {
+		if kinds[name] != kind {
+			t.Errorf("Expected %s to be %s, got %q", name, kind, kinds[name])
+		}
+	}
+
+	outside := filepath.Join(t.TempDir(), "outside")
+	for _, link := range []string{filepath.Join(dir, "sub", "file2"), outside} {
+		if err := os.Link(filepath.Join(dir, "file"), link); err != nil {
+			t.Skipf("Hard links not supported: %v", err)
+		}
+	}
+	os.Link(filepath.Join(dir, "big"), filepath.Join(dir, "sub", "big2"))
+	groups, err := fileops.FindHardLinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Size != 11 || len(groups[1].Paths) != 2 || groups[1].Links != 3 {
+		t.Errorf("Unexpected hard link groups %+v", groups)
+	}
+}
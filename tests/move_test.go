@@ -0,0 +1,140 @@
+package shell_test
+
+import (
+	"errors"
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"fmsh/vfs"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMvAndUndo(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "dest")
+	mustMkdir(t, dest)
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	mustWrite(t, filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("mv a.txt b.txt dest")
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("Expected %s to be moved: %v", name, err)
+		}
+	}
+
+	// Each move is undone separately, most recent first
+	commands.DispatchCommand("undo")
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err != nil {
+		t.Errorf("Expected b.txt to be moved back: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a.txt")); err != nil {
+		t.Errorf("Expected a.txt to stay moved: %v", err)
+	}
+	commands.DispatchCommand("undo")
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Errorf("Expected a.txt to be moved back: %v", err)
+	}
+}
+
+func TestMoveAcrossFilesystems(t *testing.T) {
+	src := t.TempDir()
+	other, err := os.MkdirTemp("/dev/shm", "fmsh-test")
+	if err != nil {
+		t.Skip("No second filesystem available")
+	}
+	defer os.RemoveAll(other)
+
+	var srcStat, otherStat syscall.Stat_t
+	if syscall.Stat(src, &srcStat) != nil || syscall.Stat(other, &otherStat) != nil || srcStat.Dev == otherStat.Dev {
+		t.Skip("Temporary directories share a filesystem")
+	}
+
+	tree := filepath.Join(src, "tree")
+	mustMkdir(t, filepath.Join(tree, "sub"))
+	mustWrite(t, filepath.Join(tree, "sub", "file.txt"), []byte("payload"), 0600)
+
+	target, err := fileops.Move(tree, filepath.Join(other, "tree"), fileops.MoveOptions{})
+	if err != nil {
+		t.Fatalf("Move failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "sub", "file.txt")); err != nil || string(data) != "payload" {
+		t.Errorf("Expected the tree to arrive intact, got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(tree); !os.IsNotExist(err) {
+		t.Errorf("Expected the source to be removed")
+	}
+	if entries, _ := os.ReadDir(other); len(entries) != 1 {
+		t.Errorf("Expected no staging leftovers, got %d entries", len(entries))
+	}
+
+	// Moving onto the existing tree is refused before anything is copied
+	mustMkdir(t, filepath.Join(tree, "sub"))
+	if _, err := fileops.Move(tree, target, fileops.MoveOptions{}); !errors.Is(err, fileops.ErrDirExists) {
+		t.Errorf("Expected the existing directory to be refused, got %v", err)
+	}
+	if entries, _ := os.ReadDir(other); len(entries) != 1 {
+		t.Errorf("Expected nothing to be staged, got %d entries", len(entries))
+	}
+}
+
+func TestMoveOntoExistingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	mustMkdir(t, filepath.Join(dir, "src"))
+	mustWrite(t, filepath.Join(dir, "src", "new.txt"), []byte("new"), 0644)
+	mustMkdir(t, filepath.Join(dir, "dst"))
+	mustWrite(t, filepath.Join(dir, "dst", "old.txt"), []byte("old"), 0644)
+
+	_, err := fileops.Move(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), fileops.MoveOptions{})
+	if !errors.Is(err, fileops.ErrDirExists) {
+		t.Fatalf("Expected the existing directory to be refused, got %v", err)
+	}
+	for _, name := range []string{filepath.Join("src", "new.txt"), filepath.Join("dst", "old.txt")} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be left alone: %v", name, err)
+		}
+	}
+}
+
+// unreadableFS is a memory backend whose files cannot be opened
+type unreadableFS struct {
+	*vfs.MemFS
+}
+
+func (unreadableFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+}
+
+func TestMoveBackupKeptWhenCopyFails(t *testing.T) {
+	src := unreadableFS{vfs.NewMemFS()}
+	dst := vfs.NewMemFS()
+	if err := vfs.WriteFile(src, "report.txt", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(dst, "report.txt", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := fileops.MoveOptions{Conflict: fileops.ConflictOptions{Policy: fileops.Backup}}
+	if _, err := fileops.MoveFS(src, "report.txt", dst, "report.txt", opts); err == nil {
+		t.Fatal("Expected the move to fail")
+	}
+	if data, err := vfs.ReadFile(dst, "report.txt"); err != nil || string(data) != "old" {
+		t.Errorf("Expected the destination to be left as it was: %q %v", data, err)
+	}
+	if _, err := dst.Lstat("report.txt" + fileops.DefaultBackupSuffix); err == nil {
+		t.Error("Expected no backup to be left behind")
+	}
+}
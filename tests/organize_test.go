@@ -0,0 +1,94 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const organizeRules = `{"rules": [
+	{"name": "photos", "extensions": ["jpg"], "dest": "Photos/{year}"},
+	{"name": "old logs", "pattern": "*.log", "older_than": "30d", "dest": "old"},
+	{"name": "large", "min_size": "1K", "dest": "large"}
+]}`
+
+func TestOrganizeRulesDryRunAndUndo(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("FMSH_HOME", home)
+	mustWrite(t, filepath.Join(home, "organize.json"), []byte(organizeRules), 0644)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	dir := t.TempDir()
+	old := time.Now().AddDate(0, -2, 0)
+	files := map[string]int{"a.jpg": 10, "new.log": 10, "old.log": 10, "big.bin": 2048, "small.bin": 10}
+	for name, size := range files {
+		mustWrite(t, filepath.Join(dir, name), make([]byte, size), 0644)
+	}
+	os.Chtimes(filepath.Join(dir, "old.log"), old, old)
+	os.Chtimes(filepath.Join(dir, "a.jpg"), old, old)
+	mustMkdir(t, filepath.Join(dir, "nested"))
+	mustWrite(t, filepath.Join(dir, "nested", "b.jpg"), []byte("b"), 0644)
+	mustMkdir(t, filepath.Join(dir, "old"))
+	mustWrite(t, filepath.Join(dir, "old", "old.log"), []byte("taken"), 0644)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("organize " + dir + " --dry-run")
+	if _, err := os.Stat(filepath.Join(dir, "a.jpg")); err != nil {
+		t.Fatalf("Expected a dry run to leave files alone: %v", err)
+	}
+
+	// Read-only mode allows a dry run but not applying the plan
+	utils.GlobalPolicy.ReadOnly = true
+	output, _ := utils.CaptureOutput(func() { commands.DispatchCommand("organize " + dir + " --dry-run") })
+	commands.DispatchCommand("organize " + dir + " --yes")
+	utils.GlobalPolicy.ReadOnly = false
+	if !strings.Contains(output, "a.jpg") || strings.Contains(output, "read-only") {
+		t.Errorf("Expected the dry run to show the plan in read-only mode, got %q", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.jpg")); err != nil {
+		t.Fatalf("Expected read-only mode to leave files alone: %v", err)
+	}
+
+	commands.DispatchCommand("organize " + dir + " --yes")
+	year := old.Format("2006")
+	for _, path := range []string{"Photos/" + year + "/a.jpg", "old/old (1).log", "large/big.bin", "new.log", "small.bin", "nested/b.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("Expected %s: %v", path, err)
+		}
+	}
+
+	// One undo restores the files and removes the folders organize created
+	commands.DispatchCommand("undo")
+	for _, path := range []string{"a.jpg", "old.log", "big.bin"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("Expected %s to be moved back: %v", path, err)
+		}
+	}
+	for _, path := range []string{"Photos", "large"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestPlanOrganizeDepth(t *testing.T) {
+	dir := t.TempDir()
+	mustMkdir(t, filepath.Join(dir, "a", "b"))
+	mustWrite(t, filepath.Join(dir, "a", "one.txt"), []byte("1"), 0644)
+	mustWrite(t, filepath.Join(dir, "a", "b", "two.txt"), []byte("2"), 0644)
+	mustWrite(t, filepath.Join(dir, ".hidden.txt"), []byte("h"), 0644)
+	rules := &fileops.OrganizeRules{Rules: []fileops.OrganizeRule{{Pattern: "*.txt", Dest: "text"}}}
+
+	for depth, want := range map[int]int{1: 0, 2: 1, 0: 2} {
+		plan, err := fileops.PlanOrganize(dir, rules, depth)
+		if err != nil || len(plan) != want {
+			t.Errorf("Depth %d: expected %d moves, got %v (%v)", depth, want, plan, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package shell_test
+
+import (
+	"bytes"
+	"fmsh/utils"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPageLines(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 50; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+
+	// Next page, search, jump to the bottom, then quit
+	commands := []string{"", "/line 37", "G", "q"}
+	var prompts []string
+	readCommand := func(prompt string) (string, error) {
+		prompts = append(prompts, prompt)
+		if len(commands) == 0 {
+			return "", io.EOF
+		}
+		command := commands[0]
+		commands = commands[1:]
+		return command, nil
+	}
+
+	var output bytes.Buffer
+	utils.PageLines(lines, 10, &output, readCommand)
+
+	want := []string{
+		"lines 1-10/50 (20%) :",
+		"lines 11-20/50 (40%) :",
+		"lines 37-46/50 (92%) :",
+		"lines 41-50/50 (100%) :",
+	}
+	if strings.Join(prompts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected pager positions:\n%s", strings.Join(prompts, "\n"))
+	}
+	if !strings.Contains(output.String(), "line 50\n") {
+		t.Errorf("Expected the last line to be shown")
+	}
+}
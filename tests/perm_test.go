@@ -0,0 +1,146 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	dir := os.ModeDir | 0755
+	cases := []struct {
+		spec string
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{"600", 0644, 0600},
+		{"4755", 0644, os.ModeSetuid | 0755},
+		{"u+x,g-w,o=r", 0666, 0744},
+		{"a+X", 0644, 0644},
+		{"a+X", 0744, 0755},
+		{"a+X", os.ModeDir | 0700, 0711},
+		{"go=u-w", 0750, 0755},
+		{"+t", dir, os.ModeSticky | 0755},
+		{"g+s,o-rx", dir, os.ModeSetgid | 0750},
+		{"u=rw,g=,o=", 0777, 0600},
+		{"a-w+x", 0644, 0555},
+		{"o=t", os.ModeSticky | 0777, os.ModeSticky | 0770},
+	}
+	for _, c := range cases {
+		change, err := fileops.ParseMode(c.spec)
+		if err != nil {
+			t.Errorf("ParseMode(%q): %v", c.spec, err)
+			continue
+		}
+		if got := change.Apply(c.mode); got != c.want {
+			t.Errorf("%q applied to %v = %v, want %v", c.spec, c.mode, got, c.want)
+		}
+	}
+	for _, spec := range []string{"", "99", "77777", "u", "u+q", "z+x", "u+rg"} {
+		if _, err := fileops.ParseMode(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestChmodRecursiveAndUndo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits")
+	}
+	dir := t.TempDir()
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustMkdir(t, filepath.Join(dir, "site", "css"))
+	mustWrite(t, filepath.Join(dir, "site", "index.html"), []byte("<html>"), 0600)
+	mustWrite(t, filepath.Join(dir, "site", "css", "main.css"), []byte("body {}"), 0600)
+	mustWrite(t, filepath.Join(dir, "ref"), []byte("ref"), 0640)
+	os.Chmod(filepath.Join(dir, "site", "css"), 0700)
+	os.Symlink("index.html", filepath.Join(dir, "site", "link"))
+	commands.InitializeCommands()
+
+	modes := func() map[string]os.FileMode {
+		result := map[string]os.FileMode{}
+		for _, name := range []string{"site", "site/css", "site/index.html", "site/css/main.css"} {
+			info, _ := os.Stat(filepath.FromSlash(name))
+			result[name] = info.Mode().Perm()
+		}
+		return result
+	}
+	before := modes()
+
+	commands.DispatchCommand("chmod -R --files 644 --dirs=755 site")
+	want := map[string]os.FileMode{"site": 0755, "site/css": 0755, "site/index.html": 0644, "site/css/main.css": 0644}
+	for name, mode := range modes() {
+		if mode != want[name] {
+			t.Errorf("Expected %s to be %04o, got %04o", name, want[name], mode)
+		}
+	}
+	commands.DispatchCommand("chmod go-r,u+x site/index.html")
+	commands.DispatchCommand("chmod --reference ref site/css/main.css")
+	if got := modes(); got["site/index.html"] != 0700 || got["site/css/main.css"] != 0640 {
+		t.Errorf("Unexpected modes %v", got)
+	}
+
+	// The recursive change is undone as one step
+	if n := len(utils.GlobalUndoManager.Actions()); n != 3 {
+		t.Fatalf("Expected 3 undoable actions, got %d", n)
+	}
+	commands.DispatchCommand("undo 3")
+	for name, mode := range modes() {
+		if mode != before[name] {
+			t.Errorf("Expected undo to restore %s to %04o, got %04o", name, before[name], mode)
+		}
+	}
+}
+
+func TestChownAndUndo(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skip("Changing owners needs root")
+	}
+	dir := t.TempDir()
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustMkdir(t, filepath.Join(dir, "data"))
+	mustWrite(t, filepath.Join(dir, "data", "tool"), []byte("tool"), 0755)
+	os.Chmod(filepath.Join(dir, "data", "tool"), os.ModeSetuid|0755)
+	commands.InitializeCommands()
+
+	owner := func(name string) (int, int) {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		uid, gid, _ := fileops.FileOwner(info)
+		return uid, gid
+	}
+
+	commands.DispatchCommand("chown -R 4242:4343 " + filepath.Join(dir, "data"))
+	for _, name := range []string{"data", filepath.Join("data", "tool")} {
+		if uid, gid := owner(name); uid != 4242 || gid != 4343 {
+			t.Errorf("Expected %s to belong to 4242:4343, got %d:%d", name, uid, gid)
+		}
+	}
+	commands.DispatchCommand("chgrp 4444 " + filepath.Join(dir, "data", "tool"))
+	if uid, gid := owner(filepath.Join("data", "tool")); uid != 4242 || gid != 4444 {
+		t.Errorf("Expected chgrp to leave the owner alone, got %d:%d", uid, gid)
+	}
+
+	commands.DispatchCommand("undo 2")
+	for _, name := range []string{"data", filepath.Join("data", "tool")} {
+		if uid, gid := owner(name); uid != 0 || gid != 0 {
+			t.Errorf("Expected undo to give %s back to root, got %d:%d", name, uid, gid)
+		}
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "data", "tool")); info.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("Expected undo to restore the setuid bit cleared by chown, got %v", info.Mode())
+	}
+}
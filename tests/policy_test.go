@@ -0,0 +1,128 @@
+package shell_test
+
+import (
+	"errors"
+	"fmsh/commands"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyRootJail(t *testing.T) {
+	outside := t.TempDir()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "inner"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+
+	policy := &utils.Policy{}
+	if err := policy.SetRoot(root); err != nil {
+		t.Fatalf("Failed to set root: %v", err)
+	}
+
+	allowed := []string{"inner", "inner/../new-file", filepath.Join(root, "inner")}
+	for _, path := range allowed {
+		if _, err := policy.Check(path); err != nil {
+			t.Errorf("Expected %s to be allowed, got: %v", path, err)
+		}
+	}
+
+	refused := []string{"..", "inner/../../etc", "escape", "escape/..", "escape/file.txt", outside}
+	for _, path := range refused {
+		if _, err := policy.Check(path); !errors.Is(err, utils.ErrOutsideRoot) {
+			t.Errorf("Expected %s to be refused, got: %v", path, err)
+		}
+	}
+
+	// The link itself lives inside the root even though its target does not
+	if _, err := policy.CheckEntry("escape"); err != nil {
+		t.Errorf("Expected the symlink entry to be allowed, got: %v", err)
+	}
+}
+
+func TestMatchPathPattern(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/etc/**", "/etc", true},
+		{"/etc/**", "/etc/ssh/sshd_config", true},
+		{"/etc/**", "/etcetera", false},
+		{"/home/*/.ssh/**", "/home/alice/.ssh/id_rsa", true},
+		{"/", "/", true},
+		{"/", "/tmp", false},
+	}
+	for _, c := range cases {
+		if got := utils.MatchPathPattern(c.pattern, c.path); got != c.want {
+			t.Errorf("MatchPathPattern(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+func TestPolicyUnprotectNeedsConfirmation(t *testing.T) {
+	originalPolicy, originalLog := utils.GlobalPolicy, utils.GlobalAuditLog
+	defer func() { utils.GlobalPolicy, utils.GlobalAuditLog = originalPolicy, originalLog }()
+	defer utils.SetInput(os.Stdin)
+	utils.GlobalPolicy = &utils.Policy{Protected: []string{"/etc/**"}}
+	utils.GlobalAuditLog = &utils.AuditLog{}
+	if err := utils.GlobalAuditLog.Open(filepath.Join(t.TempDir(), "audit.jsonl"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	commands.InitializeCommands()
+
+	utils.SetInput(strings.NewReader("n\n"))
+	commands.DispatchCommand("policy unprotect /etc/**")
+	if len(utils.GlobalPolicy.Protected) != 1 {
+		t.Fatal("Expected a declined unprotect to keep the pattern")
+	}
+	utils.SetInput(strings.NewReader("y\n"))
+	commands.DispatchCommand("policy unprotect /etc/**")
+	if len(utils.GlobalPolicy.Protected) != 0 {
+		t.Fatal("Expected a confirmed unprotect to drop the pattern")
+	}
+
+	entries, err := utils.GlobalAuditLog.Query(utils.AuditQuery{Op: "policy unprotect"})
+	if err != nil || len(entries) != 1 || entries[0].Paths[0] != "/etc/**" {
+		t.Errorf("Expected one audit entry for the change, got %v (%v)", entries, err)
+	}
+}
+
+func TestMountedDirectoryStaysInRoot(t *testing.T) {
+	outside := t.TempDir()
+	root := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	mustWrite(t, victim, []byte("secret"), 0644)
+	mustMkdir(t, filepath.Join(root, "real"))
+	if err := os.Symlink(outside, filepath.Join(root, "real", "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	originalPolicy := utils.GlobalPolicy
+	defer func() { utils.GlobalPolicy = originalPolicy }()
+	utils.GlobalPolicy = &utils.Policy{}
+	if err := utils.GlobalPolicy.SetRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	commands.InitializeCommands()
+
+	commands.DispatchCommand("mount os real m")
+	defer commands.DispatchCommand("umount " + filepath.Join(root, "m"))
+	output, _ := utils.CaptureOutput(func() { commands.DispatchCommand("preview m/escape/victim") })
+	if strings.Contains(output, "secret") {
+		t.Errorf("Expected the mount not to read outside the root, got %q", output)
+	}
+	commands.DispatchCommand("rm m/escape/victim")
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("Expected the mount not to delete outside the root: %v", err)
+	}
+}
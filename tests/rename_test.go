@@ -0,0 +1,109 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestPlanRenamesTemplatesAndCollisions(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2023, 5, 17, 10, 0, 0, 0, time.Local)
+	for _, name := range []string{"IMG 001.JPG", "IMG 002.JPG", "taken.jpg"} {
+		path := filepath.Join(dir, name)
+		mustWrite(t, path, []byte(name), 0644)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	paths := []string{filepath.Join(dir, "IMG 001.JPG"), filepath.Join(dir, "IMG 002.JPG")}
+	entries, err := fileops.PlanRenames(paths, fileops.RenameOptions{
+		Template: "{date}_{n:3}.{ext}",
+		Case:     "lower",
+		Start:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"2023-05-17_001.jpg", "2023-05-17_002.jpg"} {
+		if got := filepath.Base(entries[i].Target); got != want || entries[i].Problem != "" {
+			t.Errorf("Expected %s, got %s (%s)", want, got, entries[i].Problem)
+		}
+	}
+
+	// Both names map to the same target, and one target exists already
+	entries, _ = fileops.PlanRenames(paths, fileops.RenameOptions{Pattern: regexp.MustCompile(`.*`), Replace: "taken.jpg"})
+	for _, entry := range entries {
+		if entry.Problem == "" {
+			t.Errorf("Expected a collision for %s", entry.Source)
+		}
+	}
+	if _, err := fileops.ApplyRenames(entries); err == nil {
+		t.Errorf("Expected a plan with problems to be refused")
+	}
+
+	if got := fileops.SanitizeName("Résumé  final (v2).pdf"); got != "Resume_final_v2.pdf" {
+		t.Errorf("Unexpected sanitised name %q", got)
+	}
+}
+
+func TestBulkRenameCycleAndUndo(t *testing.T) {
+	dir := t.TempDir()
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	mustWrite(t, filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+
+	// Groups may be written \1 as in sed
+	commands.InitializeCommands()
+	commands.DispatchCommand(`bulk-rename --regex ^(a|b)\. --replace=x_\1. --case upper --yes *.txt`)
+	for name, content := range map[string]string{"X_A.TXT": "a", "X_B.TXT": "b"} {
+		if data, _ := os.ReadFile(name); string(data) != content {
+			t.Fatalf("Expected %s to hold %q, got %q", name, content, data)
+		}
+	}
+	commands.DispatchCommand("undo")
+	if entries, _ := os.ReadDir("."); len(entries) != 2 || entries[0].Name() != "a.txt" || entries[1].Name() != "b.txt" {
+		t.Fatalf("Expected the bulk rename to be undone in one step, got %v", entries)
+	}
+
+	// Arguments reach the command as typed, so $1 is a group too
+	commands.DispatchCommand(`bulk-rename --regex ^(a)\.(txt)$ --replace=$2.$1 --yes a.txt`)
+	if _, err := os.Stat("txt.a"); err != nil {
+		t.Fatalf("Expected $-style groups to be replaced: %v", err)
+	}
+	commands.DispatchCommand("undo")
+
+	// Swapping two names needs a temporary name in between
+	entries := []fileops.RenameEntry{{Source: "a.txt", Target: "b.txt"}, {Source: "b.txt", Target: "a.txt"}}
+	steps, err := fileops.ApplyRenames(entries)
+	if err != nil {
+		t.Fatalf("Swap failed: %v", err)
+	}
+	if len(steps) != 3 {
+		t.Errorf("Expected 3 steps for a swap, got %v", steps)
+	}
+	if data, _ := os.ReadFile("a.txt"); string(data) != "b" {
+		t.Errorf("Expected a.txt to hold b, got %q", data)
+	}
+
+	batch := utils.Action{Type: utils.Batch, Label: "swap"}
+	for _, step := range steps {
+		batch.Actions = append(batch.Actions, utils.Action{Type: utils.Rename, Source: step.From, Dest: step.To})
+	}
+	utils.GlobalUndoManager.Push(batch)
+	if err := utils.GlobalUndoManager.Undo(); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if data, _ := os.ReadFile("a.txt"); string(data) != "a" {
+		t.Errorf("Expected the swap to be undone, got %q in a.txt", data)
+	}
+}
@@ -0,0 +1,204 @@
+package shell_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmsh/server"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func serveFixture(t *testing.T) (string, string) {
+	outside := t.TempDir()
+	mustWrite(t, filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	root := t.TempDir()
+	mustWrite(t, filepath.Join(root, "hello.txt"), []byte("hello, world"), 0644)
+	mustMkdir(t, filepath.Join(root, "docs", "deep"))
+	mustWrite(t, filepath.Join(root, "docs", "a.txt"), []byte("aaa"), 0644)
+	mustWrite(t, filepath.Join(root, "docs", "deep", "b.txt"), []byte("bbb"), 0644)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "docs", "leak.txt")); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func get(t *testing.T, client *http.Client, url string, header http.Header) (*http.Response, string) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestServeReadOnly(t *testing.T) {
+	root, _ := serveFixture(t)
+	handler, err := server.NewHandler(server.Options{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	client := srv.Client()
+
+	resp, body := get(t, client, srv.URL+"/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "hello.txt") || !strings.Contains(body, "docs/") {
+		t.Fatalf("Unexpected index: %d %s", resp.StatusCode, body)
+	}
+	if strings.Contains(body, "escape") || strings.Contains(body, "<form") {
+		t.Errorf("Expected the index to hide escaping symlinks and the upload form: %s", body)
+	}
+
+	resp, body = get(t, client, srv.URL+"/hello.txt", http.Header{"Range": {"bytes=7-11"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "world" {
+		t.Errorf("Expected a range response, got %d %q", resp.StatusCode, body)
+	}
+
+	// Nothing outside the root is reachable
+	for _, p := range []string{"/escape/secret.txt", "/docs/leak.txt", "/../" + "secret.txt", "/docs/../../secret.txt"} {
+		if resp, _ := get(t, client, srv.URL+p, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected %s to be unreachable, got %d", p, resp.StatusCode)
+		}
+	}
+
+	resp, body = get(t, client, srv.URL+"/docs/?zip", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a zip file, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	if want := "docs/a.txt docs/deep/ docs/deep/b.txt"; strings.Join(names, " ") != want {
+		t.Errorf("Expected zip entries %q, got %q", want, names)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader("x"))
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected uploads to be refused by default, got %v %v", resp.StatusCode, err)
+	}
+}
+
+func upload(t *testing.T, client *http.Client, url, user, password string, files map[string]string) *http.Response {
+	return uploadFrom(t, client, url, "", user, password, files)
+}
+
+// uploadFrom uploads as a browser would from a page of origin
+func uploadFrom(t *testing.T, client *http.Client, url, origin, user, password string, files map[string]string) *http.Response {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, content := range files {
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write([]byte(content))
+	}
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, url, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestServeUploadsAndAuth(t *testing.T) {
+	root, outside := serveFixture(t)
+	var uploaded []string
+	handler, err := server.NewHandler(server.Options{
+		Root:      root,
+		Uploads:   true,
+		MaxUpload: 1 << 10,
+		User:      "alice",
+		Password:  "secret",
+		Uploaded:  func(path string, size int64) { uploaded = append(uploaded, path) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	client := srv.Client()
+
+	if resp, _ := get(t, client, srv.URL+"/hello.txt", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected requests without credentials to be refused, got %d", resp.StatusCode)
+	}
+	if resp := upload(t, client, srv.URL+"/docs/", "alice", "wrong", map[string]string{"x.txt": "x"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", resp.StatusCode)
+	}
+
+	resp := upload(t, client, srv.URL+"/docs/", "alice", "secret", map[string]string{"new.txt": "new", "../../evil.txt": "evil"})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected the upload to redirect to the index, got %d", resp.StatusCode)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "docs", "new.txt")); err != nil || string(data) != "new" {
+		t.Errorf("Expected the upload to be stored: %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs", "evil.txt")); err != nil {
+		t.Errorf("Expected a name with parent components to be stored by its base name: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "evil.txt")); err == nil {
+		t.Error("Expected uploads to stay inside the directory")
+	}
+
+	// Existing files are kept; the upload gets another name
+	upload(t, client, srv.URL+"/docs/", "alice", "secret", map[string]string{"a.txt": "replaced"})
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "a.txt")); string(data) != "aaa" {
+		t.Errorf("Expected the existing file to survive, got %q", data)
+	}
+	if len(uploaded) != 3 {
+		t.Errorf("Expected 3 uploads to be reported, got %v", uploaded)
+	}
+
+	if resp := upload(t, client, srv.URL+"/escape/", "alice", "secret", map[string]string{"in.txt": "x"}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected uploads through an escaping symlink to be refused, got %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "in.txt")); err == nil {
+		t.Error("Expected nothing to be written outside the root")
+	}
+	big := strings.Repeat("x", 2<<10)
+	if resp := upload(t, client, srv.URL+"/", "alice", "secret", map[string]string{"big.txt": big}); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an upload over the limit to be refused, got %d", resp.StatusCode)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, ".upload-*")); len(matches) > 0 {
+		t.Errorf("Expected failed uploads to leave nothing behind, found %v", matches)
+	}
+
+	// Other sites cannot post through the browser's saved credentials
+	if resp := uploadFrom(t, client, srv.URL+"/docs/", "https://evil.example", "alice", "secret", map[string]string{"planted.txt": "x"}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a cross-origin upload to be refused, got %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs", "planted.txt")); err == nil {
+		t.Error("Expected the cross-origin upload not to be stored")
+	}
+	if resp := uploadFrom(t, client, srv.URL+"/docs/", srv.URL, "alice", "secret", map[string]string{"form.txt": "x"}); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("Expected an upload from the share's own page to work, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,46 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionRoundTrip(t *testing.T) {
+	t.Setenv("FMSH_HOME", t.TempDir())
+	workDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to resolve temp dir: %v", err)
+	}
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("cd " + workDir)
+
+	if err := commands.CaptureSession("work").Save(); err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+
+	// Start over as a fresh shell would
+	os.Chdir(originalDir)
+
+	state, err := utils.LoadSession("work")
+	if err != nil {
+		t.Fatalf("Failed to load session: %v", err)
+	}
+	commands.RestoreSession(state)
+
+	if cwd, _ := os.Getwd(); cwd != workDir {
+		t.Errorf("Expected working directory %s, got %s", workDir, cwd)
+	}
+
+	// Other sessions keep separate state
+	other, err := utils.LoadSession("other")
+	if err != nil || other.Cwd != "" {
+		t.Errorf("Expected an empty state for a new session, got %+v (%v)", other, err)
+	}
+}
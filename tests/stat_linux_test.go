@@ -0,0 +1,32 @@
+package shell_test
+
+import (
+	"errors"
+	"fmsh/fileops"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStatXattrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	mustWrite(t, path, []byte("data"), 0644)
+	if err := syscall.Setxattr(path, "user.pipeline", []byte("ingest"), 0); err != nil {
+		t.Skipf("No user extended attributes here: %v", err)
+	}
+
+	st, err := fileops.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, attr := range st.Xattrs {
+		found = found || (attr.Name == "user.pipeline" && string(attr.Value) == "ingest")
+	}
+	if !found || st.XattrErr != nil {
+		t.Errorf("Expected the attribute to be listed, got %v (%v)", st.Xattrs, st.XattrErr)
+	}
+	if _, err := fileops.GetXattr(path, "user.missing"); err == nil || errors.Is(err, fileops.ErrXattrUnsupported) {
+		t.Errorf("Expected a missing attribute to be an error of its own, got %v", err)
+	}
+}
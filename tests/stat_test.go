@@ -0,0 +1,63 @@
+package shell_test
+
+import (
+	"fmsh/fileops"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestModeFormatting(t *testing.T) {
+	cases := []struct {
+		mode    os.FileMode
+		octal   string
+		symbols string
+	}{
+		{0644, "0644", "-rw-r--r--"},
+		{os.ModeDir | os.ModeSticky | 0777, "1777", "drwxrwxrwt"},
+		{os.ModeSetuid | 0755, "4755", "-rwsr-xr-x"},
+		{os.ModeDir | os.ModeSetgid | 0740, "2740", "drwxr-S---"},
+		{os.ModeSymlink | 0777, "0777", "lrwxrwxrwx"},
+		{os.ModeSticky | 0600, "1600", "-rw------T"},
+	}
+	for _, c := range cases {
+		if got := fileops.OctalMode(c.mode); got != c.octal {
+			t.Errorf("OctalMode(%v) = %s, want %s", c.mode, got, c.octal)
+		}
+		if got := fileops.SymbolicMode(c.mode); got != c.symbols {
+			t.Errorf("SymbolicMode(%v) = %s, want %s", c.mode, got, c.symbols)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "image.png")
+	mustWrite(t, image, []byte("\x89PNG\r\n\x1a\n0000"), 0640)
+	if err := os.Link(image, filepath.Join(dir, "again.png")); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("image.png", filepath.Join(dir, "link"))
+
+	st, err := fileops.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.MIME != "image/png" || fileops.FileTypeName(st.Info) != "regular file" {
+		t.Errorf("Unexpected type %s (%s)", st.MIME, fileops.FileTypeName(st.Info))
+	}
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		if st.Links != 2 || st.Inode == 0 || !st.HasOwner || st.Owner == "" || st.Ctime.IsZero() {
+			t.Errorf("Expected inode, link count and owner, got %+v", st)
+		}
+		if st.UID != uint32(os.Getuid()) {
+			t.Errorf("Expected the file to belong to %d, got %d", os.Getuid(), st.UID)
+		}
+	}
+
+	link, err := fileops.Stat(filepath.Join(dir, "link"))
+	if err != nil || link.LinkTarget != "image.png" || fileops.FileTypeName(link.Info) != "symbolic link" {
+		t.Errorf("Expected stat to describe the symlink itself, got %+v (%v)", link, err)
+	}
+}
@@ -0,0 +1,66 @@
+package shell_test
+
+import (
+	"fmsh/utils"
+	"os"
+	"testing"
+)
+
+func TestColorSpecDepths(t *testing.T) {
+	spec, err := utils.ParseColorSpec("bold #ff8700 on blue")
+	if err != nil {
+		t.Fatalf("Failed to parse colour spec: %v", err)
+	}
+
+	cases := map[utils.ColorDepth]string{
+		utils.DepthTrueColor: "1;38;2;255;135;0;44",
+		utils.Depth256:       "1;38;5;208;44",
+		utils.Depth16:        "1;91;44",
+		utils.DepthNone:      "1",
+	}
+	for depth, want := range cases {
+		if got := spec.SGR(depth); got != want {
+			t.Errorf("SGR(%d) = %q, want %q", depth, got, want)
+		}
+	}
+
+	if _, err := utils.ParseColorSpec("sparkly"); err == nil {
+		t.Errorf("Expected an error for an unknown colour")
+	}
+}
+
+func TestPaletteLSColors(t *testing.T) {
+	t.Setenv("LS_COLORS", "di=01;34:ex=01;32:*.tar=01;31:*.TAR.GZ=35")
+	palette := utils.NewPalette("default", utils.BuiltinThemes["default"])
+	palette.Depth = utils.Depth16
+
+	cases := []struct {
+		name string
+		mode os.FileMode
+		want string
+	}{
+		{"src", os.ModeDir | 0755, "\033[01;34msrc\033[0m"},
+		{"run.sh", 0755, "\033[01;32mrun.sh\033[0m"},
+		{"backup.tar", 0644, "\033[01;31mbackup.tar\033[0m"},
+		{"release.tar.gz", 0644, "\033[35mrelease.tar.gz\033[0m"},
+		{"notes.txt", 0644, "notes.txt"},
+		// Not in LS_COLORS, so the theme's symlink role applies
+		{"link", os.ModeSymlink | 0777, "\033[1;36mlink\033[0m"},
+	}
+	for _, c := range cases {
+		if got := palette.ColorizeFile(c.name, c.mode); got != c.want {
+			t.Errorf("ColorizeFile(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPaletteNoColor(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	palette := utils.NewPalette("default", utils.BuiltinThemes["default"])
+	if palette.Enabled() {
+		t.Fatalf("Expected NO_COLOR to disable colours")
+	}
+	if got := palette.Colorize(utils.RoleError, "boom"); got != "boom" {
+		t.Errorf("Expected plain text, got %q", got)
+	}
+}
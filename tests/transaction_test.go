@@ -0,0 +1,193 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransactionRollbackAndCommit(t *testing.T) {
+	dir := t.TempDir()
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustMkdir(t, filepath.Join(dir, "dest"))
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	mustWrite(t, filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("begin tidy")
+	commands.DispatchCommand("mv a.txt dest")
+	commands.DispatchCommand("chmod 600 b.txt")
+	commands.DispatchCommand("mkdir new")
+	commands.DispatchCommand("rollback")
+
+	if _, err := os.Stat("a.txt"); err != nil {
+		t.Errorf("Expected a.txt to be moved back: %v", err)
+	}
+	if info, err := os.Stat("b.txt"); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected b.txt to get mode 0644 back (%v)", err)
+	}
+	if _, err := os.Stat("new"); !os.IsNotExist(err) {
+		t.Errorf("Expected new to be removed, got %v", err)
+	}
+	if utils.GlobalUndoManager.Transaction() != nil {
+		t.Errorf("Expected the transaction to be closed")
+	}
+
+	// A committed transaction is undone in one step
+	commands.DispatchCommand("begin")
+	commands.DispatchCommand("mv a.txt dest")
+	commands.DispatchCommand("mv b.txt dest")
+	commands.DispatchCommand("commit")
+	if n := len(utils.GlobalUndoManager.Actions()); n != 1 {
+		t.Fatalf("Expected one undo step for the transaction, got %d", n)
+	}
+	commands.DispatchCommand("undo")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to be moved back: %v", name, err)
+		}
+	}
+}
+
+func TestTransactionAutoRollback(t *testing.T) {
+	dir := t.TempDir()
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustMkdir(t, filepath.Join(dir, "dest"))
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("begin --auto-rollback")
+	commands.DispatchCommand("mv a.txt dest")
+	commands.DispatchCommand("mv missing.txt dest")
+
+	if _, err := os.Stat("a.txt"); err != nil {
+		t.Errorf("Expected the failed mv to roll back the earlier one: %v", err)
+	}
+	if utils.GlobalUndoManager.Transaction() != nil {
+		t.Errorf("Expected the transaction to be closed")
+	}
+}
+
+func TestInterruptedTransactionIsFoundAgain(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "undo.json")
+
+	manager := &utils.UndoManager{}
+	if err := manager.Open(journal); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Begin("reorg", false); err != nil {
+		t.Fatal(err)
+	}
+	manager.Push(utils.Action{Type: utils.Mkdir, Source: filepath.Join(dir, "new")})
+
+	// A crash leaves only the journal behind
+	restarted := &utils.UndoManager{}
+	if err := restarted.Open(journal); err != nil {
+		t.Fatal(err)
+	}
+	tx := restarted.Transaction()
+	if tx == nil || tx.Name != "reorg" || len(tx.Actions) != 1 {
+		t.Fatalf("Expected the open transaction to be loaded, got %+v", tx)
+	}
+	if err := restarted.Begin("other", false); err != utils.ErrTransactionOpen {
+		t.Errorf("Expected a second begin to fail, got %v", err)
+	}
+}
+
+func TestTransactionAutoRollbackOnReportedFailures(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+	originalPolicy := utils.GlobalPolicy
+	defer func() { utils.GlobalPolicy = originalPolicy }()
+	utils.GlobalPolicy = &utils.Policy{Root: dir}
+	commands.InitializeCommands()
+
+	// None of these records a failed operation, but each one fails
+	for _, failing := range []string{
+		"chmod",                         // Usage error
+		"mkdir " + filepath.Dir(dir),    // Refused by the policy
+		"chmod 600 a.txt missing.txt",   // Fails for one path and carries on
+		"trash restore never-trashed.x", // Nothing to find
+	} {
+		mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+		commands.DispatchCommand("begin --auto-rollback")
+		commands.DispatchCommand("mkdir made")
+		commands.DispatchCommand(failing)
+
+		if _, err := os.Stat("made"); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the transaction to be rolled back", failing)
+			os.Remove("made")
+		}
+		if utils.GlobalUndoManager.Transaction() != nil {
+			t.Errorf("%s: expected the transaction to be closed", failing)
+			commands.DispatchCommand("rollback")
+		}
+	}
+}
+
+func TestTransactionConfirmsIrreversibleCommands(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+	defer utils.SetInput(os.Stdin)
+
+	mustMkdir(t, filepath.Join(dir, "dest"))
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	mustWrite(t, filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+	mustWrite(t, filepath.Join(dir, "c.txt"), []byte("c"), 0644)
+	mount := filepath.Join(dir, "scratch")
+	commands.InitializeCommands()
+	commands.DispatchCommand("mount mem " + mount)
+	defer commands.DispatchCommand("umount " + mount)
+
+	commands.DispatchCommand("begin")
+	commands.DispatchCommand("mv b.txt dest")
+	commands.DispatchCommand("rm c.txt")
+
+	// Declining refuses the command, and a change with no undo never runs unasked
+	utils.SetInput(strings.NewReader("n\nn\n"))
+	commands.DispatchCommand("mkdir " + filepath.Join(mount, "made"))
+	commands.DispatchCommand("trash empty")
+	if commands.IsDirectory(filepath.Join(mount, "made")) {
+		t.Errorf("Expected mkdir in a mount to be refused inside the transaction")
+	}
+
+	utils.SetInput(strings.NewReader("y\n"))
+	commands.DispatchCommand("rm --permanent a.txt")
+	if _, err := os.Lstat("a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the confirmed rm --permanent to run, got %v", err)
+	}
+
+	output, _ := utils.CaptureOutput(func() { commands.DispatchCommand("rollback") })
+	for _, name := range []string{"b.txt", "c.txt"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to be brought back: %v", name, err)
+		}
+	}
+	if !strings.Contains(output, "cannot be undone") || !strings.Contains(output, "rm --permanent a.txt") {
+		t.Errorf("Expected rollback to name the command it could not revert, got %q", output)
+	}
+}
@@ -0,0 +1,82 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestTopDirTrash(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", home)
+	other, err := os.MkdirTemp("/dev/shm", "fmsh-test")
+	if err != nil {
+		t.Skip("No second filesystem available")
+	}
+	defer os.RemoveAll(other)
+
+	var homeStat, otherStat syscall.Stat_t
+	if syscall.Stat(home, &homeStat) != nil || syscall.Stat(other, &otherStat) != nil || homeStat.Dev == otherStat.Dev {
+		t.Skip("Temporary directories share a filesystem")
+	}
+	top := "/dev/shm"
+	trashDir := filepath.Join(top, ".Trash-"+strconv.Itoa(os.Getuid()))
+	if _, err := os.Lstat(trashDir); os.IsNotExist(err) {
+		defer os.RemoveAll(trashDir)
+	}
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+	// /dev is protected by default
+	originalPolicy := utils.GlobalPolicy
+	defer func() { utils.GlobalPolicy = originalPolicy }()
+	utils.GlobalPolicy = &utils.Policy{}
+
+	path := filepath.Join(other, "report.txt")
+	mustWrite(t, path, []byte("report"), 0644)
+	if trash := fileops.TrashFor(path); trash.Dir != trashDir {
+		t.Fatalf("Expected the trash at the top of the filesystem, got %s", trash.Dir)
+	}
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("rm " + path)
+	items, _ := (&fileops.Trash{Dir: trashDir}).List()
+	found := false
+	for _, item := range items {
+		found = found || item.OriginalPath == path
+	}
+	if !found {
+		t.Fatalf("Expected %s in %s, got %v", path, trashDir, items)
+	}
+	if items, _ := fileops.HomeTrash().List(); len(items) != 0 {
+		t.Errorf("Expected nothing to be copied into the home trash, got %v", items)
+	}
+	if info, err := os.Stat(trashDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected a private trash directory, got %v (%v)", info, err)
+	}
+
+	// The trash command sees entries in every trash
+	commands.DispatchCommand("trash restore " + path)
+	if data, err := os.ReadFile(path); err != nil || string(data) != "report" {
+		t.Errorf("Expected the file to be restored from the top directory trash (%v)", err)
+	}
+
+	// An administrator's shared sticky .Trash is preferred, but never a plain one
+	shared := filepath.Join(top, ".Trash")
+	if _, err := os.Lstat(shared); !os.IsNotExist(err) {
+		return
+	}
+	defer os.RemoveAll(shared)
+	mustMkdir(t, shared)
+	if trash := fileops.TrashFor(path); trash.Dir != trashDir {
+		t.Errorf("Expected a .Trash without the sticky bit to be ignored, got %s", trash.Dir)
+	}
+	os.Chmod(shared, os.ModeSticky|0777)
+	if trash := fileops.TrashFor(path); trash.Dir != filepath.Join(shared, strconv.Itoa(os.Getuid())) {
+		t.Errorf("Expected the shared .Trash to be used, got %s", trash.Dir)
+	}
+}
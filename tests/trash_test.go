@@ -0,0 +1,140 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRmMovesToTrashAndUndoRestores(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	mustMkdir(t, filepath.Join(dir, "work", "docs"))
+	mustWrite(t, filepath.Join(dir, "work", "docs", "a.txt"), []byte("a"), 0644)
+	mustWrite(t, filepath.Join(dir, "work", "b.txt"), []byte("b"), 0644)
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(filepath.Join(dir, "work"))
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("rm docs")
+	if _, err := os.Stat("docs"); err != nil {
+		t.Fatalf("Expected rm without -r to keep the directory: %v", err)
+	}
+	commands.DispatchCommand("rm -r docs b.txt")
+
+	trash := fileops.HomeTrash()
+	items, err := trash.List()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected 2 trashed items, got %v (%v)", items, err)
+	}
+	info, err := os.ReadFile(filepath.Join(trash.Dir, "info", "docs.trashinfo"))
+	if err != nil {
+		t.Fatalf("Expected a trashinfo file: %v", err)
+	}
+	if !strings.HasPrefix(string(info), "[Trash Info]\nPath="+filepath.Join(dir, "work", "docs")+"\n") {
+		t.Errorf("Unexpected trashinfo content: %q", info)
+	}
+
+	commands.DispatchCommand("undo")
+	commands.DispatchCommand("undo")
+	if data, err := os.ReadFile(filepath.Join("docs", "a.txt")); err != nil || string(data) != "a" {
+		t.Errorf("Expected docs/a.txt to be restored (%v)", err)
+	}
+	if _, err := os.Stat("b.txt"); err != nil {
+		t.Errorf("Expected b.txt to be restored: %v", err)
+	}
+	if items, _ := trash.List(); len(items) != 0 {
+		t.Errorf("Expected the trash to be empty after undo, got %v", items)
+	}
+}
+
+func TestTrashRestoreConflictsAndEmpty(t *testing.T) {
+	dir := t.TempDir()
+	trash := &fileops.Trash{Dir: filepath.Join(dir, "Trash")}
+	path := filepath.Join(dir, "notes.txt")
+
+	// Trashing the same name twice keeps both entries
+	mustWrite(t, path, []byte("first"), 0644)
+	first, err := trash.Put(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, path, []byte("second"), 0644)
+	second, err := trash.Put(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("Expected distinct trash names, got %s twice", first)
+	}
+
+	// The original path is taken again, so the restore picks a free name
+	mustWrite(t, path, []byte("current"), 0644)
+	restored, err := trash.Restore(filepath.Base(first), fileops.ConflictOptions{Policy: fileops.AutoRename})
+	if err != nil || restored == path {
+		t.Fatalf("Expected a renamed restore, got %q (%v)", restored, err)
+	}
+	if data, _ := os.ReadFile(restored); string(data) != "first" {
+		t.Errorf("Expected the first version at %s, got %q", restored, data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "current" {
+		t.Errorf("Expected %s to be kept, got %q", path, data)
+	}
+
+	// Nothing is older than an hour, so only a full empty removes the entry
+	if removed, err := trash.Empty(time.Now().Add(-time.Hour)); err != nil || removed != 0 {
+		t.Errorf("Expected no old entries to be removed, got %d (%v)", removed, err)
+	}
+	if removed, err := trash.Empty(time.Time{}); err != nil || removed != 1 {
+		t.Errorf("Expected 1 entry to be removed, got %d (%v)", removed, err)
+	}
+	if _, err := os.Lstat(second); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be deleted", second)
+	}
+}
+
+func TestTrashRestoreUndo(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	mustWrite(t, filepath.Join(dir, "plan.txt"), []byte("plan"), 0644)
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("rm plan.txt")
+	commands.DispatchCommand("trash restore plan.txt")
+	if _, err := os.Stat("plan.txt"); err != nil {
+		t.Fatalf("Expected plan.txt to be restored: %v", err)
+	}
+
+	// Undoing the restore puts the entry back into the trash, listed as before
+	commands.DispatchCommand("undo")
+	if _, err := os.Stat("plan.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected undo to put plan.txt back into the trash")
+	}
+	items, _ := fileops.HomeTrash().List()
+	if len(items) != 1 || items[0].OriginalPath != filepath.Join(dir, "plan.txt") {
+		t.Fatalf("Expected the entry to be listed in the trash again, got %v", items)
+	}
+
+	commands.DispatchCommand("redo")
+	if _, err := os.Stat("plan.txt"); err != nil {
+		t.Errorf("Expected redo to restore plan.txt again: %v", err)
+	}
+	if items, _ := fileops.HomeTrash().List(); len(items) != 0 {
+		t.Errorf("Expected the trash to be empty after redo, got %v", items)
+	}
+}
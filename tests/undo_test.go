@@ -0,0 +1,253 @@
+package shell_test
+
+import (
+	"errors"
+	"fmsh/commands"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUndoJournalSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "undo", "work.json")
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	manager := &utils.UndoManager{}
+	if err := manager.Open(journal); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	manager.Push(utils.Action{Type: utils.Move, Source: filepath.Join(dir, "a.txt"), Dest: filepath.Join(dir, "b.txt")})
+
+	// A new manager reading the same journal picks up the history
+	restarted := &utils.UndoManager{}
+	if err := restarted.Open(journal); err != nil {
+		t.Fatal(err)
+	}
+	if actions := restarted.Actions(); len(actions) != 1 || actions[0].Type != utils.Move {
+		t.Fatalf("Expected the move to be loaded from the journal, got %+v", actions)
+	}
+
+	if err := restarted.Undo(); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Errorf("Expected a.txt to be moved back: %v", err)
+	}
+
+	// Redo takes the action from the redo stack instead of losing undo history
+	if err := restarted.Redo(); err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	if len(restarted.Actions()) != 1 || len(restarted.RedoActions()) != 0 {
+		t.Errorf("Expected the redone action back on the undo stack, got %d undo and %d redo",
+			len(restarted.Actions()), len(restarted.RedoActions()))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err != nil {
+		t.Errorf("Expected a.txt to be moved again: %v", err)
+	}
+}
+
+func TestUndoStepsAndConflicts(t *testing.T) {
+	dir := t.TempDir()
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustMkdir(t, filepath.Join(dir, "dest"))
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		mustWrite(t, filepath.Join(dir, name), []byte(name), 0644)
+	}
+	commands.InitializeCommands()
+	commands.DispatchCommand("mv a.txt dest")
+	commands.DispatchCommand("mv b.txt dest")
+	commands.DispatchCommand("mv c.txt dest")
+
+	// The file changed after the move, so undo refuses to move it back
+	mustWrite(t, filepath.Join(dir, "dest", "c.txt"), []byte("edited"), 0644)
+	err := utils.GlobalUndoManager.UndoSteps(3, false)
+	if !errors.Is(err, utils.ErrUndoConflict) {
+		t.Fatalf("Expected an undo conflict, got %v", err)
+	}
+	if len(utils.GlobalUndoManager.Actions()) != 3 {
+		t.Errorf("Expected the conflicting action to stay on the stack")
+	}
+
+	commands.DispatchCommand("undo --force")
+	commands.DispatchCommand("undo 2")
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be moved back: %v", name, err)
+		}
+	}
+	if n := len(utils.GlobalUndoManager.RedoActions()); n != 3 {
+		t.Errorf("Expected 3 redoable actions, got %d", n)
+	}
+}
+
+func TestUndoCoversMutatingCommands(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	work := filepath.Join(dir, "work")
+	mustMkdir(t, work)
+	mustWrite(t, filepath.Join(work, "a.txt"), []byte("a"), 0644)
+	mustWrite(t, filepath.Join(work, "b.txt"), []byte("b"), 0644)
+	mustWrite(t, filepath.Join(work, "c.txt"), []byte("c"), 0644)
+	mustWrite(t, filepath.Join(work, "old.log"), []byte("log"), 0644)
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(work)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("mkdir sub")
+	commands.DispatchCommand("chmod 600 a.txt")
+	commands.DispatchCommand("rename --backup a.txt b.txt")
+	commands.DispatchCommand("backup c.txt")
+	commands.DispatchCommand("clean-tmp --delete")
+
+	if n := len(utils.GlobalUndoManager.Actions()); n != 5 {
+		t.Fatalf("Expected 5 undoable actions, got %d", n)
+	}
+	if data, _ := os.ReadFile("b.txt"); string(data) != "a" {
+		t.Fatalf("Expected b.txt to hold a.txt's content, got %q", data)
+	}
+
+	// Read-only mode lists the stack but does not revert it
+	utils.GlobalPolicy.ReadOnly = true
+	output, _ := utils.CaptureOutput(func() { commands.DispatchCommand("undo list") })
+	commands.DispatchCommand("undo 5")
+	utils.GlobalPolicy.ReadOnly = false
+	if strings.Contains(output, "read-only") || !strings.Contains(output, "mkdir") {
+		t.Errorf("Expected undo list to work in read-only mode, got %q", output)
+	}
+	if n := len(utils.GlobalUndoManager.Actions()); n != 5 {
+		t.Fatalf("Expected read-only mode to refuse undo, %d actions left", n)
+	}
+
+	commands.DispatchCommand("undo 5")
+
+	for name, content := range map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c", "old.log": "log"} {
+		if data, err := os.ReadFile(name); err != nil || string(data) != content {
+			t.Errorf("Expected %s to be restored with %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if info, err := os.Stat("a.txt"); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected a.txt to get mode 0644 back (%v)", err)
+	}
+	if _, err := os.Stat("sub"); !os.IsNotExist(err) {
+		t.Errorf("Expected sub to be removed, got %v", err)
+	}
+	if entries, _ := os.ReadDir("."); len(entries) != 4 {
+		t.Errorf("Expected only the 4 original files, got %d entries", len(entries))
+	}
+}
+
+func TestUndoOrganiseDirectory(t *testing.T) {
+	dir := t.TempDir()
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+	mustWrite(t, filepath.Join(dir, "notes.txt"), []byte("plain text"), 0644)
+	mustWrite(t, filepath.Join(dir, "image.png"), []byte("\x89PNG\r\n\x1a\n0000"), 0644)
+
+	commands.OrganiseDirectory(dir)
+	if _, err := os.Stat(filepath.Join(dir, "png", "image.png")); err != nil {
+		t.Fatalf("Expected image.png to be organized: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".undo")); !os.IsNotExist(err) {
+		t.Errorf("Expected no .undo directory, got %v", err)
+	}
+
+	// One undo puts every file back and removes the folders it created
+	if err := utils.GlobalUndoManager.Undo(); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Expected the 2 original files only, got %d entries", len(entries))
+	}
+	for _, name := range []string{"notes.txt", "image.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be moved back: %v", name, err)
+		}
+	}
+}
+
+func TestUndoCopyAndExtract(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	work := filepath.Join(dir, "work")
+	mustMkdir(t, filepath.Join(work, "tree", "sub"))
+	mustMkdir(t, filepath.Join(work, "out", "tree"))
+	mustWrite(t, filepath.Join(work, "tree", "a.txt"), []byte("new"), 0644)
+	mustWrite(t, filepath.Join(work, "tree", "sub", "b.txt"), []byte("b"), 0644)
+	mustWrite(t, filepath.Join(work, "out", "tree", "a.txt"), []byte("old"), 0644)
+	mustWrite(t, filepath.Join(work, "out", "tree", "keep.txt"), []byte("keep"), 0644)
+	mustWrite(t, filepath.Join(work, "c.txt"), []byte("c"), 0644)
+	mustWrite(t, filepath.Join(work, "out", "c.txt"), []byte("old c"), 0644)
+	mustWrite(t, filepath.Join(work, "moved.txt"), []byte("m"), 0644)
+	writeZipEntries(t, filepath.Join(work, "x.zip"), map[string]string{"out/tree/a.txt": "zipped", "out/new/d.txt": "d"}, nil)
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(work)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("mv moved.txt out")
+	commands.DispatchCommand("cp -r tree out")
+	commands.DispatchCommand("cp --backup c.txt out")
+	if data, _ := os.ReadFile("out/tree/a.txt"); string(data) != "new" {
+		t.Fatalf("Expected the copy to replace out/tree/a.txt, got %q", data)
+	}
+
+	// Undoing the copies restores what they replaced and leaves the move alone
+	commands.DispatchCommand("undo 2")
+	for name, content := range map[string]string{"out/tree/a.txt": "old", "out/tree/keep.txt": "keep", "out/c.txt": "old c", "out/moved.txt": "m"} {
+		if data, err := os.ReadFile(name); err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold %q after undo, got %q (%v)", name, content, data, err)
+		}
+	}
+	for _, name := range []string{"out/tree/sub", "out/c.txt~"} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("Expected undo to remove %s, got %v", name, err)
+		}
+	}
+	if n := len(utils.GlobalUndoManager.Actions()); n != 1 {
+		t.Errorf("Expected only the move left to undo, got %d actions", n)
+	}
+
+	commands.DispatchCommand("redo")
+	if data, _ := os.ReadFile("out/tree/sub/b.txt"); string(data) != "b" {
+		t.Errorf("Expected redo to copy the tree again, got %q", data)
+	}
+	if data, _ := os.ReadFile("out/tree/a.txt"); string(data) != "new" {
+		t.Errorf("Expected redo to replace out/tree/a.txt again, got %q", data)
+	}
+
+	commands.DispatchCommand("archive extract --force x.zip")
+	if data, _ := os.ReadFile("out/tree/a.txt"); string(data) != "zipped" {
+		t.Fatalf("Expected the extraction to replace out/tree/a.txt, got %q", data)
+	}
+	commands.DispatchCommand("undo")
+	if data, _ := os.ReadFile("out/tree/a.txt"); string(data) != "new" {
+		t.Errorf("Expected undo to restore out/tree/a.txt, got %q", data)
+	}
+	if _, err := os.Lstat("out/new"); !os.IsNotExist(err) {
+		t.Errorf("Expected undo to remove the extracted out/new, got %v", err)
+	}
+	commands.DispatchCommand("redo")
+	if data, _ := os.ReadFile("out/new/d.txt"); string(data) != "d" {
+		t.Errorf("Expected redo to extract out/new again, got %q", data)
+	}
+}
@@ -0,0 +1,179 @@
+package shell_test
+
+import (
+	"fmsh/commands"
+	"fmsh/utils"
+	"fmsh/vfs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	if err := vfs.MkdirAll(fsys, "a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fsys, "a/b/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Symlink("b/file.txt", "a/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a/b/file.txt", "a/link"); err != nil {
+		t.Error(err)
+	}
+	if data, err := vfs.ReadFile(fsys, "a/link"); err != nil || string(data) != "hello" {
+		t.Errorf("Expected to read through the symlink: %q %v", data, err)
+	}
+
+	if err := fsys.Rename("a", "a/b/c"); err == nil {
+		t.Error("Expected moving a directory into itself to fail")
+	}
+	if err := fsys.Remove("a"); err == nil {
+		t.Error("Expected removing a non-empty directory to fail")
+	}
+	if err := vfs.RemoveAll(fsys, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := fsys.ReadDir("."); len(entries) != 0 {
+		t.Errorf("Expected an empty file system, got %v", entries)
+	}
+}
+
+func TestNamespaceResolve(t *testing.T) {
+	ns := vfs.NewNamespace()
+	outer, inner := vfs.NewMemFS(), vfs.NewMemFS()
+	ns.Mount("/mnt", outer, "mem")
+	ns.Mount("/mnt/deep", inner, "mem")
+	if err := ns.Mount("/mnt", inner, "mem"); err == nil {
+		t.Error("Expected mounting twice at one path to fail")
+	}
+
+	for _, tc := range []struct {
+		path, name, mount string
+		fsys              vfs.FS
+	}{
+		{"/mnt", ".", "/mnt", outer},
+		{"/mnt/x/y", "x/y", "/mnt", outer},
+		{"/mnt/deep/z", "z", "/mnt/deep", inner},
+		{"/mnt/deeper", "deeper", "/mnt", outer},
+		{"/mn", "/mn", "", vfs.Host},
+	} {
+		fsys, name, mount := ns.Resolve(tc.path)
+		if fsys != tc.fsys || name != tc.name || mount != tc.mount {
+			t.Errorf("%s: got %q in %q", tc.path, name, mount)
+		}
+	}
+
+	if _, err := ns.Unmount("/mnt/deep"); err != nil {
+		t.Fatal(err)
+	}
+	if _, name, _ := ns.Resolve("/mnt/deep/z"); name != "deep/z" {
+		t.Errorf("Expected the outer mount after unmounting, got %q", name)
+	}
+}
+
+func TestCommandsOnMemoryMount(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+	commands.InitializeCommands()
+
+	mount := filepath.Join(dir, "scratch")
+	commands.DispatchCommand("mount mem " + mount)
+	defer commands.DispatchCommand("umount " + mount)
+	fsys, _, _ := vfs.Default.Resolve(mount)
+
+	mustWrite(t, filepath.Join(dir, "host.txt"), []byte("host"), 0644)
+	commands.DispatchCommand("mkdir scratch/work")
+	commands.DispatchCommand("cp host.txt scratch/work")
+	commands.DispatchCommand("cd scratch/work")
+	if got := commands.Workdir(); got != filepath.Join(mount, "work") {
+		t.Fatalf("Expected to be inside the mount, got %s", got)
+	}
+	commands.DispatchCommand("mkdir sub")
+	commands.DispatchCommand("mv host.txt sub")
+	commands.DispatchCommand("chmod 600 sub/host.txt")
+	commands.DispatchCommand("organize .")
+
+	info, err := fsys.Stat("work/sub/host.txt")
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the file to be moved and its mode changed: %v %v", info, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); err == nil {
+		t.Error("Expected mkdir inside the mount to leave the host alone")
+	}
+
+	commands.DispatchCommand("cp -r sub " + filepath.Join(dir, "out"))
+	if data, err := os.ReadFile(filepath.Join(dir, "out", "host.txt")); err != nil || string(data) != "host" {
+		t.Errorf("Expected the tree to be copied back to the host: %q %v", data, err)
+	}
+
+	commands.DispatchCommand("rm -r sub")
+	commands.DispatchCommand("cd " + dir)
+	if _, err := fsys.Stat("work/sub"); err == nil {
+		t.Error("Expected rm -r to remove the directory from the mount")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "host.txt")); err != nil {
+		t.Errorf("Expected the host file to be untouched: %v", err)
+	}
+}
+
+func TestRenameLinkAndCleanOnMemoryMount(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+	commands.InitializeCommands()
+
+	mount := filepath.Join(dir, "scratch")
+	commands.DispatchCommand("mount mem " + mount)
+	defer commands.DispatchCommand("umount " + mount)
+	fsys, _, _ := vfs.Default.Resolve(mount)
+	for _, name := range []string{"a.txt", "b.txt", "old.tmp"} {
+		if err := vfs.WriteFile(fsys, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commands.DispatchCommand("cd scratch")
+	defer commands.DispatchCommand("cd " + dir)
+	commands.DispatchCommand("bulk-rename --case upper --yes *.txt")
+	if _, err := fsys.Stat("A.TXT"); err != nil {
+		t.Errorf("Expected bulk-rename to work in the mount: %v", err)
+	}
+
+	commands.DispatchCommand("ln -s A.TXT link")
+	if target, err := fsys.ReadLink("link"); err != nil || target != "A.TXT" {
+		t.Errorf("Expected ln -s to create the link in the mount: %q %v", target, err)
+	}
+	output, _ := utils.CaptureOutput(func() { commands.DispatchCommand("readlink link") })
+	if !strings.Contains(output, "A.TXT") {
+		t.Errorf("Expected readlink to print the target, got %q", output)
+	}
+	commands.DispatchCommand("ln B.TXT hard")
+	if _, err := fsys.Lstat("hard"); err == nil {
+		t.Error("Expected hard links to be refused in the mount")
+	}
+
+	commands.DispatchCommand("clean-tmp --delete")
+	if _, err := fsys.Stat("old.tmp"); err == nil {
+		t.Error("Expected clean-tmp to delete the temporary file in the mount")
+	}
+
+	rules := filepath.Join(dir, "rules.json")
+	mustWrite(t, rules, []byte(`{"rules": [{"extensions": ["txt"], "dest": "docs"}]}`), 0644)
+	commands.DispatchCommand("organize --rules " + rules + " --yes")
+	if _, err := fsys.Stat("docs/B.TXT"); err != nil {
+		t.Errorf("Expected organize to move the file inside the mount: %v", err)
+	}
+
+	output, _ = utils.CaptureOutput(func() { commands.DispatchCommand("chown root docs/B.TXT") })
+	if !strings.Contains(output, "not supported") {
+		t.Errorf("Expected chown to refuse the mounted path, got %q", output)
+	}
+}
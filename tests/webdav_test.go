@@ -0,0 +1,257 @@
+package shell_test
+
+import (
+	"errors"
+	"fmsh/commands"
+	"fmsh/vfs"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// davStub is a minimal WebDAV server for a host directory. It requires
+// basic authentication as alice and honours exclusive write locks.
+type davStub struct {
+	root    string
+	mu      sync.Mutex
+	locks   map[string]string // Token by path
+	methods map[string]int
+}
+
+func newDAVStub(root string) *davStub {
+	return &davStub{root: root, locks: map[string]string{}, methods: map[string]int{}}
+}
+
+func davETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func (s *davStub) file(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// locked reports whether another client holds a lock on p
+func (s *davStub) locked(p string, r *http.Request) bool {
+	token, ok := s.locks[p]
+	return ok && !strings.Contains(r.Header.Get("If"), "<"+token+">")
+}
+
+func (s *davStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[r.Method]++
+
+	p := path.Clean(r.URL.Path)
+	file := s.file(p)
+	info, statErr := os.Stat(file)
+	switch r.Method {
+	case "PROPFIND":
+		if statErr != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+		s.propResponse(w, p, info)
+		if info.IsDir() && r.Header.Get("Depth") == "1" {
+			entries, _ := os.ReadDir(file)
+			for _, entry := range entries {
+				if child, err := entry.Info(); err == nil {
+					s.propResponse(w, path.Join(p, entry.Name()), child)
+				}
+			}
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	case http.MethodGet:
+		f, err := os.Open(file)
+		if err != nil || info.IsDir() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("ETag", davETag(info))
+		http.ServeContent(w, r, p, info.ModTime(), f)
+	case http.MethodPut:
+		switch {
+		case s.locked(p, r):
+			w.WriteHeader(http.StatusLocked)
+		case r.Header.Get("If-None-Match") == "*" && statErr == nil:
+			w.WriteHeader(http.StatusPreconditionFailed)
+		default:
+			data, _ := io.ReadAll(r.Body)
+			if err := os.WriteFile(file, data, 0644); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "MKCOL":
+		if statErr == nil {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		} else if err := os.Mkdir(file, 0755); err != nil {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodDelete:
+		switch {
+		case statErr != nil:
+			w.WriteHeader(http.StatusNotFound)
+		case s.locked(p, r):
+			w.WriteHeader(http.StatusLocked)
+		default:
+			os.RemoveAll(file)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "MOVE", "COPY":
+		u, _ := url.Parse(r.Header.Get("Destination"))
+		dest := path.Clean(u.Path)
+		switch {
+		case statErr != nil:
+			w.WriteHeader(http.StatusNotFound)
+		case s.locked(dest, r) || (r.Method == "MOVE" && s.locked(p, r)):
+			w.WriteHeader(http.StatusLocked)
+		case r.Method == "MOVE":
+			os.RemoveAll(s.file(dest))
+			os.Rename(file, s.file(dest))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			data, _ := os.ReadFile(file)
+			os.WriteFile(s.file(dest), data, 0644)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "LOCK":
+		if _, ok := s.locks[p]; ok {
+			w.WriteHeader(http.StatusLocked)
+			return
+		}
+		if statErr != nil {
+			os.WriteFile(file, nil, 0644)
+		}
+		token := fmt.Sprintf("opaquelocktoken:%d", len(s.locks)+s.methods["LOCK"])
+		s.locks[p] = token
+		w.Header().Set("Lock-Token", "<"+token+">")
+		fmt.Fprint(w, `<?xml version="1.0"?><d:prop xmlns:d="DAV:"><d:lockdiscovery/></d:prop>`)
+	case "UNLOCK":
+		if token := strings.Trim(r.Header.Get("Lock-Token"), "<>"); s.locks[p] == token {
+			delete(s.locks, p)
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusConflict)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *davStub) propResponse(w io.Writer, p string, info fs.FileInfo) {
+	href := (&url.URL{Path: p}).EscapedPath()
+	resourceType := ""
+	if info.IsDir() {
+		href += "/"
+		resourceType = "<d:collection/>"
+	}
+	fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`+
+		`<d:resourcetype>%s</d:resourcetype><d:getcontentlength>%d</d:getcontentlength>`+
+		`<d:getlastmodified>%s</d:getlastmodified><d:getetag>%s</d:getetag>`+
+		`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`,
+		href, resourceType, info.Size(), info.ModTime().UTC().Format(http.TimeFormat), davETag(info))
+}
+
+func TestWebDAVBackend(t *testing.T) {
+	root := t.TempDir()
+	mustMkdir(t, filepath.Join(root, "share"))
+	stub := newDAVStub(root)
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	// Credentials come from the netrc file
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	mustWrite(t, netrc, []byte("machine 127.0.0.1\n  login alice\n  password secret\n"), 0600)
+	t.Setenv("NETRC", netrc)
+	share := "dav://" + strings.TrimPrefix(server.URL, "http://") + "/share"
+
+	dir := t.TempDir()
+	mustWrite(t, filepath.Join(dir, "notes.txt"), []byte("hello webdav"), 0644)
+	mustMkdir(t, filepath.Join(dir, "tree", "sub"))
+	mustWrite(t, filepath.Join(dir, "tree", "sub", "name with space.txt"), []byte("spaced"), 0644)
+
+	commands.InitializeCommands()
+	commands.DispatchCommand("cp " + filepath.Join(dir, "notes.txt") + " " + share)
+	commands.DispatchCommand("cp -r " + filepath.Join(dir, "tree") + " " + share + "/tree")
+	if data, err := os.ReadFile(filepath.Join(root, "share", "tree", "sub", "name with space.txt")); err != nil || string(data) != "spaced" {
+		t.Fatalf("Expected the tree to be uploaded: %q, %v", data, err)
+	}
+
+	fsys, name, _, err := vfs.Default.ResolveURL(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fsys.ReadDir(name)
+	if err != nil || len(entries) != 2 || entries[0].Name() != "notes.txt" || !entries[1].IsDir() {
+		t.Fatalf("Unexpected listing %v (%v)", entries, err)
+	}
+
+	// Copies and moves within the share happen on the server
+	commands.DispatchCommand("cp " + share + "/notes.txt " + share + "/copy.txt")
+	commands.DispatchCommand("mv " + share + "/copy.txt " + share + "/moved.txt")
+	if stub.methods["COPY"] != 1 || stub.methods["MOVE"] < 1 {
+		t.Errorf("Expected a server-side COPY and MOVE, got %v", stub.methods)
+	}
+	commands.DispatchCommand("cp " + share + "/moved.txt " + filepath.Join(dir, "back.txt"))
+	if data, err := os.ReadFile(filepath.Join(dir, "back.txt")); err != nil || string(data) != "hello webdav" {
+		t.Errorf("Expected the file to be copied back: %q, %v", data, err)
+	}
+
+	// Writes lock the file while they upload it
+	if err := vfs.WriteFile(fsys, "share/notes.txt", []byte("rewritten"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if stub.methods["LOCK"] != 1 || stub.methods["UNLOCK"] != 1 || len(stub.locks) != 0 {
+		t.Errorf("Expected the write to lock and unlock the file, got %v", stub.methods)
+	}
+	stub.locks["/share/notes.txt"] = "opaquelocktoken:someone-else"
+	if err := vfs.WriteFile(fsys, "share/notes.txt", []byte("clobbered"), 0644); !errors.Is(err, vfs.ErrLocked) {
+		t.Errorf("Expected a locked file to refuse writes, got %v", err)
+	}
+	if err := fsys.Remove("share/notes.txt"); !errors.Is(err, vfs.ErrLocked) {
+		t.Errorf("Expected a locked file to refuse deletion, got %v", err)
+	}
+	delete(stub.locks, "/share/notes.txt")
+
+	// Reads resume at an offset only while the entity tag is unchanged
+	f, err := fsys.Open("share/moved.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	io.ReadFull(f, buf)
+	f.(io.Seeker).Seek(6, io.SeekStart)
+	if rest, err := io.ReadAll(f); err != nil || string(rest) != "webdav" {
+		t.Errorf("Expected a ranged read of the rest, got %q (%v)", rest, err)
+	}
+	mustWrite(t, filepath.Join(root, "share", "moved.txt"), []byte("a different version"), 0644)
+	f.(io.Seeker).Seek(2, io.SeekStart)
+	if _, err := io.ReadAll(f); err == nil {
+		t.Error("Expected reading a changed file to fail")
+	}
+
+	commands.DispatchCommand("rm -r " + share + "/tree")
+	if _, err := os.Stat(filepath.Join(root, "share", "tree")); !os.IsNotExist(err) {
+		t.Errorf("Expected rm -r to delete the collection, got %v", err)
+	}
+}
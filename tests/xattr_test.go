@@ -0,0 +1,172 @@
+package shell_test
+
+import (
+	"errors"
+	"fmsh/commands"
+	"fmsh/fileops"
+	"fmsh/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// requireXattrs skips tests where the file system of dir keeps no user attributes
+func requireXattrs(t *testing.T, dir string) {
+	probe := filepath.Join(dir, ".probe")
+	mustWrite(t, probe, nil, 0644)
+	defer os.Remove(probe)
+	if err := fileops.SetXattr(probe, "user.probe", []byte("1")); err != nil {
+		t.Skipf("No user extended attributes here: %v", err)
+	}
+}
+
+func xattr(t *testing.T, path, name string) (string, bool) {
+	t.Helper()
+	value, err := fileops.GetXattr(path, name)
+	if errors.Is(err, fileops.ErrNoXattr) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value), true
+}
+
+func TestXattrName(t *testing.T) {
+	for name, want := range map[string]string{
+		"stage":            "user.stage",
+		"pipeline.stage":   "user.pipeline.stage",
+		"user.stage":       "user.stage",
+		"security.selinux": "security.selinux",
+	} {
+		if got := fileops.XattrName(name); got != want {
+			t.Errorf("XattrName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestXattrCommandsAndUndo(t *testing.T) {
+	dir := t.TempDir()
+	requireXattrs(t, dir)
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(dir)
+	defer utils.GlobalUndoManager.Restore(nil)
+	utils.GlobalUndoManager.Restore(nil)
+
+	mustMkdir(t, filepath.Join(dir, "batch", "raw"))
+	mustWrite(t, filepath.Join(dir, "batch", "raw", "1.csv"), []byte("1"), 0644)
+	mustWrite(t, filepath.Join(dir, "batch", "2.csv"), []byte("2"), 0644)
+	os.Symlink("2.csv", filepath.Join(dir, "batch", "link"))
+	commands.InitializeCommands()
+
+	commands.DispatchCommand("xattr set -R stage ingest batch")
+	for _, name := range []string{"batch", "batch/raw", "batch/raw/1.csv", "batch/2.csv"} {
+		if value, _ := xattr(t, filepath.FromSlash(name), "user.stage"); value != "ingest" {
+			t.Errorf("Expected %s to be tagged, got %q", name, value)
+		}
+	}
+	commands.DispatchCommand("xattr set --encoding base64 user.stage 0sY2xlYW4= batch/2.csv")
+	commands.DispatchCommand("xattr set -e hex checksum 00ff batch/2.csv")
+	if value, _ := xattr(t, filepath.Join("batch", "2.csv"), "user.stage"); value != "clean" {
+		t.Errorf("Expected a base64 value to be decoded, got %q", value)
+	}
+	if value, _ := xattr(t, filepath.Join("batch", "2.csv"), "user.checksum"); value != "\x00\xff" {
+		t.Errorf("Expected a hex value to be decoded, got %q", value)
+	}
+
+	commands.DispatchCommand("xattr remove -R stage batch/raw")
+	if _, ok := xattr(t, filepath.Join("batch", "raw", "1.csv"), "user.stage"); ok {
+		t.Error("Expected the attribute to be removed")
+	}
+
+	// Each command is undone as one step, bringing back the previous values
+	commands.DispatchCommand("undo 3")
+	if value, _ := xattr(t, filepath.Join("batch", "raw", "1.csv"), "user.stage"); value != "ingest" {
+		t.Errorf("Expected undo to restore the removed attribute, got %q", value)
+	}
+	if value, _ := xattr(t, filepath.Join("batch", "2.csv"), "user.stage"); value != "ingest" {
+		t.Errorf("Expected undo to restore the replaced value, got %q", value)
+	}
+	if _, ok := xattr(t, filepath.Join("batch", "2.csv"), "user.checksum"); ok {
+		t.Error("Expected undo to remove a newly set attribute")
+	}
+	commands.DispatchCommand("undo")
+	if _, ok := xattr(t, "batch", "user.stage"); ok {
+		t.Error("Expected undo to remove the attributes set recursively")
+	}
+	commands.DispatchCommand("redo")
+	if value, _ := xattr(t, filepath.Join("batch", "raw"), "user.stage"); value != "ingest" {
+		t.Errorf("Expected redo to tag the tree again, got %q", value)
+	}
+
+	// Values that look like remote paths are not operands
+	commands.DispatchCommand("xattr set user.src s3://bucket/key batch/2.csv")
+	if value, _ := xattr(t, filepath.Join("batch", "2.csv"), "user.src"); value != "s3://bucket/key" {
+		t.Errorf("Expected a URL to be accepted as a value, got %q", value)
+	}
+}
+
+func TestCopyAndArchiveXattrs(t *testing.T) {
+	dir := t.TempDir()
+	requireXattrs(t, dir)
+	src := filepath.Join(dir, "src")
+	mustMkdir(t, filepath.Join(src, "sub"))
+	mustWrite(t, filepath.Join(src, "sub", "data"), []byte("data"), 0644)
+	for _, path := range []string{filepath.Join(src, "sub"), filepath.Join(src, "sub", "data")} {
+		if err := fileops.SetXattr(path, "user.stage", []byte("ingest")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Read-only files get their attributes before their mode
+	os.Chmod(filepath.Join(src, "sub", "data"), 0444)
+
+	copied := filepath.Join(dir, "copied")
+	if _, err := fileops.Copy(src, copied, fileops.CopyOptions{Recursive: true, PreserveXattrs: true}); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "plain")
+	if _, err := fileops.Copy(src, plain, fileops.CopyOptions{Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sub", filepath.Join("sub", "data")} {
+		if value, _ := xattr(t, filepath.Join(copied, name), "user.stage"); value != "ingest" {
+			t.Errorf("Expected the copy of %s to keep its attribute, got %q", name, value)
+		}
+		if _, ok := xattr(t, filepath.Join(plain, name), "user.stage"); ok {
+			t.Errorf("Expected %s to be copied without attributes unless asked", name)
+		}
+	}
+
+	archive := filepath.Join(dir, "src.tar.gz")
+	opts := fileops.ArchiveOptions{Xattrs: true}
+	if _, err := fileops.CreateArchive(archive, []string{src}, opts); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fileops.ListArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name == "src/sub/data" && (len(entry.Xattrs) != 1 || entry.Xattrs[0].Name != "user.stage") {
+			t.Errorf("Expected the archive to record the attribute, got %v", entry.Xattrs)
+		}
+	}
+	extracted := filepath.Join(dir, "extracted")
+	if _, err := fileops.ExtractArchive(archive, extracted, opts); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := xattr(t, filepath.Join(extracted, "src", "sub", "data"), "user.stage"); value != "ingest" {
+		t.Errorf("Expected extraction to restore the attribute, got %q", value)
+	}
+	ignored := filepath.Join(dir, "ignored")
+	if _, err := fileops.ExtractArchive(archive, ignored, fileops.ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := xattr(t, filepath.Join(ignored, "src", "sub", "data"), "user.stage"); ok {
+		t.Error("Expected attributes to be restored only when asked")
+	}
+	if _, err := fileops.CreateArchive(filepath.Join(dir, "src.zip"), []string{src}, opts); err == nil {
+		t.Error("Expected zip archives to refuse attributes")
+	}
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmsh/fileops"
+	"fmsh/vfs"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log describing a file system mutation
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	User       string    `json:"user"`
+	Op         string    `json:"op"`
+	Paths      []string  `json:"paths"`
+	Sizes      []int64   `json:"sizes,omitempty"`
+	ModeBefore string    `json:"mode_before,omitempty"`
+	ModeAfter  string    `json:"mode_after,omitempty"`
+	Result     string    `json:"result"`
+}
+
+// AuditQuery selects audit entries; zero fields match everything
+type AuditQuery struct {
+	Path    string // Entries touching this path or anything beneath it
+	Since   time.Time
+	Until   time.Time
+	Op      string
+	Session string
+}
+
+// AuditLog appends entries to a JSON Lines file. The zero value discards
+// everything until Open is called.
+type AuditLog struct {
+	mu      sync.Mutex
+	path    string
+	session string
+	user    string
+}
+
+// GlobalAuditLog is the audit log of the running shell
+var GlobalAuditLog = &AuditLog{}
+
+// NewSessionID returns a random identifier for a shell session
+func NewSessionID() string {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Open starts recording to the log file at path under the given session id
+func (l *AuditLog) Open(path, session string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path = path
+	l.session = session
+	l.user = currentUserName()
+	return nil
+}
+
+// Session returns the id entries are recorded under
+func (l *AuditLog) Session() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.session
+}
+
+// Record appends entry with the outcome of the operation
+func (l *AuditLog) Record(entry AuditEntry, opErr error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		return
+	}
+
+	entry.Time = time.Now()
+	entry.Session = l.session
+	entry.User = l.user
+	// Work on a copy so the caller's slice is left as it was; URLs of
+	// remote backends are already absolute
+	paths := make([]string, len(entry.Paths))
+	for i, path := range entry.Paths {
+		paths[i] = path
+		if abs, err := filepath.Abs(path); err == nil && !vfs.IsURL(path) {
+			paths[i] = abs
+		}
+	}
+	entry.Paths = paths
+	entry.Result = "ok"
+	if opErr != nil {
+		entry.Result = opErr.Error()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Printf("Warning: Unable to write audit log: %v\n", err)
+		return
+	}
+	defer file.Close()
+	file.Write(append(data, '\n'))
+}
+
+// Query returns the recorded entries matching q, oldest first
+func (l *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	l.mu.Lock()
+	path := l.path
+	l.mu.Unlock()
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	if q.Path != "" && !vfs.IsURL(q.Path) {
+		if abs, err := filepath.Abs(q.Path); err == nil {
+			q.Path = abs
+		}
+	}
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Skip lines damaged by a crash mid-write
+		}
+		if q.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	if q.Op != "" && entry.Op != q.Op {
+		return false
+	}
+	if q.Session != "" && entry.Session != q.Session {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && entry.Time.After(q.Until) {
+		return false
+	}
+	if q.Path == "" {
+		return true
+	}
+	for _, path := range entry.Paths {
+		if IsWithin(q.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Audit records a mutation in the global audit log
+func Audit(op string, paths []string, opErr error) {
+	GlobalAuditLog.Record(AuditEntry{Op: op, Paths: paths}, opErr)
+}
+
+// FileMode returns the permission bits of path in octal, or "" when it cannot be read
+func FileMode(path string) string {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return ""
+	}
+	return fileops.OctalMode(info.Mode())
+}
+
+// FileSize returns the size of path, or 0 when it cannot be read
+func FileSize(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func currentUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
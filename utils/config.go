@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Config holds the user settings read from ~/.fmsh/config.json
+type Config struct {
+	// ProtectedPaths lists path patterns that require confirmation before they are modified
+	ProtectedPaths []string `json:"protected_paths"`
+	// Theme names the colour theme to start with
+	Theme string `json:"theme"`
+	// Themes defines custom themes, mapping role names to colour specs
+	Themes map[string]Theme `json:"themes"`
+}
+
+// GlobalConfig is the configuration of the running shell
+var GlobalConfig = &Config{}
+
+// ConfigDir returns the directory holding fmsh configuration and state files.
+// FMSH_HOME overrides the default of ~/.fmsh.
+func ConfigDir() string {
+	if dir := os.Getenv("FMSH_HOME"); dir != "" {
+		return dir
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		homeDir = "." // Default to current directory if home dir can't be determined
+	}
+	return filepath.Join(homeDir, ".fmsh")
+}
+
+// ConfigPath returns the path of a file inside the config directory
+func ConfigPath(name string) string {
+	return filepath.Join(ConfigDir(), name)
+}
+
+// LoadConfig reads the config file into GlobalConfig, keeping the defaults when it does not exist
+func LoadConfig() error {
+	data, err := os.ReadFile(ConfigPath("config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, GlobalConfig)
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"os"
+	"strings"
+)
+
+// ParseLSColors parses the GNU LS_COLORS format ("di=01;34:ln=01;36:*.tar=01;31")
+// into a map from type keys and "*.ext" globs to SGR parameters
+func ParseLSColors(value string) map[string]string {
+	colors := map[string]string{}
+	for _, field := range strings.Split(value, ":") {
+		key, sgr, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			continue
+		}
+		if strings.HasPrefix(key, "*") {
+			key = strings.ToLower(key)
+		}
+		colors[key] = sgr
+	}
+	return colors
+}
+
+// lsColorFor picks the LS_COLORS entry for a file the way GNU ls does:
+// special file types first, then name suffixes for regular files
+func lsColorFor(colors map[string]string, name string, mode os.FileMode) (string, bool) {
+	if len(colors) == 0 {
+		return "", false
+	}
+
+	var key string
+	switch {
+	case mode&os.ModeSymlink != 0:
+		key = "ln"
+	case mode.IsDir():
+		key = "di"
+		if mode&os.ModeSticky != 0 && mode&0002 != 0 {
+			key = "tw"
+		} else if mode&os.ModeSticky != 0 {
+			key = "st"
+		} else if mode&0002 != 0 {
+			key = "ow"
+		}
+	case mode&os.ModeNamedPipe != 0:
+		key = "pi"
+	case mode&os.ModeSocket != 0:
+		key = "so"
+	case mode&os.ModeDevice != 0 && mode&os.ModeCharDevice != 0:
+		key = "cd"
+	case mode&os.ModeDevice != 0:
+		key = "bd"
+	case mode&os.ModeSetuid != 0:
+		key = "su"
+	case mode&os.ModeSetgid != 0:
+		key = "sg"
+	case mode&0111 != 0:
+		key = "ex"
+	}
+
+	if sgr, ok := colors[key]; ok && key != "" {
+		return sgr, true
+	}
+	if key == "tw" || key == "st" || key == "ow" {
+		if sgr, ok := colors["di"]; ok {
+			return sgr, true
+		}
+	}
+
+	if key == "" || key == "ex" || key == "su" || key == "sg" {
+		// The longest matching suffix wins
+		lower := strings.ToLower(name)
+		best := ""
+		for pattern := range colors {
+			if strings.HasPrefix(pattern, "*") && strings.HasSuffix(lower, pattern[1:]) && len(pattern) > len(best) {
+				best = pattern
+			}
+		}
+		if best != "" {
+			return colors[best], true
+		}
+		if sgr, ok := colors["fi"]; ok {
+			return sgr, true
+		}
+	}
+	return "", false
+}
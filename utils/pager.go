@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Pager shows long command output one screen at a time
+type Pager struct {
+	Enabled bool
+}
+
+// GlobalPager is the pager of the running shell
+var GlobalPager = &Pager{Enabled: true}
+
+// Active reports whether output should be captured for paging
+func (p *Pager) Active() bool {
+	return p.Enabled && isTerminal(os.Stdout)
+}
+
+// Run executes fn and pages its output when it does not fit on the screen
+func (p *Pager) Run(fn func()) {
+	if !p.Active() {
+		fn()
+		return
+	}
+
+	output, err := CaptureOutput(fn)
+	if err != nil {
+		fmt.Printf("Error capturing output: %v\n", err)
+		return
+	}
+
+	_, height := TerminalSize()
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) < height {
+		fmt.Print(output)
+		return
+	}
+
+	if command := os.Getenv("PAGER"); command != "" {
+		err := runExternalPager(command, output)
+		if err == nil {
+			return
+		}
+		fmt.Println(Colorize(RoleWarning, fmt.Sprintf("Warning: $PAGER failed, using the built-in pager: %v", err)))
+	}
+	PageLines(lines, height-1, os.Stdout, ReadLine)
+}
+
+// CaptureOutput runs fn with os.Stdout redirected and returns what it printed
+func CaptureOutput(fn func()) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+
+	originalStdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = originalStdout }()
+
+	done := make(chan string)
+	go func() {
+		var output strings.Builder
+		io.Copy(&output, r)
+		r.Close()
+		done <- output.String()
+	}()
+
+	fn()
+	w.Close()
+	return <-done, nil
+}
+
+func runExternalPager(command, output string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(output)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// PageLines is the built-in pager. It shows height lines at a time and reads
+// commands from readCommand: Enter or space for the next page, "b" for the
+// previous one, a number of lines to scroll, "g"/"G" for top/bottom,
+// "/pattern" and "n" to search, and "q" to quit.
+func PageLines(lines []string, height int, out io.Writer, readCommand func(prompt string) (string, error)) {
+	if height < 1 {
+		height = 1
+	}
+	maxTop := len(lines) - height
+	if maxTop < 0 {
+		maxTop = 0
+	}
+	clamp := func(top int) int {
+		if top < 0 {
+			return 0
+		}
+		if top > maxTop {
+			return maxTop
+		}
+		return top
+	}
+
+	top := 0
+	pattern := ""
+	message := ""
+	for {
+		end := top + height
+		if end > len(lines) {
+			end = len(lines)
+		}
+		for _, line := range lines[top:end] {
+			fmt.Fprintln(out, highlightMatch(line, pattern))
+		}
+
+		status := fmt.Sprintf("lines %d-%d/%d (%d%%)", top+1, end, len(lines), end*100/len(lines))
+		if message != "" {
+			status += " " + message
+			message = ""
+		}
+		command, err := readCommand(Colorize(RolePrompt, status+" :"))
+		if err != nil {
+			fmt.Fprintln(out)
+			return
+		}
+
+		switch {
+		case command == "" || command == " " || command == "f":
+			if end == len(lines) {
+				return
+			}
+			top = clamp(top + height)
+		case command == "q" || command == "Q":
+			return
+		case command == "b":
+			top = clamp(top - height)
+		case command == "g":
+			top = 0
+		case command == "G":
+			top = maxTop
+		case strings.HasPrefix(command, "/") || command == "n":
+			if command != "n" {
+				pattern = command[1:]
+			}
+			if pattern == "" {
+				message = "(no search pattern)"
+				break
+			}
+			found := -1
+			for i := top + 1; i < len(lines); i++ {
+				if strings.Contains(lines[i], pattern) {
+					found = i
+					break
+				}
+			}
+			if found < 0 {
+				message = fmt.Sprintf("(pattern not found: %s)", pattern)
+				break
+			}
+			top = clamp(found)
+		default:
+			if n, err := strconv.Atoi(command); err == nil {
+				top = clamp(top + n)
+			} else {
+				message = "(Enter/space next, b back, N lines, g/G top/bottom, /pattern, n next, q quit)"
+			}
+		}
+	}
+}
+
+func highlightMatch(line, pattern string) string {
+	if pattern == "" || !GlobalPalette.Enabled() {
+		return line
+	}
+	return strings.ReplaceAll(line, pattern, "\033[7m"+pattern+Reset)
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"errors"
+	"fmsh/fileops"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrOutsideRoot is returned for paths that resolve outside the root jail
+	ErrOutsideRoot = errors.New("path is outside the shell root")
+	// ErrNotConfirmed is returned when a change to a protected path is declined
+	ErrNotConfirmed = errors.New("change to protected path not confirmed")
+)
+
+// DefaultProtectedPaths are the system locations guarded when the config does not list any
+var DefaultProtectedPaths = []string{
+	"/",
+	"/bin/**",
+	"/boot/**",
+	"/dev/**",
+	"/etc/**",
+	"/lib/**",
+	"/lib64/**",
+	"/proc/**",
+	"/sbin/**",
+	"/sys/**",
+	"/usr/**",
+	"/System/**",
+	"~",
+}
+
+// Policy describes the safety rules applied to every command of a session
+type Policy struct {
+	ReadOnly  bool     // Disable commands registered as mutating
+	Root      string   // Resolved jail directory, empty when unrestricted
+	Protected []string // Patterns of paths that need confirmation before changes
+}
+
+// GlobalPolicy is the policy of the running shell
+var GlobalPolicy = &Policy{Protected: DefaultProtectedPaths}
+
+// SetRoot confines the session to dir and moves into it
+func (p *Policy) SetRoot(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := os.Chdir(resolved); err != nil {
+		return err
+	}
+	p.Root = resolved
+	return nil
+}
+
+// Check resolves path, following every symlink, and verifies it stays inside the root
+func (p *Policy) Check(path string) (string, error) {
+	return p.check(path, true)
+}
+
+// CheckEntry verifies the directory entry named by path, without following a final symlink
+func (p *Policy) CheckEntry(path string) (string, error) {
+	return p.check(path, false)
+}
+
+// Authorize checks a path that is about to be modified and asks for
+// confirmation when it matches a protected pattern
+func (p *Policy) Authorize(path string) (string, error) {
+	resolved, err := p.CheckEntry(path)
+	if err != nil {
+		return "", err
+	}
+	abs, _ := filepath.Abs(path)
+	if p.IsProtected(abs) || p.IsProtected(resolved) {
+		if !Confirm(fmt.Sprintf("'%s' is a protected path. Continue?", path)) {
+			return "", ErrNotConfirmed
+		}
+	}
+	return resolved, nil
+}
+
+// IsProtected reports whether path matches one of the protected patterns
+func (p *Policy) IsProtected(path string) bool {
+	for _, pattern := range p.Protected {
+		if MatchPathPattern(ExpandHome(pattern), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddProtected adds a protected pattern for the rest of the session
+func (p *Policy) AddProtected(pattern string) {
+	for _, existing := range p.Protected {
+		if existing == pattern {
+			return
+		}
+	}
+	p.Protected = append(p.Protected, pattern)
+}
+
+// RemoveProtected drops a protected pattern, reporting whether it was present
+func (p *Policy) RemoveProtected(pattern string) bool {
+	for i, existing := range p.Protected {
+		if existing == pattern {
+			p.Protected = append(p.Protected[:i:i], p.Protected[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) check(path string, follow bool) (string, error) {
+	resolved, err := fileops.ResolvePath(path, follow)
+	if err != nil {
+		return "", err
+	}
+	if p.Root != "" && !IsWithin(p.Root, resolved) {
+		return "", fmt.Errorf("%s: %w", path, ErrOutsideRoot)
+	}
+	return resolved, nil
+}
+
+// MatchPathPattern matches a path against a shell pattern. A trailing "/**"
+// matches the directory itself and everything beneath it.
+func MatchPathPattern(pattern, path string) bool {
+	path = filepath.Clean(path)
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		if dir == "" {
+			return true
+		}
+		for current := path; ; current = filepath.Dir(current) {
+			if matched, _ := filepath.Match(dir, current); matched {
+				return true
+			}
+			if current == filepath.Dir(current) {
+				return false
+			}
+		}
+	}
+	matched, _ := filepath.Match(pattern, path)
+	return matched
+}
+
+// IsWithin reports whether path is root or lies beneath it
+func IsWithin(root, path string) bool {
+	return fileops.IsWithin(root, path)
+}
+
+// ExpandHome replaces a leading "~" in a pattern with the home directory
+func ExpandHome(pattern string) string {
+	if pattern != "~" && !strings.HasPrefix(pattern, "~/") {
+		return pattern
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return pattern
+	}
+	return homeDir + pattern[1:]
+}
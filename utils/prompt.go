@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// SetInput makes prompts read their answers from r instead of standard input
+func SetInput(r io.Reader) {
+	stdinReader = bufio.NewReader(r)
+}
+
+// ReadLine prints a prompt and reads one line of user input
+func ReadLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	answer, err := stdinReader.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// Confirm asks a yes/no question on the terminal; anything but "y" or "yes" declines
+func Confirm(question string) bool {
+	answer, err := ReadLine(question + " [y/N] ")
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmsh/fileops"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// DefaultSession is the session used when fmsh is started without --session
+const DefaultSession = "default"
+
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// SessionState is the part of a shell session that survives restarts. The
+// undo history is kept separately in the session's undo journal.
+type SessionState struct {
+	Name    string    `json:"name"`
+	SavedAt time.Time `json:"saved_at"`
+	Cwd     string    `json:"cwd"`
+}
+
+// ValidateSessionName rejects names that cannot be used as a file name
+func ValidateSessionName(name string) error {
+	if !sessionNamePattern.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid session name %q", name)
+	}
+	return nil
+}
+
+// SessionPath returns the state file of a named session
+func SessionPath(name string) string {
+	return filepath.Join(ConfigDir(), "sessions", name+".json")
+}
+
+// LoadSession reads the state of a named session; a missing file yields an empty state
+func LoadSession(name string) (*SessionState, error) {
+	state := &SessionState{Name: name}
+	data, err := os.ReadFile(SessionPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return &SessionState{Name: name}, fmt.Errorf("corrupt session file: %w", err)
+	}
+	state.Name = name
+	return state, nil
+}
+
+// Save writes the state atomically so a crash never leaves a truncated file
+func (s *SessionState) Save() error {
+	s.SavedAt = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(SessionPath(s.Name), data, 0600)
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it into place
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return fileops.WriteFileAtomic(path, data, perm)
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+)
+
+// TerminalSize returns the width and height of the terminal on stdout,
+// falling back to $COLUMNS/$LINES and then to 80x24
+func TerminalSize() (int, int) {
+	width, height := terminalSize(os.Stdout)
+	if width <= 0 {
+		width = envInt("COLUMNS", 80)
+	}
+	if height <= 0 {
+		height = envInt("LINES", 24)
+	}
+	return width, height
+}
+
+// StdoutIsTerminal reports whether standard output is attached to a terminal
+func StdoutIsTerminal() bool {
+	return isTerminal(os.Stdout)
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func envInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package utils
+
+import "os"
+
+func terminalSize(f *os.File) (int, int) {
+	return 0, 0
+}
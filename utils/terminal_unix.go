@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package utils
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func terminalSize(f *os.File) (int, int) {
+	var ws struct {
+		Row, Col, Xpixel, Ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, 0
+	}
+	return int(ws.Col), int(ws.Row)
+}
@@ -0,0 +1,368 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Role names a kind of output that a theme assigns a colour to
+type Role string
+
+const (
+	RoleDirectory  Role = "directory"
+	RoleExecutable Role = "executable"
+	RoleSymlink    Role = "symlink"
+	RoleError      Role = "error"
+	RoleWarning    Role = "warning"
+	RolePrompt     Role = "prompt"
+	RoleSize       Role = "size"
+)
+
+// Roles lists every themable role in display order
+var Roles = []Role{RoleDirectory, RoleExecutable, RoleSymlink, RoleError, RoleWarning, RolePrompt, RoleSize}
+
+// ColorDepth is the number of colours the terminal can show
+type ColorDepth int
+
+const (
+	DepthNone ColorDepth = iota
+	Depth16
+	Depth256
+	DepthTrueColor
+)
+
+// Theme maps roles to colour specs such as "bold blue", "208" or "#ff8700 on black"
+type Theme map[Role]string
+
+// BuiltinThemes are available without any configuration
+var BuiltinThemes = map[string]Theme{
+	"default": {
+		RoleDirectory:  "bold blue",
+		RoleExecutable: "bold green",
+		RoleSymlink:    "bold cyan",
+		RoleError:      "red",
+		RoleWarning:    "yellow",
+		RolePrompt:     "cyan",
+		RoleSize:       "magenta",
+	},
+	"solarized": {
+		RoleDirectory:  "#268bd2",
+		RoleExecutable: "#859900",
+		RoleSymlink:    "#2aa198",
+		RoleError:      "bold #dc322f",
+		RoleWarning:    "#b58900",
+		RolePrompt:     "#6c71c4",
+		RoleSize:       "#d33682",
+	},
+	"mono": {
+		RoleDirectory:  "bold",
+		RoleExecutable: "underline",
+		RoleSymlink:    "italic",
+		RoleError:      "bold",
+		RoleWarning:    "bold",
+		RolePrompt:     "bold",
+		RoleSize:       "dim",
+	},
+}
+
+// Palette renders themed output for the running shell
+type Palette struct {
+	Name     string
+	Depth    ColorDepth
+	theme    Theme
+	lsColors map[string]string
+}
+
+// GlobalPalette is the palette used by every command
+var GlobalPalette = NewPalette("default", BuiltinThemes["default"])
+
+// NewPalette builds a palette for a theme, detecting colour support from the environment
+func NewPalette(name string, theme Theme) *Palette {
+	return &Palette{
+		Name:     name,
+		Depth:    DetectColorDepth(),
+		theme:    theme,
+		lsColors: ParseLSColors(os.Getenv("LS_COLORS")),
+	}
+}
+
+// LoadTheme looks a theme up in the config first and then among the builtins
+func LoadTheme(name string) (Theme, error) {
+	if theme, ok := GlobalConfig.Themes[name]; ok {
+		merged := Theme{}
+		for role, spec := range BuiltinThemes["default"] {
+			merged[role] = spec
+		}
+		for role, spec := range theme {
+			if _, err := ParseColorSpec(spec); err != nil {
+				return nil, fmt.Errorf("theme %s: %s: %v", name, role, err)
+			}
+			merged[role] = spec
+		}
+		return merged, nil
+	}
+	if theme, ok := BuiltinThemes[name]; ok {
+		return theme, nil
+	}
+	return nil, fmt.Errorf("unknown theme %q", name)
+}
+
+// ThemeNames returns the builtin and configured theme names, sorted
+func ThemeNames() []string {
+	seen := map[string]bool{}
+	for name := range BuiltinThemes {
+		seen[name] = true
+	}
+	for name := range GlobalConfig.Themes {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DetectColorDepth honours NO_COLOR, non-terminal output, COLORTERM and TERM
+func DetectColorDepth() ColorDepth {
+	if _, set := os.LookupEnv("NO_COLOR"); set {
+		return DepthNone
+	}
+	if !isTerminal(os.Stdout) {
+		return DepthNone
+	}
+	term := os.Getenv("TERM")
+	if term == "dumb" {
+		return DepthNone
+	}
+	switch strings.ToLower(os.Getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return DepthTrueColor
+	}
+	if strings.Contains(term, "256color") {
+		return Depth256
+	}
+	return Depth16
+}
+
+// Enabled reports whether any colour is written
+func (p *Palette) Enabled() bool {
+	return p.Depth != DepthNone
+}
+
+// Colorize wraps text in the colour of role
+func (p *Palette) Colorize(role Role, text string) string {
+	if !p.Enabled() {
+		return text
+	}
+	spec, err := ParseColorSpec(p.theme[role])
+	if err != nil {
+		return text
+	}
+	return wrapSGR(spec.SGR(p.Depth), text)
+}
+
+// ColorizeFile colours a file name by type, preferring the user's LS_COLORS
+func (p *Palette) ColorizeFile(name string, mode os.FileMode) string {
+	if !p.Enabled() {
+		return name
+	}
+	if sgr, ok := lsColorFor(p.lsColors, name, mode); ok {
+		return wrapSGR(sgr, name)
+	}
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return p.Colorize(RoleSymlink, name)
+	case mode.IsDir():
+		return p.Colorize(RoleDirectory, name)
+	case mode&0111 != 0:
+		return p.Colorize(RoleExecutable, name)
+	}
+	return name
+}
+
+// Colorize wraps text in the colour of role using the global palette
+func Colorize(role Role, text string) string {
+	return GlobalPalette.Colorize(role, text)
+}
+
+// ColorizeFile colours a file name using the global palette
+func ColorizeFile(name string, mode os.FileMode) string {
+	return GlobalPalette.ColorizeFile(name, mode)
+}
+
+func wrapSGR(sgr, text string) string {
+	if sgr == "" {
+		return text
+	}
+	return "\033[" + sgr + "m" + text + Reset
+}
+
+// colorValue is a foreground or background colour in one of the supported depths
+type colorValue struct {
+	kind    ColorDepth // Depth16, Depth256 or DepthTrueColor; DepthNone when unset
+	index   int        // Basic (0-15) or 256-colour index
+	r, g, b int
+}
+
+// ColorSpec is a parsed colour description
+type ColorSpec struct {
+	attrs []int
+	fg    colorValue
+	bg    colorValue
+}
+
+var colorAttributes = map[string]int{
+	"bold": 1, "dim": 2, "italic": 3, "underline": 4, "blink": 5, "reverse": 7,
+}
+
+var colorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// ParseColorSpec parses specs made of attributes and colours, e.g.
+// "bold red", "bright-blue on black", "208" or "#ff8700"
+func ParseColorSpec(spec string) (ColorSpec, error) {
+	var parsed ColorSpec
+	background := false
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		if code, ok := colorAttributes[word]; ok {
+			parsed.attrs = append(parsed.attrs, code)
+			continue
+		}
+		if word == "on" {
+			background = true
+			continue
+		}
+		value, err := parseColorValue(word)
+		if err != nil {
+			return ColorSpec{}, err
+		}
+		if background {
+			parsed.bg = value
+		} else {
+			parsed.fg = value
+		}
+	}
+	return parsed, nil
+}
+
+func parseColorValue(word string) (colorValue, error) {
+	if strings.HasPrefix(word, "#") && len(word) == 7 {
+		rgb, err := strconv.ParseUint(word[1:], 16, 32)
+		if err != nil {
+			return colorValue{}, fmt.Errorf("invalid colour %q", word)
+		}
+		return colorValue{kind: DepthTrueColor, r: int(rgb >> 16 & 0xff), g: int(rgb >> 8 & 0xff), b: int(rgb & 0xff)}, nil
+	}
+	if n, err := strconv.Atoi(word); err == nil {
+		if n < 0 || n > 255 {
+			return colorValue{}, fmt.Errorf("colour index %d out of range", n)
+		}
+		return colorValue{kind: Depth256, index: n}, nil
+	}
+	name, bright := strings.CutPrefix(word, "bright-")
+	for i, candidate := range colorNames {
+		if candidate == name {
+			if bright {
+				i += 8
+			}
+			return colorValue{kind: Depth16, index: i}, nil
+		}
+	}
+	return colorValue{}, fmt.Errorf("unknown colour %q", word)
+}
+
+// SGR renders the spec as Select Graphic Rendition parameters for a terminal of the given depth
+func (s ColorSpec) SGR(depth ColorDepth) string {
+	var codes []string
+	for _, attr := range s.attrs {
+		codes = append(codes, strconv.Itoa(attr))
+	}
+	if fg := s.fg.sgr(depth, 30); fg != "" {
+		codes = append(codes, fg)
+	}
+	if bg := s.bg.sgr(depth, 40); bg != "" {
+		codes = append(codes, bg)
+	}
+	return strings.Join(codes, ";")
+}
+
+// sgr renders the colour, downgrading it when the terminal has fewer colours
+func (c colorValue) sgr(depth ColorDepth, base int) string {
+	if c.kind == DepthNone || depth == DepthNone {
+		return ""
+	}
+	value := c
+	if value.kind == DepthTrueColor && depth < DepthTrueColor {
+		value = colorValue{kind: Depth256, index: rgbTo256(c.r, c.g, c.b)}
+	}
+	if value.kind == Depth256 && depth < Depth256 {
+		value = colorValue{kind: Depth16, index: xterm256To16(value.index)}
+	}
+
+	switch value.kind {
+	case DepthTrueColor:
+		return fmt.Sprintf("%d;2;%d;%d;%d", base+8, value.r, value.g, value.b)
+	case Depth256:
+		return fmt.Sprintf("%d;5;%d", base+8, value.index)
+	}
+	if value.index >= 8 {
+		return strconv.Itoa(base + 60 + value.index - 8)
+	}
+	return strconv.Itoa(base + value.index)
+}
+
+// rgbTo256 maps a truecolour value onto the 6x6x6 cube or grey ramp of xterm-256
+func rgbTo256(r, g, b int) int {
+	if r == g && g == b {
+		switch {
+		case r < 8:
+			return 16
+		case r > 248:
+			return 231
+		}
+		return 232 + (r-8)*24/247
+	}
+	cube := func(v int) int {
+		if v < 48 {
+			return 0
+		}
+		if v < 115 {
+			return 1
+		}
+		return (v - 35) / 40
+	}
+	return 16 + 36*cube(r) + 6*cube(g) + cube(b)
+}
+
+// xterm256To16 approximates an xterm-256 index with one of the 16 basic colours
+func xterm256To16(index int) int {
+	switch {
+	case index < 16:
+		return index
+	case index >= 232:
+		if index < 244 {
+			return 8 // Bright black
+		}
+		return 7
+	}
+	index -= 16
+	r, g, b := index/36, index/6%6, index%6
+	basic := 0
+	if r >= 3 {
+		basic |= 1
+	}
+	if g >= 3 {
+		basic |= 2
+	}
+	if b >= 3 {
+		basic |= 4
+	}
+	if r == 5 || g == 5 || b == 5 {
+		basic += 8
+	}
+	return basic
+}
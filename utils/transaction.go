@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrTransactionOpen is returned when an operation needs the open transaction finished first
+	ErrTransactionOpen = errors.New("a transaction is open")
+	// ErrNoTransaction is returned by Commit and Rollback outside a transaction
+	ErrNoTransaction = errors.New("no transaction is open")
+)
+
+// Transaction groups the actions recorded between begin and commit so they
+// can be rolled back together. It is kept in the undo journal while open,
+// which is how a transaction interrupted by a crash is found again.
+type Transaction struct {
+	Name         string    `json:"name"`
+	Started      time.Time `json:"started"`
+	AutoRollback bool      `json:"auto_rollback,omitempty"` // Roll back when an operation fails
+	Actions      []Action  `json:"actions,omitempty"`
+	Irreversible []string  `json:"irreversible,omitempty"` // Commands run inside it that rollback cannot revert
+}
+
+// batch returns the transaction's actions as a single undoable action
+func (tx *Transaction) batch() Action {
+	label := "transaction"
+	if tx.Name != "" {
+		label += " " + tx.Name
+	}
+	return Action{
+		Type:    Batch,
+		Label:   label,
+		Actions: append([]Action(nil), tx.Actions...),
+		Time:    tx.Started,
+	}
+}
+
+// Begin opens a transaction; actions pushed until Commit or Rollback are collected in it
+func (um *UndoManager) Begin(name string, autoRollback bool) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx != nil {
+		return ErrTransactionOpen
+	}
+	um.tx = &Transaction{Name: name, Started: time.Now(), AutoRollback: autoRollback}
+	um.save()
+	return nil
+}
+
+// Transaction returns a copy of the open transaction, or nil
+func (um *UndoManager) Transaction() *Transaction {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx == nil {
+		return nil
+	}
+	tx := *um.tx
+	tx.Actions = append([]Action(nil), um.tx.Actions...)
+	tx.Irreversible = append([]string(nil), um.tx.Irreversible...)
+	return &tx
+}
+
+// NoteIrreversible records in the open transaction a command whose changes
+// rollback cannot revert, so rollback can name it
+func (um *UndoManager) NoteIrreversible(command string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx == nil {
+		return
+	}
+	um.tx.Irreversible = append(um.tx.Irreversible, command)
+	um.save()
+}
+
+// Commit closes the transaction, recording its actions as one undo step,
+// and returns how many actions it held
+func (um *UndoManager) Commit() (int, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx == nil {
+		return 0, ErrNoTransaction
+	}
+	n := len(um.tx.Actions)
+	if n > 0 {
+		um.history = appendBounded(um.history, um.tx.batch())
+	}
+	um.tx = nil
+	um.save()
+	return n, nil
+}
+
+// Rollback reverts every action of the open transaction, last first, and
+// closes it. The reverted transaction can be re-applied with redo. Unless
+// force is set, a transaction whose files changed since is refused with
+// ErrUndoConflict and stays open; when reverting fails part way, the steps
+// already reverted are re-applied and the transaction also stays open.
+func (um *UndoManager) Rollback(force bool) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx == nil {
+		return ErrNoTransaction
+	}
+
+	batch := um.tx.batch()
+	if !force {
+		if err := batch.CheckConflict(); err != nil {
+			return err
+		}
+	}
+	if err := revert(batch); err != nil {
+		return fmt.Errorf("rollback failed, nothing was reverted: %w", err)
+	}
+	if len(batch.Actions) > 0 {
+		um.redo = appendBounded(um.redo, batch)
+	}
+	um.tx = nil
+	um.save()
+	return nil
+}
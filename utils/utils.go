@@ -1,8 +1,15 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
+	"fmsh/fileops"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type ActionType int
@@ -11,49 +18,451 @@ const (
 	Create ActionType = iota
 	Delete
 	Move
+	Trash   // Source was moved into the trash at Dest
+	Mkdir   // Source is a newly created directory
+	Rename  // Source was renamed to Dest in place
+	Chmod   // Source's permissions changed from Mode to NewMode
+	Batch   // Actions are undone together, last first
+	Symlink // Source is a new symlink to Target
+	Link    // Source is a new hard link to Dest
+	Chown   // Source's owner and group changed from UID/GID to NewUID/NewGID
+	Xattr   // An extended attribute of Source changed as Attr describes
+	Copy    // Source was copied to Dest, which did not exist or was moved away first
+	Extract // The entry Target of the archive Source was extracted to Dest
 )
 
+var actionNames = map[ActionType]string{
+	Create:  "create",
+	Delete:  "delete",
+	Move:    "move",
+	Trash:   "trash",
+	Mkdir:   "mkdir",
+	Rename:  "rename",
+	Chmod:   "chmod",
+	Batch:   "batch",
+	Symlink: "symlink",
+	Link:    "link",
+	Chown:   "chown",
+	Xattr:   "xattr",
+	Copy:    "copy",
+	Extract: "extract",
+}
+
+func (t ActionType) String() string {
+	if name, ok := actionNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("action(%d)", int(t))
+}
+
 type Action struct {
-	Type    ActionType
-	Source  string
-	Dest    string // Used for Move operations
-	Content []byte // Used for Create/Delete operations
+	Type    ActionType  `json:"type"`
+	Source  string      `json:"source"`
+	Dest    string      `json:"dest,omitempty"`     // Used for Move, Rename, Trash, Link, Copy and Extract operations
+	Target  string      `json:"target,omitempty"`   // Contents of a Symlink, kept as written, or the entry name of an Extract
+	Content []byte      `json:"content,omitempty"`  // Used for Create/Delete operations
+	Mode    os.FileMode `json:"mode,omitempty"`     // Permissions before a Chmod
+	NewMode os.FileMode `json:"new_mode,omitempty"` // Permissions after a Chmod
+	UID     int         `json:"uid,omitempty"`      // Owner before a Chown
+	GID     int         `json:"gid,omitempty"`      // Group before a Chown
+	NewUID  int         `json:"new_uid,omitempty"`  // Owner after a Chown
+	NewGID  int         `json:"new_gid,omitempty"`  // Group after a Chown
+	Attr    *AttrChange `json:"attr,omitempty"`     // Used for Xattr operations
+	Actions []Action    `json:"actions,omitempty"`  // Steps of a Batch, in the order they were done
+	Label   string      `json:"label,omitempty"`    // Command that recorded a Batch
+	Time    time.Time   `json:"time"`
+	Stamp   *FileStamp  `json:"stamp,omitempty"` // State of the result when the action was recorded
+}
+
+// AttrChange is an extended attribute before and after an Xattr action; a
+// nil value stands for an attribute the file did not have
+type AttrChange struct {
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+	New   []byte `json:"new"`
+}
+
+// setAttr gives path's attribute name the value, removing it when nil
+func setAttr(path, name string, value []byte) error {
+	if value == nil {
+		return fileops.RemoveXattr(path, name)
+	}
+	return fileops.SetXattr(path, name, value)
+}
+
+// String describes the action for undo listings
+func (a Action) String() string {
+	switch a.Type {
+	case Move, Rename, Copy:
+		return fmt.Sprintf("%s %s -> %s", a.Type, a.Source, a.Dest)
+	case Extract:
+		return fmt.Sprintf("extract %s:%s -> %s", a.Source, a.Target, a.Dest)
+	case Chmod:
+		return fmt.Sprintf("chmod %s %s -> %s", a.Source, fileops.OctalMode(a.Mode), fileops.OctalMode(a.NewMode))
+	case Chown:
+		return fmt.Sprintf("chown %s %d:%d -> %d:%d", a.Source, a.UID, a.GID, a.NewUID, a.NewGID)
+	case Xattr:
+		if a.Attr.New == nil {
+			return fmt.Sprintf("xattr %s remove %s", a.Source, a.Attr.Name)
+		}
+		return fmt.Sprintf("xattr %s set %s", a.Source, a.Attr.Name)
+	case Symlink:
+		return fmt.Sprintf("symlink %s -> %s", a.Source, a.Target)
+	case Link:
+		return fmt.Sprintf("link %s => %s", a.Source, a.Dest)
+	case Batch:
+		return fmt.Sprintf("%s (%d actions)", a.Label, len(a.Actions))
+	default:
+		return fmt.Sprintf("%s %s", a.Type, a.Source)
+	}
+}
+
+// resultPath is the path an action left behind, which undo is about to touch
+func (a Action) resultPath() string {
+	if a.Type == Move || a.Type == Rename || a.Type == Trash || a.Type == Copy || a.Type == Extract {
+		return a.Dest
+	}
+	return a.Source
+}
+
+// absolute makes the action's paths absolute, so undo keeps working after a cd
+func (a Action) absolute() Action {
+	for _, path := range []*string{&a.Source, &a.Dest} {
+		if *path != "" {
+			if abs, err := filepath.Abs(*path); err == nil {
+				*path = abs
+			}
+		}
+	}
+	if len(a.Actions) > 0 {
+		steps := make([]Action, len(a.Actions))
+		for i, step := range a.Actions {
+			steps[i] = step.absolute()
+		}
+		a.Actions = steps
+	}
+	return a
+}
+
+// stamped records the current state of the action's result, and of every
+// step of a batch, for later conflict checks
+func (a Action) stamped() Action {
+	if a.Type == Batch {
+		steps := make([]Action, len(a.Actions))
+		for i, step := range a.Actions {
+			steps[i] = step.stamped()
+		}
+		a.Actions = steps
+		return a
+	}
+	if a.Type != Delete {
+		stamp := StampFile(a.resultPath())
+		a.Stamp = &stamp
+	}
+	return a
+}
+
+// FileStamp is enough of a file's state to notice that it changed
+type FileStamp struct {
+	Exists  bool        `json:"exists"`
+	IsDir   bool        `json:"is_dir,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mod_time,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
 }
 
+// StampFile records the current state of path
+func StampFile(path string) FileStamp {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return FileStamp{}
+	}
+	return FileStamp{
+		Exists:  true,
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}
+}
+
+// Matches reports whether path is still in the stamped state. Directories
+// only need to still be directories, since their size and time change
+// whenever something inside them does.
+func (s FileStamp) Matches(path string) bool {
+	now := StampFile(path)
+	if s.IsDir || now.IsDir {
+		return s.Exists == now.Exists && s.IsDir == now.IsDir
+	}
+	return s.Exists == now.Exists && s.Size == now.Size && s.ModTime.Equal(now.ModTime) && s.Mode == now.Mode
+}
+
+// ErrUndoConflict is returned when the file system changed since an action was recorded
+var ErrUndoConflict = errors.New("changed since the action was recorded")
+
+// MaxUndoEntries bounds each stack of the undo journal
+const MaxUndoEntries = 500
+
+// UndoManager keeps separate undo and redo stacks. Recording a new action
+// clears the redo stack. After Open, every change is written to a journal
+// file so the history survives restarts and crashes; the zero value keeps
+// the history in memory only.
 type UndoManager struct {
+	mu      sync.Mutex
+	path    string
 	history []Action
+	redo    []Action
+	tx      *Transaction
 }
 
 var GlobalUndoManager = &UndoManager{}
 
-// Push an action onto the stack
+type undoJournal struct {
+	Undo        []Action     `json:"undo"`
+	Redo        []Action     `json:"redo"`
+	Transaction *Transaction `json:"transaction,omitempty"`
+}
+
+// UndoJournalPath returns the journal file of a named session
+func UndoJournalPath(session string) string {
+	return filepath.Join(ConfigDir(), "undo", session+".json")
+}
+
+// Open loads the journal at path and keeps it up to date from now on
+func (um *UndoManager) Open(path string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.path = path
+	um.history, um.redo, um.tx = nil, nil, nil
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var journal undoJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return fmt.Errorf("corrupt undo journal: %w", err)
+	}
+	um.history, um.redo, um.tx = journal.Undo, journal.Redo, journal.Transaction
+	return nil
+}
+
+// save writes the journal; callers hold um.mu
+func (um *UndoManager) save() {
+	if um.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(undoJournal{Undo: um.history, Redo: um.redo, Transaction: um.tx}, "", "  ")
+	if err == nil {
+		err = WriteFileAtomic(um.path, data, 0600)
+	}
+	if err != nil {
+		fmt.Printf("Warning: Unable to write undo journal: %v\n", err)
+	}
+}
+
+// Push an action onto the stack, or onto the open transaction
 func (um *UndoManager) Push(action Action) {
-	um.history = append(um.history, action)
+	if action.Time.IsZero() {
+		action.Time = time.Now()
+	}
+	action = action.absolute()
+	if action.Stamp == nil {
+		action = action.stamped()
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx != nil {
+		um.tx.Actions = append(um.tx.Actions, action)
+	} else {
+		um.history = appendBounded(um.history, action)
+	}
+	um.redo = nil
+	um.save()
+}
+
+func appendBounded(stack []Action, action Action) []Action {
+	stack = append(stack, action)
+	if len(stack) > MaxUndoEntries {
+		stack = append([]Action(nil), stack[len(stack)-MaxUndoEntries:]...)
+	}
+	return stack
 }
 
 // Pop the last action from the stack
 func (um *UndoManager) Pop() (Action, bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
 	if len(um.history) == 0 {
 		return Action{}, false
 	}
 	action := um.history[len(um.history)-1]
 	um.history = um.history[:len(um.history)-1]
+	um.save()
 	return action, true
 }
 
+// Actions returns a copy of the recorded actions, oldest first
+func (um *UndoManager) Actions() []Action {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return append([]Action(nil), um.history...)
+}
+
+// RedoActions returns a copy of the undone actions, the next one to redo last
+func (um *UndoManager) RedoActions() []Action {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return append([]Action(nil), um.redo...)
+}
+
+// Restore replaces the recorded actions, clearing the redo stack and any open transaction
+func (um *UndoManager) Restore(actions []Action) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.history = append([]Action(nil), actions...)
+	um.redo, um.tx = nil, nil
+	um.save()
+}
+
 // Undo the last action
-func (um *UndoManager) Undo() {
-	action, ok := um.Pop()
-	if !ok {
+func (um *UndoManager) Undo() error {
+	return um.UndoSteps(1, false)
+}
+
+// UndoSteps undoes up to n actions, most recent first, stopping at the first
+// failure. Unless force is set, an action whose result has changed since it
+// was recorded is refused with ErrUndoConflict and left on the stack.
+func (um *UndoManager) UndoSteps(n int, force bool) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx != nil {
+		fmt.Println("Undo: finish the open transaction with commit or rollback first")
+		return ErrTransactionOpen
+	}
+	if len(um.history) == 0 {
 		fmt.Println("Nothing to undo!")
-		return
+		return nil
 	}
 
+	for ; n > 0 && len(um.history) > 0; n-- {
+		action := um.history[len(um.history)-1]
+		if !force {
+			if err := action.CheckConflict(); err != nil {
+				fmt.Printf("Undo: %v (use undo --force to undo anyway)\n", err)
+				return err
+			}
+		}
+		if err := revert(action); err != nil {
+			return err
+		}
+		um.history = um.history[:len(um.history)-1]
+		um.redo = appendBounded(um.redo, action)
+		um.save()
+	}
+	return nil
+}
+
+// Redo the last undone action
+func (um *UndoManager) Redo() error {
+	return um.RedoSteps(1)
+}
+
+// RedoSteps re-applies up to n undone actions, stopping at the first failure
+func (um *UndoManager) RedoSteps(n int) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if um.tx != nil {
+		fmt.Println("Redo: finish the open transaction with commit or rollback first")
+		return ErrTransactionOpen
+	}
+	if len(um.redo) == 0 {
+		fmt.Println("Nothing to redo!")
+		return nil
+	}
+
+	for ; n > 0 && len(um.redo) > 0; n-- {
+		action, err := reapply(um.redo[len(um.redo)-1])
+		if err != nil {
+			return err
+		}
+		action = action.stamped()
+		um.redo = um.redo[:len(um.redo)-1]
+		um.history = appendBounded(um.history, action)
+		um.save()
+	}
+	return nil
+}
+
+// CheckConflict reports when undoing the action would clobber or lose
+// changes made after it was recorded
+func (a Action) CheckConflict() error {
+	return a.checkConflict(map[string]bool{}, map[string]bool{})
+}
+
+// checkConflict checks the action against the file system as it will be once
+// the actions after it are undone: vacated paths are emptied by those undos
+// and restored paths are recreated by them
+func (a Action) checkConflict(vacated, restored map[string]bool) error {
+	if a.Type == Batch {
+		for i := len(a.Actions) - 1; i >= 0; i-- {
+			if err := a.Actions[i].checkConflict(vacated, restored); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	result := a.resultPath()
+	if a.Stamp != nil && !restored[result] && !a.Stamp.Matches(result) {
+		return fmt.Errorf("%s: %w", result, ErrUndoConflict)
+	}
+	recreatesSource := a.Type == Delete || a.Type == Move || a.Type == Rename || a.Type == Trash
+	if recreatesSource {
+		// Undo recreates Source, which must not have been taken since
+		_, err := os.Lstat(a.Source)
+		if restored[a.Source] || (err == nil && !vacated[a.Source]) {
+			return fmt.Errorf("%s already exists: %w", a.Source, ErrUndoConflict)
+		}
+	}
+
+	if a.Type != Chmod && a.Type != Chown && a.Type != Xattr && a.Type != Delete {
+		vacated[result] = true
+		delete(restored, result)
+	}
+	if recreatesSource {
+		restored[a.Source] = true
+		delete(vacated, a.Source)
+	}
+	return nil
+}
+
+// revert undoes one action and reports the outcome
+func revert(action Action) error {
+	var err error
 	switch action.Type {
+	case Create:
+		// Undo file creation
+		err = os.RemoveAll(action.Source)
+		Audit("undo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to remove file: %v\n", err)
+		} else {
+			fmt.Println("Undo: File removed:", action.Source)
+		}
 	case Delete:
 		if action.Content != nil {
 			// Undo file deletion
-			err := os.WriteFile(action.Source, action.Content, 0644)
+			err = os.WriteFile(action.Source, action.Content, 0644)
+			GlobalAuditLog.Record(AuditEntry{
+				Op:    "undo",
+				Paths: []string{action.Source},
+				Sizes: []int64{int64(len(action.Content))},
+			}, err)
 			if err != nil {
 				fmt.Printf("Undo: Failed to restore file: %v\n", err)
 			} else {
@@ -61,39 +470,132 @@ func (um *UndoManager) Undo() {
 			}
 		} else {
 			// Undo directory deletion
-			err := os.Mkdir(action.Source, 0755)
+			err = os.Mkdir(action.Source, 0755)
+			Audit("undo", []string{action.Source}, err)
 			if err != nil {
 				fmt.Printf("Undo: Failed to restore directory: %v\n", err)
 			} else {
 				fmt.Println("Undo: Directory restored:", action.Source)
 			}
 		}
-	case Move:
-		// Undo file move
-		err := os.Rename(action.Dest, action.Source)
+	case Move, Rename:
+		// Undo file move, copying back when the move crossed filesystems. An
+		// entry restored from the trash is put back into it.
+		if fileops.InTrash(action.Source) {
+			err = fileops.TrashOf(action.Source).Return(action.Dest, filepath.Base(action.Source))
+		} else {
+			_, err = fileops.Move(action.Dest, action.Source, fileops.MoveOptions{})
+		}
+		Audit("undo", []string{action.Dest, action.Source}, err)
 		if err != nil {
 			fmt.Printf("Undo: Failed to move file: %v\n", err)
 		} else {
 			fmt.Printf("Undo: Moved file back to %s\n", action.Source)
 		}
+	case Trash:
+		// Undo deletion by restoring the entry from the trash
+		trash := fileops.TrashOf(action.Dest)
+		var restored string
+		restored, err = trash.RestoreTo(filepath.Base(action.Dest), action.Source, fileops.ConflictOptions{Policy: fileops.NoClobber})
+		if err == nil && restored == "" {
+			err = fmt.Errorf("%s already exists", action.Source)
+		}
+		Audit("undo", []string{action.Dest, action.Source}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to restore from trash: %v\n", err)
+		} else {
+			fmt.Println("Undo: Restored from trash:", action.Source)
+		}
+	case Mkdir:
+		// Undo directory creation; a directory that is no longer empty stays
+		err = os.Remove(action.Source)
+		Audit("undo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to remove directory: %v\n", err)
+		} else {
+			fmt.Println("Undo: Directory removed:", action.Source)
+		}
+	case Symlink, Link:
+		// Undo link creation; what the link points to stays
+		err = os.Remove(action.Source)
+		Audit("undo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to remove link: %v\n", err)
+		} else {
+			fmt.Println("Undo: Link removed:", action.Source)
+		}
+	case Chmod:
+		// Undo permission change
+		err = os.Chmod(action.Source, action.Mode)
+		GlobalAuditLog.Record(AuditEntry{
+			Op:         "undo",
+			Paths:      []string{action.Source},
+			ModeBefore: fileops.OctalMode(action.NewMode),
+			ModeAfter:  FileMode(action.Source),
+		}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to restore permissions: %v\n", err)
+		} else {
+			fmt.Printf("Undo: Permissions of %s restored to %s\n", action.Source, fileops.OctalMode(action.Mode))
+		}
+	case Chown:
+		// Undo ownership change; the change itself never followed a symlink
+		err = os.Lchown(action.Source, action.UID, action.GID)
+		Audit("undo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to restore owner: %v\n", err)
+		} else {
+			fmt.Printf("Undo: Owner of %s restored to %d:%d\n", action.Source, action.UID, action.GID)
+		}
+	case Xattr:
+		// Undo attribute change
+		err = setAttr(action.Source, action.Attr.Name, action.Attr.Value)
+		Audit("undo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to restore attribute: %v\n", err)
+		} else {
+			fmt.Printf("Undo: Attribute %s of %s restored\n", action.Attr.Name, action.Source)
+		}
+	case Copy, Extract:
+		// Undo a copy or extraction by removing what it wrote
+		err = os.RemoveAll(action.Dest)
+		Audit("undo", []string{action.Dest}, err)
+		if err != nil {
+			fmt.Printf("Undo: Failed to remove %s: %v\n", action.Type, err)
+		} else {
+			fmt.Println("Undo: Removed:", action.Dest)
+		}
+	case Batch:
+		// Undo every step, last first; a failure re-applies the steps
+		// already undone so the batch is never left half reverted
+		for i := len(action.Actions) - 1; i >= 0; i-- {
+			if err = revert(action.Actions[i]); err != nil {
+				for _, step := range action.Actions[i+1:] {
+					reapply(step)
+				}
+				break
+			}
+		}
 	default:
+		err = fmt.Errorf("unknown action type %d", int(action.Type))
 		fmt.Println("Unknown action type")
 	}
+	return err
 }
 
-// Redo the last undone action
-func (um *UndoManager) Redo() {
-	action, ok := um.Pop()
-	if !ok {
-		fmt.Println("Nothing to redo!")
-		return
-	}
-
+// reapply performs an undone action again, returning it as now recorded
+func reapply(action Action) (Action, error) {
+	var err error
 	switch action.Type {
 	case Create:
 		// Redo file creation
 		if action.Content != nil {
-			err := os.WriteFile(action.Source, action.Content, 0644)
+			err = os.WriteFile(action.Source, action.Content, 0644)
+			GlobalAuditLog.Record(AuditEntry{
+				Op:    "redo",
+				Paths: []string{action.Source},
+				Sizes: []int64{int64(len(action.Content))},
+			}, err)
 			if err != nil {
 				fmt.Printf("Redo: Failed to restore file: %v\n", err)
 			} else {
@@ -101,22 +603,164 @@ func (um *UndoManager) Redo() {
 			}
 		} else {
 			// Redo directory creation
-			err := os.Mkdir(action.Source, 0755)
+			err = os.Mkdir(action.Source, 0755)
+			Audit("redo", []string{action.Source}, err)
 			if err != nil {
 				fmt.Printf("Redo: Failed to restore directory: %v\n", err)
 			} else {
 				fmt.Println("Redo: Directory restored:", action.Source)
 			}
 		}
-	case Move:
+	case Delete:
+		// Redo file deletion
+		err = os.RemoveAll(action.Source)
+		Audit("redo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to delete file: %v\n", err)
+		} else {
+			fmt.Println("Redo: File deleted:", action.Source)
+		}
+	case Move, Rename:
 		// Redo file move
-		err := os.Rename(action.Source, action.Dest)
+		var moved string
+		noClobber := fileops.ConflictOptions{Policy: fileops.NoClobber}
+		if fileops.InTrash(action.Source) {
+			moved, err = fileops.TrashOf(action.Source).RestoreTo(filepath.Base(action.Source), action.Dest, noClobber)
+		} else {
+			moved, err = fileops.Move(action.Source, action.Dest, fileops.MoveOptions{Conflict: noClobber})
+		}
+		if err == nil && moved == "" {
+			err = fmt.Errorf("%s already exists", action.Dest)
+		}
+		Audit("redo", []string{action.Source, action.Dest}, err)
 		if err != nil {
 			fmt.Printf("Redo: Failed to move file: %v\n", err)
 		} else {
 			fmt.Printf("Redo: Moved file to %s\n", action.Dest)
 		}
+	case Trash:
+		// Redo deletion by trashing the entry again, possibly under a new name
+		var trashed string
+		trashed, err = fileops.TrashOf(action.Dest).Put(action.Source)
+		Audit("redo", []string{action.Source, trashed}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to move to trash: %v\n", err)
+		} else {
+			action.Dest = trashed
+			fmt.Println("Redo: Moved to trash:", action.Source)
+		}
+	case Mkdir:
+		// Redo directory creation
+		err = os.Mkdir(action.Source, 0755)
+		Audit("redo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to create directory: %v\n", err)
+		} else {
+			fmt.Println("Redo: Directory created:", action.Source)
+		}
+	case Symlink:
+		// Redo symlink creation
+		err = os.Symlink(action.Target, action.Source)
+		Audit("redo", []string{action.Source, action.Target}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to create symlink: %v\n", err)
+		} else {
+			fmt.Println("Redo: Symlink created:", action.Source)
+		}
+	case Link:
+		// Redo hard link creation
+		err = os.Link(action.Dest, action.Source)
+		Audit("redo", []string{action.Source, action.Dest}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to create hard link: %v\n", err)
+		} else {
+			fmt.Println("Redo: Hard link created:", action.Source)
+		}
+	case Chmod:
+		// Redo permission change
+		err = os.Chmod(action.Source, action.NewMode)
+		GlobalAuditLog.Record(AuditEntry{
+			Op:         "redo",
+			Paths:      []string{action.Source},
+			ModeBefore: fileops.OctalMode(action.Mode),
+			ModeAfter:  FileMode(action.Source),
+		}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to change permissions: %v\n", err)
+		} else {
+			fmt.Printf("Redo: Permissions of %s changed to %s\n", action.Source, fileops.OctalMode(action.NewMode))
+		}
+	case Chown:
+		// Redo ownership change
+		err = os.Lchown(action.Source, action.NewUID, action.NewGID)
+		Audit("redo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to change owner: %v\n", err)
+		} else {
+			fmt.Printf("Redo: Owner of %s changed to %d:%d\n", action.Source, action.NewUID, action.NewGID)
+		}
+	case Xattr:
+		// Redo attribute change
+		err = setAttr(action.Source, action.Attr.Name, action.Attr.New)
+		Audit("redo", []string{action.Source}, err)
+		if err != nil {
+			fmt.Printf("Redo: Failed to change attribute: %v\n", err)
+		} else {
+			fmt.Printf("Redo: Attribute %s of %s changed\n", action.Attr.Name, action.Source)
+		}
+	case Copy:
+		// Redo the copy. A regular file may have been copied from a symlink,
+		// which only a copy that is not recursive follows.
+		recursive := action.Stamp == nil || !action.Stamp.Mode.IsRegular()
+		if _, err = os.Lstat(action.Dest); err == nil {
+			err = fmt.Errorf("%s already exists", action.Dest)
+		} else {
+			var stats fileops.CopyStats
+			stats, err = fileops.Copy(action.Source, action.Dest, fileops.CopyOptions{Recursive: recursive, PreserveOwnership: true})
+			GlobalAuditLog.Record(AuditEntry{
+				Op:    "redo",
+				Paths: []string{action.Source, action.Dest},
+				Sizes: []int64{stats.Bytes},
+			}, err)
+		}
+		if err != nil {
+			fmt.Printf("Redo: Failed to copy: %v\n", err)
+		} else {
+			fmt.Printf("Redo: Copied %s to %s\n", action.Source, action.Dest)
+		}
+	case Extract:
+		// Redo the extraction of the one entry
+		if _, err = os.Lstat(action.Dest); err == nil {
+			err = fmt.Errorf("%s already exists", action.Dest)
+		} else {
+			dest := strings.TrimSuffix(action.Dest, filepath.FromSlash(action.Target))
+			_, err = fileops.ExtractArchive(action.Source, dest, fileops.ArchiveOptions{Only: action.Target})
+			Audit("redo", []string{action.Source, action.Dest}, err)
+		}
+		if err != nil {
+			fmt.Printf("Redo: Failed to extract: %v\n", err)
+		} else {
+			fmt.Printf("Redo: Extracted %s to %s\n", action.Target, action.Dest)
+		}
+	case Batch:
+		// Redo every step in order, undoing them again when one fails
+		steps := make([]Action, 0, len(action.Actions))
+		for _, step := range action.Actions {
+			var done Action
+			if done, err = reapply(step); err != nil {
+				for i := len(steps) - 1; i >= 0; i-- {
+					revert(steps[i])
+				}
+				break
+			}
+			steps = append(steps, done)
+		}
+		if err == nil {
+			action.Actions = steps
+		}
 	default:
+		err = fmt.Errorf("unknown action type %d", int(action.Type))
 		fmt.Println("Unknown action type")
 	}
+	return action, err
 }
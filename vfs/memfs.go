@@ -0,0 +1,442 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is a file system held in memory, for scratch space and for testing
+// destructive commands. It is safe for concurrent use.
+type MemFS struct {
+	mu   sync.RWMutex
+	root *memNode
+}
+
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte
+	target   string // Symlink target
+	children map[string]*memNode
+}
+
+// NewMemFS returns an empty in-memory file system
+func NewMemFS() *MemFS {
+	return &MemFS{root: newDirNode(".", 0755)}
+}
+
+func newDirNode(name string, perm fs.FileMode) *memNode {
+	return &memNode{name: name, mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), children: map[string]*memNode{}}
+}
+
+var errNotDir = errors.New("not a directory")
+var errIsDir = errors.New("is a directory")
+var errLoop = errors.New("too many levels of symbolic links")
+
+// lookup walks to name, following symlinks on the way and, when follow is
+// set, at the end. It returns the node, which is nil when only the last
+// element is missing, and its parent directory.
+func (m *MemFS) lookup(op, name string, follow bool) (*memNode, *memNode, string, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return m.walk(op, name, name, follow, 0)
+}
+
+func (m *MemFS) walk(op, orig, name string, follow bool, depth int) (*memNode, *memNode, string, error) {
+	if depth > 40 {
+		return nil, nil, "", &fs.PathError{Op: op, Path: orig, Err: errLoop}
+	}
+	// Symlink targets may contain ".." and start at the root
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return m.root, nil, ".", nil
+	}
+
+	parts := strings.Split(name, "/")
+	dir := m.root
+	dirPath := ""
+	for i, part := range parts {
+		node := dir.children[part]
+		last := i == len(parts)-1
+		if node == nil {
+			if last {
+				return nil, dir, part, nil
+			}
+			return nil, nil, "", &fs.PathError{Op: op, Path: orig, Err: fs.ErrNotExist}
+		}
+		if node.mode&fs.ModeSymlink != 0 && (!last || follow) {
+			// Relative targets start at the link's directory, absolute ones at the root
+			target := node.target
+			if !path.IsAbs(target) {
+				target = path.Join(dirPath, target)
+			}
+			rest := strings.Join(parts[i+1:], "/")
+			return m.walk(op, orig, path.Join(target, rest), follow, depth+1)
+		}
+		if last {
+			return node, dir, part, nil
+		}
+		if !node.mode.IsDir() {
+			return nil, nil, "", &fs.PathError{Op: op, Path: orig, Err: errNotDir}
+		}
+		dir = node
+		dirPath = path.Join(dirPath, part)
+	}
+	return nil, nil, "", &fs.PathError{Op: op, Path: orig, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) existing(op, name string, follow bool) (*memNode, error) {
+	node, _, _, err := m.lookup(op, name, follow)
+	if err == nil && node == nil {
+		err = &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return node, err
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, err := m.existing("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, err := m.existing("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, err := m.existing("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return node.entries(), nil
+}
+
+func (n *memNode) entries() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info()))
+	}
+	sortEntries(entries)
+	return entries
+}
+
+func (m *MemFS) ReadLink(name string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, err := m.existing("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.target, nil
+}
+
+func (m *MemFS) Open(name string) (fs.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, parent, base, err := m.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case node == nil && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case node == nil:
+		node = &memNode{name: base, mode: perm.Perm(), modTime: time.Now()}
+		parent.children[base] = node
+		parent.modTime = node.modTime
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+
+	if flag&os.O_TRUNC != 0 && !node.mode.IsDir() {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	f := &memFile{fs: m, node: node, name: name, flag: flag}
+	if flag&os.O_APPEND != 0 {
+		f.offset = int64(len(node.data))
+	}
+	return f, nil
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, parent, base, err := m.lookup("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	parent.children[base] = newDirNode(base, perm)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, oldParent, oldBase, err := m.lookup("rename", oldname, false)
+	if err == nil && node == nil {
+		err = &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return err
+	}
+	existing, newParent, newBase, err := m.lookup("rename", newname, false)
+	if err != nil {
+		return err
+	}
+	if existing == node {
+		return nil
+	}
+	if node.mode.IsDir() && newParent.isBelow(node) {
+		return &fs.PathError{Op: "rename", Path: newname, Err: errors.New("cannot move a directory into itself")}
+	}
+	if existing != nil {
+		switch {
+		case existing.mode.IsDir() && !node.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newname, Err: errIsDir}
+		case !existing.mode.IsDir() && node.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newname, Err: errNotDir}
+		case existing.mode.IsDir() && len(existing.children) > 0:
+			return &fs.PathError{Op: "rename", Path: newname, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(oldParent.children, oldBase)
+	node.name = newBase
+	newParent.children[newBase] = node
+	now := time.Now()
+	oldParent.modTime, newParent.modTime = now, now
+	return nil
+}
+
+// isBelow reports whether n is dir or lies beneath it
+func (n *memNode) isBelow(dir *memNode) bool {
+	if n == dir {
+		return true
+	}
+	for _, child := range dir.children {
+		if child.mode.IsDir() && n.isBelow(child) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, parent, base, err := m.lookup("remove", name, false)
+	if err == nil && node == nil {
+		err = &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	if node.mode.IsDir() && len(node.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(parent.children, base)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.existing("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode&fs.ModeType | mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)
+	return nil
+}
+
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.existing("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (m *MemFS) Symlink(target, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, parent, base, err := m.lookup("symlink", name, false)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrExist}
+	}
+	parent.children[base] = &memNode{name: base, mode: fs.ModeSymlink | 0777, modTime: time.Now(), target: target}
+	return nil
+}
+
+func (n *memNode) info() fs.FileInfo {
+	size := int64(len(n.data))
+	if n.mode&fs.ModeSymlink != 0 {
+		size = int64(len(n.target))
+	}
+	return memInfo{name: n.name, size: size, mode: n.mode, modTime: n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+// memFile is an open file; writes go straight to the node
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	listed int
+	closed bool
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return f.node.info(), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile
+func (f *memFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if !f.node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	entries := f.node.entries()[f.listed:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	f.listed += len(entries)
+	return entries, nil
+}
@@ -0,0 +1,163 @@
+package vfs
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mount is a backend mounted at an absolute host path
+type Mount struct {
+	Path string
+	FS   FS
+	Kind string // Shown by the mount command, such as "mem"
+}
+
+// Opener opens the backend for the host part of a URL, such as the bucket
+// of "s3://bucket/key"
+type Opener func(host string) (FS, error)
+
+// Namespace maps absolute paths to backends. Paths below no mount belong
+// to the host. URLs such as "s3://bucket/key" name backends of their own,
+// opened by the opener registered for the scheme.
+type Namespace struct {
+	mu      sync.RWMutex
+	mounts  []Mount
+	schemes map[string]Opener
+	remotes map[string]FS // Opened backends by "scheme://host"
+}
+
+// NewNamespace returns a namespace with nothing mounted
+func NewNamespace() *Namespace {
+	return &Namespace{schemes: map[string]Opener{}, remotes: map[string]FS{}}
+}
+
+// Default is the namespace of the shell session
+var Default = NewNamespace()
+
+// Mount mounts fsys at an absolute path. Mounts may nest but a path can only
+// be mounted once.
+func (n *Namespace) Mount(path string, fsys FS, kind string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("mount point must be absolute: %s", path)
+	}
+	path = filepath.Clean(path)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, m := range n.mounts {
+		if m.Path == path {
+			return fmt.Errorf("%s: already mounted", path)
+		}
+	}
+	n.mounts = append(n.mounts, Mount{Path: path, FS: fsys, Kind: kind})
+	sort.Slice(n.mounts, func(i, j int) bool { return n.mounts[i].Path < n.mounts[j].Path })
+	return nil
+}
+
+// Unmount removes the mount at path and returns it
+func (n *Namespace) Unmount(path string) (Mount, error) {
+	path = filepath.Clean(path)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, m := range n.mounts {
+		if m.Path == path {
+			n.mounts = append(n.mounts[:i], n.mounts[i+1:]...)
+			return m, nil
+		}
+	}
+	return Mount{}, fmt.Errorf("%s: not mounted", path)
+}
+
+// Mounts returns the mounts sorted by path
+func (n *Namespace) Mounts() []Mount {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return append([]Mount(nil), n.mounts...)
+}
+
+// Resolve returns the backend holding an absolute path, the name of the
+// path within it and the mount point. Paths below no mount resolve to Host
+// with the path itself as name and an empty mount point.
+func (n *Namespace) Resolve(abs string) (FS, string, string) {
+	abs = filepath.Clean(abs)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var best *Mount
+	for i, m := range n.mounts {
+		if within(abs, m.Path) && (best == nil || len(m.Path) > len(best.Path)) {
+			best = &n.mounts[i]
+		}
+	}
+	if best == nil {
+		return Host, abs, ""
+	}
+	rel, _ := filepath.Rel(best.Path, abs)
+	return best.FS, filepath.ToSlash(rel), best.Path
+}
+
+// RegisterScheme makes URLs with scheme resolve to the backends of open
+func (n *Namespace) RegisterScheme(scheme string, open Opener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.schemes[scheme] = open
+	for root := range n.remotes {
+		if strings.HasPrefix(root, scheme+"://") {
+			delete(n.remotes, root)
+		}
+	}
+}
+
+// IsURL reports whether p is a URL such as "s3://bucket/key" rather than a path
+func IsURL(p string) bool {
+	scheme, _, ok := strings.Cut(p, "://")
+	return ok && scheme != "" && !strings.ContainsAny(scheme, "/\\")
+}
+
+// ResolveURL returns the backend of a URL, the name within it and the URL
+// of the backend's root, such as "s3://bucket". Backends are opened once
+// and then reused.
+func (n *Namespace) ResolveURL(rawURL string) (FS, string, string, error) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return nil, "", "", fmt.Errorf("%s: not a URL", rawURL)
+	}
+	host, name, _ := strings.Cut(rest, "/")
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+	if host == "" || host == "." || host == ".." {
+		return nil, "", "", fmt.Errorf("%s: missing host", rawURL)
+	}
+	root := scheme + "://" + host
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if fsys, ok := n.remotes[root]; ok {
+		return fsys, name, root, nil
+	}
+	open, ok := n.schemes[scheme]
+	if !ok {
+		return nil, "", "", fmt.Errorf("%s: unsupported scheme %q", rawURL, scheme)
+	}
+	fsys, err := open(host)
+	if err != nil {
+		return nil, "", "", err
+	}
+	n.remotes[root] = fsys
+	return fsys, name, root, nil
+}
+
+// within reports whether path is dir or lies below it
+func within(path, dir string) bool {
+	if path == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, dir)
+}
@@ -0,0 +1,153 @@
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// OSFS is the host file system below a root directory. Symlinks are
+// followed by the host, so they may lead outside the root unless a check
+// refuses the host paths they resolve to.
+type OSFS struct {
+	root  string
+	check func(path string, follow bool) error
+}
+
+// Host is the host file system itself. Unlike other backends it takes host
+// paths, absolute or relative to the working directory, as names, so code
+// written for host paths can use the same helpers as every other backend.
+var Host FS = &OSFS{}
+
+// NewOSFS returns the host file system below root. A non-nil check vets
+// the host path of every operation first; follow tells whether the
+// operation follows a final symlink.
+func NewOSFS(root string, check func(path string, follow bool) error) *OSFS {
+	return &OSFS{root: filepath.Clean(root), check: check}
+}
+
+// Root returns the host directory of the backend, "" for Host
+func (o *OSFS) Root() string {
+	return o.root
+}
+
+func (o *OSFS) path(name string) string {
+	if o.root == "" {
+		return filepath.FromSlash(name)
+	}
+	// Names cannot climb out of the root, though symlinks may lead out
+	return filepath.Join(o.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// resolve returns the host path of name once the check accepts it
+func (o *OSFS) resolve(name string, follow bool) (string, error) {
+	p := o.path(name)
+	if o.check != nil {
+		if err := o.check(p, follow); err != nil {
+			return "", err
+		}
+	}
+	return p, nil
+}
+
+func (o *OSFS) Open(name string) (fs.File, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (o *OSFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (o *OSFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (o *OSFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (o *OSFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (o *OSFS) ReadLink(name string) (string, error) {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+func (o *OSFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (o *OSFS) Rename(oldname, newname string) error {
+	from, err := o.resolve(oldname, false)
+	if err != nil {
+		return err
+	}
+	to, err := o.resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func (o *OSFS) Remove(name string) error {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (o *OSFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+func (o *OSFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+func (o *OSFS) Symlink(target, name string) error {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
@@ -0,0 +1,680 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPartSize is the size of the parts of multipart uploads; smaller
+// files are uploaded with a single request
+const DefaultPartSize = 16 << 20
+
+// maxCopySize is the largest object S3 copies in one request
+const maxCopySize = 5 << 30
+
+// S3FS is a bucket of an S3-compatible object store. Keys are names, and
+// the prefixes up to each "/" act as directories: a directory exists while
+// any key lies below it or an empty "name/" marker object, which Mkdir
+// creates, marks it. Objects have no modes, times or symlinks; Chmod and
+// Chtimes are ignored.
+type S3FS struct {
+	config S3Config
+	bucket string
+	client *http.Client
+
+	PartSize int64 // Size of multipart upload parts, DefaultPartSize when 0
+	PageSize int   // Keys per list request, the server's default when 0
+}
+
+// NewS3FS returns the bucket of the service that config describes
+func NewS3FS(config S3Config, bucket string) *S3FS {
+	return &S3FS{config: config, bucket: bucket, client: http.DefaultClient}
+}
+
+func init() {
+	Default.RegisterScheme("s3", OpenS3)
+}
+
+// OpenS3 opens bucket with the configuration of LoadS3Config
+func OpenS3(bucket string) (FS, error) {
+	config, err := LoadS3Config()
+	if err != nil {
+		return nil, err
+	}
+	return NewS3FS(config, bucket), nil
+}
+
+func (s *S3FS) writesAtomically() {}
+
+// s3Error is an error response of the service
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("S3 request failed: %d %s", e.Status, e.Code)
+	}
+	return fmt.Sprintf("S3 request failed: %s: %s", e.Code, e.Message)
+}
+
+// Is maps the response onto the errors of io/fs
+func (e *s3Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Status == http.StatusNotFound
+	case fs.ErrPermission:
+		return e.Status == http.StatusForbidden
+	case fs.ErrExist:
+		return e.Status == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// request sends a signed request for key. The response must be closed by
+// the caller unless an error is returned, which is an *s3Error for
+// responses other than 2xx.
+func (s *S3FS) request(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	endpoint, err := s.config.endpoint(s.bucket)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if s.config.pathStyle(s.bucket) {
+		prefix = "/" + uriEncode(s.bucket, false)
+	}
+	u.RawPath = strings.TrimSuffix(u.Path, "/") + prefix + "/" + uriEncode(key, false)
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	s.config.Sign(req, hashHex(body), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &s3Error{Status: resp.StatusCode, Code: resp.Status}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// call sends a request and reads an XML response into out, which may be nil
+func (s *S3FS) call(method, key string, query url.Values, header http.Header, body []byte, out any) error {
+	resp, err := s.request(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list lists the keys below prefix page by page. With a delimiter, keys
+// below the next delimiter are rolled up into common prefixes. A limit
+// above 0 stops after that many keys and prefixes.
+func (s *S3FS) list(prefix, delimiter string, limit int, fn func(*s3ListResult)) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	pageSize := s.PageSize
+	if limit > 0 && (pageSize == 0 || limit < pageSize) {
+		pageSize = limit
+	}
+	if pageSize > 0 {
+		query.Set("max-keys", strconv.Itoa(pageSize))
+	}
+
+	seen := 0
+	for {
+		var result s3ListResult
+		if err := s.call(http.MethodGet, "", query, nil, nil, &result); err != nil {
+			return err
+		}
+		fn(&result)
+		seen += len(result.Contents) + len(result.CommonPrefixes)
+		if !result.IsTruncated || result.NextContinuationToken == "" || (limit > 0 && seen >= limit) {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// key turns a name into the object key, "" for the bucket itself
+func (s *S3FS) key(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// pathError wraps the errors of requests about name; nil stays nil
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if err == nil || errors.As(err, &pe) {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// head returns the object named key, or an error wrapping fs.ErrNotExist
+func (s *S3FS) head(key string) (fs.FileInfo, error) {
+	resp, err := s.request(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp), nil
+}
+
+func objectInfo(key string, resp *http.Response) fs.FileInfo {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return memInfo{name: path.Base(key), size: resp.ContentLength, mode: 0644, modTime: modTime}
+}
+
+func dirInfo(name string) fs.FileInfo {
+	return memInfo{name: path.Base(name), mode: fs.ModeDir | 0755}
+}
+
+// isDir reports whether any key lies below the directory key
+func (s *S3FS) isDir(key string) (bool, error) {
+	found := false
+	err := s.list(key+"/", "/", 1, func(result *s3ListResult) {
+		found = found || len(result.Contents) > 0 || len(result.CommonPrefixes) > 0
+	})
+	return found, err
+}
+
+func (s *S3FS) Stat(name string) (fs.FileInfo, error) {
+	key, err := s.key("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return dirInfo(name), nil
+	}
+	info, err := s.head(key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		if err != nil {
+			return nil, pathError("stat", name, err)
+		}
+		return info, nil
+	}
+	dir, err := s.isDir(key)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	if !dir {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return dirInfo(name), nil
+}
+
+// Lstat is Stat, as objects cannot be symlinks
+func (s *S3FS) Lstat(name string) (fs.FileInfo, error) {
+	return s.Stat(name)
+}
+
+func (s *S3FS) ReadLink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (s *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	key, err := s.key("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+
+	var entries []fs.DirEntry
+	err = s.list(prefix, "/", 0, func(result *s3ListResult) {
+		for _, p := range result.CommonPrefixes {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(strings.TrimSuffix(p.Prefix, "/"))))
+		}
+		for _, object := range result.Contents {
+			if object.Key == prefix {
+				continue // The directory's own marker
+			}
+			info := memInfo{name: path.Base(object.Key), size: object.Size, mode: 0644, modTime: object.LastModified}
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	})
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	if len(entries) == 0 && key != "" {
+		// Nothing listed: an empty directory marker, a file or nothing at all
+		if _, err := s.head(prefix); err == nil {
+			return entries, nil
+		}
+		if _, err := s.head(key); err == nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (s *S3FS) Open(name string) (fs.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens an object for reading, or creates or replaces it for
+// writing. Written objects appear when the file is closed; appending and
+// reading and writing at once are not supported.
+func (s *S3FS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	key, err := s.key("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if key == "" {
+			return &s3File{fs: s, name: name, info: dirInfo(name)}, nil
+		}
+		resp, err := s.request(http.MethodGet, key, nil, nil, nil)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Directories have no object of their own
+			info, statErr := s.Stat(name)
+			if statErr != nil {
+				return nil, statErr
+			}
+			return &s3File{fs: s, name: name, info: info}, nil
+		}
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		return &s3File{fs: s, name: name, info: objectInfo(key, resp), body: resp.Body}, nil
+	}
+
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 || key == "" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	if flag&os.O_EXCL != 0 {
+		if _, err := s.Stat(name); err == nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+	}
+	return &s3Writer{fs: s, name: name, key: key}, nil
+}
+
+func (s *S3FS) Mkdir(name string, perm fs.FileMode) error {
+	key, err := s.key("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	return pathError("mkdir", name, s.call(http.MethodPut, key+"/", nil, nil, nil, nil))
+}
+
+// Remove deletes an object, or the marker of an empty directory. A
+// directory that only existed through its last key is already gone.
+func (s *S3FS) Remove(name string) error {
+	key, err := s.key("remove", name)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	if _, err := s.head(key); err == nil {
+		return pathError("remove", name, s.call(http.MethodDelete, key, nil, nil, nil, nil))
+	}
+
+	var entries int
+	err = s.list(key+"/", "/", 2, func(result *s3ListResult) {
+		for _, object := range result.Contents {
+			if object.Key != key+"/" {
+				entries++
+			}
+		}
+		entries += len(result.CommonPrefixes)
+	})
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	if entries > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	if _, err := s.head(key + "/"); err != nil {
+		return pathError("remove", name, err)
+	}
+	return pathError("remove", name, s.call(http.MethodDelete, key+"/", nil, nil, nil, nil))
+}
+
+// Rename copies objects to their new keys and deletes the old ones; a
+// directory is renamed key by key
+func (s *S3FS) Rename(oldname, newname string) error {
+	oldKey, err := s.key("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newKey, err := s.key("rename", newname)
+	if err != nil {
+		return err
+	}
+	if oldKey == "" || newKey == "" || oldKey == newKey {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return pathError("rename", oldname, s.move(oldKey, newKey, info.Size()))
+	}
+	if strings.HasPrefix(newKey+"/", oldKey+"/") {
+		return &fs.PathError{Op: "rename", Path: newname, Err: errors.New("cannot move a directory into itself")}
+	}
+
+	var objects []s3Object
+	err = s.list(oldKey+"/", "", 0, func(result *s3ListResult) {
+		objects = append(objects, result.Contents...)
+	})
+	for _, object := range objects {
+		if err != nil {
+			break
+		}
+		err = s.move(object.Key, newKey+strings.TrimPrefix(object.Key, oldKey), object.Size)
+	}
+	return pathError("rename", oldname, err)
+}
+
+// Copy copies an object on the server
+func (s *S3FS) Copy(oldname, newname string) error {
+	oldKey, err := s.key("copy", oldname)
+	if err != nil {
+		return err
+	}
+	newKey, err := s.key("copy", newname)
+	if err != nil {
+		return err
+	}
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "copy", Path: oldname, Err: errIsDir}
+	}
+	return pathError("copy", oldname, s.copyObject(oldKey, newKey, info.Size()))
+}
+
+// move copies an object on the server and deletes the original
+func (s *S3FS) move(from, to string, size int64) error {
+	if err := s.copyObject(from, to, size); err != nil {
+		return err
+	}
+	return s.call(http.MethodDelete, from, nil, nil, nil, nil)
+}
+
+// copyObject copies an object on the server, in parts above the 5GiB a
+// single copy allows
+func (s *S3FS) copyObject(from, to string, size int64) error {
+	source := "/" + uriEncode(s.bucket, false) + "/" + uriEncode(from, false)
+	if size <= maxCopySize {
+		header := http.Header{"X-Amz-Copy-Source": {source}}
+		if err := s.call(http.MethodPut, to, nil, header, nil, nil); err != nil {
+			return err
+		}
+	} else {
+		upload, err := s.startUpload(to)
+		if err != nil {
+			return err
+		}
+		for offset := int64(0); offset < size; offset += maxCopySize {
+			end := min(offset+maxCopySize, size) - 1
+			header := http.Header{
+				"X-Amz-Copy-Source":       {source},
+				"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, end)},
+			}
+			var result struct {
+				ETag string `xml:"ETag"`
+			}
+			if err := s.call(http.MethodPut, to, upload.query(), header, nil, &result); err != nil {
+				upload.abort()
+				return err
+			}
+			upload.parts = append(upload.parts, s3Part{Number: len(upload.parts) + 1, ETag: result.ETag})
+		}
+		return upload.complete()
+	}
+	return nil
+}
+
+// Chmod is ignored, as objects have no modes
+func (s *S3FS) Chmod(name string, mode fs.FileMode) error {
+	return nil
+}
+
+// Chtimes is ignored, as the service sets the modification time
+func (s *S3FS) Chtimes(name string, atime, mtime time.Time) error {
+	return nil
+}
+
+func (s *S3FS) Symlink(target, name string) error {
+	return &fs.PathError{Op: "symlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+// s3File is an object or a directory opened for reading
+type s3File struct {
+	fs     *S3FS
+	name   string
+	info   fs.FileInfo
+	body   io.ReadCloser
+	listed int
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.body == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	return f.body.Read(p)
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile
+func (f *s3File) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	return readDirFile(f.fs, f.name, &f.listed, n)
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// s3Upload is a multipart upload in progress
+type s3Upload struct {
+	fs    *S3FS
+	key   string
+	id    string
+	parts []s3Part
+}
+
+func (s *S3FS) startUpload(key string) (*s3Upload, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.call(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &s3Upload{fs: s, key: key, id: result.UploadID}, nil
+}
+
+// query addresses the next part
+func (u *s3Upload) query() url.Values {
+	return url.Values{"partNumber": {strconv.Itoa(len(u.parts) + 1)}, "uploadId": {u.id}}
+}
+
+func (u *s3Upload) upload(data []byte) error {
+	resp, err := u.fs.request(http.MethodPut, u.key, u.query(), nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	u.parts = append(u.parts, s3Part{Number: len(u.parts) + 1, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (u *s3Upload) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: u.parts})
+	if err == nil {
+		err = u.fs.call(http.MethodPost, u.key, url.Values{"uploadId": {u.id}}, nil, body, nil)
+	}
+	if err != nil {
+		u.abort()
+	}
+	return err
+}
+
+func (u *s3Upload) abort() {
+	u.fs.call(http.MethodDelete, u.key, url.Values{"uploadId": {u.id}}, nil, nil, nil)
+}
+
+// s3Writer buffers an object being written. Objects up to a part in size
+// are uploaded on Close; larger ones switch to a multipart upload and send
+// every part as soon as it is full.
+type s3Writer struct {
+	fs     *S3FS
+	name   string
+	key    string
+	buf    []byte
+	upload *s3Upload
+	err    error
+	closed bool
+}
+
+func (w *s3Writer) partSize() int {
+	if w.fs.PartSize > 0 {
+		return int(w.fs.PartSize)
+	}
+	return DefaultPartSize
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= w.partSize() {
+		if w.upload == nil {
+			if w.upload, w.err = w.fs.startUpload(w.key); w.err != nil {
+				return 0, pathError("write", w.name, w.err)
+			}
+		}
+		if w.err = w.upload.upload(w.buf[:w.partSize()]); w.err != nil {
+			w.upload.abort()
+			return 0, pathError("write", w.name, w.err)
+		}
+		w.buf = append(w.buf[:0], w.buf[w.partSize():]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.name, Err: fs.ErrPermission}
+}
+
+func (w *s3Writer) Stat() (fs.FileInfo, error) {
+	return memInfo{name: path.Base(w.key), size: int64(len(w.buf)), mode: 0644, modTime: time.Now()}, nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	if w.upload == nil {
+		return pathError("close", w.name, w.fs.call(http.MethodPut, w.key, nil, nil, w.buf, nil))
+	}
+	if len(w.buf) > 0 {
+		if err := w.upload.upload(w.buf); err != nil {
+			w.upload.abort()
+			return pathError("close", w.name, err)
+		}
+	}
+	return pathError("close", w.name, w.upload.complete())
+}
@@ -0,0 +1,246 @@
+package vfs
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config describes an S3-compatible service and the credentials for it
+type S3Config struct {
+	Endpoint     string // Base URL of the service; AWS in Region when empty
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool // Address buckets as "endpoint/bucket" rather than "bucket.endpoint"
+}
+
+// LoadS3Config reads the configuration the AWS tools use: the credentials
+// and config files of the profile in $AWS_PROFILE, "default" otherwise,
+// overridden by $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY,
+// $AWS_SESSION_TOKEN, $AWS_REGION and $AWS_ENDPOINT_URL_S3 or
+// $AWS_ENDPOINT_URL. Custom endpoints, such as local stand-in servers, are
+// addressed path-style.
+func LoadS3Config() (S3Config, error) {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	home, _ := os.UserHomeDir()
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+
+	credentials := readINISection(credentialsFile, profile)
+	section := "profile " + profile
+	if profile == "default" {
+		section = "default"
+	}
+	settings := readINISection(configFile, section)
+
+	config := S3Config{
+		Endpoint:     settings["endpoint_url"],
+		Region:       settings["region"],
+		AccessKey:    credentials["aws_access_key_id"],
+		SecretKey:    credentials["aws_secret_access_key"],
+		SessionToken: credentials["aws_session_token"],
+	}
+	for _, env := range []struct {
+		field *string
+		names []string
+	}{
+		{&config.AccessKey, []string{"AWS_ACCESS_KEY_ID"}},
+		{&config.SecretKey, []string{"AWS_SECRET_ACCESS_KEY"}},
+		{&config.SessionToken, []string{"AWS_SESSION_TOKEN"}},
+		{&config.Region, []string{"AWS_REGION", "AWS_DEFAULT_REGION"}},
+		{&config.Endpoint, []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"}},
+	} {
+		for _, name := range env.names {
+			if value := os.Getenv(name); value != "" {
+				*env.field = value
+				break
+			}
+		}
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.PathStyle = config.Endpoint != ""
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return config, errors.New("no S3 credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or configure ~/.aws/credentials")
+	}
+	return config, nil
+}
+
+// readINISection returns the keys of one section of an AWS style INI file
+func readINISection(file, section string) map[string]string {
+	values := map[string]string{}
+	f, err := os.Open(file)
+	if err != nil {
+		return values
+	}
+	defer f.Close()
+
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == section
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && inSection {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+// pathStyle reports whether bucket goes into the path of requests. Bucket
+// names with dots would break TLS as host names, so they always do.
+func (c S3Config) pathStyle(bucket string) bool {
+	return c.PathStyle || strings.Contains(bucket, ".")
+}
+
+// endpoint returns the base URL of requests for bucket
+func (c S3Config) endpoint(bucket string) (string, error) {
+	if bucket == "" {
+		return "", errors.New("missing bucket name")
+	}
+	if c.Endpoint != "" {
+		return c.Endpoint, nil
+	}
+	host := "s3." + c.Region + ".amazonaws.com"
+	if !c.pathStyle(bucket) {
+		host = bucket + "." + host
+	}
+	return "https://" + host, nil
+}
+
+// Sign adds AWS Signature Version 4 headers to req: X-Amz-Date,
+// X-Amz-Content-Sha256, X-Amz-Security-Token with a session token, and
+// Authorization. payloadHash is the hex SHA-256 of the body. The host,
+// Content-Type, Range and every X-Amz header are signed.
+func (c S3Config) Sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "range" || lower == "content-md5" {
+			headers[lower] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(headers[name]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), day)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery encodes a query the way SigV4 expects: sorted by key and
+// value, everything but unreserved characters percent-encoded
+func canonicalQuery(query url.Values) string {
+	var pairs [][2]string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, [2]string{uriEncode(key, true), uriEncode(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// uriEncode percent-encodes all but the unreserved characters of RFC 3986,
+// keeping slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+// Package vfs defines the file system interface fmsh commands work through,
+// with a backend for the host file system, an in-memory backend, and a
+// namespace that mounts backends at paths.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FS is a file system backend. Names are slash-separated and relative to
+// the backend's root, "." being the root itself, as in io/fs. Every FS is
+// an fs.FS, so fs.WalkDir, fs.ReadFile and friends work on it.
+type FS interface {
+	fs.FS
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error) // Sorted by name
+	ReadLink(name string) (string, error)
+
+	// OpenFile opens a file with os.O_* flags, creating it with perm
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Rename(oldname, newname string) error
+	Remove(name string) error // Files and empty directories
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Symlink(target, name string) error
+}
+
+// File is an open file of an FS. Backends that can seek return files that
+// also implement io.Seeker.
+type File interface {
+	fs.File
+	io.Writer
+}
+
+// Copier is implemented by backends that copy files on the server rather
+// than through the client
+type Copier interface {
+	Copy(oldname, newname string) error // Replaces newname
+}
+
+// ErrReadOnly is returned by backends that cannot be modified
+var ErrReadOnly = errors.New("read-only file system")
+
+// ReadFile reads a whole file
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	return fs.ReadFile(fsys, name)
+}
+
+// WriteFile writes data to a file, creating or truncating it
+func WriteFile(fsys FS, name string, data []byte, perm fs.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// MkdirAll creates a directory and any missing parents
+func MkdirAll(fsys FS, name string, perm fs.FileMode) error {
+	if info, err := fsys.Stat(name); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+	}
+	if parent, _ := Split(fsys, name); parent != name {
+		if err := MkdirAll(fsys, parent, perm); err != nil {
+			return err
+		}
+	}
+	err := fsys.Mkdir(name, perm)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+// RemoveAll removes a file or a directory with everything beneath it. A
+// missing name is not an error.
+func RemoveAll(fsys FS, name string) error {
+	info, err := fsys.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := RemoveAll(fsys, Join(fsys, name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	err = fsys.Remove(name)
+	if info.IsDir() && errors.Is(err, fs.ErrNotExist) {
+		return nil // Object stores drop directories with their last entry
+	}
+	return err
+}
+
+// WritesAtomically reports whether files of fsys only appear, complete,
+// once they are closed, so writers need no temporary name
+func WritesAtomically(fsys FS) bool {
+	_, ok := fsys.(interface{ writesAtomically() })
+	return ok
+}
+
+// Join joins name elements the way fsys expects them: with the host
+// separator for Host and with slashes for every other backend
+func Join(fsys FS, elem ...string) string {
+	if fsys == Host {
+		return filepath.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+// Split splits a name into its directory and base name as Join would join them
+func Split(fsys FS, name string) (string, string) {
+	if fsys == Host {
+		return filepath.Dir(name), filepath.Base(name)
+	}
+	return path.Dir(name), path.Base(name)
+}
+
+// readDirFile implements fs.ReadDirFile for backends that list whole
+// directories at once; listed counts the entries already returned
+func readDirFile(fsys FS, name string, listed *int, n int) ([]fs.DirEntry, error) {
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[min(*listed, len(entries)):]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	*listed += len(entries)
+	return entries, nil
+}
+
+// sortEntries orders directory entries by name
+func sortEntries(entries []fs.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
@@ -0,0 +1,688 @@
+package vfs
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DAVFS is a share of a WebDAV server: collections are directories and
+// every other resource a file. Files being written are locked until they
+// are uploaded, and a file being read only continues from an offset while
+// its entity tag is unchanged. Chmod and Chtimes are ignored.
+type DAVFS struct {
+	base     *url.URL // Root of the share
+	user     string
+	password string
+	client   *http.Client
+}
+
+// ErrLocked is returned for resources another client holds a lock on
+var ErrLocked = errors.New("resource is locked")
+
+// errChanged is returned when a file changes on the server while it is read
+var errChanged = errors.New("file changed on the server while reading")
+
+// NewDAVFS returns the share at base, an http or https URL, authenticating
+// with user and password unless user is empty
+func NewDAVFS(base, user, password string) (*DAVFS, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s: not an http or https URL", base)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	client := &http.Client{
+		// Redirects would turn PROPFIND and friends into GETs
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &DAVFS{base: u, user: user, password: password, client: client}, nil
+}
+
+// "dav://host/path" is served over HTTP and "davs://host/path" over HTTPS,
+// as in GNOME's gvfs
+func init() {
+	Default.RegisterScheme("dav", openDAV("http"))
+	Default.RegisterScheme("davs", openDAV("https"))
+}
+
+// openDAV opens the servers of dav URLs. Credentials come from the URL, as
+// in "dav://user@host", and from the host's entry in ~/.netrc or $NETRC.
+func openDAV(scheme string) Opener {
+	return func(host string) (FS, error) {
+		u, err := url.Parse(scheme + "://" + host)
+		if err != nil {
+			return nil, err
+		}
+		login := ""
+		if u.User != nil {
+			login = u.User.Username()
+		}
+		user, password := netrcLogin(u.Hostname(), login)
+		if u.User != nil {
+			user = login
+			if p, ok := u.User.Password(); ok {
+				password = p
+			}
+		}
+		u.User = nil
+		return NewDAVFS(u.String(), user, password)
+	}
+}
+
+// netrcLogin returns the login and password of machine in the netrc file,
+// the entry for login when it is given, falling back to the default entry
+func netrcLogin(machine, login string) (string, string) {
+	file := os.Getenv("NETRC")
+	if file == "" {
+		home, _ := os.UserHomeDir()
+		file = filepath.Join(home, ".netrc")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return login, ""
+	}
+	defer f.Close()
+
+	type entry struct{ machine, login, password string }
+	var entries []entry
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "machine", "default":
+			e := entry{}
+			if token == "machine" && scanner.Scan() {
+				e.machine = scanner.Text()
+			}
+			entries = append(entries, e)
+		case "login", "password":
+			if !scanner.Scan() || len(entries) == 0 {
+				continue
+			}
+			if token == "login" {
+				entries[len(entries)-1].login = scanner.Text()
+			} else {
+				entries[len(entries)-1].password = scanner.Text()
+			}
+		}
+	}
+	for _, wantMachine := range []string{machine, ""} {
+		for _, e := range entries {
+			if e.machine == wantMachine && (login == "" || e.login == login) {
+				return e.login, e.password
+			}
+		}
+	}
+	return login, ""
+}
+
+// davError is a failed response of the server
+type davError struct {
+	Method string
+	Status int
+	Text   string
+}
+
+func (e *davError) Error() string {
+	return fmt.Sprintf("WebDAV %s failed: %s", e.Method, e.Text)
+}
+
+// Is maps the response onto the errors of io/fs
+func (e *davError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		// 409 Conflict is the answer when a parent collection is missing
+		return e.Status == http.StatusNotFound || e.Status == http.StatusConflict
+	case fs.ErrPermission:
+		return e.Status == http.StatusForbidden || e.Status == http.StatusUnauthorized
+	case fs.ErrExist:
+		return e.Status == http.StatusPreconditionFailed
+	case ErrLocked:
+		return e.Status == http.StatusLocked
+	}
+	return false
+}
+
+// url returns the URL of name
+func (d *DAVFS) url(name string) string {
+	u := *d.base
+	if name != "." {
+		u.Path += "/" + name
+	}
+	return u.String()
+}
+
+func (d *DAVFS) newRequest(method, name string, header http.Header, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, d.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if d.user != "" {
+		req.SetBasicAuth(d.user, d.password)
+	}
+	return req, nil
+}
+
+// do sends a request. The response must be closed by the caller unless an
+// error is returned, which is a *davError for failed responses. A
+// Multi-Status answer to anything but PROPFIND reports a partial failure.
+func (d *DAVFS) do(req *http.Request) (*http.Response, error) {
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 || (resp.StatusCode == http.StatusMultiStatus && req.Method != "PROPFIND") {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		return nil, &davError{Method: req.Method, Status: resp.StatusCode, Text: resp.Status}
+	}
+	return resp, nil
+}
+
+func (d *DAVFS) request(method, name string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := d.newRequest(method, name, header, body)
+	if err != nil {
+		return nil, err
+	}
+	return d.do(req)
+}
+
+// call sends a request whose response body is of no interest
+func (d *DAVFS) call(method, name string, header http.Header) error {
+	resp, err := d.request(method, name, header, nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// check validates a name
+func (d *DAVFS) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/></D:prop></D:propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				Length   string `xml:"getcontentlength"`
+				Modified string `xml:"getlastmodified"`
+				ETag     string `xml:"getetag"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// davEntry is a resource listed by PROPFIND
+type davEntry struct {
+	name string // Name within the share
+	info fs.FileInfo
+	etag string
+}
+
+// propfind lists name, and its members with depth 1
+func (d *DAVFS) propfind(name string, depth int) ([]davEntry, error) {
+	header := http.Header{"Depth": {strconv.Itoa(depth)}, "Content-Type": {"application/xml"}}
+	resp, err := d.request("PROPFIND", name, header, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	var entries []davEntry
+	for _, r := range result.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		rel := strings.Trim(strings.TrimPrefix(href.Path, d.base.Path), "/")
+		if rel == "" {
+			rel = "."
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			prop := ps.Prop
+			info := memInfo{name: path.Base(rel), mode: 0644}
+			info.size, _ = strconv.ParseInt(prop.Length, 10, 64)
+			info.modTime, _ = http.ParseTime(prop.Modified)
+			if prop.ResourceType.Collection != nil {
+				info.mode = fs.ModeDir | 0755
+			}
+			entries = append(entries, davEntry{name: rel, info: info, etag: prop.ETag})
+		}
+	}
+	return entries, nil
+}
+
+// stat returns name's entry
+func (d *DAVFS) stat(op, name string) (davEntry, error) {
+	if err := d.check(op, name); err != nil {
+		return davEntry{}, err
+	}
+	entries, err := d.propfind(name, 0)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return davEntry{}, pathError(op, name, err)
+	}
+	for _, entry := range entries {
+		if entry.name == name {
+			return entry, nil
+		}
+	}
+	// A bare fs.ErrNotExist, so os.IsNotExist recognises it
+	return davEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (d *DAVFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := d.stat("stat", name)
+	return entry.info, err
+}
+
+// Lstat is Stat, as WebDAV has no symlinks
+func (d *DAVFS) Lstat(name string) (fs.FileInfo, error) {
+	return d.Stat(name)
+}
+
+func (d *DAVFS) ReadLink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (d *DAVFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := d.check("readdir", name); err != nil {
+		return nil, err
+	}
+	listed, err := d.propfind(name, 1)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	var entries []fs.DirEntry
+	for _, entry := range listed {
+		if entry.name == name {
+			if !entry.info.IsDir() {
+				return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+			}
+			continue
+		}
+		if path.Dir(entry.name) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(entry.info))
+		}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (d *DAVFS) Open(name string) (fs.File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file for reading, or creates or replaces it for writing.
+// Written files are uploaded when they are closed; appending and reading
+// and writing at once are not supported.
+func (d *DAVFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		entry, err := d.stat("open", name)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{fs: d, name: name, info: entry.info, etag: entry.etag}, nil
+	}
+
+	if err := d.check("open", name); err != nil {
+		return nil, err
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 || name == "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	_, err := d.Stat(name)
+	switch {
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case err != nil && flag&os.O_CREATE == 0:
+		return nil, err
+	}
+
+	w := &davWriter{fs: d, name: name, exclusive: flag&os.O_EXCL != 0}
+	if !w.exclusive {
+		// Exclusive creates rely on If-None-Match instead, as locking
+		// would create the file
+		if w.token, err = d.lock(name); err != nil {
+			return nil, pathError("open", name, err)
+		}
+	}
+	if w.spool, err = os.CreateTemp("", "fmsh-dav-*"); err != nil {
+		d.unlock(name, w.token)
+		return nil, err
+	}
+	return w, nil
+}
+
+const lockBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>fmsh</D:owner></D:lockinfo>`
+
+// lock takes an exclusive write lock on name and returns its token, or ""
+// when the server does not lock
+func (d *DAVFS) lock(name string) (string, error) {
+	header := http.Header{"Depth": {"0"}, "Timeout": {"Second-600"}, "Content-Type": {"application/xml"}}
+	resp, err := d.request("LOCK", name, header, strings.NewReader(lockBody))
+	var e *davError
+	if errors.As(err, &e) && (e.Status == http.StatusMethodNotAllowed || e.Status == http.StatusNotImplemented) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("Lock-Token"), "<>"), nil
+}
+
+// unlock releases a lock taken by lock
+func (d *DAVFS) unlock(name, token string) error {
+	if token == "" {
+		return nil
+	}
+	return d.call("UNLOCK", name, http.Header{"Lock-Token": {"<" + token + ">"}})
+}
+
+func (d *DAVFS) Mkdir(name string, perm fs.FileMode) error {
+	if err := d.check("mkdir", name); err != nil {
+		return err
+	}
+	err := d.call("MKCOL", name, nil)
+	var e *davError
+	if errors.As(err, &e) && e.Status == http.StatusMethodNotAllowed {
+		// MKCOL is not allowed on existing resources
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	return pathError("mkdir", name, err)
+}
+
+// Remove deletes a file or an empty collection; DELETE alone would take a
+// collection's members with it
+func (d *DAVFS) Remove(name string) error {
+	if err := d.check("remove", name); err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := d.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := d.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	return pathError("remove", name, d.call(http.MethodDelete, name, nil))
+}
+
+// Rename moves a resource on the server, replacing newname
+func (d *DAVFS) Rename(oldname, newname string) error {
+	return d.transfer("MOVE", "rename", oldname, newname)
+}
+
+// Copy copies a file on the server, replacing newname
+func (d *DAVFS) Copy(oldname, newname string) error {
+	info, err := d.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "copy", Path: oldname, Err: errIsDir}
+	}
+	return d.transfer("COPY", "copy", oldname, newname)
+}
+
+// transfer sends a MOVE or COPY of oldname to newname
+func (d *DAVFS) transfer(method, op, oldname, newname string) error {
+	if err := d.check(op, oldname); err != nil {
+		return err
+	}
+	if err := d.check(op, newname); err != nil {
+		return err
+	}
+	if oldname == "." || newname == "." || oldname == newname {
+		return &fs.PathError{Op: op, Path: oldname, Err: fs.ErrInvalid}
+	}
+	if strings.HasPrefix(newname+"/", oldname+"/") {
+		return &fs.PathError{Op: op, Path: newname, Err: errors.New("cannot move a directory into itself")}
+	}
+	header := http.Header{"Destination": {d.url(newname)}, "Overwrite": {"T"}}
+	return pathError(op, oldname, d.call(method, oldname, header))
+}
+
+// Chmod is ignored, as WebDAV has no modes
+func (d *DAVFS) Chmod(name string, mode fs.FileMode) error {
+	return nil
+}
+
+// Chtimes is ignored, as the server sets the modification time
+func (d *DAVFS) Chtimes(name string, atime, mtime time.Time) error {
+	return nil
+}
+
+func (d *DAVFS) Symlink(target, name string) error {
+	return &fs.PathError{Op: "symlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+// davFile is a file or a collection opened for reading. The file is only
+// fetched on the first read, and again from the offset after a seek.
+type davFile struct {
+	fs     *DAVFS
+	name   string
+	info   fs.FileInfo
+	etag   string
+	offset int64
+	body   io.ReadCloser
+	listed int
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	if f.body == nil {
+		if err := f.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+// fetch starts a GET at the current offset. Ranges carry the entity tag of
+// the first response, so the pieces of a file never come from two versions
+// of it.
+func (f *davFile) fetch() error {
+	header := http.Header{}
+	if f.offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		if f.etag != "" && !strings.HasPrefix(f.etag, "W/") {
+			header.Set("If-Match", f.etag)
+		}
+	}
+	resp, err := f.fs.request(http.MethodGet, f.name, header, nil)
+	var e *davError
+	if errors.As(err, &e) && e.Status == http.StatusPreconditionFailed {
+		return &fs.PathError{Op: "read", Path: f.name, Err: errChanged}
+	}
+	if errors.As(err, &e) && e.Status == http.StatusRequestedRangeNotSatisfiable {
+		f.body = io.NopCloser(strings.NewReader(""))
+		return nil
+	}
+	if err != nil {
+		return pathError("read", f.name, err)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && f.offset == 0 {
+		f.etag = etag
+	}
+	if f.offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// The server ignored the range
+		if _, err := io.CopyN(io.Discard, resp.Body, f.offset); err != nil {
+			resp.Body.Close()
+			return pathError("read", f.name, err)
+		}
+	}
+	f.body = resp.Body
+	return nil
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *davFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile
+func (f *davFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	return readDirFile(f.fs, f.name, &f.listed, n)
+}
+
+// davWriter spools a file being written to a local temporary file and
+// uploads it with a single PUT on Close, then releases its lock
+type davWriter struct {
+	fs        *DAVFS
+	name      string
+	exclusive bool   // Fail the upload if the file has appeared meanwhile
+	token     string // Lock token, "" when the server does not lock
+	spool     *os.File
+	closed    bool
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	return w.spool.Write(p)
+}
+
+func (w *davWriter) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.name, Err: fs.ErrPermission}
+}
+
+func (w *davWriter) Stat() (fs.FileInfo, error) {
+	info, err := w.spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return memInfo{name: path.Base(w.name), size: info.Size(), mode: 0644, modTime: time.Now()}, nil
+}
+
+func (w *davWriter) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+
+	err := w.upload()
+	if unlockErr := w.fs.unlock(w.name, w.token); err == nil {
+		err = unlockErr
+	}
+	return pathError("write", w.name, err)
+}
+
+func (w *davWriter) upload() error {
+	size, err := w.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := http.Header{}
+	if w.exclusive {
+		header.Set("If-None-Match", "*")
+	}
+	if w.token != "" {
+		header.Set("If", "(<"+w.token+">)")
+	}
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = io.NopCloser(w.spool)
+	}
+	req, err := w.fs.newRequest(http.MethodPut, w.name, header, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := w.fs.do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}